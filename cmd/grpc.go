@@ -0,0 +1,32 @@
+//go:build grpc
+
+package main
+
+import (
+	"context"
+	"log"
+
+	"go-search-logger/config"
+	"go-search-logger/internal/rpc"
+	"go-search-logger/internal/searchlogger"
+)
+
+func init() {
+	startGRPC = func(logger *searchlogger.Logger) func() {
+		if config.GRPCPort == "" {
+			return nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := rpc.ServeGRPC(ctx, config.GRPCPort, &rpc.Service{Logger: logger}); err != nil {
+				log.Fatalf("gRPC server failed: %v", err)
+			}
+		}()
+		return func() {
+			cancel()
+			<-done
+		}
+	}
+}
@@ -2,33 +2,454 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"flag"
 	"go-search-logger/config"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"go-search-logger/internal/database"
+	"go-search-logger/internal/importer"
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
 	"go-search-logger/internal/searchlogger"
 	"go-search-logger/internal/server"
 
 	"github.com/go-redis/redis/v8"
 )
 
+// startGRPC starts the gRPC server alongside HTTP and returns a function
+// stopping it gracefully, or nil if disabled. It is set in grpc.go, which is
+// only built with the "grpc" build tag.
+var startGRPC func(logger *searchlogger.Logger) func()
+
+// connectSQLite opens a SQLite database. It is set in sqlite.go, which is
+// only built with the "sqlite" build tag.
+var connectSQLite func(path string) *sql.DB
+
+// startOTelLogs sets up emitting committed searches as OpenTelemetry log
+// records and returns a function flushing them at exit, or nil if disabled.
+// It is set in otel.go, which is only built with the "otel" build tag.
+var startOTelLogs func(ctx context.Context, logger *searchlogger.Logger) func(context.Context) error
+
+// outboxPublisher relays the outbox when OUTBOX=true. It is set by
+// optional integrations such as nats.go, built with their build tags.
+var outboxPublisher searchlogger.Publisher
+
+// startNATS sets up publishing committed searches to NATS and returns a
+// function flushing them at exit, or nil if disabled. It is set in nats.go,
+// which is only built with the "nats" build tag.
+var startNATS func(logger *searchlogger.Logger) func(context.Context) error
+
 func main() {
+	importPath := flag.String("import", "", "import newline-delimited JSON search records from `file` and exit")
+	useCopy := flag.Bool("copy", false, "with --import, bulk-load records using COPY instead of batched inserts")
+	purge := flag.Bool("purge", false, "delete searches older than RETENTION_DAYS and exit")
+	migrate := flag.Bool("migrate", false, "apply the database schema and exit")
+	renormalize := flag.Bool("renormalize", false, "re-apply the current query normalization to all stored searches and exit")
+	replayDLQ := flag.Bool("replay-dlq", false, "write the searches parked by DEAD_LETTER to the database and exit")
+	flag.Parse()
+
+	level, err := logging.ParseLevel(config.LogLevel)
+	if err != nil {
+		log.Fatalf("invalid log level: %v", err)
+	}
+	logging.SetLevel(level)
+
+	tz, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		log.Fatalf("invalid time zone: %v", err)
+	}
+	retention := time.Duration(config.RetentionDays) * 24 * time.Hour
+
 	redisClient := redis.NewClient(&redis.Options{
-		Addr: config.RedisAddr,
+		Addr:         config.RedisAddr,
+		Password:     config.RedisPassword,
+		PoolSize:     config.RedisPoolSize,
+		MinIdleConns: config.RedisMinIdleConns,
+		DialTimeout:  config.RedisDialTimeout,
+		ReadTimeout:  config.RedisReadTimeout,
+		WriteTimeout: config.RedisWriteTimeout,
 	})
 
-	db := database.ConnectPostgres(config.DBConnStr)
+	var db *sql.DB
+	if config.StdoutStore {
+		// No database; searches are written to stdout below.
+	} else if config.SQLitePath != "" {
+		if connectSQLite == nil {
+			log.Fatalf("SQLITE_PATH requires a binary built with -tags sqlite")
+		}
+		db = connectSQLite(config.SQLitePath)
+	} else {
+		db = database.ConnectPostgres(config.DBConnStr)
+	}
 
 	logger := &searchlogger.Logger{
 		Redis: redisClient,
 		DB:    db,
+
+		LinkAnonID:  config.LinkAnonID,
+		DailyCounts: config.DailyCounts,
+		TrackGaps:   config.TrackGaps,
+		TimeZone:    tz,
+
+		DebounceInterval: config.Debounce,
+		DedupLookback:    config.DedupLookback,
+
+		TrailingSpaceCommits: config.TrailingSpaceCommits,
+		AnonIDRotation:       config.AnonIDRotation,
+		MaxUserAgentLength:   config.MaxUserAgentLength,
+		RedisFallback:        config.RedisFallback,
+		ShadowEditDistance:   config.ShadowEditDistance,
+		ResetGrace:           config.ResetGrace,
+		ExpiryCoalesceWindow: config.ExpiryCoalesceWindow,
+		ExpiryBufferSize:     config.ExpiryBufferSize,
+		TermsTable:           config.TermsTable,
+		CaptureSearchTime:    config.CaptureSearchTime,
+		CommitDedupWindow:    config.CommitDedupWindow,
+		DailyUserCap:         config.DailyUserCap,
+		MinDwell:             config.MinDwell,
+		HistoryCacheSize:     config.HistoryCacheSize,
+		HistoryCacheTTL:      config.HistoryCacheTTL,
+		LastQueryCacheSize:   config.LastQueryCacheSize,
+		LastQueryCacheTTL:    config.LastQueryCacheTTL,
+		DeadLetter:           config.DeadLetter,
+		TrendingHalfLife:     config.TrendingHalfLife,
+		TrackRefinements:     config.TrackRefinements,
+		SessionTTL:           config.SessionTTL,
+		IdleCommit:           config.IdleCommit,
+		SingleKeySessions:    config.SingleKeySessions,
+		ReapInterval:         config.ReapInterval,
+		AnonVisitWindow:      config.AnonVisitWindow,
+		Sequence:             config.Sequence,
+		QueryStats:           config.QueryStats,
+		Outbox:               config.Outbox,
+		EventStream:          config.EventStream,
+		EventStreamMaxLen:    config.EventStreamMaxLen,
+		EventStreamTTL:       config.EventStreamTTL,
+		SequenceTTL:          config.SequenceTTL,
+		TrajectoryMode:       config.Trajectory,
+		MaxTrajectory:        config.MaxTrajectory,
+	}
+	if config.CompleteLength > 0 {
+		logger.CompletenessScorer = searchlogger.LengthCompleteness(config.CompleteLength)
+	}
+	if config.PopularTermCommits > 0 {
+		logger.PopularTermCommits = config.PopularTermCommits
+		logger.DailyCounts = true
+	}
+	if config.SQLitePath != "" {
+		logger.Store = &searchlogger.SQLiteStore{DB: db}
+	}
+	if config.StdoutStore {
+		logger.Store = &searchlogger.StdoutStore{W: os.Stdout}
+		if *migrate || *importPath != "" || *purge || *renormalize || retention > 0 || config.ShardDSNs != "" {
+			log.Fatalf("STDOUT_STORE cannot be combined with migrations, imports, purges, renormalization, RETENTION_DAYS or SHARD_DSNS, which need a database")
+		}
+	}
+	if config.ShardDSNs != "" {
+		for _, dsn := range strings.Split(config.ShardDSNs, ",") {
+			logger.Shards = append(logger.Shards, database.ConnectPostgres(dsn))
+		}
+	}
+	logger.OnConflict, err = searchlogger.ParseConflictMode(config.OnConflict)
+	if err != nil {
+		log.Fatalf("invalid ON_CONFLICT: %v", err)
+	}
+	if logger.OnConflict == searchlogger.ConflictUpsert && config.ConflictTarget == "" {
+		log.Fatalf("ON_CONFLICT=upsert requires CONFLICT_TARGET")
+	}
+	if logger.OnConflict != searchlogger.ConflictError && config.SQLitePath != "" {
+		log.Fatalf("ON_CONFLICT=%s cannot be combined with SQLITE_PATH, which only supports ON_CONFLICT=error", config.OnConflict)
+	}
+	logger.ConflictTarget = config.ConflictTarget
+	logger.EmptyUserAgent, err = searchlogger.ParseEmptyUserAgentMode(config.EmptyUserAgent)
+	if err != nil {
+		log.Fatalf("invalid EMPTY_USER_AGENT: %v", err)
+	}
+	logger.AnonSessionsPerIP = config.AnonSessionsPerIP
+	logger.AnonSessionWindow = config.AnonSessionWindow
+	logger.AnonOverflow, err = searchlogger.ParseAnonOverflowMode(config.AnonOverflow)
+	if err != nil {
+		log.Fatalf("invalid ANON_OVERFLOW: %v", err)
+	}
+	logger.PIIMode, err = searchlogger.ParsePIIMode(config.PIIMode)
+	if err != nil {
+		log.Fatalf("invalid PII_MODE: %v", err)
+	}
+	if config.MemoryGuardPercent > 0 {
+		logger.MemoryGuardThreshold = float64(config.MemoryGuardPercent) / 100
+		logger.MemoryGuardKeep = float64(config.MemoryGuardKeepPercent) / 100
+		if config.MemoryGuardKeepPercent == 0 {
+			logger.MemoryGuardKeep = -1 // zero would mean the default
+		}
+	}
+	if config.TrimPunctuation {
+		logger.TrimPunctuation = searchlogger.DefaultTrimPunctuation
+		if config.TrimPunctuationChars != "" {
+			logger.TrimPunctuation = config.TrimPunctuationChars
+		}
+	}
+	if config.GeneralizeQueries {
+		logger.QueryGeneralizer = searchlogger.FirstWord
+	}
+	logger.IPStorage, err = searchlogger.ParseIPStorageMode(config.IPStorage)
+	if err != nil {
+		log.Fatalf("invalid IP_STORAGE: %v", err)
+	}
+	if logger.IPStorage == searchlogger.IPStorageHashed && config.IPSalt == "" {
+		log.Fatal("IP_STORAGE=hashed requires IP_SALT")
+	}
+	logger.IPSalt = config.IPSalt
+	logger.ResetCompare, err = searchlogger.ParseResetComparison(config.ResetCompare)
+	if err != nil {
+		log.Fatalf("invalid RESET_COMPARE: %v", err)
+	}
+	logger.Variants, err = searchlogger.ParseVariants(config.Variants)
+	if err != nil {
+		log.Fatalf("invalid VARIANTS: %v", err)
+	}
+	if config.ParseUserAgent {
+		logger.UAParser = searchlogger.SimpleUAParser{}
+	}
+	if config.FilterBots {
+		patterns := append([]string{}, searchlogger.DefaultBotPatterns...)
+		if config.BotPatterns != "" {
+			patterns = append(patterns, strings.Split(config.BotPatterns, ",")...)
+		}
+		logger.BotFilter, err = searchlogger.NewBotFilter(patterns...)
+		if err != nil {
+			log.Fatalf("invalid bot patterns: %v", err)
+		}
+	}
+	if config.AllowPatterns != "" {
+		logger.AllowPatterns, err = searchlogger.CompileQueryPatterns(strings.Split(config.AllowPatterns, ",")...)
+		if err != nil {
+			log.Fatalf("invalid allow patterns: %v", err)
+		}
+	}
+	if config.DenyPatterns != "" {
+		logger.DenyPatterns, err = searchlogger.CompileQueryPatterns(strings.Split(config.DenyPatterns, ",")...)
+		if err != nil {
+			log.Fatalf("invalid deny patterns: %v", err)
+		}
+	}
+	var archive *searchlogger.ArchiveStore
+	if config.ArchiveDir != "" {
+		archive = &searchlogger.ArchiveStore{
+			Objects: searchlogger.DirObjectStore{Dir: config.ArchiveDir},
+			Window:  config.ArchiveWindow,
+		}
+		logger.Store = &searchlogger.MultiStore{
+			Primary:     logger.ActiveStore(),
+			Secondaries: []searchlogger.Store{archive},
+		}
 	}
 	ctx := context.Background()
-	// Start listener in background
-	go logger.StartKeyspaceListener(ctx)
+
+	if *migrate || (config.AutoMigrate && config.SQLitePath == "" && !config.StdoutStore) {
+		// ConnectSQLite already created the SQLite schema, so only the
+		// PostgreSQL databases need migrating.
+		dbs := logger.Shards
+		if config.SQLitePath == "" {
+			dbs = append([]*sql.DB{db}, dbs...)
+		}
+		for _, db := range dbs {
+			if err := database.Migrate(ctx, db); err != nil {
+				log.Fatalf("migration failed: %v", err)
+			}
+		}
+		log.Printf("schema applied")
+		if *migrate {
+			return
+		}
+	}
+
+	if *importPath != "" {
+		im := &importer.Importer{Writer: logger}
+		if *useCopy {
+			im.Writer = importer.WriterFunc(logger.CopyBatch)
+			im.BatchSize = importer.DefaultCopyBatchSize
+		}
+		res, err := im.ImportFile(ctx, *importPath)
+		if err != nil {
+			log.Fatalf("import failed after %d records (%d errors): %v", res.Imported, res.Errors, err)
+		}
+		log.Printf("import finished: %d imported, %d resumed, %d errors", res.Imported, res.Resumed, res.Errors)
+		return
+	}
+
+	if *purge {
+		if retention == 0 {
+			log.Fatalf("--purge requires RETENTION_DAYS to be set")
+		}
+		n, err := logger.PurgeOlderThan(ctx, retention)
+		if err != nil {
+			log.Fatalf("purge failed after removing %d rows: %v", n, err)
+		}
+		log.Printf("purge finished: %d rows removed", n)
+		return
+	}
+
+	if *renormalize {
+		res, err := logger.RenormalizeExisting(ctx)
+		if err != nil {
+			log.Fatalf("renormalize failed after %d rows: %v", res.Scanned, err)
+		}
+		log.Printf("renormalize finished: %d scanned, %d updated, %d deleted", res.Scanned, res.Updated, res.Deleted)
+		return
+	}
+
+	if *replayDLQ {
+		n, err := logger.ReplayDeadLetters(ctx)
+		if err != nil {
+			log.Fatalf("dead-letter replay failed after %d searches: %v", n, err)
+		}
+		log.Printf("dead-letter replay finished: %d searches written", n)
+		return
+	}
+
+	// Start listener in background. It has its own context so shutdown can
+	// stop it after the final flush and wait for it to return.
+	listenerCtx, stopListener := context.WithCancel(ctx)
+	defer stopListener()
+	listenerDone := make(chan struct{})
+	go func() {
+		defer close(listenerDone)
+		logger.StartKeyspaceListener(listenerCtx)
+	}()
+	if config.MemoryGuardPercent > 0 {
+		go logger.StartMemoryGuard(ctx, config.MemoryGuardInterval)
+	}
+	if archive != nil {
+		go archive.Run(ctx, config.ArchiveFlushInterval)
+	}
+	if retention > 0 {
+		go logger.StartRetentionJob(ctx, retention, searchlogger.DefaultPurgeInterval)
+	}
+
+	stopGRPC := func() {}
+	if startGRPC != nil {
+		if stop := startGRPC(logger); stop != nil {
+			stopGRPC = stop
+		}
+	}
+	// Exporters flush on exit. They are closed by closeExporters rather than
+	// deferred, so a shutdown that times out can still flush them.
+	var exporters []func()
+	closeExporters := sync.OnceFunc(func() {
+		for i := len(exporters) - 1; i >= 0; i-- {
+			exporters[i]()
+		}
+	})
+	defer closeExporters()
+	closeOnExit := func(name string, shutdown func(context.Context) error) {
+		exporters = append(exporters, func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(shutdownCtx); err != nil {
+				log.Printf("%s shutdown failed: %v", name, err)
+			}
+		})
+	}
+	if startOTelLogs != nil {
+		if shutdown := startOTelLogs(ctx, logger); shutdown != nil {
+			closeOnExit("OTel log", shutdown)
+		}
+	}
+	if startNATS != nil {
+		if shutdown := startNATS(logger); shutdown != nil {
+			closeOnExit("NATS", shutdown)
+		}
+	}
+	if config.Outbox {
+		if outboxPublisher == nil {
+			log.Fatal("OUTBOX=true needs a publisher: build with -tags nats and set NATS_URL")
+		}
+		if config.OutboxRelayInterval <= 0 {
+			log.Fatal("OUTBOX_RELAY_INTERVAL must be positive")
+		}
+		go logger.StartOutboxRelay(ctx, outboxPublisher, config.OutboxRelayInterval)
+	}
 
 	srv := server.NewServer(logger)
-	if err := srv.Start(config.Port); err != nil {
-		log.Fatalf("server failed: %v", err)
+	srv.BasePath = config.BasePath
+	srv.TrustProxy = config.TrustProxy
+	srv.ProxyHops = config.ProxyHops
+	// Half of SHUTDOWN_TIMEOUT drains requests, leaving the rest for the
+	// flushes that follow.
+	srv.ShutdownTimeout = config.ShutdownTimeout / 2
+	srv.BeaconFlushTimeout = config.BeaconFlushTimeout
+	srv.DisableBeacon = !config.Beacon
+	srv.RequestIDHeader = config.RequestIDHeader
+	srv.VariantHeader = config.VariantHeader
+	srv.Headers, err = server.ParseHeaders(config.ResponseHeaders)
+	if err != nil {
+		log.Fatalf("invalid RESPONSE_HEADERS: %v", err)
+	}
+	if config.CacheControl != "" {
+		srv.Headers.Set("Cache-Control", config.CacheControl)
+	}
+	if config.Pprof {
+		srv.Pprof = true
+		metrics.PublishRuntime()
+	}
+	if config.CORSOrigins != "" {
+		srv.CORS = &server.CORS{
+			AllowedOrigins:   strings.Split(config.CORSOrigins, ","),
+			AllowCredentials: config.CORSCredentials,
+			MaxAge:           time.Hour,
+		}
+	}
+	if config.AdminUser != "" && config.AdminPassword != "" {
+		srv.Auth = &server.BasicAuth{Username: config.AdminUser, Password: config.AdminPassword}
+	}
+	// On SIGINT or SIGTERM, or if the server fails, shut down in order: stop
+	// accepting requests and wait for in-flight ones, over HTTP and gRPC,
+	// then, with FLUSH_ON_SHUTDOWN, write the live sessions, so the last
+	// searches are not left waiting in Redis, then stop
+	// the listener and wait for it, so it cannot race the flush, and write
+	// the expirations it was still coalescing and the resets held for
+	// RESET_GRACE. The whole sequence is bounded by SHUTDOWN_TIMEOUT; past
+	// it, the exporters are still flushed, but sessions not yet written are
+	// left in Redis.
+	runCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		<-runCtx.Done()
+		select {
+		case <-shutdownDone:
+		case <-time.After(config.ShutdownTimeout):
+			log.Printf("shutdown did not finish within %s", config.ShutdownTimeout)
+			closeExporters()
+			os.Exit(1)
+		}
+	}()
+	// A server error still runs the rest of the sequence, so the sessions
+	// and pending writes are not lost with it.
+	runErr := srv.Run(runCtx, config.Port)
+	if runErr != nil {
+		log.Printf("server failed: %v", runErr)
+	}
+	stopGRPC()
+	drainAfterServe(logger, config.FlushOnShutdown, stopListener, listenerDone)
+	if archive != nil {
+		flushCtx, cancel := context.WithTimeout(context.Background(), searchlogger.DefaultFlushTimeout)
+		defer cancel()
+		if err := archive.Flush(flushCtx); err != nil {
+			log.Printf("archive flush failed: %v", err)
+		}
+	}
+	close(shutdownDone)
+	log.Println("Shutdown complete")
+	if runErr != nil {
+		closeExporters()
+		os.Exit(1)
 	}
 }
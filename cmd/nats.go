@@ -0,0 +1,39 @@
+//go:build nats
+
+package main
+
+import (
+	"context"
+	"log"
+
+	"go-search-logger/config"
+	"go-search-logger/internal/natspub"
+	"go-search-logger/internal/searchlogger"
+)
+
+func init() {
+	startNATS = func(logger *searchlogger.Logger) func(context.Context) error {
+		if config.NATSURL == "" {
+			return nil
+		}
+		pub, err := natspub.New(config.NATSURL, config.NATSSubject, config.NATSJetStream)
+		if err != nil {
+			log.Fatalf("NATS connect: %v", err)
+		}
+		// With OUTBOX=true the relay publishes searches from the outbox, so
+		// publishing on commit too would send each one twice.
+		if config.Outbox {
+			outboxPublisher = pub
+			return pub.Close
+		}
+		// A subscriber rather than Logger.Emitter, so it can run alongside
+		// the OTel emitter.
+		cancel := logger.OnCommit(func(entry searchlogger.SearchEntry) {
+			pub.EmitSearch(context.Background(), entry)
+		})
+		return func(ctx context.Context) error {
+			cancel()
+			return pub.Close(ctx)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"log"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+
+	"go-search-logger/config"
+	"go-search-logger/internal/otellog"
+	"go-search-logger/internal/searchlogger"
+)
+
+func init() {
+	startOTelLogs = func(ctx context.Context, logger *searchlogger.Logger) func(context.Context) error {
+		if !config.OTelLogs {
+			return nil
+		}
+		// The exporter is configured by the standard OTEL_EXPORTER_OTLP_*
+		// environment variables.
+		exp, err := otlploggrpc.New(ctx)
+		if err != nil {
+			log.Fatalf("OTLP log exporter: %v", err)
+		}
+		provider := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewBatchProcessor(exp)))
+		logger.Emitter = &otellog.Emitter{Logger: provider.Logger("go-search-logger")}
+		return provider.Shutdown
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+// drainAfterServe runs the shutdown steps that follow stopping the server:
+// with flush, it writes every live session, then stops the keyspace
+// listener and waits for it, so it cannot race the flush, and writes the
+// expirations and resets the logger was still holding.
+func drainAfterServe(logger *searchlogger.Logger, flush bool, stopListener func(), listenerDone <-chan struct{}) {
+	if flush {
+		if _, err := logger.FlushAll(); err != nil {
+			log.Printf("shutdown flush failed: %v", err)
+		}
+	}
+	stopListener()
+	<-listenerDone
+	logger.FlushPending()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+// startLogger returns a Logger on the test Redis with its keyspace listener
+// running, as main starts it.
+func startLogger(t *testing.T) (*searchlogger.Logger, *searchlogger.MemoryStore, func(), <-chan struct{}) {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	rdb.FlushAll(context.Background())
+	t.Cleanup(func() { rdb.Close() })
+	store := &searchlogger.MemoryStore{}
+	logger := &searchlogger.Logger{Redis: rdb, Store: store}
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger.StartKeyspaceListener(ctx)
+	}()
+	return logger, store, stop, done
+}
+
+func TestDrainAfterServe_FlushesLiveSessions(t *testing.T) {
+	logger, store, stop, done := startLogger(t)
+	if err := logger.LogSearch(context.Background(), "test-shutdown", "TestAgent", "lamps"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+
+	drainAfterServe(logger, true, stop, done)
+
+	if entry, ok := store.Latest("test-shutdown"); !ok || entry.Query != "lamps" {
+		t.Errorf("expected the live session written at shutdown, got %+v", entry)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("expected the listener to have stopped")
+	}
+}
+
+func TestDrainAfterServe_LeavesSessionsWithoutFlush(t *testing.T) {
+	logger, store, stop, done := startLogger(t)
+	if err := logger.LogSearch(context.Background(), "test-shutdown", "TestAgent", "lamps"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+
+	drainAfterServe(logger, false, stop, done)
+
+	if _, ok := store.Latest("test-shutdown"); ok {
+		t.Error("expected the live session left in Redis without FLUSH_ON_SHUTDOWN")
+	}
+}
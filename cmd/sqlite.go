@@ -0,0 +1,9 @@
+//go:build sqlite
+
+package main
+
+import "go-search-logger/internal/database"
+
+func init() {
+	connectSQLite = database.ConnectSQLite
+}
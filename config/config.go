@@ -1,7 +1,481 @@
 package config
 
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
 const (
 	RedisAddr = "localhost:6379"
-	DBConnStr = "postgres://localhost/search_logs?sslmode=disable"
 	Port      = ":8080"
+
+	// DedupLookback suppresses re-committing any of a session's last N
+	// committed terms within 10 minutes. Zero disables it.
+	DedupLookback = 0
+
+	// TrailingSpaceCommits commits a query sent with trailing whitespace
+	// ("cat ") immediately. By default trailing whitespace is ignored.
+	TrailingSpaceCommits = false
+
+	// RedisFallback writes searches straight to PostgreSQL while Redis is
+	// down instead of failing them. Every keystroke becomes a row.
+	RedisFallback = false
+
+	// ShadowEditDistance, if positive, compares an edit-distance reset
+	// classifier (allowing that many edits) with the prefix classifier and
+	// counts disagreements, without changing what is logged.
+	ShadowEditDistance = 0
+)
+
+// Debounce coalesces each user's keystrokes within this interval (e.g.
+// "150ms") into a single Redis update. Zero disables debouncing.
+var Debounce = envDuration("DEBOUNCE", 0)
+
+// LinkAnonID stores the User-Agent derived anon id on logged-in users'
+// rows too, when set to "true".
+var LinkAnonID = os.Getenv("LINK_ANON_ID") == "true"
+
+// DailyCounts maintains per-term daily commit counters in Redis when set
+// to "true". POPULAR_TERM_COMMITS turns them on as well.
+var DailyCounts = os.Getenv("DAILY_COUNTS") == "true"
+
+// ParseUserAgent stores the device, browser and OS parsed from each
+// search's User-Agent when set to "true".
+var ParseUserAgent = os.Getenv("PARSE_USER_AGENT") == "true"
+
+// TermsTable stores each search as a term id into the search_terms table
+// instead of inline text when set to "true", saving space when terms
+// repeat.
+var TermsTable = os.Getenv("TERMS_TABLE") == "true"
+
+// CaptureSearchTime stores the time each search was made rather than the
+// time it was committed when set to "true", keeping history in search
+// order.
+var CaptureSearchTime = os.Getenv("CAPTURE_SEARCH_TIME") == "true"
+
+// TrackGaps keeps a leaderboard of searches reported with
+// outcome=no_results, served at /gaps, when set to "true".
+var TrackGaps = os.Getenv("TRACK_GAPS") == "true"
+
+// CORSOrigins are comma-separated origins allowed to call the search
+// endpoints from browsers, e.g. "https://shop.example.com", or "*". Empty
+// disables CORS. Set CORS_CREDENTIALS=true to allow cookies.
+var (
+	CORSOrigins     = os.Getenv("CORS_ORIGINS")
+	CORSCredentials = os.Getenv("CORS_CREDENTIALS") == "true"
+)
+
+// RequestIDHeader is the header request ids are read from and echoed in
+// (default X-Request-Id). CacheControl, if set, is sent as Cache-Control on
+// every response, and ResponseHeaders adds semicolon-separated
+// "Name: value" headers, e.g. "X-Frame-Options: DENY".
+var (
+	RequestIDHeader = os.Getenv("REQUEST_ID_HEADER")
+	CacheControl    = os.Getenv("CACHE_CONTROL")
+	ResponseHeaders = os.Getenv("RESPONSE_HEADERS")
 )
+
+// StdoutStore writes committed searches as JSON lines to stdout instead of a
+// database when set to "true". No database is connected; endpoints and
+// commands that read or update stored searches are unavailable.
+var StdoutStore = os.Getenv("STDOUT_STORE") == "true"
+
+// DeadLetter parks searches that fail to be written in a Redis list instead
+// of dropping them, when set to "true". Replay them with --replay-dlq.
+var DeadLetter = os.Getenv("DEAD_LETTER") == "true"
+
+// TrendingHalfLife keeps a leaderboard of committed searches in which each
+// commit's weight halves every half-life, for GET /rising. Zero disables it.
+var TrendingHalfLife = envDuration("TRENDING_HALF_LIFE", 0)
+
+// SessionTTL is how long a session stays live without a keystroke (default
+// 10s). IdleCommit commits a live query once it has been unchanged this
+// long, without ending the session; it must be shorter than SessionTTL.
+var (
+	SessionTTL = envDuration("SESSION_TTL", 0)
+	IdleCommit = envDuration("IDLE_COMMIT", 0)
+)
+
+// SingleKeySessions keeps each session in one Redis key when set to "true",
+// finding expired sessions by polling instead of through keyspace
+// notifications. ReapInterval is the polling interval (default 5s).
+var (
+	SingleKeySessions = os.Getenv("SINGLE_KEY_SESSIONS") == "true"
+	ReapInterval      = envDuration("REAP_INTERVAL", 0)
+)
+
+// AnonVisitWindow groups anonymous searches without a pause this long (e.g.
+// 30m) under one visit_id. Zero disables it.
+var AnonVisitWindow = envDuration("ANON_VISIT_WINDOW", 0)
+
+// MemoryGuardPercent, if set, sheds new sessions while Redis used memory is
+// at least this percentage of maxmemory, keeping MemoryGuardKeepPercent
+// (default 10, 0 keeps none) of them. Memory is checked every
+// MemoryGuardInterval (default 10s).
+var (
+	MemoryGuardPercent     = envInt("MEMORY_GUARD_PERCENT", 0)
+	MemoryGuardKeepPercent = envInt("MEMORY_GUARD_KEEP_PERCENT", 10)
+	MemoryGuardInterval    = envDuration("MEMORY_GUARD_INTERVAL", 0)
+)
+
+// TrackRefinements stores the previously committed query in refined_from
+// when a search follows a reset, when set to "true".
+var TrackRefinements = os.Getenv("TRACK_REFINEMENTS") == "true"
+
+// Sequence numbers each user's committed searches in the seq column when set
+// to "true". SEQUENCE_TTL, if set, forgets a counter after that long idle.
+var (
+	Sequence    = os.Getenv("SEQUENCE") == "true"
+	SequenceTTL = envDuration("SEQUENCE_TTL", 0)
+)
+
+// QueryStats stores each committed query's word and character counts in
+// token_count and char_count when set to "true".
+var QueryStats = os.Getenv("QUERY_STATS") == "true"
+
+// Outbox records every committed search in search_outbox, in the same
+// transaction, and relays it to a publisher every OUTBOX_RELAY_INTERVAL
+// (default 1s) when set to "true". The publisher comes from an optional
+// integration, e.g. NATS in binaries built with the "nats" build tag.
+var (
+	Outbox              = os.Getenv("OUTBOX") == "true"
+	OutboxRelayInterval = envDuration("OUTBOX_RELAY_INTERVAL", time.Second)
+)
+
+// ShutdownTimeout bounds the whole shutdown sequence, from the signal until
+// the server, the final flush and the listener have stopped. The process
+// exits with an error if it takes longer.
+var ShutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+// FlushOnShutdown writes every live session to the DB when the server stops,
+// if FLUSH_ON_SHUTDOWN is true. Leave it off when several instances share
+// Redis, since it also ends sessions that users are continuing on other
+// instances.
+var FlushOnShutdown = envBool("FLUSH_ON_SHUTDOWN", false)
+
+// EventStream appends every committed search to a Redis stream per UTC day
+// when set to "true". EVENT_STREAM_MAXLEN bounds each day's stream and
+// EVENT_STREAM_TTL how long it is kept; zero selects the defaults.
+var (
+	EventStream       = os.Getenv("EVENT_STREAM") == "true"
+	EventStreamMaxLen = int64(envInt("EVENT_STREAM_MAXLEN", 0))
+	EventStreamTTL    = envDuration("EVENT_STREAM_TTL", 0)
+)
+
+// ArchiveDir, if set, also archives every committed search as gzipped NDJSON
+// files under this directory (e.g. a mounted bucket), one part per
+// ARCHIVE_WINDOW (default 1h) per ARCHIVE_FLUSH_INTERVAL (default 1m).
+var (
+	ArchiveDir           = os.Getenv("ARCHIVE_DIR")
+	ArchiveWindow        = envDuration("ARCHIVE_WINDOW", 0)
+	ArchiveFlushInterval = envDuration("ARCHIVE_FLUSH_INTERVAL", 0)
+)
+
+// Pprof serves net/http/pprof at /debug/pprof/ and Go runtime gauges in
+// /debug/vars, both behind the admin credentials, when set to "true".
+var Pprof = os.Getenv("PPROF") == "true"
+
+// BasePath mounts all HTTP routes under a prefix, e.g. "/api/searchlog".
+var BasePath = os.Getenv("BASE_PATH")
+
+// Beacon serves /beacon; set BEACON=false to leave it out. BeaconFlushTimeout
+// bounds each flush it starts (default 5s).
+var (
+	Beacon             = envBool("BEACON", true)
+	BeaconFlushTimeout = envDuration("BEACON_FLUSH_TIMEOUT", 0)
+)
+
+// LogLevel is the minimum log level: debug, info, warn or error. Per-keystroke
+// and per-write detail is only logged at debug.
+var LogLevel = envOr("LOG_LEVEL", "info")
+
+// FilterBots drops searches whose User-Agent matches a known crawler
+// pattern. Set FILTER_BOTS=false to log them. BotPatterns are additional
+// comma-separated User-Agent regexes treated as bots.
+var (
+	FilterBots  = envBool("FILTER_BOTS", true)
+	BotPatterns = os.Getenv("BOT_PATTERNS")
+)
+
+// AllowPatterns are comma-separated query regexes. When set, only matching
+// queries are logged.
+var AllowPatterns = os.Getenv("ALLOW_PATTERNS")
+
+// PIIMode redacts ("redact") or drops ("drop") searches containing email
+// addresses, card numbers, SSNs, IBANs or phone numbers. "off" by default.
+var PIIMode = envOr("PII_MODE", "off")
+
+// GeneralizeQueries stores only the first word of each query.
+var GeneralizeQueries = os.Getenv("GENERALIZE_QUERIES") == "true"
+
+// DenyPatterns are comma-separated query regexes that are never logged. They
+// take precedence over AllowPatterns.
+var DenyPatterns = os.Getenv("DENY_PATTERNS")
+
+// GRPCPort is the address of the gRPC server, e.g. ":9090". It is only used
+// by binaries built with the "grpc" build tag; empty disables it.
+var GRPCPort = os.Getenv("GRPC_PORT")
+
+// OTelLogs emits each committed search as an OpenTelemetry log record over
+// OTLP when set to "true". It is only used by binaries built with the "otel"
+// build tag.
+var OTelLogs = os.Getenv("OTEL_LOGS") == "true"
+
+// NATSURL is the NATS server committed searches are published to, e.g.
+// "nats://localhost:4222". It is only used by binaries built with the "nats"
+// build tag; empty disables it.
+var NATSURL = os.Getenv("NATS_URL")
+
+// NATSSubject is the subject committed searches are published to.
+var NATSSubject = envOr("NATS_SUBJECT", "searches.committed")
+
+// NATSJetStream publishes through JetStream, so searches are persisted by a
+// stream bound to NATSSubject, when set to "true".
+var NATSJetStream = os.Getenv("NATS_JETSTREAM") == "true"
+
+// CompleteLength commits a session's query as soon as it reaches this many
+// characters, once per session, instead of waiting for a reset or the TTL.
+// Zero disables it.
+var CompleteLength = envInt("COMPLETE_LENGTH", 0)
+
+// PopularTermCommits commits a session's query as soon as it exactly matches
+// a term committed at least this many times today and yesterday, once per
+// session. It turns on the daily counters it reads. Zero disables it.
+var PopularTermCommits = int64(envInt("POPULAR_TERM_COMMITS", 0))
+
+// Trajectory stores every keystroke of a session, up to MaxTrajectory
+// (default 100), in the trajectory column of the committed row when set to
+// "true". It is meant for training autocompletion models and is expensive.
+var (
+	Trajectory    = os.Getenv("TRAJECTORY") == "true"
+	MaxTrajectory = envInt("MAX_TRAJECTORY", 0)
+)
+
+// DailyUserCap caps the searches committed per user or anon id per day;
+// further ones are dropped. Zero means unlimited.
+var DailyUserCap = envInt("DAILY_USER_CAP", 0)
+
+// HistoryCacheSize caches each user's most recent searches in Redis for the
+// first page of /history and /recent, for HISTORY_CACHE_TTL (default 1h).
+// Zero disables the cache.
+var (
+	HistoryCacheSize = envInt("HISTORY_CACHE_SIZE", 0)
+	HistoryCacheTTL  = envDuration("HISTORY_CACHE_TTL", 0)
+)
+
+// LastQueryCacheSize caches up to this many sessions' live queries in process
+// memory for LAST_QUERY_CACHE_TTL (default 2s), saving a Redis read per
+// keystroke. It assumes sticky sessions. Zero disables the cache.
+var (
+	LastQueryCacheSize = envInt("LAST_QUERY_CACHE_SIZE", 0)
+	LastQueryCacheTTL  = envDuration("LAST_QUERY_CACHE_TTL", 0)
+)
+
+// MinDwell discards a query replaced by a reset less than this long after it
+// was set, e.g. MIN_DWELL=500ms, instead of committing it. Zero keeps every
+// query.
+var MinDwell = envDuration("MIN_DWELL", 0)
+
+// CommitDedupWindow skips re-committing a query the same user committed
+// within this window, e.g. COMMIT_DEDUP_WINDOW=30s, to absorb retry bursts.
+// Zero disables it.
+var CommitDedupWindow = envDuration("COMMIT_DEDUP_WINDOW", 0)
+
+// ResetGrace delays reset-triggered writes so typo corrections within the
+// window don't commit the previous query, e.g. RESET_GRACE=1500ms. Zero
+// writes immediately.
+var ResetGrace = envDuration("RESET_GRACE", 0)
+
+// ExpiryCoalesceWindow makes the keyspace listener gather expirations for
+// the same id within the window and flush them once, e.g.
+// EXPIRY_COALESCE_WINDOW=200ms. Zero flushes each expiration immediately.
+var ExpiryCoalesceWindow = envDuration("EXPIRY_COALESCE_WINDOW", 0)
+
+// ExpiryBufferSize is how many expired-key events the keyspace listener
+// buffers; overflow triggers a scan for the missed sessions.
+var ExpiryBufferSize = envInt("EXPIRY_BUFFER_SIZE", 0)
+
+// ShardDSNs are comma-separated PostgreSQL connection strings of the shards
+// holding user_searches and search_results. Empty keeps everything in
+// DBConnStr.
+var ShardDSNs = os.Getenv("SHARD_DSNS")
+
+// AutoMigrate applies the PostgreSQL schema on start when set to "true", so
+// a fresh database works without running --migrate first.
+var AutoMigrate = os.Getenv("AUTO_MIGRATE") == "true"
+
+// SQLitePath, if set, writes searches to this SQLite file instead of
+// PostgreSQL, for single-node and edge deployments. It is only supported by
+// binaries built with the "sqlite" build tag.
+var SQLitePath = os.Getenv("SQLITE_PATH")
+
+// EmptyUserAgent selects how anonymous requests without a User-Agent are
+// identified: "shared" (one anon id for all of them), "reject",
+// "require_anon_id" (reject unless the client sends anon_id) or "bucket"
+// (log them under a separate anon id and warn).
+var EmptyUserAgent = envOr("EMPTY_USER_AGENT", "shared")
+
+// ResetCompare selects which form of a query reset detection compares:
+// "normalized" (the default, so "Cat" -> "cat" continues the search) or
+// "raw" (trimmed but otherwise as typed, so "Cat" -> "cat" is a reset). The
+// normalized query is stored either way; "raw" also stores the raw query.
+var ResetCompare = envOr("RESET_COMPARE", "normalized")
+
+// Variants are semicolon-separated A/B variants of the logging heuristics,
+// e.g. "control=;typo=edit-distance:2,trailing-space". A request selects one
+// with the VariantHeader header (default X-SearchLog-Variant), which is only
+// honored on requests that pass basic auth.
+var (
+	Variants      = os.Getenv("VARIANTS")
+	VariantHeader = os.Getenv("VARIANT_HEADER")
+)
+
+// TrimPunctuation trims punctuation from both ends of queries when set to
+// "true", so "hello?" is stored as "hello". TrimPunctuationChars, if set,
+// overrides the characters trimmed.
+var (
+	TrimPunctuation      = os.Getenv("TRIM_PUNCTUATION") == "true"
+	TrimPunctuationChars = os.Getenv("TRIM_PUNCTUATION_CHARS")
+)
+
+// AnonSessionsPerIP caps the distinct anon ids one client IP may create
+// within AnonSessionWindow (default 1h); zero disables the cap. Sessions
+// beyond it are logged under a shared overflow anon id with
+// ANON_OVERFLOW=bucket (the default), or rejected with ANON_OVERFLOW=reject.
+var (
+	AnonSessionsPerIP = envInt("ANON_SESSIONS_PER_IP", 0)
+	AnonSessionWindow = envDuration("ANON_SESSION_WINDOW", 0)
+	AnonOverflow      = envOr("ANON_OVERFLOW", "bucket")
+)
+
+// TrustProxy takes client IPs from X-Forwarded-For. Set TRUST_PROXY=true only
+// behind a proxy that sets the header.
+var TrustProxy = os.Getenv("TRUST_PROXY") == "true"
+
+// ProxyHops is the number of trusted proxies in front of the server; the
+// client IP is that many X-Forwarded-For addresses from the right. Zero
+// means one.
+var ProxyHops = envInt("TRUST_PROXY_HOPS", 0)
+
+// IPStorage stores each search's client IP in the ip column: "off" (the
+// default), "raw", "truncated" (to /24 or /48) or "hashed" (HMAC-SHA256 keyed
+// with IP_SALT, which is then required).
+var (
+	IPStorage = envOr("IP_STORAGE", "off")
+	IPSalt    = os.Getenv("IP_SALT")
+)
+
+// OnConflict handles inserts that violate a unique constraint added to
+// user_searches: "error", "ignore" or "upsert" (bump last_searched_at of the
+// existing row). ConflictTarget names the constraint, e.g.
+// CONFLICT_TARGET="(user_id, search_text)"; upsert requires it. With
+// SQLitePath only "error" is supported.
+var (
+	OnConflict     = envOr("ON_CONFLICT", "error")
+	ConflictTarget = os.Getenv("CONFLICT_TARGET")
+)
+
+// TimeZone is the IANA zone used for day boundaries in daily counters.
+var TimeZone = envOr("SEARCH_TIMEZONE", "UTC")
+
+// RetentionDays is how many days of searches are kept; older rows are purged
+// daily. Zero keeps everything.
+var RetentionDays = envInt("RETENTION_DAYS", 0)
+
+// AnonIDRotation rotates User-Agent derived anon ids every period, e.g. 24h.
+// Zero keeps them stable forever. Rotating ids means anonymous activity can
+// no longer be linked across periods.
+var AnonIDRotation = envDuration("ANON_ID_ROTATION", 0)
+
+// MaxUserAgentLength caps the User-Agent bytes hashed into an anon id.
+// Defaults to 512.
+var MaxUserAgentLength = envInt("MAX_USER_AGENT_LENGTH", 0)
+
+// Redis connection pool and timeouts. Zero values use the go-redis defaults
+// (10 connections per CPU, 5s dial timeout, 3s read/write timeouts). Every
+// autocomplete keystroke costs 2-3 Redis round trips, so for high-QPS
+// deployments start from REDIS_POOL_SIZE=100, REDIS_MIN_IDLE_CONNS=20,
+// REDIS_DIAL_TIMEOUT=1s and REDIS_READ_TIMEOUT/REDIS_WRITE_TIMEOUT=200ms,
+// which fail fast instead of queueing requests behind a slow Redis.
+var (
+	RedisPoolSize     = envInt("REDIS_POOL_SIZE", 0)
+	RedisMinIdleConns = envInt("REDIS_MIN_IDLE_CONNS", 0)
+	RedisDialTimeout  = envDuration("REDIS_DIAL_TIMEOUT", 0)
+	RedisReadTimeout  = envDuration("REDIS_READ_TIMEOUT", 0)
+	RedisWriteTimeout = envDuration("REDIS_WRITE_TIMEOUT", 0)
+)
+
+// DBConnStr is the PostgreSQL DSN and RedisPassword the Redis AUTH password.
+// Each can be read from a mounted secret file instead, via DB_CONN_STR_FILE
+// or REDIS_PASSWORD_FILE, which take precedence over the variable itself.
+var (
+	DBConnStr     = secretOr("DB_CONN_STR", "postgres://localhost/search_logs?sslmode=disable")
+	RedisPassword = secretOr("REDIS_PASSWORD", "")
+)
+
+// Admin credentials for /admin and the read endpoints. Access is disabled
+// unless both are set.
+var (
+	AdminUser     = os.Getenv("ADMIN_USER")
+	AdminPassword = os.Getenv("ADMIN_PASSWORD")
+)
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// secretOr returns the contents of the file named by key+"_FILE", without
+// trailing newlines, or else the value of key, or else fallback. Secrets
+// mounted as files stay out of the process environment.
+func secretOr(key, fallback string) string {
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("config: reading %s_FILE: %v", key, err)
+		}
+		return strings.TrimRight(string(b), "\r\n")
+	}
+	return envOr(key, fallback)
+}
+
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("config: invalid %s %q: must be a non-negative integer", key, v)
+	}
+	return n
+}
+
+func envBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("config: invalid %s %q: must be true or false", key, v)
+	}
+	return b
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatalf("config: invalid %s %q: must be a duration such as 500ms", key, v)
+	}
+	return d
+}
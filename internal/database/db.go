@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"log"
 
@@ -21,3 +22,10 @@ func ConnectPostgres(dsn string) *sql.DB {
 	}
 	return db
 }
+
+// Migrate applies Schema to db. Every statement is idempotent, so it is safe
+// to run on every start.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, Schema)
+	return err
+}
@@ -0,0 +1,100 @@
+package database
+
+// Schema is the DDL for the tables used by the search logger. Optional
+// columns are nullable and only written when the corresponding field is set,
+// so older deployments can add them when they start using the feature.
+const Schema = `
+CREATE TABLE IF NOT EXISTS user_searches (
+	user_id          TEXT,
+	search_text      TEXT NOT NULL,
+	last_searched_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	anon_id          TEXT
+);
+
+CREATE TABLE IF NOT EXISTS search_terms (
+	id   BIGSERIAL PRIMARY KEY,
+	term TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS search_terms_term ON search_terms (md5(term));
+
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS id BIGSERIAL; -- tie-breaker for history cursors
+CREATE INDEX IF NOT EXISTS user_searches_last_searched_at_id ON user_searches (last_searched_at DESC, id DESC);
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS location TEXT;
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS extra JSONB;
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS outcome TEXT; -- success, no_results or error
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS latency_ms INTEGER; -- client-reported
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS device TEXT;  -- mobile, tablet or desktop
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS browser TEXT;
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS os TEXT;
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS term_id BIGINT REFERENCES search_terms (id);
+ALTER TABLE user_searches ALTER COLUMN search_text DROP NOT NULL; -- NULL when term_id is set
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS raw_text TEXT; -- query as typed, with RESET_COMPARE=raw
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS trajectory JSONB; -- keystrokes, with TRAJECTORY=true
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS ip TEXT; -- client IP, raw, truncated or hashed per IP_STORAGE
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS utm_source TEXT;
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS utm_campaign TEXT;
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS seq BIGINT; -- per-user commit number, with SEQUENCE=true
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS refined_from TEXT; -- previous committed query, with TRACK_REFINEMENTS=true
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS visit_id TEXT; -- anonymous visit, with ANON_VISIT_WINDOW
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS variant TEXT; -- A/B variant of the logging heuristics, with VARIANTS
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS token_count INTEGER; -- words in the query, with QUERY_STATS=true
+ALTER TABLE user_searches ADD COLUMN IF NOT EXISTS char_count INTEGER; -- characters in the query, with QUERY_STATS=true
+CREATE INDEX IF NOT EXISTS user_searches_utm_campaign ON user_searches (utm_campaign, last_searched_at) WHERE utm_campaign IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS search_results (
+	user_id     TEXT,
+	anon_id     TEXT,
+	search_text TEXT NOT NULL,
+	result_id   TEXT NOT NULL,
+	position    INTEGER NOT NULL,
+	searched_at TIMESTAMPTZ, -- most recent matching user_searches row, if any
+	selected_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS search_outbox (
+	id           BIGSERIAL PRIMARY KEY,
+	key          TEXT NOT NULL, -- user id, or anon id for anonymous users
+	payload      JSONB NOT NULL,
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	published_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS search_outbox_unpublished ON search_outbox (id) WHERE published_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS search_term_daily_counts (
+	day   DATE   NOT NULL,
+	term  TEXT   NOT NULL,
+	count BIGINT NOT NULL,
+	PRIMARY KEY (day, term)
+);
+`
+
+// SQLiteSchema is the DDL for the user_searches table in SQLite, as written
+// by searchlogger.SQLiteStore. It includes every optional column.
+const SQLiteSchema = `
+CREATE TABLE IF NOT EXISTS user_searches (
+	id               INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id          TEXT,
+	search_text      TEXT NOT NULL,
+	raw_text         TEXT,
+	anon_id          TEXT,
+	location         TEXT,
+	extra            TEXT, -- JSON
+	outcome          TEXT,
+	latency_ms       INTEGER,
+	device           TEXT,
+	browser          TEXT,
+	os               TEXT,
+	ip               TEXT,
+	utm_source       TEXT,
+	utm_campaign     TEXT,
+	seq              INTEGER,
+	refined_from     TEXT,
+	visit_id         TEXT,
+	variant          TEXT,
+	token_count      INTEGER,
+	char_count       INTEGER,
+	trajectory       TEXT, -- JSON
+	last_searched_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS user_searches_last_searched_at_id ON user_searches (last_searched_at DESC, id DESC);
+`
@@ -0,0 +1,26 @@
+//go:build sqlite
+
+package database
+
+import (
+	"database/sql"
+	"log"
+
+	_ "modernc.org/sqlite"
+)
+
+// ConnectSQLite opens the SQLite database at path, creating it and its
+// tables if needed. Use ":memory:" for a throwaway database. Connections are
+// limited to one, since SQLite serializes writers and each connection to
+// ":memory:" would otherwise get its own empty database.
+func ConnectSQLite(path string) *sql.DB {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		log.Fatalf("failed to open sqlite db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(SQLiteSchema); err != nil {
+		log.Fatalf("failed to create sqlite schema: %v", err)
+	}
+	return db
+}
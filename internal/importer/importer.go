@@ -0,0 +1,154 @@
+package importer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+// DefaultBatchSize is the number of records written per transaction.
+const DefaultBatchSize = 500
+
+// DefaultCopyBatchSize is a suitable batch size when the writer uses COPY,
+// which amortizes far larger batches than individual inserts.
+const DefaultCopyBatchSize = 10000
+
+// BatchWriter persists a batch of searches. *searchlogger.Logger implements it.
+type BatchWriter interface {
+	WriteBatch(ctx context.Context, entries []searchlogger.SearchEntry) error
+}
+
+// WriterFunc adapts a function, such as (*searchlogger.Logger).CopyBatch, to
+// a BatchWriter.
+type WriterFunc func(ctx context.Context, entries []searchlogger.SearchEntry) error
+
+// WriteBatch calls f(ctx, entries).
+func (f WriterFunc) WriteBatch(ctx context.Context, entries []searchlogger.SearchEntry) error {
+	return f(ctx, entries)
+}
+
+// Importer backfills historical searches from newline-delimited JSON files.
+// Each line is a record such as
+//
+//	{"user_id": "123", "anon_id": "", "query": "shoes", "timestamp": "2024-06-01T12:00:00Z"}
+//
+// Progress is recorded in a "<file>.progress" sidecar after every batch so an
+// interrupted import can be re-run and resumes after the last written line.
+type Importer struct {
+	Writer    BatchWriter
+	BatchSize int
+}
+
+// Result summarizes an import run.
+type Result struct {
+	Imported int // records written
+	Resumed  int // lines skipped because a previous run already imported them
+	Errors   int // malformed records that were skipped
+}
+
+// ImportFile imports the records in path, resuming from its progress file if present.
+func (im *Importer) ImportFile(ctx context.Context, path string) (Result, error) {
+	var res Result
+
+	f, err := os.Open(path)
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+
+	progressPath := path + ".progress"
+	done, err := readProgress(progressPath)
+	if err != nil {
+		return res, err
+	}
+	if done > 0 {
+		log.Printf("Import: resuming %s after line %d", path, done)
+	}
+
+	batchSize := im.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	batch := make([]searchlogger.SearchEntry, 0, batchSize)
+	line := 0
+
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := im.Writer.WriteBatch(ctx, batch); err != nil {
+				return fmt.Errorf("writing batch ending at line %d: %w", line, err)
+			}
+			res.Imported += len(batch)
+			batch = batch[:0]
+		}
+		if err := writeProgress(progressPath, line); err != nil {
+			return err
+		}
+		log.Printf("Import: %d lines read, %d imported, %d errors", line, res.Imported, res.Errors)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line++
+		if line <= done {
+			res.Resumed++
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var entry searchlogger.SearchEntry
+		if err := json.Unmarshal([]byte(text), &entry); err != nil || strings.TrimSpace(entry.Query) == "" {
+			res.Errors++
+			log.Printf("Import: skipping malformed record on line %d: %v", line, err)
+			continue
+		}
+		batch = append(batch, entry)
+
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return res, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return res, err
+	}
+	if err := flush(); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// readProgress returns the last imported line recorded in path, or 0 if none.
+func readProgress(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid progress file %s: %w", path, err)
+	}
+	return n, nil
+}
+
+func writeProgress(path string, line int) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(line)+"\n"), 0o644)
+}
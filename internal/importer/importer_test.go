@@ -0,0 +1,81 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+type fakeWriter struct {
+	entries []searchlogger.SearchEntry
+	failAt  int // fail the call once this many entries have been written
+}
+
+func (w *fakeWriter) WriteBatch(ctx context.Context, entries []searchlogger.SearchEntry) error {
+	if w.failAt > 0 && len(w.entries)+len(entries) > w.failAt {
+		return errors.New("write failed")
+	}
+	w.entries = append(w.entries, entries...)
+	return nil
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "searches.ndjson")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	return path
+}
+
+const sample = `{"user_id": "1", "query": "shoes", "timestamp": "2024-06-01T12:00:00Z"}
+not json
+{"anon_id": "anonabc", "query": "socks"}
+{"user_id": "2", "query": "   "}
+
+{"user_id": "3", "query": "hats"}
+`
+
+func TestImportFile_CountsAndSkipsMalformed(t *testing.T) {
+	path := writeFile(t, sample)
+	w := &fakeWriter{}
+	im := &Importer{Writer: w, BatchSize: 2}
+
+	res, err := im.ImportFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("ImportFile error: %v", err)
+	}
+	if res.Imported != 3 || res.Errors != 2 {
+		t.Errorf("expected 3 imported and 2 errors, got %+v", res)
+	}
+	if len(w.entries) != 3 || w.entries[0].Query != "shoes" || w.entries[0].Timestamp.IsZero() {
+		t.Errorf("unexpected entries written: %+v", w.entries)
+	}
+}
+
+func TestImportFile_ResumesAfterFailure(t *testing.T) {
+	path := writeFile(t, sample)
+	im := &Importer{Writer: &fakeWriter{failAt: 2}, BatchSize: 2}
+
+	if _, err := im.ImportFile(context.Background(), path); err == nil {
+		t.Fatal("expected first run to fail")
+	}
+
+	w := &fakeWriter{}
+	im.Writer = w
+	res, err := im.ImportFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("ImportFile error: %v", err)
+	}
+	if res.Resumed == 0 {
+		t.Errorf("expected second run to resume, got %+v", res)
+	}
+	// Only the batch that failed and what follows is written again.
+	if len(w.entries) != 1 || w.entries[0].Query != "hats" {
+		t.Errorf("expected only 'hats' to be imported on resume, got %+v", w.entries)
+	}
+}
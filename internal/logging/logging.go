@@ -0,0 +1,68 @@
+// Package logging adds levels on top of the standard library logger so
+// high-volume diagnostics can be switched off in production.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is a logging severity. Names match log/slog's levels.
+type Level int32
+
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var level int32 = int32(LevelInfo)
+
+// SetLevel sets the minimum level that is written.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// Enabled reports whether messages at l are written.
+func Enabled(l Level) bool {
+	return l >= Level(atomic.LoadInt32(&level))
+}
+
+// ParseLevel parses "debug", "info", "warn" or "error" (case-insensitive).
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Debugf logs at debug level. Use it for per-request and per-keystroke detail.
+func Debugf(format string, args ...interface{}) {
+	if Enabled(LevelDebug) {
+		log.Printf(format, args...)
+	}
+}
+
+// Infof logs at info level.
+func Infof(format string, args ...interface{}) {
+	if Enabled(LevelInfo) {
+		log.Printf(format, args...)
+	}
+}
+
+// Warnf logs at warn level.
+func Warnf(format string, args ...interface{}) {
+	if Enabled(LevelWarn) {
+		log.Printf("WARNING: "+format, args...)
+	}
+}
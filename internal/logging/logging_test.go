@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	cases := map[string]Level{
+		"debug": LevelDebug,
+		"INFO":  LevelInfo,
+		"":      LevelInfo,
+		"warn":  LevelWarn,
+		"error": LevelError,
+	}
+	for in, want := range cases {
+		got, err := ParseLevel(in)
+		if err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+}
+
+func TestDebugfRespectsLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLevel(LevelInfo)
+
+	SetLevel(LevelInfo)
+	Debugf("hidden")
+	Infof("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Errorf("unexpected output at info level: %q", buf.String())
+	}
+
+	buf.Reset()
+	SetLevel(LevelDebug)
+	Debugf("visible")
+	if !strings.Contains(buf.String(), "visible") {
+		t.Errorf("expected debug output at debug level, got %q", buf.String())
+	}
+}
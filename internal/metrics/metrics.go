@@ -0,0 +1,102 @@
+// Package metrics publishes operational counters and gauges via expvar. They
+// are served as JSON at /debug/vars.
+package metrics
+
+import "expvar"
+
+var (
+	// RedisFallbackActive is 1 while searches are written straight to the DB
+	// because Redis is unavailable, and 0 otherwise.
+	RedisFallbackActive = expvar.NewInt("redis_fallback_active")
+	// RedisFallbackWrites counts searches written straight to the DB.
+	RedisFallbackWrites = expvar.NewInt("redis_fallback_writes_total")
+
+	// ResetClassifierDisagreements counts transitions where the shadow reset
+	// classifier disagreed with the active one.
+	ResetClassifierDisagreements = expvar.NewInt("reset_classifier_disagreements_total")
+
+	// EmptyUserAgentRequests counts requests without a User-Agent that were
+	// bucketed under a separate anon id.
+	EmptyUserAgentRequests = expvar.NewInt("empty_user_agent_requests_total")
+
+	// UserAgentsTruncated counts User-Agents longer than MaxUserAgentLength
+	// that were truncated before deriving an anon id.
+	UserAgentsTruncated = expvar.NewInt("user_agents_truncated_total")
+
+	// ExpiryEventsDropped counts expired-key events the keyspace listener
+	// could not buffer. Their sessions are recovered by a reconcile scan.
+	ExpiryEventsDropped = expvar.NewInt("expiry_events_dropped_total")
+
+	// SessionsStarted counts searches that started a new session.
+	SessionsStarted = expvar.NewInt("sessions_started_total")
+
+	// BuffersMissing counts expired sessions whose buffered entry was gone,
+	// e.g. evicted under memory pressure, so their query was lost.
+	BuffersMissing = expvar.NewInt("buffers_missing_total")
+
+	// AnonSessionsOverflowed counts anonymous sessions beyond the per-IP cap
+	// that were bucketed or rejected.
+	AnonSessionsOverflowed = expvar.NewInt("anon_sessions_overflowed_total")
+
+	// DailyUserCapDropped counts commits dropped because their user or anon
+	// id reached the daily cap.
+	DailyUserCapDropped = expvar.NewInt("daily_user_cap_dropped_total")
+
+	// TransientDropped counts live queries discarded on reset because they
+	// were live for less than MinDwell.
+	TransientDropped = expvar.NewInt("transient_dropped_total")
+
+	// TailEventsDropped counts committed searches not sent to a /tail
+	// client because it had fallen too far behind.
+	TailEventsDropped = expvar.NewInt("tail_events_dropped_total")
+
+	// PIIDetected counts searches found to contain personal data with
+	// PIIMode set, whether redacted or dropped.
+	PIIDetected = expvar.NewInt("pii_detected_total")
+
+	// LastQueryCacheHits counts live queries read from the process-local
+	// cache instead of Redis.
+	LastQueryCacheHits = expvar.NewInt("last_query_cache_hits_total")
+	// LastQueryCacheConflicts counts writes that found another process had
+	// changed the live query, after which that id is no longer cached.
+	LastQueryCacheConflicts = expvar.NewInt("last_query_cache_conflicts_total")
+
+	// PopularTermCommits counts live queries committed early because they
+	// matched a popular term.
+	PopularTermCommits = expvar.NewInt("popular_term_commits_total")
+
+	// ArchiveObjectsWritten counts objects uploaded by an ArchiveStore.
+	ArchiveObjectsWritten = expvar.NewInt("archive_objects_written_total")
+	// ArchiveEntriesDropped counts searches an ArchiveStore gave up on after
+	// repeated upload failures filled its buffer.
+	ArchiveEntriesDropped = expvar.NewInt("archive_entries_dropped_total")
+
+	// DeadLettered counts searches parked in the dead-letter list after a
+	// failed write.
+	DeadLettered = expvar.NewInt("dead_lettered_total")
+	// DeadLetterDepth is the length of the dead-letter list as of the last
+	// park or replay.
+	DeadLetterDepth = expvar.NewInt("dead_letter_depth")
+
+	// IdleCommits counts live queries committed after IdleCommit without
+	// change.
+	IdleCommits = expvar.NewInt("idle_commits_total")
+
+	// RedisMemoryUsedPercent is Redis used_memory as a percentage of
+	// maxmemory, as of the memory guard's last check.
+	RedisMemoryUsedPercent = expvar.NewInt("redis_memory_used_percent")
+	// RedisMemoryPressure is 1 while the memory guard sheds new sessions.
+	RedisMemoryPressure = expvar.NewInt("redis_memory_pressure")
+	// SessionsShed counts new sessions dropped under memory pressure.
+	SessionsShed = expvar.NewInt("sessions_shed_total")
+
+	// StoreSecondaryErrors counts failed writes to secondary stores.
+	StoreSecondaryErrors = expvar.NewInt("store_secondary_errors_total")
+	// EnrichErrors counts searches stored without enrichment because the
+	// Enricher failed.
+	EnrichErrors = expvar.NewInt("enrich_errors_total")
+
+	// NATSPublishErrors counts committed searches that could not be published
+	// to NATS.
+	NATSPublishErrors = expvar.NewInt("nats_publish_errors_total")
+)
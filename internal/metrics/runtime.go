@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"expvar"
+	"runtime"
+	"sync"
+)
+
+var runtimeOnce sync.Once
+
+// PublishRuntime publishes Go runtime gauges as "runtime": the goroutine
+// count and a heap and GC summary. Reading them briefly stops the world, so
+// they are only computed when /debug/vars is fetched. Safe to call more than
+// once.
+func PublishRuntime() {
+	runtimeOnce.Do(func() {
+		expvar.Publish("runtime", expvar.Func(func() interface{} {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			return map[string]interface{}{
+				"goroutines":        runtime.NumGoroutine(),
+				"heap_alloc_bytes":  m.HeapAlloc,
+				"heap_objects":      m.HeapObjects,
+				"gc_runs":           m.NumGC,
+				"gc_pause_total_ns": m.PauseTotalNs,
+			}
+		}))
+	})
+}
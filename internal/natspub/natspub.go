@@ -0,0 +1,140 @@
+//go:build nats
+
+// Package natspub publishes committed searches to NATS.
+package natspub
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"go-search-logger/internal/metrics"
+	"go-search-logger/internal/searchlogger"
+)
+
+// DefaultSubject is the subject searches are published to if none is set.
+const DefaultSubject = "searches.committed"
+
+// KeyHeader carries the message key, the user id or anon id of the search.
+const KeyHeader = "Search-Key"
+
+// PublishTimeout bounds Publish when its context has no deadline, as with
+// the outbox relay's, since waiting for the acknowledgement needs one.
+const PublishTimeout = 10 * time.Second
+
+// Publisher publishes searches as JSON SearchEntry messages to Subject. It
+// is both a searchlogger.SearchEmitter, for publishing each search as it is
+// committed, and a searchlogger.Publisher, for relaying the outbox.
+type Publisher struct {
+	Conn *nats.Conn
+	// JS, if set, publishes through JetStream, so messages are persisted by
+	// a stream bound to Subject. Otherwise core NATS is used, which delivers
+	// only to subscribers connected at the time.
+	JS      nats.JetStreamContext
+	Subject string
+}
+
+// New connects to the NATS server at url and returns a Publisher for
+// subject, using JetStream if jetStream is true.
+func New(url, subject string, jetStream bool) (*Publisher, error) {
+	conn, err := nats.Connect(url, nats.Name("go-search-logger"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	p := &Publisher{Conn: conn, Subject: subject}
+	if jetStream {
+		p.JS, err = conn.JetStream(nats.PublishAsyncErrHandler(func(_ nats.JetStream, msg *nats.Msg, err error) {
+			metrics.NATSPublishErrors.Add(1)
+			log.Printf("NATS: JetStream publish to %s failed: %v", msg.Subject, err)
+		}))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *Publisher) subject() string {
+	if p.Subject == "" {
+		return DefaultSubject
+	}
+	return p.Subject
+}
+
+// EmitSearch publishes entry without waiting for the server, so a slow or
+// unavailable NATS never delays the commit. Failures are logged and counted
+// in nats_publish_errors_total; the search is still in the database.
+func (p *Publisher) EmitSearch(ctx context.Context, entry searchlogger.SearchEntry) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("NATS: marshal search: %v", err)
+		return
+	}
+	msg := p.msg(entryKey(entry), payload)
+	if p.JS != nil {
+		_, err = p.JS.PublishMsgAsync(msg)
+	} else {
+		err = p.Conn.PublishMsg(msg)
+	}
+	if err != nil {
+		metrics.NATSPublishErrors.Add(1)
+		log.Printf("NATS: publish to %s failed: %v", msg.Subject, err)
+	}
+}
+
+// Publish publishes an outbox message and returns once it is acknowledged:
+// stored by the stream with JetStream, or flushed to the server with core
+// NATS. The outbox id is sent as the JetStream message id, so the stream
+// drops redeliveries within its duplicate window.
+func (p *Publisher) Publish(ctx context.Context, m searchlogger.OutboxMessage) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, PublishTimeout)
+		defer cancel()
+	}
+	msg := p.msg(m.Key, m.Payload)
+	if p.JS != nil {
+		msg.Header.Set(nats.MsgIdHdr, strconv.FormatInt(m.ID, 10))
+		_, err := p.JS.PublishMsg(msg, nats.Context(ctx))
+		return err
+	}
+	if err := p.Conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	return p.Conn.FlushWithContext(ctx)
+}
+
+// Close waits for pending JetStream acknowledgements, up to ctx, and drains
+// the connection.
+func (p *Publisher) Close(ctx context.Context) error {
+	if p.JS != nil {
+		select {
+		case <-p.JS.PublishAsyncComplete():
+		case <-ctx.Done():
+		}
+	}
+	return p.Conn.Drain()
+}
+
+func (p *Publisher) msg(key string, payload []byte) *nats.Msg {
+	msg := nats.NewMsg(p.subject())
+	msg.Data = payload
+	if key != "" {
+		msg.Header.Set(KeyHeader, key)
+	}
+	return msg
+}
+
+// entryKey matches OutboxMessage.Key: the user id, or the anon id for
+// anonymous users.
+func entryKey(entry searchlogger.SearchEntry) string {
+	if entry.UserID != "" {
+		return entry.UserID
+	}
+	return entry.AnonID
+}
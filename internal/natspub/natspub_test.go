@@ -0,0 +1,169 @@
+//go:build nats
+
+package natspub
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+// published is a message received by fakeServer.
+type published struct {
+	subject string
+	header  string
+	data    string
+}
+
+// fakeServer speaks just enough of the NATS protocol for Publish: it answers
+// PINGs, records published messages and acknowledges those with a reply
+// subject as JetStream would.
+func fakeServer(t *testing.T) (url string, msgs <-chan published) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan published, 16)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "INFO {\"server_id\":\"test\",\"version\":\"2.10.0\",\"proto\":1,\"headers\":true,\"max_payload\":1048576}\r\n")
+		r := bufio.NewReader(conn)
+		sids := map[string]string{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			f := strings.Fields(line)
+			if len(f) == 0 {
+				continue
+			}
+			switch f[0] {
+			case "PING":
+				fmt.Fprint(conn, "PONG\r\n")
+			case "SUB":
+				sids[strings.TrimSuffix(f[1], "*")] = f[len(f)-1]
+			case "PUB", "HPUB":
+				hdrLen := 0
+				if f[0] == "HPUB" {
+					hdrLen, _ = strconv.Atoi(f[len(f)-2])
+				}
+				total, _ := strconv.Atoi(f[len(f)-1])
+				body := make([]byte, total+2)
+				if _, err := io.ReadFull(r, body); err != nil {
+					return
+				}
+				ch <- published{subject: f[1], header: string(body[:hdrLen]), data: string(body[hdrLen:total])}
+				// A reply subject comes before the sizes: HPUB has two, PUB one.
+				if hasReply := len(f) == 5 || f[0] == "PUB" && len(f) == 4; hasReply {
+					reply := f[2]
+					for prefix, sid := range sids {
+						if strings.HasPrefix(reply, prefix) {
+							ack := `{"stream":"SEARCHES","seq":1}`
+							fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", reply, sid, len(ack), ack)
+						}
+					}
+				}
+			}
+		}
+	}()
+	return "nats://" + ln.Addr().String(), ch
+}
+
+func receive(t *testing.T, msgs <-chan published) published {
+	t.Helper()
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message published")
+		return published{}
+	}
+}
+
+func TestMsg(t *testing.T) {
+	p := &Publisher{}
+	msg := p.msg("u1", []byte(`{"query":"shoes"}`))
+	if msg.Subject != DefaultSubject {
+		t.Errorf("subject = %q, want %q", msg.Subject, DefaultSubject)
+	}
+	if got := msg.Header.Get(KeyHeader); got != "u1" {
+		t.Errorf("%s = %q, want u1", KeyHeader, got)
+	}
+	if string(msg.Data) != `{"query":"shoes"}` {
+		t.Errorf("data = %q", msg.Data)
+	}
+
+	p.Subject = "custom"
+	msg = p.msg("", nil)
+	if msg.Subject != "custom" {
+		t.Errorf("subject = %q, want custom", msg.Subject)
+	}
+	if _, ok := msg.Header[KeyHeader]; ok {
+		t.Errorf("empty key should not set %s", KeyHeader)
+	}
+}
+
+func TestPublish_CoreNATS(t *testing.T) {
+	url, msgs := fakeServer(t)
+	p, err := New(url, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Conn.Close()
+
+	m := searchlogger.OutboxMessage{ID: 42, Key: "u1", Payload: []byte(`{"query":"shoes"}`)}
+	if err := p.Publish(context.Background(), m); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	got := receive(t, msgs)
+	if got.subject != DefaultSubject || got.data != `{"query":"shoes"}` {
+		t.Errorf("published %+v", got)
+	}
+	if !strings.Contains(got.header, KeyHeader+": u1") {
+		t.Errorf("header %q missing %s", got.header, KeyHeader)
+	}
+	if strings.Contains(got.header, nats.MsgIdHdr) {
+		t.Errorf("core NATS should not set %s: %q", nats.MsgIdHdr, got.header)
+	}
+}
+
+func TestPublish_JetStreamSetsMsgID(t *testing.T) {
+	url, msgs := fakeServer(t)
+	p, err := New(url, "searches", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Conn.Close()
+
+	m := searchlogger.OutboxMessage{ID: 42, Key: "anon-1", Payload: []byte(`{}`)}
+	if err := p.Publish(context.Background(), m); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	got := receive(t, msgs)
+	if got.subject != "searches" {
+		t.Errorf("subject = %q, want searches", got.subject)
+	}
+	if !strings.Contains(got.header, nats.MsgIdHdr+": 42") {
+		t.Errorf("header %q missing %s", got.header, nats.MsgIdHdr)
+	}
+	if !strings.Contains(got.header, KeyHeader+": anon-1") {
+		t.Errorf("header %q missing %s", got.header, KeyHeader)
+	}
+}
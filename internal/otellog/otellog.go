@@ -0,0 +1,58 @@
+//go:build otel
+
+// Package otellog emits committed searches as OpenTelemetry log records.
+package otellog
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/log"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+// EventName is the body of every record, identifying it as a search event.
+const EventName = "search.committed"
+
+// Emitter is a searchlogger.SearchEmitter writing one log record per
+// committed search to an OTel logger, typically from an SDK LoggerProvider
+// exporting over OTLP.
+type Emitter struct {
+	Logger log.Logger
+}
+
+// EmitSearch emits entry as an info-level record. Empty optional fields are
+// left out of the attributes.
+func (e *Emitter) EmitSearch(ctx context.Context, entry searchlogger.SearchEntry) {
+	var r log.Record
+	ts := entry.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	r.SetTimestamp(ts)
+	r.SetSeverity(log.SeverityInfo)
+	r.SetBody(attribute.StringValue(EventName))
+	r.AddAttributes(attribute.String("search.query", entry.Query))
+	for _, a := range []struct{ key, val string }{
+		{"user.id", entry.UserID},
+		{"search.anon_id", entry.AnonID},
+		{"search.outcome", entry.Outcome},
+		{"search.location", entry.Location},
+		{"search.device", entry.Device},
+		{"search.browser", entry.Browser},
+		{"search.os", entry.OS},
+	} {
+		if a.val != "" {
+			r.AddAttributes(attribute.String(a.key, a.val))
+		}
+	}
+	if entry.LatencyMS != nil {
+		r.AddAttributes(attribute.Int64("search.latency_ms", *entry.LatencyMS))
+	}
+	for k, v := range entry.Extra {
+		r.AddAttributes(attribute.String("search.extra."+k, v))
+	}
+	e.Logger.Emit(ctx, r)
+}
@@ -0,0 +1,122 @@
+//go:build grpc
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+
+	"go-search-logger/internal/searchlogger"
+	pb "go-search-logger/proto/searchlogger/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer adapts Service to the generated SearchLoggerServer interface.
+type grpcServer struct {
+	pb.UnimplementedSearchLoggerServer
+	svc *Service
+}
+
+// ServeGRPC serves the SearchLogger gRPC service on addr (e.g. ":9090")
+// until ctx is cancelled, then stops accepting RPCs and waits for those in
+// flight, including open StreamSearches streams, to finish.
+func ServeGRPC(ctx context.Context, addr string, svc *Service) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	pb.RegisterSearchLoggerServer(s, &grpcServer{svc: svc})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		log.Println("Shutting down gRPC server")
+		s.GracefulStop()
+	}()
+	log.Printf("gRPC server running on %s", addr)
+	err = s.Serve(lis)
+	if ctx.Err() != nil {
+		<-stopped
+		return nil
+	}
+	return err
+}
+
+func (g *grpcServer) LogSearch(ctx context.Context, req *pb.SearchRequest) (*pb.LogSearchResponse, error) {
+	if err := g.svc.LogSearch(ctx, fromProto(ctx, req)); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.LogSearchResponse{}, nil
+}
+
+func (g *grpcServer) StreamSearches(stream pb.SearchLogger_StreamSearchesServer) error {
+	ctx := stream.Context()
+	n, err := g.svc.StreamSearches(ctx, func() (searchlogger.SearchRequest, error) {
+		req, err := stream.Recv()
+		if err != nil {
+			return searchlogger.SearchRequest{}, err
+		}
+		return fromProto(ctx, req), nil
+	})
+	if err != nil {
+		return statusError(err)
+	}
+	return stream.SendAndClose(&pb.StreamSearchesResponse{Received: n})
+}
+
+// peerIP returns the IP address of the client calling, if known.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func fromProto(ctx context.Context, req *pb.SearchRequest) searchlogger.SearchRequest {
+	ua := req.GetUserAgent()
+	if ua == "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("user-agent")) > 0 {
+			ua = md.Get("user-agent")[0]
+		}
+	}
+	return searchlogger.SearchRequest{
+		UserID:    req.GetUserId(),
+		UserAgent: ua,
+		ClientIP:  peerIP(ctx),
+		AnonID:    req.GetAnonId(),
+		Query:     req.GetQuery(),
+		Location:  req.GetLocation(),
+		Extra:     req.GetExtra(),
+		Outcome:   req.GetOutcome(),
+		LatencyMS: req.LatencyMs,
+		Submit:    req.GetSubmit(),
+	}
+}
+
+// statusError maps logger errors to gRPC codes, mirroring the HTTP statuses.
+func statusError(err error) error {
+	switch {
+	case errors.Is(err, searchlogger.ErrInvalidQuery),
+		errors.Is(err, searchlogger.ErrInvalidUserID),
+		errors.Is(err, searchlogger.ErrInvalidRequest):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, searchlogger.ErrRedisUnavailable):
+		return status.Error(codes.Unavailable, "search logging temporarily unavailable")
+	default:
+		log.Printf("gRPC: error logging search: %v", err)
+		return status.Error(codes.Internal, "error logging search")
+	}
+}
@@ -0,0 +1,42 @@
+// Package rpc exposes the search logger to RPC transports. Service holds the
+// transport-neutral logic; the gRPC binding in grpc.go is only built with the
+// "grpc" build tag. Its generated code in proto/searchlogger/v1 is checked in
+// and must be regenerated after editing searchlogger.proto.
+package rpc
+
+import (
+	"context"
+	"io"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+// Service implements the SearchLogger RPCs on top of a Logger.
+type Service struct {
+	Logger *searchlogger.Logger
+}
+
+// LogSearch records a single search.
+func (s *Service) LogSearch(ctx context.Context, req searchlogger.SearchRequest) error {
+	return s.Logger.LogSearchRequest(ctx, req)
+}
+
+// StreamSearches records searches from recv, in order, until it returns
+// io.EOF. It returns the number of searches accepted, stopping at the first
+// error.
+func (s *Service) StreamSearches(ctx context.Context, recv func() (searchlogger.SearchRequest, error)) (int64, error) {
+	var n int64
+	for {
+		req, err := recv()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := s.Logger.LogSearchRequest(ctx, req); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,47 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+func TestStreamSearches_CountsUntilEOF(t *testing.T) {
+	logger := &searchlogger.Logger{}
+	logger.SetPaused(true) // accept without Redis or a DB
+	svc := &Service{Logger: logger}
+
+	reqs := []searchlogger.SearchRequest{{Query: "s"}, {Query: "sh"}, {Query: "sho"}}
+	n, err := svc.StreamSearches(context.Background(), func() (searchlogger.SearchRequest, error) {
+		if len(reqs) == 0 {
+			return searchlogger.SearchRequest{}, io.EOF
+		}
+		req := reqs[0]
+		reqs = reqs[1:]
+		return req, nil
+	})
+	if err != nil || n != 3 {
+		t.Errorf("expected 3 searches and no error, got %d, %v", n, err)
+	}
+}
+
+func TestStreamSearches_StopsOnInvalidRequest(t *testing.T) {
+	svc := &Service{Logger: &searchlogger.Logger{}}
+
+	reqs := []searchlogger.SearchRequest{{Query: strings.Repeat("a", searchlogger.MaxQueryLength+1)}, {Query: "never read"}}
+	n, err := svc.StreamSearches(context.Background(), func() (searchlogger.SearchRequest, error) {
+		req := reqs[0]
+		reqs = reqs[1:]
+		return req, nil
+	})
+	if !errors.Is(err, searchlogger.ErrInvalidQuery) || n != 0 {
+		t.Errorf("expected ErrInvalidQuery after 0 searches, got %d, %v", n, err)
+	}
+	if len(reqs) != 1 {
+		t.Errorf("expected the stream to stop at the invalid request")
+	}
+}
@@ -0,0 +1,119 @@
+package searchlogger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
+)
+
+// Common AnonIDRotation periods.
+const (
+	RotateNever  time.Duration = 0
+	RotateDaily                = 24 * time.Hour
+	RotateWeekly               = 7 * 24 * time.Hour
+)
+
+// anonID derives the anon id for a User-Agent. With AnonIDRotation set, the
+// current rotation period (counted in whole periods since the Unix epoch, UTC)
+// is mixed into the hash, so the same browser gets a new id every period.
+func (l *Logger) anonID(userAgent string) string {
+	if l.AnonIDRotation <= 0 {
+		return generateAnonID(userAgent)
+	}
+	// Counted in nanoseconds, so sub-second rotations work too.
+	period := l.now().UnixNano() / int64(l.AnonIDRotation)
+	return generateAnonID(userAgent + "|" + strconv.FormatInt(period, 10))
+}
+
+// DefaultMaxUserAgentLength is the default MaxUserAgentLength. Real browser
+// User-Agents are well under it.
+const DefaultMaxUserAgentLength = 512
+
+func (l *Logger) maxUserAgentLength() int {
+	if l.MaxUserAgentLength > 0 {
+		return l.MaxUserAgentLength
+	}
+	return DefaultMaxUserAgentLength
+}
+
+// capUserAgent returns the part of userAgent that identifies an anonymous
+// user: its first MaxUserAgentLength bytes. Longer values are counted, since
+// they usually come from abusive clients.
+func (l *Logger) capUserAgent(userAgent string) string {
+	max := l.maxUserAgentLength()
+	if len(userAgent) <= max {
+		return userAgent
+	}
+	metrics.UserAgentsTruncated.Add(1)
+	logging.Debugf("LogSearch: User-Agent of %d bytes truncated to %d for the anon id", len(userAgent), max)
+	return userAgent[:max]
+}
+
+// EmptyUserAgentMode selects how anonymous requests with a blank User-Agent,
+// common for API clients, are identified. Without a User-Agent they would
+// all share the anon id derived from "".
+type EmptyUserAgentMode int
+
+const (
+	// EmptyUAShared derives the anon id from the blank User-Agent as usual,
+	// so all such clients share one anon id. This is the default.
+	EmptyUAShared EmptyUserAgentMode = iota
+	// EmptyUAReject rejects the request with ErrInvalidRequest, even if it
+	// carries its own anon id.
+	EmptyUAReject
+	// EmptyUARequireAnonID rejects the request with ErrInvalidRequest unless
+	// the client sends its own anon id (SearchRequest.AnonID).
+	EmptyUARequireAnonID
+	// EmptyUABucket logs the request under NoUserAgentAnonID, where it is
+	// easy to exclude, and counts it in empty_user_agent_requests_total.
+	EmptyUABucket
+)
+
+// NoUserAgentAnonID is the anon id used for blank User-Agents by EmptyUABucket.
+const NoUserAgentAnonID = "anon-no-user-agent"
+
+// ParseEmptyUserAgentMode parses "shared", "reject", "require_anon_id" or "bucket".
+func ParseEmptyUserAgentMode(s string) (EmptyUserAgentMode, error) {
+	switch s {
+	case "", "shared":
+		return EmptyUAShared, nil
+	case "reject":
+		return EmptyUAReject, nil
+	case "require_anon_id":
+		return EmptyUARequireAnonID, nil
+	case "bucket":
+		return EmptyUABucket, nil
+	}
+	return EmptyUAShared, fmt.Errorf("unknown empty User-Agent mode %q", s)
+}
+
+// anonIDFor returns the anon id for a request: derived from the client's own
+// anon id if it sent one, and otherwise from its User-Agent, with a blank
+// User-Agent handled per EmptyUserAgent.
+func (l *Logger) anonIDFor(userAgent, clientAnonID string) (string, error) {
+	blank := strings.TrimSpace(userAgent) == ""
+	if blank && l.EmptyUserAgent == EmptyUAReject {
+		return "", fmt.Errorf("%w: User-Agent is required", ErrInvalidRequest)
+	}
+	if clientAnonID != "" {
+		return l.anonID("client:" + clientAnonID), nil
+	}
+	if !blank {
+		return l.anonID(l.capUserAgent(userAgent)), nil
+	}
+	switch l.EmptyUserAgent {
+	case EmptyUABucket:
+		metrics.EmptyUserAgentRequests.Add(1)
+		l.emptyUAWarning.Do(func() {
+			logging.Warnf("LogSearch: requests without a User-Agent are logged under anon id %s", NoUserAgentAnonID)
+		})
+		return NoUserAgentAnonID, nil
+	case EmptyUARequireAnonID:
+		return "", fmt.Errorf("%w: anon_id is required without a User-Agent", ErrInvalidRequest)
+	}
+	return l.anonID(l.capUserAgent(userAgent)), nil
+}
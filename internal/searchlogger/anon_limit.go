@@ -0,0 +1,86 @@
+package searchlogger
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go-search-logger/internal/metrics"
+)
+
+// AnonOverflowMode selects what happens to an anonymous session beyond
+// AnonSessionsPerIP.
+type AnonOverflowMode int
+
+const (
+	// AnonOverflowBucket logs the session under OverflowAnonID. This is the
+	// default.
+	AnonOverflowBucket AnonOverflowMode = iota
+	// AnonOverflowReject rejects the request with ErrInvalidRequest.
+	AnonOverflowReject
+)
+
+// OverflowAnonID is the anon id used by AnonOverflowBucket.
+const OverflowAnonID = "anon-ip-overflow"
+
+// DefaultAnonSessionWindow is the default AnonSessionWindow.
+const DefaultAnonSessionWindow = time.Hour
+
+// ParseAnonOverflowMode parses "bucket" or "reject".
+func ParseAnonOverflowMode(s string) (AnonOverflowMode, error) {
+	switch s {
+	case "", "bucket":
+		return AnonOverflowBucket, nil
+	case "reject":
+		return AnonOverflowReject, nil
+	}
+	return AnonOverflowBucket, fmt.Errorf("unknown anon overflow mode %q", s)
+}
+
+func (l *Logger) anonSessionWindow() time.Duration {
+	if l.AnonSessionWindow > 0 {
+		return l.AnonSessionWindow
+	}
+	return DefaultAnonSessionWindow
+}
+
+// buildIPAnonKey constructs the key holding the anon ids seen from an IP.
+func buildIPAnonKey(ip string) string {
+	return "search:ipanon:" + ip
+}
+
+// limitAnonSession applies AnonSessionsPerIP to an anonymous session. The
+// anon ids seen from an IP are kept in a set that expires AnonSessionWindow
+// after the IP's last request; a new id beyond the cap is not added to it,
+// and its searches are logged under OverflowAnonID from its own session.
+// If Redis fails the session is allowed, since the cap is only a safeguard.
+func (l *Logger) limitAnonSession(ctx context.Context, sess session, ip string) (session, error) {
+	if l.AnonSessionsPerIP <= 0 || ip == "" || sess.userID != "" || sess.anonID == NoUserAgentAnonID {
+		return sess, nil
+	}
+
+	key := buildIPAnonKey(ip)
+	pipe := l.Redis.TxPipeline()
+	added := pipe.SAdd(ctx, key, sess.anonID)
+	count := pipe.SCard(ctx, key)
+	pipe.Expire(ctx, key, l.anonSessionWindow())
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("LogSearch: could not check anon sessions for ip=%s: %v", ip, err)
+		return sess, nil
+	}
+	if added.Val() == 0 || count.Val() <= int64(l.AnonSessionsPerIP) {
+		return sess, nil
+	}
+
+	if err := l.Redis.SRem(ctx, key, sess.anonID).Err(); err != nil {
+		log.Printf("LogSearch: could not remove overflow anon id for ip=%s: %v", ip, err)
+	}
+	metrics.AnonSessionsOverflowed.Add(1)
+	if l.AnonOverflow == AnonOverflowReject {
+		return session{}, fmt.Errorf("%w: too many anonymous sessions from this address", ErrInvalidRequest)
+	}
+	// Overflowing clients share the anon id, but each keeps its own session
+	// state, so one client's query is not taken as a reset of another's.
+	return session{anonID: OverflowAnonID, id: OverflowAnonID, key: sess.key}, nil
+}
@@ -0,0 +1,259 @@
+package searchlogger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
+)
+
+// ObjectStore uploads archive objects, e.g. to S3 or GCS. PutObject must
+// replace any object already stored under key.
+type ObjectStore interface {
+	PutObject(ctx context.Context, key string, data []byte) error
+}
+
+// DirObjectStore is an ObjectStore writing objects as files under Dir, with
+// the key as relative path. It suits local archives and mounted buckets.
+type DirObjectStore struct {
+	Dir string
+}
+
+// PutObject writes data to Dir/key via a temporary file, so a partial
+// object is never visible under its final name.
+func (d DirObjectStore) PutObject(ctx context.Context, key string, data []byte) error {
+	path := filepath.Join(d.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+const (
+	// DefaultArchiveWindow is the default ArchiveStore.Window.
+	DefaultArchiveWindow = time.Hour
+	// DefaultArchiveFlushInterval is the default interval of ArchiveStore.Run.
+	DefaultArchiveFlushInterval = time.Minute
+	// DefaultArchiveMaxPending is the default ArchiveStore.MaxPending.
+	DefaultArchiveMaxPending = 100000
+	// DefaultArchiveRetries is the default ArchiveStore.Retries.
+	DefaultArchiveRetries = 3
+)
+
+// errArchiveFull is returned by ArchiveStore.WriteSearch when MaxPending
+// entries are already waiting to be flushed.
+var errArchiveFull = errors.New("archive buffer full")
+
+// ArchiveStore is a Store for long-term archives in cheap object storage,
+// usually a MultiStore secondary next to PostgreSQL. Searches are buffered
+// in memory and flushed by Run as gzipped NDJSON objects, one per Window of
+// last_searched_at, named
+//
+//	<Prefix>2024/06/01/15/part-<flush time>-<n>.ndjson.gz
+//
+// so each flush adds new parts rather than rewriting old ones. Failed
+// uploads are retried with backoff, then kept for the next flush. Buffered
+// searches are lost if the process exits without a final Flush.
+type ArchiveStore struct {
+	Objects ObjectStore
+	// Prefix is prepended to every object key, e.g. "searches/".
+	Prefix string
+	// Window is the time span of searches per object. Defaults to
+	// DefaultArchiveWindow.
+	Window time.Duration
+	// MaxPending caps the searches buffered between flushes; further writes
+	// fail until a flush succeeds. Defaults to DefaultArchiveMaxPending.
+	MaxPending int
+	// Retries is how many times a failed upload is retried within a flush,
+	// waiting RetryBackoff (default one second) and doubling it each time,
+	// with ±20% jitter. Defaults to DefaultArchiveRetries.
+	Retries      int
+	RetryBackoff time.Duration
+	// Rand is the source of the jitter. Defaults to a clock-seeded source.
+	Rand rand.Source
+	rand lazyRand
+
+	mu      sync.Mutex
+	pending []SearchEntry
+	flushes int
+	flushMu sync.Mutex
+}
+
+func (a *ArchiveStore) window() time.Duration {
+	if a.Window > 0 {
+		return a.Window
+	}
+	return DefaultArchiveWindow
+}
+
+func (a *ArchiveStore) maxPending() int {
+	if a.MaxPending > 0 {
+		return a.MaxPending
+	}
+	return DefaultArchiveMaxPending
+}
+
+func (a *ArchiveStore) retries() int {
+	if a.Retries > 0 {
+		return a.Retries
+	}
+	return DefaultArchiveRetries
+}
+
+func (a *ArchiveStore) retryBackoff() time.Duration {
+	if a.RetryBackoff > 0 {
+		return a.RetryBackoff
+	}
+	return time.Second
+}
+
+// WriteSearch buffers entry for the next flush. Entries without a Timestamp
+// are stamped with the current time.
+func (a *ArchiveStore) WriteSearch(ctx context.Context, entry SearchEntry) error {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) >= a.maxPending() {
+		return dbError(errArchiveFull)
+	}
+	a.pending = append(a.pending, entry)
+	return nil
+}
+
+// Run flushes the buffer every interval (DefaultArchiveFlushInterval if not
+// positive) until ctx is done. Call Flush after it returns to archive the
+// remainder.
+func (a *ArchiveStore) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultArchiveFlushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.Flush(ctx); err != nil {
+				logging.Warnf("ArchiveStore: flush failed: %v", err)
+			}
+		}
+	}
+}
+
+// Flush uploads the buffered searches, one object per window. Searches of
+// windows whose upload still fails after the retries are put back in the
+// buffer and the first error is returned.
+func (a *ArchiveStore) Flush(ctx context.Context) error {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.mu.Lock()
+	entries := a.pending
+	a.pending = nil
+	a.flushes++
+	flushID := fmt.Sprintf("%d-%d", time.Now().UnixNano(), a.flushes)
+	a.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	groups := make(map[time.Time][]SearchEntry)
+	for _, entry := range entries {
+		start := entry.Timestamp.UTC().Truncate(a.window())
+		groups[start] = append(groups[start], entry)
+	}
+	starts := make([]time.Time, 0, len(groups))
+	for start := range groups {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	var firstErr error
+	var failed []SearchEntry
+	for _, start := range starts {
+		key := a.Prefix + start.Format("2006/01/02/15") + "/part-" + flushID
+		if a.window() < time.Hour {
+			key = a.Prefix + start.Format("2006/01/02/15/04") + "/part-" + flushID
+		}
+		key += ".ndjson.gz"
+		if err := a.upload(ctx, key, groups[start]); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed = append(failed, groups[start]...)
+			continue
+		}
+		metrics.ArchiveObjectsWritten.Add(1)
+		logging.Debugf("ArchiveStore: wrote %d searches to %s", len(groups[start]), key)
+	}
+	if len(failed) > 0 {
+		a.requeue(failed)
+	}
+	return firstErr
+}
+
+// requeue puts entries whose upload failed back in front of the buffer,
+// dropping the oldest beyond MaxPending.
+func (a *ArchiveStore) requeue(entries []SearchEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(entries, a.pending...)
+	if over := len(a.pending) - a.maxPending(); over > 0 {
+		metrics.ArchiveEntriesDropped.Add(int64(over))
+		logging.Warnf("ArchiveStore: dropping %d searches that could not be archived", over)
+		a.pending = a.pending[over:]
+	}
+}
+
+// upload encodes entries as gzipped NDJSON and puts them under key,
+// retrying with exponential backoff.
+func (a *ArchiveStore) upload(ctx context.Context, key string, entries []SearchEntry) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	backoff := a.retryBackoff()
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = a.Objects.PutObject(ctx, key, buf.Bytes()); err == nil {
+			return nil
+		}
+		if attempt == a.retries() {
+			return fmt.Errorf("archiving %s: %w", key, err)
+		}
+		wait := jitterBy(backoff, backoffJitter, func() float64 { return a.rand.float64(a.Rand) })
+		logging.Warnf("ArchiveStore: upload of %s failed, retrying in %v: %v", key, wait, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("archiving %s: %w", key, err)
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,176 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// WriteBatch writes already-committed searches directly to the DB in a single
+// transaction, bypassing Redis and reset detection. Each entry's Timestamp is
+// used for last_searched_at (the current time if zero). Queries are
+// normalized and entries left with an empty query are skipped. With Shards,
+// each shard's entries are written in their own transaction.
+func (l *Logger) WriteBatch(ctx context.Context, entries []SearchEntry) error {
+	defer l.invalidateBatchHistory(ctx, entries)
+	return l.forEachShard(entries, func(db *sql.DB, group []SearchEntry) error {
+		return l.writeBatchTo(ctx, db, group)
+	})
+}
+
+// forEachShard calls fn with each shard's entries, stopping at the first error.
+func (l *Logger) forEachShard(entries []SearchEntry, fn func(db *sql.DB, group []SearchEntry) error) error {
+	if len(l.Shards) <= 1 {
+		return fn(l.shards()[0], entries)
+	}
+	for k, group := range l.groupByShard(entries) {
+		if err := fn(l.Shards[k], group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Logger) writeBatchTo(ctx context.Context, db *sql.DB, entries []SearchEntry) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("WriteBatch: error starting transaction: %v", err)
+		return dbError(err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			log.Printf("WriteBatch: panic recovered: %v", p)
+			panic(p)
+		}
+	}()
+
+	for _, entry := range entries {
+		entry.Query = l.normalize(entry.Query)
+		entry = l.generalize(entry)
+		if entry.Query == "" {
+			continue
+		}
+		if entry.Timestamp.IsZero() {
+			entry.Timestamp = time.Now()
+		}
+		insertQuery, args := buildInsert(entry)
+		if _, err := tx.ExecContext(ctx, insertQuery+conflictClause(l.OnConflict, l.ConflictTarget), args...); err != nil {
+			tx.Rollback()
+			log.Printf("WriteBatch: error inserting query for userID=%s: %v", entry.UserID, err)
+			return dbError(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("WriteBatch: error committing transaction: %v", err)
+		return dbError(err)
+	}
+	return nil
+}
+
+// CopyBatch writes already-committed searches like WriteBatch, but loads them
+// with a single COPY FROM instead of one INSERT per entry. It is much faster
+// for large backfills; the whole batch fails if any row is rejected. With
+// Shards, each shard's entries are copied in their own transaction.
+func (l *Logger) CopyBatch(ctx context.Context, entries []SearchEntry) error {
+	defer l.invalidateBatchHistory(ctx, entries)
+	return l.forEachShard(entries, func(db *sql.DB, group []SearchEntry) error {
+		return l.copyBatchTo(ctx, db, group)
+	})
+}
+
+func (l *Logger) copyBatchTo(ctx context.Context, db *sql.DB, entries []SearchEntry) error {
+	now := time.Now()
+	var prepared []SearchEntry
+	for _, entry := range entries {
+		entry.Query = l.normalize(entry.Query)
+		entry = l.generalize(entry)
+		if entry.Query == "" {
+			continue
+		}
+		if entry.Timestamp.IsZero() {
+			entry.Timestamp = now
+		}
+		prepared = append(prepared, entry)
+	}
+	if len(prepared) == 0 {
+		return nil
+	}
+	cols, rows := copyRows(prepared)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("CopyBatch: error starting transaction: %v", err)
+		return dbError(err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("user_searches", cols...))
+	if err != nil {
+		tx.Rollback()
+		log.Printf("CopyBatch: error preparing COPY: %v", err)
+		return dbError(err)
+	}
+
+	for i, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			log.Printf("CopyBatch: error copying query for userID=%s: %v", prepared[i].UserID, err)
+			return dbError(err)
+		}
+	}
+
+	// An Exec with no arguments flushes the buffered rows.
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		log.Printf("CopyBatch: error flushing COPY: %v", err)
+		return dbError(err)
+	}
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		log.Printf("CopyBatch: error closing COPY: %v", err)
+		return dbError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("CopyBatch: error committing transaction: %v", err)
+		return dbError(err)
+	}
+	return nil
+}
+
+// copyRows returns the COPY columns and rows for entries. The columns are
+// those buildInsert would write for any of the entries, so COPY stores the
+// same fields as WriteBatch and, like it, names an optional column only if
+// some entry sets it. A row's unset columns are NULL.
+func copyRows(entries []SearchEntry) ([]string, [][]interface{}) {
+	var cols []string
+	index := map[string]int{}
+	values := make([]map[string]interface{}, len(entries))
+	for i, entry := range entries {
+		entryCols, args := insertColumns(entry, "search_text", entry.Query)
+		entryCols = append(entryCols, "last_searched_at")
+		args = append(args, entry.Timestamp)
+		values[i] = make(map[string]interface{}, len(entryCols))
+		for j, col := range entryCols {
+			if _, ok := index[col]; !ok {
+				index[col] = len(cols)
+				cols = append(cols, col)
+			}
+			values[i][col] = args[j]
+		}
+	}
+	rows := make([][]interface{}, len(entries))
+	for i := range entries {
+		row := make([]interface{}, len(cols))
+		for col, v := range values[i] {
+			row[index[col]] = v
+		}
+		rows[i] = row
+	}
+	return cols, rows
+}
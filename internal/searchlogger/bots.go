@@ -0,0 +1,52 @@
+package searchlogger
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultBotPatterns match the User-Agents of common crawlers and automated
+// browsers. Matching is case-insensitive.
+var DefaultBotPatterns = []string{
+	`bot\b`,
+	`crawl`,
+	`spider`,
+	`slurp`,
+	`facebookexternalhit`,
+	`headlesschrome`,
+	`lighthouse`,
+}
+
+// BotFilter recognizes crawler traffic by User-Agent. Since anon ids are
+// derived from the User-Agent, unfiltered bots collapse into a handful of
+// anon ids with very large search counts.
+type BotFilter struct {
+	patterns []*regexp.Regexp
+}
+
+// NewBotFilter compiles the given patterns (case-insensitive). Pass
+// DefaultBotPatterns, optionally extended, for the built-in list.
+func NewBotFilter(patterns ...string) (*BotFilter, error) {
+	f := &BotFilter{}
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bot pattern %q: %w", p, err)
+		}
+		f.patterns = append(f.patterns, re)
+	}
+	return f, nil
+}
+
+// IsBot reports whether userAgent matches any pattern. A nil filter matches nothing.
+func (f *BotFilter) IsBot(userAgent string) bool {
+	if f == nil {
+		return false
+	}
+	for _, re := range f.patterns {
+		if re.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
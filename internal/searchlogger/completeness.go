@@ -0,0 +1,112 @@
+package searchlogger
+
+import (
+	"context"
+	"strconv"
+	"unicode/utf8"
+
+	"go-search-logger/internal/metrics"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultCompletenessThreshold is the default CompletenessThreshold.
+const DefaultCompletenessThreshold = 1.0
+
+func (l *Logger) completenessThreshold() float64 {
+	if l.CompletenessThreshold > 0 {
+		return l.CompletenessThreshold
+	}
+	return DefaultCompletenessThreshold
+}
+
+// LengthCompleteness returns a CompletenessScorer that rates a query by its
+// length: 1 at n characters or more, proportionally less below.
+func LengthCompleteness(n int) func(string) float64 {
+	return func(query string) float64 {
+		if n <= 0 {
+			return 1
+		}
+		score := float64(utf8.RuneCountInString(query)) / float64(n)
+		if score > 1 {
+			score = 1
+		}
+		return score
+	}
+}
+
+// complete reports whether query should be committed early: CompletenessScorer
+// rates it complete or, with PopularTermCommits, it is a popular term.
+func (l *Logger) complete(ctx context.Context, query string) (bool, error) {
+	if l.CompletenessScorer != nil && l.CompletenessScorer(query) >= l.completenessThreshold() {
+		return true, nil
+	}
+	if l.PopularTermCommits <= 0 {
+		return false, nil
+	}
+	popular, err := l.popularTerm(ctx, query)
+	if popular {
+		metrics.PopularTermCommits.Add(1)
+	}
+	return popular, err
+}
+
+// popularTerm reports whether query was committed at least
+// PopularTermCommits times today and yesterday, per the daily counters.
+func (l *Logger) popularTerm(ctx context.Context, query string) (bool, error) {
+	now := l.now()
+	counts, err := l.Redis.MGet(ctx, buildCountKey(l.dayOf(now), query),
+		buildCountKey(l.dayOf(now.AddDate(0, 0, -1)), query)).Result()
+	if err != nil {
+		return false, redisError(err)
+	}
+	var n int64
+	for _, c := range counts {
+		if s, ok := c.(string); ok {
+			v, _ := strconv.ParseInt(s, 10, 64)
+			n += v
+		}
+	}
+	return n >= l.PopularTermCommits, nil
+}
+
+// commitIfComplete writes entry early if it is complete, per complete, and
+// the session has not committed early yet, recording the committed query
+// in entry.CommittedQuery. For a continuing session, the CommittedQuery of the
+// previous buffered entry is carried over, so a session commits early at most
+// once.
+func (l *Logger) commitIfComplete(ctx context.Context, entry *SearchEntry, bufferKey string, newSession bool) error {
+	if !newSession {
+		if err := l.carryCommittedQuery(ctx, entry, bufferKey); err != nil {
+			return err
+		}
+	}
+	if entry.CommittedQuery != "" {
+		return nil
+	}
+	if ok, err := l.complete(ctx, entry.Query); err != nil || !ok {
+		return err
+	}
+	if err := l.writeSearch(ctx, *entry); err != nil {
+		return err
+	}
+	entry.CommittedQuery = entry.Query
+	return nil
+}
+
+// carryCommittedQuery copies the CommittedQuery of the buffered entry to
+// entry, the next one of the same session.
+func (l *Logger) carryCommittedQuery(ctx context.Context, entry *SearchEntry, bufferKey string) error {
+	prev, err := l.Redis.Get(ctx, bufferKey).Result()
+	if err != nil && err != redis.Nil {
+		return redisError(err)
+	}
+	entry.CommittedQuery = decodeBuffer(prev).CommittedQuery
+	return nil
+}
+
+// committedEarly reports whether entry was already written by
+// commitIfComplete, so flushing it again would duplicate the row.
+func committedEarly(entry SearchEntry) bool {
+	return entry.CommittedQuery != "" && entry.CommittedQuery == entry.Query
+}
@@ -0,0 +1,79 @@
+package searchlogger
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// ConflictMode selects what happens when an insert into user_searches
+// violates a unique constraint, such as one added to deduplicate searches.
+type ConflictMode int
+
+const (
+	// ConflictError fails the write with an error matching ErrDBWrite. Use
+	// IsUniqueViolation to tell conflicts from other failures. This is the
+	// default.
+	ConflictError ConflictMode = iota
+	// ConflictIgnore keeps the existing row and treats the write as done.
+	ConflictIgnore
+	// ConflictUpsert updates last_searched_at of the existing row. It needs
+	// ConflictTarget to name the constraint.
+	ConflictUpsert
+)
+
+// SQLSTATEs the logger handles specially.
+const (
+	uniqueViolation = "23505"
+	undefinedTable  = "42P01"
+)
+
+// ParseConflictMode parses "error", "ignore" or "upsert".
+func ParseConflictMode(s string) (ConflictMode, error) {
+	switch s {
+	case "", "error":
+		return ConflictError, nil
+	case "ignore":
+		return ConflictIgnore, nil
+	case "upsert":
+		return ConflictUpsert, nil
+	}
+	return ConflictError, fmt.Errorf("unknown conflict mode %q", s)
+}
+
+// IsUniqueViolation reports whether err is caused by a unique constraint
+// violation. It recognizes lib/pq errors and any driver error exposing the
+// SQLSTATE through a SQLState method, as pgx does.
+func IsUniqueViolation(err error) bool {
+	return sqlState(err) == uniqueViolation
+}
+
+// sqlState returns the SQLSTATE of a driver error, or "" if err has none.
+func sqlState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+	return ""
+}
+
+// conflictClause returns the ON CONFLICT clause appended to inserts for mode.
+// target is a PostgreSQL conflict target, e.g. "(user_id, search_text)" or
+// "ON CONSTRAINT user_searches_dedup".
+func conflictClause(mode ConflictMode, target string) string {
+	switch mode {
+	case ConflictIgnore:
+		if target == "" {
+			return " ON CONFLICT DO NOTHING"
+		}
+		return " ON CONFLICT " + target + " DO NOTHING"
+	case ConflictUpsert:
+		return " ON CONFLICT " + target + " DO UPDATE SET last_searched_at = EXCLUDED.last_searched_at"
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package searchlogger
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultDailyCountTTL is how long per-term daily counters are kept in Redis.
+// It leaves several days to snapshot a day into Postgres.
+const DefaultDailyCountTTL = 8 * 24 * time.Hour
+
+const dayLayout = "2006-01-02"
+
+// buildCountKey constructs the Redis key counting commits of term on day.
+func buildCountKey(day, term string) string {
+	return "search:count:" + day + ":" + term
+}
+
+// dayOf formats t as a day in the configured time zone.
+func (l *Logger) dayOf(t time.Time) string {
+	tz := l.TimeZone
+	if tz == nil {
+		tz = time.UTC
+	}
+	return t.In(tz).Format(dayLayout)
+}
+
+func (l *Logger) dailyCountTTL() time.Duration {
+	if l.DailyCountTTL > 0 {
+		return l.DailyCountTTL
+	}
+	return DefaultDailyCountTTL
+}
+
+// incrementDailyCount counts a committed query towards today's total.
+func (l *Logger) incrementDailyCount(ctx context.Context, term string) error {
+	key := buildCountKey(l.dayOf(l.now()), term)
+	pipe := l.Redis.TxPipeline()
+	pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, l.dailyCountTTL())
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// TermCountForDay returns how many times term was committed on the day
+// containing day (in the configured time zone). It returns 0 once the
+// counter has expired; use SnapshotDailyCounts for long-term retention.
+func (l *Logger) TermCountForDay(ctx context.Context, term string, day time.Time) (int64, error) {
+	n, err := l.Redis.Get(ctx, buildCountKey(l.dayOf(day), l.normalize(term))).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+const upsertDailyCountQuery = `INSERT INTO search_term_daily_counts (day, term, count)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (day, term) DO UPDATE SET count = EXCLUDED.count`
+
+// SnapshotDailyCounts copies all of a day's Redis counters into the
+// search_term_daily_counts table. Snapshotting the same day again overwrites
+// the stored counts, so it is safe to run repeatedly, e.g. shortly after
+// midnight for the previous day. It returns the number of terms written.
+func (l *Logger) SnapshotDailyCounts(ctx context.Context, day time.Time) (int, error) {
+	dayStr := l.dayOf(day)
+	prefix := buildCountKey(dayStr, "")
+
+	tx, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	written := 0
+	iter := l.Redis.Scan(ctx, 0, prefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		val, err := l.Redis.Get(ctx, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		count, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, upsertDailyCountQuery, dayStr, strings.TrimPrefix(key, prefix), count); err != nil {
+			return 0, err
+		}
+		written++
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
@@ -0,0 +1,92 @@
+package searchlogger
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// deadLetterKey is the Redis list of searches the store failed to write,
+// newest first.
+const deadLetterKey = "search:deadletter"
+
+// deadLetter is a search parked in the dead-letter list, with why and when
+// its write failed.
+type deadLetter struct {
+	Entry    SearchEntry `json:"entry"`
+	Error    string      `json:"error"`
+	FailedAt time.Time   `json:"failed_at"`
+}
+
+// parkDeadLetters pushes entries, which the store failed to write with err,
+// to the dead-letter list. It reports whether they were parked, in which case
+// the write counts as handled. Unique violations surfaced by ConflictError
+// are the caller's to see and are not parked.
+func (l *Logger) parkDeadLetters(ctx context.Context, entries []SearchEntry, err error) bool {
+	if !l.DeadLetter || IsUniqueViolation(err) {
+		return false
+	}
+	now := l.now()
+	vals := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		// Keep the commit time, so a replay days later sorts where it belongs.
+		if entry.Timestamp.IsZero() {
+			entry.Timestamp = now
+		}
+		b, jerr := json.Marshal(deadLetter{Entry: entry, Error: err.Error(), FailedAt: now})
+		if jerr != nil {
+			return false
+		}
+		vals = append(vals, b)
+	}
+	depth, perr := l.Redis.LPush(ctx, deadLetterKey, vals...).Result()
+	if perr != nil {
+		log.Printf("writeSearch: failed to park %d searches as dead letters: %v", len(entries), perr)
+		return false
+	}
+	metrics.DeadLettered.Add(int64(len(entries)))
+	metrics.DeadLetterDepth.Set(depth)
+	log.Printf("writeSearch: parked %d searches as dead letters after write error: %v", len(entries), err)
+	return true
+}
+
+// ReplayDeadLetters writes the searches parked by DeadLetter to the store,
+// oldest first, removing each once written. It stops at the first failure,
+// leaving that search and the newer ones parked, and returns how many were
+// replayed. Replayed searches get the usual commit side effects.
+func (l *Logger) ReplayDeadLetters(ctx context.Context) (int, error) {
+	replayed := 0
+	defer func() {
+		if depth, err := l.Redis.LLen(ctx, deadLetterKey).Result(); err == nil {
+			metrics.DeadLetterDepth.Set(depth)
+		}
+	}()
+	for {
+		raw, err := l.Redis.LIndex(ctx, deadLetterKey, -1).Result()
+		if err == redis.Nil {
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, redisError(err)
+		}
+		var dl deadLetter
+		if err := json.Unmarshal([]byte(raw), &dl); err != nil {
+			log.Printf("ReplayDeadLetters: dropping unreadable dead letter %q: %v", raw, err)
+		} else if err := l.commit(ctx, dl.Entry); err != nil {
+			return replayed, err
+		} else {
+			replayed++
+			logging.Debugf("ReplayDeadLetters: replayed query='%s' for userID=%s, parked at %s", dl.Entry.Query, entrySessionID(dl.Entry), dl.FailedAt)
+		}
+		// Remove this copy only, in case an identical search was parked again.
+		if err := l.Redis.LRem(ctx, deadLetterKey, -1, raw).Err(); err != nil {
+			return replayed, redisError(err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package searchlogger
+
+import (
+	"sync"
+	"time"
+)
+
+// debounceUpdateTimeout bounds a deferred session update.
+const debounceUpdateTimeout = 5 * time.Second
+
+// debouncer runs only the most recent function submitted for a key within
+// an interval. The zero value is ready to use.
+type debouncer struct {
+	mu      sync.Mutex
+	pending map[string]func()
+	timers  map[string]*time.Timer
+	// running counts timers that have been scheduled and not stopped, so
+	// flush can wait for those already firing.
+	running sync.WaitGroup
+}
+
+// do schedules fn to run once interval has passed since the first pending
+// call for key. Later calls for the same key within the window replace fn.
+func (d *debouncer) do(key string, interval time.Duration, fn func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pending == nil {
+		d.pending = make(map[string]func())
+		d.timers = make(map[string]*time.Timer)
+	}
+	_, scheduled := d.pending[key]
+	d.pending[key] = fn
+	if scheduled {
+		return
+	}
+	d.running.Add(1)
+	d.timers[key] = time.AfterFunc(interval, func() {
+		defer d.running.Done()
+		d.mu.Lock()
+		latest := d.pending[key]
+		delete(d.pending, key)
+		delete(d.timers, key)
+		d.mu.Unlock()
+		if latest != nil {
+			latest()
+		}
+	})
+}
+
+// stop stops the timer for key, if it has not fired yet. d.mu must be held.
+func (d *debouncer) stop(key string) {
+	if t, ok := d.timers[key]; ok && t.Stop() {
+		d.running.Done()
+	}
+	delete(d.timers, key)
+}
+
+// cancel drops the pending function for key, if any.
+func (d *debouncer) cancel(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, key)
+	d.stop(key)
+}
+
+// take removes and returns the pending function for key, if any, so the
+// caller can run it now instead of when the interval ends.
+func (d *debouncer) take(key string) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fn := d.pending[key]
+	delete(d.pending, key)
+	d.stop(key)
+	return fn
+}
+
+// flush runs every pending function now instead of when its interval ends,
+// then waits for functions whose timers had already fired.
+func (d *debouncer) flush() {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = nil
+	for key := range d.timers {
+		d.stop(key)
+	}
+	d.mu.Unlock()
+	for _, fn := range pending {
+		fn()
+	}
+	d.running.Wait()
+}
@@ -0,0 +1,101 @@
+package searchlogger
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"time"
+)
+
+// DefaultDedupWindow is how long committed terms are remembered per session
+// when DedupLookback is enabled.
+const DefaultDedupWindow = 10 * time.Minute
+
+// buildCommitsKey constructs the Redis key listing a session's recently committed terms.
+func buildCommitsKey(id string) string {
+	return "search:commits:" + id
+}
+
+// entrySessionID returns the id of the session an entry belongs to.
+func entrySessionID(entry SearchEntry) string {
+	if entry.UserID != "" {
+		return entry.UserID
+	}
+	return entry.AnonID
+}
+
+func (l *Logger) dedupWindow() time.Duration {
+	if l.DedupWindow > 0 {
+		return l.DedupWindow
+	}
+	return DefaultDedupWindow
+}
+
+// isRecentCommit reports whether the entry's query is among the session's
+// last DedupLookback committed terms. Redis errors are logged and treated as
+// not a duplicate so a search is never lost to the dedup check.
+func (l *Logger) isRecentCommit(ctx context.Context, entry SearchEntry) bool {
+	if l.DedupLookback <= 0 {
+		return false
+	}
+	recent, err := l.Redis.LRange(ctx, buildCommitsKey(entrySessionID(entry)), 0, int64(l.DedupLookback)-1).Result()
+	if err != nil {
+		log.Printf("isRecentCommit: could not read recent commits for userID=%s: %v", entrySessionID(entry), err)
+		return false
+	}
+	for _, q := range recent {
+		if q == entry.Query {
+			return true
+		}
+	}
+	return false
+}
+
+// rememberCommit records the entry's query as the session's latest commit.
+func (l *Logger) rememberCommit(ctx context.Context, entry SearchEntry) error {
+	key := buildCommitsKey(entrySessionID(entry))
+	pipe := l.Redis.TxPipeline()
+	pipe.LPush(ctx, key, entry.Query)
+	pipe.LTrim(ctx, key, 0, int64(l.DedupLookback)-1)
+	pipe.Expire(ctx, key, l.dedupWindow())
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// buildCommittedKey constructs the Redis key marking that a session committed
+// a query within CommitDedupWindow. The query is hashed to bound the key size.
+func buildCommittedKey(id, query string) string {
+	return fmt.Sprintf("search:committed:%s:%x", id, sha256.Sum256([]byte(query)))
+}
+
+// claimCommit marks the entry's query as committed for CommitDedupWindow. It
+// reports the key to release if the write fails, and whether the query was
+// already committed within the window. Redis errors are logged and treated as
+// not a duplicate so a search is never lost to the dedup check.
+func (l *Logger) claimCommit(ctx context.Context, entry SearchEntry) (key string, dup bool) {
+	if l.CommitDedupWindow <= 0 {
+		return "", false
+	}
+	key = buildCommittedKey(entrySessionID(entry), entry.Query)
+	ok, err := l.Redis.SetNX(ctx, key, 1, l.CommitDedupWindow).Result()
+	if err != nil {
+		log.Printf("claimCommit: could not mark commit for userID=%s: %v", entrySessionID(entry), err)
+		return "", false
+	}
+	if !ok {
+		return "", true
+	}
+	return key, false
+}
+
+// releaseCommit removes a claim made by claimCommit for a write that failed,
+// so a retry is not suppressed.
+func (l *Logger) releaseCommit(ctx context.Context, key string) {
+	if key == "" {
+		return
+	}
+	if err := l.Redis.Del(ctx, key).Err(); err != nil {
+		log.Printf("releaseCommit: could not release commit mark: %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+package searchlogger
+
+import "fmt"
+
+// dialect holds the SQL differences between the databases searches can be
+// written to.
+type dialect struct {
+	placeholder func(n int) string // the nth bind parameter, counting from 1
+	now         string             // the current timestamp
+}
+
+var (
+	postgresDialect = dialect{
+		placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+		now:         "NOW()",
+	}
+	sqliteDialect = dialect{
+		placeholder: func(int) string { return "?" },
+		now:         "CURRENT_TIMESTAMP",
+	}
+)
@@ -0,0 +1,32 @@
+package searchlogger
+
+import (
+	"context"
+	"log"
+
+	"go-search-logger/internal/metrics"
+)
+
+// transient reports whether the session's live query was set less than
+// MinDwell ago, so a reset should discard it rather than commit it. The live
+// query's TTL is refreshed each time it changes, so the time it was set is
+// read back from the TTL remaining. Redis errors are logged and treated as
+// not transient so a search is never lost to the dwell check.
+func (l *Logger) transient(ctx context.Context, id string) bool {
+	if l.MinDwell <= 0 {
+		return false
+	}
+	ttl, err := l.liveTTL(ctx, id)
+	if err != nil {
+		log.Printf("transient: could not read TTL for userID=%s: %v", id, err)
+		return false
+	}
+	if ttl <= 0 {
+		return false
+	}
+	if l.sessionTTL()-ttl >= l.MinDwell {
+		return false
+	}
+	metrics.TransientDropped.Add(1)
+	return true
+}
@@ -0,0 +1,51 @@
+package searchlogger
+
+import (
+	"context"
+	"sync"
+)
+
+// SearchEmitter receives every committed search, e.g. to forward it to an
+// observability pipeline. EmitSearch runs synchronously after the commit, so
+// it should hand the entry off rather than block; it reports its own errors.
+type SearchEmitter interface {
+	EmitSearch(ctx context.Context, entry SearchEntry)
+}
+
+// commitFanout holds the callbacks registered with OnCommit.
+type commitFanout struct {
+	mu   sync.Mutex
+	next int
+	subs map[int]func(SearchEntry)
+}
+
+// OnCommit registers fn to be called with every committed search and returns
+// a function that unregisters it. Like an Emitter, fn runs synchronously after
+// the commit, so it must not block; a subscriber that cannot keep up should
+// drop entries. Safe for concurrent use.
+func (l *Logger) OnCommit(fn func(SearchEntry)) (cancel func()) {
+	f := &l.commitSubs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs == nil {
+		f.subs = make(map[int]func(SearchEntry))
+	}
+	id := f.next
+	f.next++
+	f.subs[id] = fn
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.subs, id)
+	}
+}
+
+// publishCommit calls the OnCommit subscribers with entry.
+func (l *Logger) publishCommit(entry SearchEntry) {
+	f := &l.commitSubs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, fn := range f.subs {
+		fn(entry)
+	}
+}
@@ -0,0 +1,35 @@
+package searchlogger
+
+import (
+	"context"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
+)
+
+// enrich runs the Enricher on an entry about to be stored. The entry's
+// session and query are restored afterwards, as dedup and the per-user cap
+// have already been applied to them. If the Enricher fails, the search is
+// stored without its additions rather than lost.
+func (l *Logger) enrich(ctx context.Context, entry SearchEntry) SearchEntry {
+	if l.Enricher == nil {
+		return entry
+	}
+	// The Extra map may be shared with the buffered entry, so the Enricher
+	// gets a copy, allocated even if empty so it can always add to it.
+	enriched := entry
+	enriched.Extra = make(map[string]string, len(entry.Extra))
+	for k, v := range entry.Extra {
+		enriched.Extra[k] = v
+	}
+	if err := l.Enricher(ctx, &enriched); err != nil {
+		metrics.EnrichErrors.Add(1)
+		logging.Warnf("writeSearch: enricher failed for userID=%s, storing query='%s' unenriched: %v", entrySessionID(entry), entry.Query, err)
+		return entry
+	}
+	enriched.UserID, enriched.AnonID, enriched.Query = entry.UserID, entry.AnonID, entry.Query
+	if len(enriched.Extra) == 0 && entry.Extra == nil {
+		enriched.Extra = nil
+	}
+	return enriched
+}
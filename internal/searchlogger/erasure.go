@@ -0,0 +1,93 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// erasedTables are the tables DeleteAnon deletes an anon id's rows from.
+var erasedTables = []string{"user_searches", "search_results"}
+
+// DeleteAnon erases an anonymous user, e.g. for a "forget me" request from a
+// visitor who cannot be linked to a user id: the live session is dropped
+// without being committed, the id's other Redis keys are deleted, its
+// searches are removed from the event streams (see EventStream), and its
+// rows are deleted from every shard. Rows already linked to a user id are
+// kept, as they belong to that user. It returns the number of rows deleted.
+// Searches parked by DeadLetter or buffered by an ArchiveStore are not
+// touched.
+func (l *Logger) DeleteAnon(ctx context.Context, anonID string) (int64, error) {
+	if anonID == "" {
+		return 0, fmt.Errorf("%w: empty anon id", ErrInvalidUserID)
+	}
+	if err := validateUserID(anonID); err != nil {
+		return 0, err
+	}
+
+	// Redis goes first, so an expiring session cannot commit new rows after
+	// the database is cleared.
+	key := sessionKeyID("", anonID)
+	l.debouncer.cancel(key)
+	l.forgetLastQuery(key)
+	keys := []string{buildRedisKey(key), buildBufferKey(key), buildPendingKey(key),
+		buildTrajectoryKey(key), buildCommitsKey(anonID), buildSeqKey(anonID), buildHistoryKey(anonID), buildVisitKey(anonID)}
+	// CommitDedupWindow keys end in a query hash; see buildCommittedKey.
+	iter := l.Redis.Scan(ctx, 0, escapeGlob("search:committed:"+anonID+":")+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return 0, redisError(err)
+	}
+	if err := l.Redis.Del(ctx, keys...).Err(); err != nil {
+		return 0, redisError(err)
+	}
+	if err := l.deleteAnonEvents(ctx, anonID); err != nil {
+		return 0, redisError(err)
+	}
+
+	if !l.HasDB() {
+		return 0, nil
+	}
+	var total int64
+	for _, db := range l.shards() {
+		n, err := deleteAnonRows(ctx, db, anonID)
+		if err != nil {
+			return total, dbError(err)
+		}
+		total += n
+	}
+	log.Printf("DeleteAnon: deleted %d rows for anonID=%s", total, anonID)
+	return total, nil
+}
+
+// deleteAnonRows deletes the anon id's unlinked rows from db in one
+// transaction.
+func deleteAnonRows(ctx context.Context, db *sql.DB, anonID string) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var total int64
+	for _, table := range erasedTables {
+		res, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE anon_id = $1 AND COALESCE(user_id, '') = ''", anonID)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, tx.Commit()
+}
+
+// escapeGlob escapes the characters Redis SCAN MATCH treats as patterns.
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
@@ -0,0 +1,114 @@
+package searchlogger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Errors returned by the logger. Use errors.Is to test for them; the
+// underlying Redis or driver error remains available via errors.Unwrap.
+var (
+	ErrRedisUnavailable = errors.New("searchlogger: redis unavailable")
+	ErrDBWrite          = errors.New("searchlogger: db write failed")
+	ErrInvalidQuery     = errors.New("searchlogger: invalid query")
+	ErrInvalidUserID    = errors.New("searchlogger: invalid user id")
+	ErrInvalidRequest   = errors.New("searchlogger: invalid request")
+
+	// ErrSchemaMissing is returned when a table the logger writes to does
+	// not exist, usually because the schema was never applied. It also
+	// matches ErrDBWrite.
+	ErrSchemaMissing = errors.New("searchlogger: db schema missing")
+)
+
+const (
+	// MaxQueryLength is the maximum length of a normalized query, in characters.
+	MaxQueryLength = 1024
+	// MaxUserIDLength is the maximum length of a user id, in bytes.
+	MaxUserIDLength = 256
+	// MaxLatencyMS is the largest client-reported latency accepted (10 minutes).
+	MaxLatencyMS = 10 * 60 * 1000
+	// MaxUTMLength is the maximum length of a utm_source or utm_campaign, in bytes.
+	MaxUTMLength = 256
+)
+
+// opError attaches one of the package's sentinel errors to an underlying error.
+type opError struct {
+	kind error
+	err  error
+}
+
+func (e *opError) Error() string { return e.kind.Error() + ": " + e.err.Error() }
+func (e *opError) Unwrap() error { return e.err }
+
+// Is matches the error's kind. ErrSchemaMissing is a kind of ErrDBWrite.
+func (e *opError) Is(target error) bool {
+	return target == e.kind || (e.kind == ErrSchemaMissing && target == ErrDBWrite)
+}
+
+func redisError(err error) error { return &opError{kind: ErrRedisUnavailable, err: err} }
+
+// schemaWarning ensures the setup instructions for a missing schema are
+// logged once rather than with every failed write.
+var schemaWarning sync.Once
+
+func dbError(err error) error {
+	if sqlState(err) == undefinedTable {
+		schemaWarning.Do(func() {
+			log.Printf("searchlogger: a table is missing (%v). Apply the schema with `go run cmd/main.go --migrate`, or set AUTO_MIGRATE=true", err)
+		})
+		return &opError{kind: ErrSchemaMissing, err: err}
+	}
+	return &opError{kind: ErrDBWrite, err: err}
+}
+
+// validateQuery checks a normalized query.
+func validateQuery(query string) error {
+	if n := utf8.RuneCountInString(query); n > MaxQueryLength {
+		return fmt.Errorf("%w: %d characters exceeds maximum of %d", ErrInvalidQuery, n, MaxQueryLength)
+	}
+	if !utf8.ValidString(query) {
+		return fmt.Errorf("%w: not valid UTF-8", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// validateUserID checks a user id. Empty ids are valid and mean anonymous.
+func validateUserID(userID string) error {
+	if len(userID) > MaxUserIDLength {
+		return fmt.Errorf("%w: %d bytes exceeds maximum of %d", ErrInvalidUserID, len(userID), MaxUserIDLength)
+	}
+	if strings.IndexFunc(userID, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: contains control characters", ErrInvalidUserID)
+	}
+	return nil
+}
+
+// validateOutcome checks an optional client-reported outcome.
+func validateOutcome(outcome string) error {
+	switch outcome {
+	case "", OutcomeSuccess, OutcomeNoResults, OutcomeError:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown outcome %q", ErrInvalidRequest, outcome)
+}
+
+// validateLatency checks an optional client-reported latency.
+func validateLatency(latencyMS *int64) error {
+	if latencyMS != nil && (*latencyMS < 0 || *latencyMS > MaxLatencyMS) {
+		return fmt.Errorf("%w: latency_ms must be between 0 and %d", ErrInvalidRequest, MaxLatencyMS)
+	}
+	return nil
+}
+
+// validateUTM checks the optional campaign attribution fields.
+func validateUTM(source, campaign string) error {
+	if len(source) > MaxUTMLength || len(campaign) > MaxUTMLength {
+		return fmt.Errorf("%w: utm_source and utm_campaign must be at most %d bytes", ErrInvalidRequest, MaxUTMLength)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package searchlogger
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultEventStreamMaxLen is roughly how many searches a day's event stream
+// keeps; older ones are trimmed as new ones are added.
+const DefaultEventStreamMaxLen = 1000000
+
+// DefaultEventStreamTTL is how long a day's event stream is kept after its
+// last search.
+const DefaultEventStreamTTL = 8 * 24 * time.Hour
+
+// eventStreamPage is how many entries deleteAnonEvents reads at a time.
+const eventStreamPage = 1000
+
+// eventStreamBlock is how long ConsumeEventStream waits for new searches
+// before checking for cancellation and the next day's stream.
+const eventStreamBlock = time.Second
+
+// buildEventStreamKey constructs the key of the Redis stream of searches
+// committed on day, a UTC date.
+func buildEventStreamKey(day string) string {
+	return "search:stream:" + day
+}
+
+// StreamEvent is a committed search read from an event stream.
+type StreamEvent struct {
+	ID    string // stream entry id, increasing within a day's stream
+	Day   string // UTC date of the stream, e.g. "2024-05-01"
+	Entry SearchEntry
+}
+
+func (l *Logger) eventStreamMaxLen() int64 {
+	if l.EventStreamMaxLen > 0 {
+		return l.EventStreamMaxLen
+	}
+	return DefaultEventStreamMaxLen
+}
+
+func (l *Logger) eventStreamTTL() time.Duration {
+	if l.EventStreamTTL > 0 {
+		return l.EventStreamTTL
+	}
+	return DefaultEventStreamTTL
+}
+
+// appendEventStream adds a committed search to the stream of the current
+// UTC day, trimming it to about EventStreamMaxLen entries.
+func (l *Logger) appendEventStream(ctx context.Context, entry SearchEntry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key := buildEventStreamKey(l.now().UTC().Format(dayLayout))
+	pipe := l.Redis.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: key,
+		MaxLen: l.eventStreamMaxLen(),
+		Approx: true,
+		Values: map[string]interface{}{"key": entrySessionID(entry), "entry": payload},
+	})
+	pipe.Expire(ctx, key, l.eventStreamTTL())
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// ReadEventStream returns up to count searches committed on day (in UTC)
+// after the stream id after, in commit order. Pass "" to read from the
+// start of the day, and the ID of the last event returned to continue.
+func (l *Logger) ReadEventStream(ctx context.Context, day time.Time, after string, count int64) ([]StreamEvent, error) {
+	d := day.UTC().Format(dayLayout)
+	start := "-"
+	if after != "" {
+		start = "(" + after
+	}
+	msgs, err := l.Redis.XRangeN(ctx, buildEventStreamKey(d), start, "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeStreamEvents(d, msgs)
+}
+
+// ConsumeEventStream calls fn with every search committed from the start of
+// since's UTC day, or of the oldest day still kept (EventStreamTTL), in
+// commit order, then waits for new ones, moving on to
+// each following day's stream once that day has begun. It returns when ctx
+// is cancelled, with ctx.Err(), or when fn or a Redis read fails. It keeps
+// no position across calls; a consumer that must resume where it stopped
+// should record the last event it handled and catch up with ReadEventStream.
+func (l *Logger) ConsumeEventStream(ctx context.Context, since time.Time, fn func(StreamEvent) error) error {
+	if oldest := l.now().Add(-l.eventStreamTTL()); since.Before(oldest) {
+		since = oldest
+	}
+	day := since.UTC().Format(dayLayout)
+	last := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		today := l.now().UTC().Format(dayLayout)
+		block := eventStreamBlock
+		if day < today {
+			// Past streams are complete, so there is nothing to wait for.
+			block = -1
+		}
+		streams, err := l.Redis.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{buildEventStreamKey(day), last},
+			Count:   100,
+			Block:   block,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		var msgs []redis.XMessage
+		if len(streams) > 0 {
+			msgs = streams[0].Messages
+		}
+		if len(msgs) == 0 {
+			if day < today {
+				next, _ := time.Parse(dayLayout, day)
+				day, last = next.AddDate(0, 0, 1).Format(dayLayout), "0"
+			}
+			continue
+		}
+		events, err := decodeStreamEvents(day, msgs)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		last = msgs[len(msgs)-1].ID
+	}
+}
+
+// deleteAnonEvents removes an anon id's anonymous searches from every day's
+// event stream, for DeleteAnon.
+func (l *Logger) deleteAnonEvents(ctx context.Context, anonID string) error {
+	iter := l.Redis.Scan(ctx, 0, buildEventStreamKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		start := "-"
+		for {
+			msgs, err := l.Redis.XRangeN(ctx, key, start, "+", eventStreamPage).Result()
+			if err != nil {
+				return err
+			}
+			var ids []string
+			for _, msg := range msgs {
+				if msg.Values["key"] == anonID {
+					ids = append(ids, msg.ID)
+				}
+			}
+			if len(ids) > 0 {
+				if err := l.Redis.XDel(ctx, key, ids...).Err(); err != nil {
+					return err
+				}
+			}
+			if len(msgs) < eventStreamPage {
+				break
+			}
+			start = "(" + msgs[len(msgs)-1].ID
+		}
+	}
+	return iter.Err()
+}
+
+func decodeStreamEvents(day string, msgs []redis.XMessage) ([]StreamEvent, error) {
+	events := make([]StreamEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		payload, _ := msg.Values["entry"].(string)
+		var entry SearchEntry
+		if err := json.Unmarshal([]byte(payload), &entry); err != nil {
+			return nil, err
+		}
+		events = append(events, StreamEvent{ID: msg.ID, Day: day, Entry: entry})
+	}
+	return events, nil
+}
@@ -0,0 +1,123 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RefinementGap is the longest pause between two committed searches of a
+// user that QueryRefinements still treats as one refinement chain.
+const RefinementGap = 10 * time.Minute
+
+// Refinement is a sequence of queries users refined one into the next, with
+// the number of times it was seen.
+type Refinement struct {
+	Steps []string `json:"steps"`
+	Count int64    `json:"count"`
+}
+
+const refinementSearchesQuery = `SELECT COALESCE(NULLIF(s.user_id, ''), s.anon_id, ''), COALESCE(s.search_text, t.term), s.last_searched_at
+			FROM user_searches s LEFT JOIN search_terms t ON t.id = s.term_id
+			WHERE s.last_searched_at >= $1
+			ORDER BY 1, s.last_searched_at`
+
+// QueryRefinements reconstructs how users refined their queries since the
+// given time. Each user's or anon id's committed searches are walked oldest
+// first, and consecutive ones form a chain while each is a refinement of the
+// one before (see refines) and follows it within RefinementGap. Chains of at
+// least two distinct queries are counted across users and returned most
+// frequent first. With Shards, each shard's chains are computed separately
+// and summed, which is exact since a user's rows live on one shard.
+func (l *Logger) QueryRefinements(ctx context.Context, since time.Time) ([]Refinement, error) {
+	counts := make(map[string]*Refinement)
+	for _, db := range l.shards() {
+		entries, err := refinementSearches(ctx, db, since)
+		if err != nil {
+			return nil, err
+		}
+		for _, chain := range refinementChains(entries) {
+			key := strings.Join(chain, "\x00")
+			if r, ok := counts[key]; ok {
+				r.Count++
+				continue
+			}
+			counts[key] = &Refinement{Steps: chain, Count: 1}
+		}
+	}
+
+	refinements := []Refinement{}
+	for _, r := range counts {
+		refinements = append(refinements, *r)
+	}
+	sort.Slice(refinements, func(i, j int) bool {
+		if refinements[i].Count != refinements[j].Count {
+			return refinements[i].Count > refinements[j].Count
+		}
+		return strings.Join(refinements[i].Steps, "\x00") < strings.Join(refinements[j].Steps, "\x00")
+	})
+	return refinements, nil
+}
+
+func refinementSearches(ctx context.Context, db *sql.DB, since time.Time) ([]SearchEntry, error) {
+	rows, err := db.QueryContext(ctx, refinementSearchesQuery, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []SearchEntry
+	for rows.Next() {
+		var entry SearchEntry
+		if err := rows.Scan(&entry.UserID, &entry.Query, &entry.Timestamp); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// refinementChains splits searches, ordered by UserID then Timestamp, into
+// refinement chains. A search continues the current chain if it has the same
+// UserID, follows the previous search within RefinementGap and refines its
+// query; a repeat of the previous query is skipped. Chains of a single query
+// are dropped.
+func refinementChains(entries []SearchEntry) [][]string {
+	var chains [][]string
+	var chain []string
+	flush := func() {
+		if len(chain) > 1 {
+			chains = append(chains, chain)
+		}
+		chain = nil
+	}
+	for i, entry := range entries {
+		if i > 0 {
+			prev := entries[i-1]
+			switch {
+			case entry.UserID != prev.UserID || entry.Timestamp.Sub(prev.Timestamp) > RefinementGap:
+				flush()
+			case entry.Query == chain[len(chain)-1]:
+				continue
+			case !refines(chain[len(chain)-1], entry.Query):
+				flush()
+			}
+		}
+		chain = append(chain, entry.Query)
+	}
+	flush()
+	return chains
+}
+
+// refines reports whether next is a refinement of prev: one is a prefix of
+// the other ("sho" -> "shoes", "red shoes" -> "red"), or they start with the
+// same word ("red shoes" -> "red boots").
+func refines(prev, next string) bool {
+	if strings.HasPrefix(next, prev) || strings.HasPrefix(prev, next) {
+		return true
+	}
+	p, n := strings.Fields(prev), strings.Fields(next)
+	return len(p) > 0 && len(n) > 0 && p[0] == n[0]
+}
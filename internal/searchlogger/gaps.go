@@ -0,0 +1,37 @@
+package searchlogger
+
+import (
+	"context"
+)
+
+// gapsKey is the sorted set counting committed searches that found nothing,
+// scored by count.
+const gapsKey = "search:gaps"
+
+// MaxGaps is the number of zero-result queries kept in the leaderboard; the
+// least frequent are trimmed beyond it.
+const MaxGaps = 10000
+
+// incrementGap counts a committed zero-result search.
+func (l *Logger) incrementGap(ctx context.Context, term string) error {
+	pipe := l.Redis.TxPipeline()
+	pipe.ZIncrBy(ctx, gapsKey, 1, term)
+	pipe.ZRemRangeByRank(ctx, gapsKey, 0, -MaxGaps-1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// TopGaps returns the n most frequent committed searches reported with
+// outcome no_results, most frequent first. It is empty unless TrackGaps is
+// enabled.
+func (l *Logger) TopGaps(ctx context.Context, n int) ([]TermCount, error) {
+	zs, err := l.Redis.ZRevRangeWithScores(ctx, gapsKey, 0, int64(n)-1).Result()
+	if err != nil {
+		return nil, redisError(err)
+	}
+	gaps := make([]TermCount, len(zs))
+	for i, z := range zs {
+		gaps[i] = TermCount{Term: z.Member.(string), Count: int64(z.Score)}
+	}
+	return gaps, nil
+}
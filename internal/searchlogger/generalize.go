@@ -0,0 +1,36 @@
+package searchlogger
+
+import "strings"
+
+// FirstWord is a QueryGeneralizer that keeps only the first word of a
+// query, e.g. "red running shoes" is stored as "red".
+func FirstWord(query string) string {
+	if fields := strings.Fields(query); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+// generalize returns entry as stored with QueryGeneralizer: the query is
+// generalized, and the raw query and keystrokes, which would reveal the full
+// text, are dropped. Whether the query was already committed early is
+// decided on the full text, so "lamps" committed early and extended to
+// "lamps for kids" still gives two rows, even if both generalize alike.
+func (l *Logger) generalize(entry SearchEntry) SearchEntry {
+	if l.QueryGeneralizer == nil || entry.Query == "" {
+		return entry
+	}
+	general := l.QueryGeneralizer(entry.Query)
+	if committedEarly(entry) {
+		entry.CommittedQuery = general
+	} else {
+		entry.CommittedQuery = ""
+	}
+	entry.Query = general
+	if entry.RefinedFrom != "" {
+		entry.RefinedFrom = l.QueryGeneralizer(entry.RefinedFrom)
+	}
+	entry.RawQuery = ""
+	entry.Trajectory = nil
+	return entry
+}
@@ -0,0 +1,95 @@
+package searchlogger
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"go-search-logger/internal/logging"
+)
+
+// resetGraceWriteTimeout bounds the deferred write of a pending reset.
+const resetGraceWriteTimeout = 5 * time.Second
+
+// buildPendingKey constructs the key holding a reset-triggered entry that is
+// waiting out ResetGrace.
+func buildPendingKey(id string) string {
+	return "search:pending:" + id
+}
+
+// cancelCorrectedReset discards the session's pending entry if the new query
+// corrects the typo that triggered it: the new query must be prefix-related
+// to the pending one and share more of it than lastQuery did, so
+// "shoes" -> "shoex" -> "shoes" is a correction but "shoes" -> "socks" -> "s"
+// is not. It reports whether the entry was discarded.
+func (l *Logger) cancelCorrectedReset(ctx context.Context, sess session, lastQuery, liveQuery string) (bool, error) {
+	pendingKey := buildPendingKey(sess.key)
+	pending, err := l.Redis.Get(ctx, pendingKey).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, redisError(err)
+	}
+	pendingQuery := l.liveForm(decodeBuffer(pending))
+	if isPrefixReset(pendingQuery, liveQuery) ||
+		commonPrefixLen(liveQuery, pendingQuery) <= commonPrefixLen(lastQuery, pendingQuery) {
+		return false, nil
+	}
+	if err := l.Redis.Del(ctx, pendingKey).Err(); err != nil {
+		return false, redisError(err)
+	}
+	logging.Debugf("LogSearch: reset corrected within grace period for redisKey=%s", buildRedisKey(sess.key))
+	return true, nil
+}
+
+// deferReset holds a reset-triggered entry for ResetGrace before writing it.
+// An entry already pending for the session is written first.
+func (l *Logger) deferReset(ctx context.Context, sess session, entry SearchEntry) error {
+	if err := l.commitPending(ctx, sess.key); err != nil {
+		return err
+	}
+	buffered, err := encodeBuffer(entry)
+	if err != nil {
+		return err
+	}
+	if err := l.Redis.Set(ctx, buildPendingKey(sess.key), buffered, l.bufferTTL()).Err(); err != nil {
+		return redisError(err)
+	}
+	l.resetGrace.do(sess.key, l.ResetGrace, func() {
+		if l.Paused() {
+			// Written with the session when it ends after resuming.
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), resetGraceWriteTimeout)
+		defer cancel()
+		if err := l.commitPending(ctx, sess.key); err != nil {
+			log.Printf("LogSearch: error writing pending reset for id=%s: %v", sess.id, err)
+		}
+	})
+	return nil
+}
+
+// commitPending writes the session's pending entry, if any. GETDEL ensures
+// the entry is written at most once.
+func (l *Logger) commitPending(ctx context.Context, id string) error {
+	pending, err := l.Redis.GetDel(ctx, buildPendingKey(id)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return redisError(err)
+	}
+	return l.writeSearch(ctx, decodeBuffer(pending))
+}
+
+// commonPrefixLen returns the length in bytes of the common prefix of a and b.
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
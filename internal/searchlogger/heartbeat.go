@@ -0,0 +1,47 @@
+package searchlogger
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// listenerHeartbeatInterval is how often the keyspace listener pings its
+// subscription and, if that works, records a heartbeat.
+const listenerHeartbeatInterval = 5 * time.Second
+
+// listenerMissedBeats is how many heartbeats may be missed before
+// ListenerAlive reports the listener as dead.
+const listenerMissedBeats = 3
+
+// beat records that the keyspace listener, or the reaper standing in for
+// it, is working.
+func (l *Logger) beat() {
+	atomic.StoreInt64(&l.listenerBeat, l.now().UnixNano())
+}
+
+// ListenerHeartbeat returns when the keyspace listener, or the reaper it
+// falls back to, last showed it was working: the listener after a ping of
+// its subscription every few seconds, the reaper after each scan. It is
+// zero if neither has started.
+func (l *Logger) ListenerHeartbeat() time.Time {
+	nanos := atomic.LoadInt64(&l.listenerBeat)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// ListenerAlive reports whether the listener has recorded a heartbeat
+// recently enough that expired sessions are still being flushed. A listener
+// that never started, or stopped or hung, is not alive.
+func (l *Logger) ListenerAlive() bool {
+	last := l.ListenerHeartbeat()
+	if last.IsZero() {
+		return false
+	}
+	interval := listenerHeartbeatInterval
+	if l.reapInterval() > interval {
+		interval = l.reapInterval()
+	}
+	return l.now().Sub(last) <= listenerMissedBeats*interval
+}
@@ -0,0 +1,180 @@
+package searchlogger
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// DefaultHistoryCacheTTL is the default HistoryCacheTTL.
+const DefaultHistoryCacheTTL = time.Hour
+
+// buildHistoryKey constructs the Redis key caching an id's recent history.
+func buildHistoryKey(id string) string {
+	return "search:history:" + id
+}
+
+func (l *Logger) historyCacheTTL() time.Duration {
+	if l.HistoryCacheTTL > 0 {
+		return l.HistoryCacheTTL
+	}
+	return DefaultHistoryCacheTTL
+}
+
+// historyIDs returns the ids whose history lists entry: its user id and, if
+// recorded, its anon id.
+func historyIDs(entry SearchEntry) []string {
+	var ids []string
+	for _, id := range []string{entry.UserID, entry.AnonID} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// historyEntry returns the fields of entry that history reads return.
+func historyEntry(entry SearchEntry) SearchEntry {
+	return SearchEntry{UserID: entry.UserID, Query: entry.Query, AnonID: entry.AnonID, RefinedFrom: entry.RefinedFrom, Timestamp: entry.Timestamp}
+}
+
+// stampHistory sets the entry's Timestamp, if zero, when HistoryCacheSize is
+// set, so the cached entry and the stored row agree on it and cursors taken
+// from cached pages line up with the DB.
+func (l *Logger) stampHistory(entry SearchEntry) SearchEntry {
+	if l.HistoryCacheSize > 0 && entry.Timestamp.IsZero() {
+		entry.Timestamp = l.now().Truncate(time.Microsecond)
+	}
+	return entry
+}
+
+// cacheHistory adds a committed entry to the cached history of its ids. Only
+// lists that are already cached are extended, since a new list would be
+// missing older searches. With OnConflict the insert may have updated an
+// existing row instead, so the lists are invalidated. Failures are logged.
+func (l *Logger) cacheHistory(ctx context.Context, entry SearchEntry) {
+	if l.OnConflict != ConflictError {
+		l.invalidateHistory(ctx, historyIDs(entry)...)
+		return
+	}
+	data, err := json.Marshal(historyEntry(entry))
+	if err != nil {
+		return
+	}
+	pipe := l.Redis.TxPipeline()
+	for _, id := range historyIDs(entry) {
+		key := buildHistoryKey(id)
+		pipe.LPushX(ctx, key, data)
+		pipe.LTrim(ctx, key, 0, int64(l.HistoryCacheSize)-1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("cacheHistory: failed to cache search for userID=%s: %v", entrySessionID(entry), err)
+	}
+}
+
+// cachedHistory returns the first limit cached searches for id, newest
+// first. It reports false on a miss, including when Redis fails.
+func (l *Logger) cachedHistory(ctx context.Context, id string, limit int) ([]SearchEntry, bool) {
+	cached, err := l.Redis.LRange(ctx, buildHistoryKey(id), 0, int64(limit)-1).Result()
+	if err != nil {
+		log.Printf("cachedHistory: could not read cached history for userID=%s: %v", id, err)
+		return nil, false
+	}
+	if len(cached) == 0 {
+		return nil, false
+	}
+	entries := make([]SearchEntry, 0, len(cached))
+	for _, data := range cached {
+		var entry SearchEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, false
+		}
+		entries = append(entries, entry)
+	}
+	return entries, true
+}
+
+// historyCursor returns the cursor following a page served from the cache,
+// or nil if it is the last page. Cached entries carry no row id, so the
+// cursor continues strictly before the last entry's timestamp.
+func historyCursor(entries []SearchEntry, limit int) *Cursor {
+	if len(entries) == 0 || len(entries) < limit {
+		return nil
+	}
+	return &Cursor{At: entries[len(entries)-1].Timestamp}
+}
+
+// fillHistory caches id's most recent searches, as read from the DB. A
+// commit racing with the fill may be missing from the list until it expires.
+func (l *Logger) fillHistory(ctx context.Context, id string, entries []SearchEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	values := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		data, err := json.Marshal(historyEntry(entry))
+		if err != nil {
+			return
+		}
+		values[i] = data
+	}
+	key := buildHistoryKey(id)
+	pipe := l.Redis.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.RPush(ctx, key, values...)
+	pipe.Expire(ctx, key, l.historyCacheTTL())
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("fillHistory: failed to cache history for userID=%s: %v", id, err)
+	}
+}
+
+// invalidateHistory drops the cached history of the given ids, after their
+// rows changed in the DB. Failures are logged.
+func (l *Logger) invalidateHistory(ctx context.Context, ids ...string) {
+	if l.HistoryCacheSize <= 0 || len(ids) == 0 {
+		return
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = buildHistoryKey(id)
+	}
+	if err := l.Redis.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("invalidateHistory: failed to drop cached history: %v", err)
+	}
+}
+
+// invalidateBatchHistory drops the cached history of every id in entries.
+func (l *Logger) invalidateBatchHistory(ctx context.Context, entries []SearchEntry) {
+	if l.HistoryCacheSize <= 0 {
+		return
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, entry := range entries {
+		for _, id := range historyIDs(entry) {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	l.invalidateHistory(ctx, ids...)
+}
+
+// clearHistoryCache drops every cached history, after a change to rows of
+// unknown ids. Failures are logged.
+func (l *Logger) clearHistoryCache(ctx context.Context) {
+	if l.HistoryCacheSize <= 0 {
+		return
+	}
+	iter := l.Redis.Scan(ctx, 0, buildHistoryKey("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		if err := l.Redis.Del(ctx, iter.Val()).Err(); err != nil {
+			log.Printf("clearHistoryCache: failed to drop %s: %v", iter.Val(), err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("clearHistoryCache: scan failed: %v", err)
+	}
+}
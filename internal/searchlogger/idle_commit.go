@@ -0,0 +1,101 @@
+package searchlogger
+
+import (
+	"log"
+	"strings"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// buildIdleKey constructs the Redis key whose expiry marks a session's live
+// query as unchanged for IdleCommit.
+func buildIdleKey(id string) string {
+	return "search:idle:" + id
+}
+
+// idleCommitEnabled reports whether IdleCommit is set and shorter than the
+// session TTL; a longer one would never fire before the session expires.
+func (l *Logger) idleCommitEnabled() bool {
+	return l.IdleCommit > 0 && l.IdleCommit < l.sessionTTL()
+}
+
+// idleCommit commits the buffered query of a live session that has not
+// changed for IdleCommit, without ending the session. The buffered entry is
+// marked as committed, so the session's eventual flush or reset does not
+// write it again unless the query changes. It runs under flushContext.
+func (l *Logger) idleCommit(id string) {
+	if l.Paused() {
+		return
+	}
+	ctx, cancel := l.flushContext()
+	defer cancel()
+	bufferKey := buildBufferKey(id)
+
+	live, err := l.sessionLive(ctx, id)
+	if err != nil {
+		log.Printf("IdleCommit: could not check session for userID=%s: %v", id, err)
+		return
+	}
+	idle, err := l.Redis.Exists(ctx, buildIdleKey(id)).Result()
+	if err != nil {
+		log.Printf("IdleCommit: could not check session for userID=%s: %v", id, err)
+		return
+	}
+	// Without a live query the session has ended and is flushed as usual;
+	// with the idle key back, a keystroke restarted the timer.
+	if !live || idle == 1 {
+		return
+	}
+	buffered, err := l.Redis.Get(ctx, bufferKey).Result()
+	if err == redis.Nil {
+		return
+	}
+	if err != nil {
+		log.Printf("IdleCommit: could not retrieve buffered query for userID=%s: %v", id, err)
+		return
+	}
+	entry := decodeBuffer(buffered)
+	if entry.Query == "" || committedEarly(entry) {
+		return
+	}
+	if err := l.writeSearch(ctx, l.withTrajectory(ctx, id, entry)); err != nil {
+		log.Printf("IdleCommit: failed to write search to DB for userID=%s: %v", id, err)
+		return
+	}
+	metrics.IdleCommits.Add(1)
+	logging.Debugf("IdleCommit: committed unchanged query='%s' for userID=%s", entry.Query, id)
+
+	// Mark the buffer as committed, unless a keystroke replaced it meanwhile.
+	entry.CommittedQuery = entry.Query
+	updated, err := encodeBuffer(entry)
+	if err != nil {
+		return
+	}
+	err = l.Redis.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, bufferKey).Result()
+		if err != nil || current != buffered {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetArgs(ctx, bufferKey, updated, redis.SetArgs{KeepTTL: true})
+			return nil
+		})
+		return err
+	}, bufferKey)
+	if err != nil && err != redis.Nil {
+		log.Printf("IdleCommit: could not mark query as committed for userID=%s: %v", id, err)
+	}
+}
+
+// handleExpiredKey dispatches an expired-key event of the keyspace listener.
+func (l *Logger) handleExpiredKey(key string) {
+	switch {
+	case strings.HasPrefix(key, "search:last:"):
+		l.handleExpired(strings.TrimPrefix(key, "search:last:"))
+	case strings.HasPrefix(key, "search:idle:"):
+		l.idleCommit(strings.TrimPrefix(key, "search:idle:"))
+	}
+}
@@ -0,0 +1,65 @@
+package searchlogger
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net"
+)
+
+// IPStorageMode selects whether and how the client IP is stored in the ip
+// column.
+type IPStorageMode int
+
+const (
+	// IPStorageOff does not store the client IP. This is the default.
+	IPStorageOff IPStorageMode = iota
+	// IPStorageRaw stores the client IP as received.
+	IPStorageRaw
+	// IPStorageTruncated stores the network of the client IP, /24 for IPv4
+	// and /48 for IPv6, which is still enough for coarse geolocation.
+	IPStorageTruncated
+	// IPStorageHashed stores an HMAC-SHA256 of the client IP keyed with
+	// IPSalt, so searches from one address can be grouped but the address
+	// cannot be recovered without the salt.
+	IPStorageHashed
+)
+
+// ParseIPStorageMode parses "off", "raw", "truncated" or "hashed".
+func ParseIPStorageMode(s string) (IPStorageMode, error) {
+	switch s {
+	case "", "off":
+		return IPStorageOff, nil
+	case "raw":
+		return IPStorageRaw, nil
+	case "truncated":
+		return IPStorageTruncated, nil
+	case "hashed":
+		return IPStorageHashed, nil
+	}
+	return IPStorageOff, fmt.Errorf("unknown IP storage mode %q", s)
+}
+
+// storedIP returns the form of a client IP stored per IPStorage, or "" if
+// it is not stored or is not a valid address.
+func (l *Logger) storedIP(addr string) string {
+	if l.IPStorage == IPStorageOff {
+		return ""
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	switch l.IPStorage {
+	case IPStorageTruncated:
+		if v4 := ip.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case IPStorageHashed:
+		mac := hmac.New(sha256.New, []byte(l.IPSalt))
+		mac.Write([]byte(ip.String()))
+		return fmt.Sprintf("%x", mac.Sum(nil))
+	}
+	return ip.String()
+}
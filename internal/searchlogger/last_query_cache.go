@@ -0,0 +1,171 @@
+package searchlogger
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"go-search-logger/internal/metrics"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultLastQueryCacheTTL is the default LastQueryCacheTTL.
+const DefaultLastQueryCacheTTL = 2 * time.Second
+
+// lastQuerySharedTTL is how long the cache is bypassed for an id after
+// another process was seen writing its live query.
+const lastQuerySharedTTL = 5 * time.Minute
+
+func (l *Logger) lastQueryCacheTTL() time.Duration {
+	ttl := l.LastQueryCacheTTL
+	if ttl <= 0 {
+		ttl = DefaultLastQueryCacheTTL
+	}
+	// A cached query must not outlive its live key, or an expired session
+	// would be seen as still live.
+	if ttl > l.sessionTTL() {
+		ttl = l.sessionTTL()
+	}
+	return ttl
+}
+
+// lastQueryCache is a bounded LRU of session ids to their live query, as
+// last written by this process. The zero value is ready to use.
+type lastQueryCache struct {
+	mu      sync.Mutex
+	order   list.List // of *lastQueryItem, most recently used first
+	entries map[string]*list.Element
+}
+
+type lastQueryItem struct {
+	id      string
+	query   string
+	expires time.Time
+	shared  bool // another process writes this id; bypass until expires
+}
+
+// get returns the cached live query for id, if it is fresh.
+func (c *lastQueryCache) get(id string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok {
+		return "", false
+	}
+	item := e.Value.(*lastQueryItem)
+	if !now.Before(item.expires) {
+		c.remove(e)
+		return "", false
+	}
+	if item.shared {
+		return "", false
+	}
+	c.order.MoveToFront(e)
+	return item.query, true
+}
+
+// put caches query as id's live query until expires, evicting the least
+// recently used ids beyond size. An id marked shared stays uncached.
+func (c *lastQueryCache) put(id, query string, expires time.Time, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok {
+		item := e.Value.(*lastQueryItem)
+		if item.shared && expires.Before(item.expires) {
+			return
+		}
+		*item = lastQueryItem{id: id, query: query, expires: expires}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.insert(&lastQueryItem{id: id, query: query, expires: expires}, size)
+}
+
+// markShared bypasses the cache for id until the given time.
+func (c *lastQueryCache) markShared(id string, until time.Time, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok {
+		*e.Value.(*lastQueryItem) = lastQueryItem{id: id, expires: until, shared: true}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.insert(&lastQueryItem{id: id, expires: until, shared: true}, size)
+}
+
+// forget drops id's cached query, keeping a shared mark.
+func (c *lastQueryCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok && !e.Value.(*lastQueryItem).shared {
+		c.remove(e)
+	}
+}
+
+func (c *lastQueryCache) insert(item *lastQueryItem, size int) {
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	c.entries[item.id] = c.order.PushFront(item)
+	for c.order.Len() > size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *lastQueryCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*lastQueryItem).id)
+}
+
+// cachedLastQuery returns id's live query from the process-local cache,
+// if LastQueryCacheSize is set and it holds a fresh entry.
+func (l *Logger) cachedLastQuery(id string) (string, bool) {
+	if l.LastQueryCacheSize <= 0 {
+		return "", false
+	}
+	query, ok := l.lastQueries.get(id, l.now())
+	if ok {
+		metrics.LastQueryCacheHits.Add(1)
+	}
+	return query, ok
+}
+
+// rememberLastQuery caches query as id's live query after this process
+// wrote it. prev is the value the write replaced, from SET ... GET; if it is
+// not the expected one, another process also writes id's live key, so the
+// cache is bypassed for id rather than risk acting on a stale query.
+func (l *Logger) rememberLastQuery(id, query, expected string, prev *redis.StatusCmd) {
+	if prev == nil {
+		return
+	}
+	now := l.now()
+	if prev.Val() != expected {
+		metrics.LastQueryCacheConflicts.Add(1)
+		l.lastQueries.markShared(id, now.Add(lastQuerySharedTTL), l.LastQueryCacheSize)
+		return
+	}
+	l.lastQueries.put(id, query, now.Add(l.lastQueryCacheTTL()), l.LastQueryCacheSize)
+}
+
+// forgetLastQuery drops id's cached live query after this process deleted
+// or replaced the live key outside updateSession.
+func (l *Logger) forgetLastQuery(id string) {
+	if l.LastQueryCacheSize > 0 {
+		l.lastQueries.forget(id)
+	}
+}
+
+// execIgnoringNil returns the first error of a pipeline's commands other
+// than redis.Nil, which SET ... GET replies for a key that did not exist.
+func execIgnoringNil(cmds []redis.Cmder, err error) error {
+	if err != redis.Nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			return err
+		}
+	}
+	return nil
+}
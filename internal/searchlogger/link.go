@@ -0,0 +1,245 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	linkSearchesQuery = `UPDATE user_searches SET user_id = $2
+			WHERE anon_id = $1 AND COALESCE(user_id, '') = ''`
+	linkResultsQuery = `UPDATE search_results SET user_id = $2
+			WHERE anon_id = $1 AND COALESCE(user_id, '') = ''`
+)
+
+// LinkAnonToUser attributes everything logged for anonID before a login to
+// userID: rows in user_searches and search_results get userID (anon_id is
+// kept, so the link stays visible), and the anon id's live Redis session
+// continues as the user's. Rows that already belong to a user are left alone.
+//
+// The rows are updated in one transaction. With Shards, if the two ids live
+// on different shards the rows are copied to the user's shard and then
+// deleted from the anon id's; a failure in between leaves duplicates rather
+// than losing rows.
+func (l *Logger) LinkAnonToUser(ctx context.Context, anonID, userID string) error {
+	if anonID == "" || userID == "" {
+		return fmt.Errorf("%w: anon id and user id are required", ErrInvalidRequest)
+	}
+	for _, id := range []string{anonID, userID} {
+		if err := validateUserID(id); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch {
+	case !l.HasDB():
+		// Searches went to a Store that cannot be updated, e.g. a
+		// StdoutStore; only the live session is linked.
+	case l.shardIndex(anonID) == l.shardIndex(userID):
+		err = linkRows(ctx, l.shardDB(anonID), anonID, userID)
+	default:
+		err = moveRows(ctx, l.shardDB(anonID), l.shardDB(userID), anonID, userID)
+	}
+	if err != nil {
+		log.Printf("LinkAnonToUser: failed to link rows of anonID=%s to userID=%s: %v", anonID, userID, err)
+		return dbError(err)
+	}
+	l.invalidateHistory(ctx, anonID, userID)
+	return l.linkSession(ctx, anonID, userID)
+}
+
+func linkRows(ctx context.Context, db *sql.DB, anonID, userID string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{linkSearchesQuery, linkResultsQuery} {
+		if _, err := tx.ExecContext(ctx, q, anonID, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// movedTables lists the columns copied by moveRows. user_id must come first;
+// it is replaced with the new user id. JSONB is moved as text, and term ids
+// are resolved to inline text since each database has its own search_terms.
+var movedTables = []struct {
+	table string
+	cols  []string
+	exprs string
+}{
+	{
+		table: "user_searches",
+		cols:  []string{"user_id", "search_text", "anon_id", "raw_text", "location", "extra", "outcome", "latency_ms", "device", "browser", "os", "ip", "utm_source", "utm_campaign", "seq", "token_count", "char_count", "refined_from", "visit_id", "variant", "trajectory", "last_searched_at"},
+		exprs: "user_id, COALESCE(search_text, (SELECT term FROM search_terms WHERE id = term_id)), anon_id, raw_text, location, extra::text, outcome, latency_ms, device, browser, os, ip, utm_source, utm_campaign, seq, token_count, char_count, refined_from, visit_id, variant, trajectory::text, last_searched_at",
+	},
+	{
+		table: "search_results",
+		cols:  []string{"user_id", "anon_id", "search_text", "result_id", "position", "searched_at", "selected_at"},
+		exprs: "user_id, anon_id, search_text, result_id, position, searched_at, selected_at",
+	},
+}
+
+// moveRows copies the anon id's rows from src to dst under userID, then
+// deletes them from src. The source rows stay locked until they are deleted.
+func moveRows(ctx context.Context, src, dst *sql.DB, anonID, userID string) error {
+	srcTx, err := src.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer srcTx.Rollback()
+	dstTx, err := dst.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer dstTx.Rollback()
+
+	where := " WHERE anon_id = $1 AND COALESCE(user_id, '') = ''"
+	for _, t := range movedTables {
+		rows, err := readRows(ctx, srcTx, "SELECT "+t.exprs+" FROM "+t.table+where+" FOR UPDATE", len(t.cols), anonID)
+		if err != nil {
+			return err
+		}
+		insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.table, strings.Join(t.cols, ", "), placeholders(len(t.cols)))
+		for _, row := range rows {
+			row[0] = userID
+			if _, err := dstTx.ExecContext(ctx, insert, row...); err != nil {
+				return err
+			}
+		}
+		if _, err := srcTx.ExecContext(ctx, "DELETE FROM "+t.table+where, anonID); err != nil {
+			return err
+		}
+	}
+	if err := dstTx.Commit(); err != nil {
+		return err
+	}
+	return srcTx.Commit()
+}
+
+func readRows(ctx context.Context, tx *sql.Tx, query string, ncols int, args ...interface{}) ([][]interface{}, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res [][]interface{}
+	for rows.Next() {
+		vals := make([]interface{}, ncols)
+		ptrs := make([]interface{}, ncols)
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		res = append(res, vals)
+	}
+	return res, rows.Err()
+}
+
+// placeholders returns "$1, $2, ..., $n".
+func placeholders(n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		ps[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return strings.Join(ps, ", ")
+}
+
+// linkSession moves the anon id's live session to userID. If the user already
+// has a live session of their own, the anon query is written to the DB
+// instead, so neither session is lost.
+func (l *Logger) linkSession(ctx context.Context, anonID, userID string) error {
+	anonKey, userKey := sessionKeyID("", anonID), sessionKeyID(userID, "")
+	if l.ResetGrace > 0 {
+		pending, err := l.Redis.GetDel(ctx, buildPendingKey(anonKey)).Result()
+		if err != nil && err != redis.Nil {
+			return redisError(err)
+		}
+		if err == nil {
+			if err := l.writeSearch(ctx, linkedEntry(decodeBuffer(pending), anonID, userID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	buffered, err := l.Redis.GetDel(ctx, buildBufferKey(anonKey)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return redisError(err)
+	}
+	// Without its buffer the anon key's expiry flushes nothing, but remove it
+	// so it cannot be mistaken for a live session.
+	l.forgetLastQuery(anonKey)
+	l.forgetLastQuery(userKey)
+	if err := l.Redis.Del(ctx, buildRedisKey(anonKey)).Err(); err != nil {
+		return redisError(err)
+	}
+
+	entry := linkedEntry(decodeBuffer(buffered), anonID, userID)
+	if l.SingleKeySessions {
+		entry.LiveUntil = l.now().Add(l.sessionTTL()).UnixMilli()
+	}
+	val, err := encodeBuffer(entry)
+	if err != nil {
+		return err
+	}
+	if l.SingleKeySessions {
+		ok, err := l.Redis.SetNX(ctx, buildBufferKey(userKey), val, l.bufferTTL()).Result()
+		if err != nil {
+			return redisError(err)
+		}
+		if !ok {
+			return l.writeSearch(ctx, entry)
+		}
+		return nil
+	}
+	ok, err := l.Redis.SetNX(ctx, buildRedisKey(userKey), l.liveForm(entry), l.sessionTTL()).Result()
+	if err != nil {
+		return redisError(err)
+	}
+	if !ok {
+		return l.writeSearch(ctx, entry)
+	}
+	if err := l.Redis.Set(ctx, buildBufferKey(userKey), val, l.bufferTTL()).Err(); err != nil {
+		// A live key without its buffer would expire without flushing, so
+		// take it back and commit the entry now instead.
+		log.Printf("linkSession: failed to move buffer to userID=%s, committing it: %v", userID, err)
+		_ = l.Redis.Del(ctx, buildRedisKey(userKey)).Err()
+		return l.writeSearch(ctx, entry)
+	}
+	return nil
+}
+
+// linkedEntry attributes a buffered anonymous entry to userID.
+func linkedEntry(entry SearchEntry, anonID, userID string) SearchEntry {
+	entry.UserID = userID
+	if entry.AnonID == "" {
+		entry.AnonID = anonID
+	}
+	return entry
+}
+
+// LinkSession is LinkAnonToUser for the anon id LogSearch would use for the
+// request: the client's own anon id if given, otherwise one derived from
+// userAgent.
+func (l *Logger) LinkSession(ctx context.Context, userID, userAgent, clientAnonID string) error {
+	anonID, err := l.anonIDFor(userAgent, clientAnonID)
+	if err != nil {
+		return err
+	}
+	return l.LinkAnonToUser(ctx, anonID, userID)
+}
@@ -0,0 +1,144 @@
+package searchlogger
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
+)
+
+const (
+	// DefaultMemoryGuardInterval is the default interval of StartMemoryGuard.
+	DefaultMemoryGuardInterval = 10 * time.Second
+	// DefaultMemoryGuardKeep is the default MemoryGuardKeep.
+	DefaultMemoryGuardKeep = 0.1
+)
+
+func (l *Logger) memoryGuardKeep() float64 {
+	switch {
+	case l.MemoryGuardKeep > 0:
+		return l.MemoryGuardKeep
+	case l.MemoryGuardKeep < 0:
+		return 0
+	}
+	return DefaultMemoryGuardKeep
+}
+
+// underMemoryPressure reports whether the last memory check found Redis
+// past MemoryGuardThreshold.
+func (l *Logger) underMemoryPressure() bool {
+	return atomic.LoadInt32(&l.memoryPressure) == 1
+}
+
+// shedSession reports whether a new session should be dropped to relieve
+// memory pressure, keeping MemoryGuardKeep of them. A submit, or a blur,
+// starting a session is shed like a keystroke, so it is not written either.
+func (l *Logger) shedSession() bool {
+	if !l.underMemoryPressure() || l.sampled(l.memoryGuardKeep()) {
+		return false
+	}
+	metrics.SessionsShed.Add(1)
+	return true
+}
+
+// StartMemoryGuard checks Redis memory use every interval
+// (DefaultMemoryGuardInterval if not positive) until ctx is cancelled. While
+// used_memory is at least MemoryGuardThreshold of maxmemory, new sessions
+// are shed, so Redis does not start evicting the buffers of live ones.
+// Without a maxmemory limit there is nothing to guard against.
+func (l *Logger) StartMemoryGuard(ctx context.Context, interval time.Duration) {
+	if l.MemoryGuardThreshold <= 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultMemoryGuardInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Started Redis memory guard (threshold %.0f%%, interval %s)", l.MemoryGuardThreshold*100, interval)
+
+	for {
+		l.checkMemory(ctx)
+		select {
+		case <-ctx.Done():
+			log.Println("Stopping Redis memory guard")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkMemory reads Redis memory use and updates the pressure state. Errors
+// leave the state unchanged.
+func (l *Logger) checkMemory(ctx context.Context) {
+	info, err := l.Redis.Info(ctx, "memory").Result()
+	if err != nil {
+		log.Printf("MemoryGuard: could not read Redis memory use: %v", err)
+		return
+	}
+	used, max, err := parseMemoryInfo(info)
+	if err != nil {
+		log.Printf("MemoryGuard: %v", err)
+		return
+	}
+	if max == 0 {
+		logging.Debugf("MemoryGuard: Redis has no maxmemory limit")
+		l.setMemoryPressure(false, 0)
+		return
+	}
+	ratio := float64(used) / float64(max)
+	l.setMemoryPressure(ratio >= l.MemoryGuardThreshold, ratio)
+}
+
+// setMemoryPressure records the pressure state, logging transitions.
+func (l *Logger) setMemoryPressure(pressure bool, ratio float64) {
+	metrics.RedisMemoryUsedPercent.Set(int64(ratio * 100))
+	var v int32
+	if pressure {
+		v = 1
+	}
+	metrics.RedisMemoryPressure.Set(int64(v))
+	if atomic.SwapInt32(&l.memoryPressure, v) == v {
+		return
+	}
+	if pressure {
+		logging.Warnf("MemoryGuard: Redis memory at %.0f%% of maxmemory, shedding new sessions", ratio*100)
+	} else {
+		log.Printf("MemoryGuard: Redis memory at %.0f%% of maxmemory, no longer shedding", ratio*100)
+	}
+}
+
+// parseMemoryInfo extracts used_memory and maxmemory, in bytes, from the
+// output of INFO memory.
+func parseMemoryInfo(info string) (used, max int64, err error) {
+	found := 0
+	sc := bufio.NewScanner(strings.NewReader(info))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(sc.Text()), ":")
+		if !ok || (key != "used_memory" && key != "maxmemory") {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		if key == "used_memory" {
+			used = n
+		} else {
+			max = n
+		}
+		found++
+	}
+	if found < 2 {
+		return 0, 0, errors.New("INFO memory lacks used_memory or maxmemory")
+	}
+	return used, max, nil
+}
@@ -0,0 +1,63 @@
+package searchlogger
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore is a BatchStore that keeps searches in memory, for tests and
+// local development. It is safe for concurrent use.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries []SearchEntry
+}
+
+// WriteSearch appends entry.
+func (m *MemoryStore) WriteSearch(ctx context.Context, entry SearchEntry) error {
+	return m.WriteSearches(ctx, []SearchEntry{entry})
+}
+
+// WriteSearches appends entries.
+func (m *MemoryStore) WriteSearches(ctx context.Context, entries []SearchEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entries...)
+	return nil
+}
+
+// Entries returns every stored search, oldest first.
+func (m *MemoryStore) Entries() []SearchEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SearchEntry(nil), m.entries...)
+}
+
+// EntriesFor returns the stored searches whose user id or anon id is id,
+// oldest first.
+func (m *MemoryStore) EntriesFor(id string) []SearchEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []SearchEntry
+	for _, entry := range m.entries {
+		if entry.UserID == id || entry.AnonID == id {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+// Latest returns the most recently stored search for a user or anon id.
+func (m *MemoryStore) Latest(id string) (SearchEntry, bool) {
+	entries := m.EntriesFor(id)
+	if len(entries) == 0 {
+		return SearchEntry{}, false
+	}
+	return entries[len(entries)-1], true
+}
+
+// Reset removes every stored search.
+func (m *MemoryStore) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = nil
+}
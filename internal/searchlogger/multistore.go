@@ -0,0 +1,32 @@
+package searchlogger
+
+import (
+	"context"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
+)
+
+// MultiStore writes every search to a primary store and then to each
+// secondary store, e.g. PostgreSQL plus a data lake. Only the primary
+// determines success: if it fails, the error is returned and the secondaries
+// are not written, so they never hold searches the primary lacks. Secondary
+// failures are logged and counted in store_secondary_errors_total.
+type MultiStore struct {
+	Primary     Store
+	Secondaries []Store
+}
+
+// WriteSearch implements Store.
+func (m *MultiStore) WriteSearch(ctx context.Context, entry SearchEntry) error {
+	if err := m.Primary.WriteSearch(ctx, entry); err != nil {
+		return err
+	}
+	for i, s := range m.Secondaries {
+		if err := s.WriteSearch(ctx, entry); err != nil {
+			metrics.StoreSecondaryErrors.Add(1)
+			logging.Warnf("MultiStore: secondary store %d failed for userID=%s: %v", i, entrySessionID(entry), err)
+		}
+	}
+	return nil
+}
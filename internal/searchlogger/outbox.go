@@ -0,0 +1,142 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// OutboxMessage is a committed search waiting to be published.
+type OutboxMessage struct {
+	ID      int64  // outbox row id, increasing; consumers can use it to drop redeliveries
+	Key     string // user id, or anon id for anonymous users, e.g. a Kafka partition key
+	Payload []byte // the SearchEntry as JSON
+}
+
+// Publisher delivers outbox messages to a downstream system such as Kafka.
+// Publish should return only once the message is durably accepted.
+type Publisher interface {
+	Publish(ctx context.Context, msg OutboxMessage) error
+}
+
+// DefaultOutboxBatchSize is the number of messages RelayOutbox publishes per
+// shard and call.
+const DefaultOutboxBatchSize = 100
+
+const (
+	insertOutboxQuery = `INSERT INTO search_outbox (key, payload) VALUES ($1, $2)`
+	selectOutboxQuery = `SELECT id, key, payload FROM search_outbox
+			WHERE published_at IS NULL
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED`
+	markOutboxQuery = `UPDATE search_outbox SET published_at = NOW() WHERE id = ANY($1)`
+)
+
+// insertOutbox records entry in the outbox within tx, the transaction that
+// inserts the search, so the two commit or roll back together.
+func insertOutbox(ctx context.Context, tx *sql.Tx, entry SearchEntry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, insertOutboxQuery, entrySessionID(entry), string(payload))
+	return err
+}
+
+// RelayOutbox publishes up to DefaultOutboxBatchSize unpublished messages
+// from each shard, in order, and marks them published. It stops at the
+// first publish error so order is kept; the failed message is retried on the
+// next call. Delivery is at least once: if the process dies after publishing
+// but before marking, the message is published again. It returns the number
+// of messages published.
+func (l *Logger) RelayOutbox(ctx context.Context, pub Publisher) (int, error) {
+	total := 0
+	for _, db := range l.shards() {
+		n, err := relayOutboxShard(ctx, db, pub)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func relayOutboxShard(ctx context.Context, db *sql.DB, pub Publisher) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, selectOutboxQuery, DefaultOutboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var msgs []OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		var payload string
+		if err := rows.Scan(&msg.ID, &msg.Key, &payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		msg.Payload = []byte(payload)
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var published []int64
+	var pubErr error
+	for _, msg := range msgs {
+		if pubErr = pub.Publish(ctx, msg); pubErr != nil {
+			break
+		}
+		published = append(published, msg.ID)
+	}
+	if len(published) > 0 {
+		if _, err := tx.ExecContext(ctx, markOutboxQuery, pq.Array(published)); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	return len(published), pubErr
+}
+
+// StartOutboxRelay calls RelayOutbox every interval until ctx is cancelled.
+// A full batch is followed immediately by another, so a backlog drains
+// without waiting for the interval. After an error the wait is jittered, so
+// relays that failed together do not retry in lockstep.
+func (l *Logger) StartOutboxRelay(ctx context.Context, pub Publisher, interval time.Duration) {
+	log.Printf("Started outbox relay (interval %s)", interval)
+
+	for {
+		n, err := l.RelayOutbox(ctx, pub)
+		if err != nil {
+			log.Printf("OutboxRelay: published %d messages before error: %v", n, err)
+		}
+		if err == nil && n >= DefaultOutboxBatchSize {
+			continue
+		}
+		wait := interval
+		if err != nil {
+			wait = l.jitter(interval, backoffJitter)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Stopping outbox relay")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
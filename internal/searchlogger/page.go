@@ -0,0 +1,51 @@
+package searchlogger
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page selects a page of results, newest first. Either skip Offset rows, or
+// set Cursor to a previous page's next cursor. Cursors stay fast and stable
+// however deep the page, whereas large offsets make PostgreSQL scan and
+// discard every skipped row.
+type Page struct {
+	Limit  int
+	Offset int
+	Cursor *Cursor
+}
+
+// Cursor marks the position after the last row of a page: its
+// last_searched_at and row id.
+type Cursor struct {
+	At time.Time
+	ID int64
+}
+
+// String encodes the cursor as an opaque token for clients.
+func (c *Cursor) String() string {
+	raw := strconv.FormatInt(c.At.UnixNano(), 10) + ":" + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseCursor decodes a token produced by Cursor.String. Malformed tokens
+// return an error matching ErrInvalidRequest.
+func ParseCursor(token string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidRequest)
+	}
+	at, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidRequest)
+	}
+	nanos, err1 := strconv.ParseInt(at, 10, 64)
+	rowID, err2 := strconv.ParseInt(id, 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidRequest)
+	}
+	return &Cursor{At: time.Unix(0, nanos), ID: rowID}, nil
+}
@@ -0,0 +1,39 @@
+package searchlogger
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// CompileQueryPatterns compiles patterns for AllowPatterns or DenyPatterns.
+// Matching is case-insensitive and unanchored; use ^ and $ to match whole
+// queries, e.g. `^(shoes|socks)$`.
+func CompileQueryPatterns(patterns ...string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query pattern %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// queryAllowed reports whether a normalized query may be logged. DenyPatterns
+// take precedence: a query matching both lists is dropped.
+func (l *Logger) queryAllowed(q string) bool {
+	if matchAny(l.DenyPatterns, q) {
+		return false
+	}
+	return len(l.AllowPatterns) == 0 || matchAny(l.AllowPatterns, q)
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package searchlogger
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// SetPaused pauses or resumes logging. While paused, nothing is written to
+// the DB, so it can be taken down for maintenance without client-visible
+// errors:
+//
+//   - LogSearch, LogSearchRequest, EndSession, FlushSession, FlushUser and
+//     RecordResult accept their input and return nil without touching Redis
+//     or the DB. Searches and selections made while paused are lost.
+//   - Sessions that end while paused, on expiry, idle commit or after
+//     ResetGrace, are left in Redis. Resuming scans for them and writes
+//     those whose buffers have not expired (see BufferTTL).
+//   - FlushAll leaves every session in Redis.
+//
+// Operations run explicitly by an operator are exempt: LinkSession,
+// ClearSession, DeleteAnon, imports, purges, RenormalizeExisting and
+// ReplayDeadLetters. Safe for concurrent use.
+func (l *Logger) SetPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	if atomic.SwapInt32(&l.paused, v) == 1 && !paused && l.Redis != nil {
+		go l.reapExpired(context.Background())
+	}
+}
+
+// Paused reports whether logging is paused.
+func (l *Logger) Paused() bool {
+	return atomic.LoadInt32(&l.paused) == 1
+}
@@ -0,0 +1,151 @@
+package searchlogger
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// PIIMode selects what happens to a search containing personal data matched
+// by PIIPatterns.
+type PIIMode int
+
+const (
+	// PIIOff logs queries as typed. This is the default.
+	PIIOff PIIMode = iota
+	// PIIRedact replaces each match with its pattern name in brackets, e.g.
+	// "mail [email]", and logs the rest of the query.
+	PIIRedact
+	// PIIDrop does not log the search at all.
+	PIIDrop
+)
+
+// ParsePIIMode parses "off", "redact" or "drop".
+func ParsePIIMode(s string) (PIIMode, error) {
+	switch s {
+	case "", "off":
+		return PIIOff, nil
+	case "redact":
+		return PIIRedact, nil
+	case "drop":
+		return PIIDrop, nil
+	}
+	return PIIOff, fmt.Errorf("unknown PII mode %q", s)
+}
+
+// PIIPattern detects one kind of personal data in queries.
+type PIIPattern struct {
+	Name   string
+	Regexp *regexp.Regexp
+	// Valid, if set, confirms a match, e.g. with a checksum, to cut false
+	// positives. Matches it rejects are left alone.
+	Valid func(match string) bool
+}
+
+// DefaultPIIPatterns detects email addresses, IBANs, payment card numbers
+// (Luhn-checked), US Social Security numbers in ddd-dd-dddd form and
+// international phone numbers starting with "+". Patterns are applied in
+// order, so earlier ones take precedence over overlapping later ones.
+func DefaultPIIPatterns() []PIIPattern {
+	return []PIIPattern{
+		{Name: "email", Regexp: regexp.MustCompile(`(?i)[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}`)},
+		{Name: "iban", Regexp: regexp.MustCompile(`(?i)\b[a-z]{2}\d{2}(?: ?[a-z0-9]{4}){2,7}(?: ?[a-z0-9]{1,3})?\b`), Valid: validIBAN},
+		{Name: "card", Regexp: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), Valid: luhnValid},
+		{Name: "ssn", Regexp: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), Valid: validSSN},
+		{Name: "phone", Regexp: regexp.MustCompile(`\+\d{1,3}[ .-]?(?:\(\d{1,4}\)[ .-]?)?\d{2,4}(?:[ .-]?\d{2,4}){1,4}\b`)},
+	}
+}
+
+func (l *Logger) piiPatterns() []PIIPattern {
+	if l.PIIPatterns != nil {
+		return l.PIIPatterns
+	}
+	return DefaultPIIPatterns()
+}
+
+// scrubPII returns query with every PII match replaced by "[name]", and
+// whether anything matched.
+func (l *Logger) scrubPII(query string) (string, bool) {
+	found := false
+	for _, p := range l.piiPatterns() {
+		query = p.Regexp.ReplaceAllStringFunc(query, func(match string) string {
+			if p.Valid != nil && !p.Valid(match) {
+				return match
+			}
+			found = true
+			return "[" + p.Name + "]"
+		})
+	}
+	return query, found
+}
+
+// discardPIIPrefix abandons the session if its live query is a prefix of
+// query, which contains PII. The prefix was typed on the way to the PII, e.g.
+// a partial email address, and would otherwise be committed by the next
+// reset or on expiry.
+func (l *Logger) discardPIIPrefix(ctx context.Context, sess session, query string) error {
+	lastQuery, err := l.liveQuery(ctx, sess.key)
+	if err != nil {
+		return err
+	}
+	if lastQuery == "" || isPrefixReset(lastQuery, l.compareForm(query, l.normalize(query))) {
+		return nil
+	}
+	l.debouncer.cancel(sess.key)
+	l.forgetLastQuery(sess.key)
+	err = l.Redis.Del(ctx, buildRedisKey(sess.key), buildBufferKey(sess.key),
+		buildPendingKey(sess.key), buildTrajectoryKey(sess.key)).Err()
+	if err != nil {
+		log.Printf("LogSearch: failed to discard partial PII for userID=%s: %v", sess.id, err)
+		return redisError(err)
+	}
+	return nil
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum used by
+// payment card numbers.
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// validSSN rejects ddd-dd-dddd numbers that are never issued as SSNs.
+func validSSN(s string) bool {
+	area, group, serial := s[:3], s[4:6], s[7:]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// validIBAN reports whether s passes the IBAN mod-97 check.
+func validIBAN(s string) bool {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	s = s[4:] + s[:4]
+	rem := 0
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			rem = (rem*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z':
+			rem = (rem*100 + int(c-'A'+10)) % 97
+		default:
+			return false
+		}
+	}
+	return rem == 1
+}
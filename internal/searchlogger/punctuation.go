@@ -0,0 +1,48 @@
+package searchlogger
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultTrimPunctuation is the punctuation trimmed from the ends of queries
+// with TrimPunctuation, so "hello?" and "hello" are one query. Symbols that
+// carry meaning at the end of a term, such as # and + in "c#" and "c++", are
+// not included.
+const DefaultTrimPunctuation = `.,;:!?¿¡"'“”‘’«»()[]{}…`
+
+// trimPunctuation strips leading and trailing characters in set from query,
+// along with whitespace left exposed. Internal punctuation is kept, and so is
+// the final period of a trailing abbreviation like "a.i." or "u.s.".
+func trimPunctuation(query, set string) string {
+	trimmed := strings.TrimLeftFunc(query, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(set, r)
+	})
+	for trimmed != "" {
+		r, size := utf8.DecodeLastRuneInString(trimmed)
+		if !unicode.IsSpace(r) && !strings.ContainsRune(set, r) {
+			break
+		}
+		if r == '.' && endsWithAbbreviation(trimmed) {
+			break
+		}
+		trimmed = trimmed[:len(trimmed)-size]
+	}
+	return trimmed
+}
+
+// endsWithAbbreviation reports whether s ends in a word of single letters
+// each followed by a period, e.g. "a.i.", with at least two letters.
+func endsWithAbbreviation(s string) bool {
+	word := []rune(s[strings.LastIndexFunc(s, unicode.IsSpace)+1:])
+	if len(word) < 4 || len(word)%2 != 0 {
+		return false
+	}
+	for i, r := range word {
+		if i%2 == 0 && !unicode.IsLetter(r) || i%2 == 1 && r != '.' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,18 @@
+package searchlogger
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// stampQueryStats sets the token and character counts of the query about
+// to be stored, with QueryStats. Tokens are split on whitespace, as queries
+// are trimmed by normalizeQuery, and characters are counted in runes.
+func (l *Logger) stampQueryStats(entry SearchEntry) SearchEntry {
+	if !l.QueryStats {
+		return entry
+	}
+	entry.TokenCount = len(strings.Fields(entry.Query))
+	entry.CharCount = utf8.RuneCountInString(entry.Query)
+	return entry
+}
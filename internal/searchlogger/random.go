@@ -0,0 +1,62 @@
+package searchlogger
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// backoffJitter is the fraction by which retry backoffs are jittered, so
+// clients failing together do not retry in lockstep.
+const backoffJitter = 0.2
+
+// lazyRand draws from a rand.Source, or from a source seeded from the clock
+// if it is nil, created on first use. The zero value is ready to use and safe
+// for concurrent use.
+type lazyRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (r *lazyRand) float64(src rand.Source) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rng == nil {
+		if src == nil {
+			src = rand.NewSource(time.Now().UnixNano())
+		}
+		r.rng = rand.New(src)
+	}
+	return r.rng.Float64()
+}
+
+// randFloat returns a pseudo-random number in [0, 1) from Rand, for sampling
+// and jitter. Safe for concurrent use.
+func (l *Logger) randFloat() float64 {
+	return l.rand.float64(l.Rand)
+}
+
+// sampled reports whether an event kept with probability rate is kept.
+func (l *Logger) sampled(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	return l.randFloat() < rate
+}
+
+// jitter returns d scaled by a random factor in [1-frac, 1+frac), so periodic
+// work started together does not stay in lockstep.
+func (l *Logger) jitter(d time.Duration, frac float64) time.Duration {
+	return jitterBy(d, frac, l.randFloat)
+}
+
+// jitterBy is jitter drawing from rnd.
+func jitterBy(d time.Duration, frac float64, rnd func() float64) time.Duration {
+	if frac <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 - frac + 2*frac*rnd()))
+}
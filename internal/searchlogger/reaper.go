@@ -0,0 +1,123 @@
+package searchlogger
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"go-search-logger/internal/logging"
+)
+
+// DefaultReapInterval is the polling interval of the expired-session reaper.
+const DefaultReapInterval = 5 * time.Second
+
+// DefaultExpiryBufferSize is the default ExpiryBufferSize.
+const DefaultExpiryBufferSize = 1000
+
+func (l *Logger) expiryBufferSize() int {
+	if l.ExpiryBufferSize > 0 {
+		return l.ExpiryBufferSize
+	}
+	return DefaultExpiryBufferSize
+}
+
+func (l *Logger) reapInterval() time.Duration {
+	if l.ReapInterval > 0 {
+		return l.ReapInterval
+	}
+	return DefaultReapInterval
+}
+
+// ensureKeyspaceEvents checks that Redis publishes expired-key events and tries
+// to enable them if not. It reports whether the listener can rely on them.
+func (l *Logger) ensureKeyspaceEvents(ctx context.Context) bool {
+	cfg, err := l.Redis.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		// Without the current flags, setting them could drop ones the
+		// operator enabled, so leave them alone and poll.
+		logging.Warnf("Could not read Redis notify-keyspace-events (%v). "+
+			"Run `CONFIG SET notify-keyspace-events Ex` (or set it in your provider's parameter group). "+
+			"Falling back to polling for expired sessions every %s.", err, l.reapInterval())
+		return false
+	}
+	current := ""
+	if len(cfg) == 2 {
+		current, _ = cfg[1].(string)
+	}
+	if hasExpiredEvents(current) {
+		return true
+	}
+
+	if err := l.Redis.ConfigSet(ctx, "notify-keyspace-events", current+"Ex").Err(); err != nil {
+		logging.Warnf("Redis keyspace notifications for expired keys are disabled and could not be enabled (%v). "+
+			"Run `CONFIG SET notify-keyspace-events Ex` (or set it in your provider's parameter group). "+
+			"Falling back to polling for expired sessions every %s.", err, l.reapInterval())
+		return false
+	}
+	log.Printf("Enabled Redis keyspace notifications for expired keys")
+	return true
+}
+
+// hasExpiredEvents reports whether notify-keyspace-events flags include
+// keyevent notifications (E) for expired keys (x, or A for all events).
+func hasExpiredEvents(flags string) bool {
+	return strings.Contains(flags, "E") && strings.ContainsAny(flags, "xA")
+}
+
+// runReaper periodically flushes expired sessions until ctx is cancelled.
+func (l *Logger) runReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Started expired session reaper (interval %s)", interval)
+	l.beat()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Stopping expired session reaper")
+			return
+		case <-ticker.C:
+			l.reapExpired(ctx)
+			l.beat()
+		}
+	}
+}
+
+// reapIdle applies IdleCommit to a live session found by reapExpired, if
+// its idle key has expired.
+func (l *Logger) reapIdle(ctx context.Context, userID string) {
+	n, err := l.Redis.Exists(ctx, buildIdleKey(userID)).Result()
+	if err != nil {
+		log.Printf("Reaper: could not check idle key for userID=%s: %v", userID, err)
+		return
+	}
+	if n == 0 {
+		l.idleCommit(userID)
+	}
+}
+
+// reapExpired flushes every buffered entry whose live query has expired.
+// The buffer outlives the live key, so a buffer without one is a finished
+// session; with SingleKeySessions the buffer records the expiry itself.
+// With IdleCommit, live sessions that went idle are committed.
+func (l *Logger) reapExpired(ctx context.Context) {
+	iter := l.Redis.Scan(ctx, 0, buildBufferKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		userID := strings.TrimPrefix(iter.Val(), buildBufferKey(""))
+		live, err := l.sessionLive(ctx, userID)
+		if err != nil {
+			log.Printf("Reaper: could not check live query for userID=%s: %v", userID, err)
+			continue
+		}
+		if !live {
+			l.flushExpired(userID)
+		} else if l.idleCommitEnabled() {
+			l.reapIdle(ctx, userID)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Reaper: error scanning buffered sessions: %v", err)
+	}
+}
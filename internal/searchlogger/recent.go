@@ -0,0 +1,87 @@
+package searchlogger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RecentSearch is a search returned by RecentWithActive. Active marks the
+// session's in-progress query, which has not been committed yet.
+type RecentSearch struct {
+	SearchEntry
+	Active bool `json:"active,omitempty"`
+}
+
+// RecentWithActive returns up to limit of a user's or anon id's searches,
+// newest first: the live query, if the session is active, followed by the
+// committed history. The latest committed search is omitted if it repeats
+// the live query.
+func (l *Logger) RecentWithActive(ctx context.Context, id string, limit int) ([]RecentSearch, error) {
+	if id == "" {
+		return nil, fmt.Errorf("%w: user id is required", ErrInvalidRequest)
+	}
+	if err := validateUserID(id); err != nil {
+		return nil, err
+	}
+
+	// The id may be a user's or an anon id; a user's session comes first.
+	active, ok, err := l.activeSearch(ctx, sessionKeyID(id, ""))
+	if err == nil && !ok {
+		active, ok, err = l.activeSearch(ctx, sessionKeyID("", id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	history, err := l.RecentSearches(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]RecentSearch, 0, len(history)+1)
+	if ok {
+		res = append(res, RecentSearch{SearchEntry: active, Active: true})
+		if len(history) > 0 && history[0].Query == active.Query {
+			history = history[1:]
+		}
+	}
+	for _, entry := range history {
+		res = append(res, RecentSearch{SearchEntry: entry})
+	}
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// activeSearch returns the live query of the session with sessionKeyID id,
+// with the fields buffered for it, and whether the session is active.
+func (l *Logger) activeSearch(ctx context.Context, id string) (SearchEntry, bool, error) {
+	if l.SingleKeySessions {
+		buffered, err := l.Redis.Get(ctx, buildBufferKey(id)).Result()
+		if err != nil && err != redis.Nil {
+			return SearchEntry{}, false, redisError(err)
+		}
+		entry := decodeBuffer(buffered)
+		if !l.live(entry) {
+			return SearchEntry{}, false, nil
+		}
+		entry.LiveUntil = 0
+		return entry, true, nil
+	}
+	pipe := l.Redis.Pipeline()
+	last := pipe.Get(ctx, buildRedisKey(id))
+	buffered := pipe.Get(ctx, buildBufferKey(id))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return SearchEntry{}, false, redisError(err)
+	}
+	if last.Val() == "" {
+		return SearchEntry{}, false, nil
+	}
+	entry := decodeBuffer(buffered.Val())
+	if entry.Query == "" {
+		entry.Query = l.normalize(last.Val())
+	}
+	return entry, true, nil
+}
@@ -0,0 +1,24 @@
+package searchlogger
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// carryRefinedFrom sets entry.RefinedFrom for TrackRefinements. A session
+// that just started takes refinedFrom, the query its reset committed, if
+// any; a continuing one carries over the RefinedFrom of its buffered entry,
+// so the link survives every keystroke until the session is committed.
+func (l *Logger) carryRefinedFrom(ctx context.Context, entry *SearchEntry, bufferKey, refinedFrom string, newSession bool) error {
+	if newSession {
+		entry.RefinedFrom = refinedFrom
+		return nil
+	}
+	prev, err := l.Redis.Get(ctx, bufferKey).Result()
+	if err != nil && err != redis.Nil {
+		return redisError(err)
+	}
+	entry.RefinedFrom = decodeBuffer(prev).RefinedFrom
+	return nil
+}
@@ -0,0 +1,135 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// RenormalizeBatchSize is the number of rows examined per transaction by
+// RenormalizeExisting.
+const RenormalizeBatchSize = 1000
+
+// RenormalizeResult summarizes a RenormalizeExisting run.
+type RenormalizeResult struct {
+	Scanned int64 // rows examined
+	Updated int64 // rows whose search_text changed
+	Deleted int64 // rows whose query normalizes to nothing
+}
+
+const (
+	renormalizeSelectQuery = `SELECT s.id, COALESCE(s.search_text, t.term)
+			FROM user_searches s LEFT JOIN search_terms t ON t.id = s.term_id
+			WHERE s.id > $1 ORDER BY s.id LIMIT $2`
+	renormalizeUpdateQuery     = `UPDATE user_searches SET search_text = $1, term_id = NULL WHERE id = $2`
+	renormalizeUpdateTermQuery = `UPDATE user_searches SET term_id = $1, search_text = NULL WHERE id = $2`
+	renormalizeDeleteQuery     = `DELETE FROM user_searches WHERE id = $1`
+)
+
+// RenormalizeExisting re-applies the current normalization to every stored
+// search, so rows written before a normalization change match new ones for
+// dedup and trending. Rows that now normalize to an empty query are deleted.
+// It works through the table in id order in batches of RenormalizeBatchSize,
+// each in its own transaction, and logs progress after every batch. Running
+// it again is harmless; rows that are already normalized are left alone.
+func (l *Logger) RenormalizeExisting(ctx context.Context) (RenormalizeResult, error) {
+	var res RenormalizeResult
+	defer l.clearHistoryCache(ctx)
+	for _, db := range l.shards() {
+		if err := l.renormalizeShard(ctx, db, &res); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func (l *Logger) renormalizeShard(ctx context.Context, db *sql.DB, res *RenormalizeResult) error {
+	var lastID int64
+	for {
+		n, err := l.renormalizeBatch(ctx, db, &lastID, res)
+		if err != nil {
+			return err
+		}
+		log.Printf("Renormalize: %d rows scanned, %d updated, %d deleted", res.Scanned, res.Updated, res.Deleted)
+		if n < RenormalizeBatchSize {
+			return nil
+		}
+	}
+}
+
+// renormalizeBatch renormalizes the batch of rows after *lastID, advancing it,
+// and returns the number of rows scanned.
+func (l *Logger) renormalizeBatch(ctx context.Context, db *sql.DB, lastID *int64, res *RenormalizeResult) (int, error) {
+	type row struct {
+		id   int64
+		text string
+	}
+	rows, err := db.QueryContext(ctx, renormalizeSelectQuery, *lastID, RenormalizeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var batch []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.text); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var updated, deleted int64
+	for _, r := range batch {
+		normalized := l.normalize(r.text)
+		switch {
+		case normalized == r.text:
+		case normalized == "":
+			if _, err := tx.ExecContext(ctx, renormalizeDeleteQuery, r.id); err != nil {
+				return 0, err
+			}
+			deleted++
+		default:
+			if err := l.renormalizeRow(ctx, tx, r.id, normalized); err != nil {
+				return 0, err
+			}
+			updated++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	*lastID = batch[len(batch)-1].id
+	res.Scanned += int64(len(batch))
+	res.Updated += updated
+	res.Deleted += deleted
+	return len(batch), nil
+}
+
+// renormalizeRow stores the renormalized text of a row, as a term id if
+// TermsTable is set.
+func (l *Logger) renormalizeRow(ctx context.Context, tx *sql.Tx, id int64, text string) error {
+	if !l.TermsTable {
+		_, err := tx.ExecContext(ctx, renormalizeUpdateQuery, text, id)
+		return err
+	}
+	tid, err := termID(ctx, tx, text)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, renormalizeUpdateTermQuery, tid, id)
+	return err
+}
@@ -0,0 +1,73 @@
+package searchlogger
+
+import (
+	"strings"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
+)
+
+// isPrefixReset is the active reset classifier: a new query starts a new
+// search unless one of the two queries is a prefix of the other.
+func isPrefixReset(lastQuery, query string) bool {
+	return !strings.HasPrefix(query, lastQuery) && !strings.HasPrefix(lastQuery, query)
+}
+
+// isEditDistanceReset is an experimental classifier that tolerates small
+// edits such as typo corrections ("shoez" -> "shoes"). The shorter query is
+// compared with the same-length prefix of the longer one, so extending a
+// query is never a reset; more than maxEdits edits is.
+func isEditDistanceReset(lastQuery, query string, maxEdits int) bool {
+	a, b := []rune(lastQuery), []rune(query)
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	return editDistance(a, b[:len(a)]) > maxEdits
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// shadowClassify runs the experimental edit-distance classifier alongside
+// the default prefix classifier and records disagreements. It compares with
+// isPrefixReset rather than the request's decision, so a variant overriding
+// the classifier does not skew the count. It never changes behavior.
+func (l *Logger) shadowClassify(userID, lastQuery, query string) {
+	if l.ShadowEditDistance <= 0 || lastQuery == "" {
+		return
+	}
+	prefix := isPrefixReset(lastQuery, query)
+	if shadow := isEditDistanceReset(lastQuery, query, l.ShadowEditDistance); shadow != prefix {
+		metrics.ResetClassifierDisagreements.Add(1)
+		logging.Debugf("LogSearch: reset classifiers disagree for userID=%s, lastQuery='%s', newQuery='%s', prefix=%t, editDistance=%t",
+			userID, lastQuery, query, prefix, shadow)
+	}
+}
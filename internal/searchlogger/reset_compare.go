@@ -0,0 +1,56 @@
+package searchlogger
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ResetComparison selects which form of a query is compared with the
+// session's live query to detect resets.
+type ResetComparison int
+
+const (
+	// CompareNormalized compares normalized queries, so "Cat" -> "cat" is
+	// the same search. This is the default.
+	CompareNormalized ResetComparison = iota
+	// CompareRaw compares queries as typed, only trimmed of surrounding
+	// whitespace, so "Cat" -> "cat" is a reset. The normalized query is still
+	// what is stored, with the raw query alongside it in raw_text.
+	CompareRaw
+)
+
+// ParseResetComparison parses "normalized" or "raw".
+func ParseResetComparison(s string) (ResetComparison, error) {
+	switch s {
+	case "", "normalized":
+		return CompareNormalized, nil
+	case "raw":
+		return CompareRaw, nil
+	}
+	return CompareNormalized, fmt.Errorf("unknown reset comparison %q", s)
+}
+
+// rawQuery returns the raw form of a query stored in SearchEntry.RawQuery.
+func (l *Logger) rawQuery(query string) string {
+	if l.ResetCompare == CompareRaw {
+		return strings.TrimSpace(query)
+	}
+	return ""
+}
+
+// compareForm returns the form of a query that is kept as the session's live
+// query and compared for resets.
+func (l *Logger) compareForm(rawQuery, normalizedQuery string) string {
+	if l.ResetCompare == CompareRaw {
+		return strings.TrimSpace(rawQuery)
+	}
+	return normalizedQuery
+}
+
+// liveForm returns the live query for a buffered entry.
+func (l *Logger) liveForm(entry SearchEntry) string {
+	if l.ResetCompare == CompareRaw && entry.RawQuery != "" {
+		return entry.RawQuery
+	}
+	return entry.Query
+}
@@ -0,0 +1,86 @@
+package searchlogger
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// ResultSelection records which result a user chose after searching.
+type ResultSelection struct {
+	UserID    string `json:"user_id"`
+	UserAgent string `json:"-"`
+	AnonID    string `json:"anon_id"` // client-chosen anon id, as sent to LogSearchRequest
+	Query     string `json:"query"`
+	ResultID  string `json:"result_id"`
+	Position  int    `json:"position"` // 1-based rank of the result in the list shown
+}
+
+// insertResultQuery links the selection to the most recent committed search
+// for the same user (or anon id) and normalized query. searched_at is NULL if
+// there is no such search.
+const insertResultQuery = `INSERT INTO search_results
+			(user_id, anon_id, search_text, result_id, position, searched_at, selected_at)
+			VALUES ($1, $2, $3, $4, $5,
+				(SELECT MAX(last_searched_at) FROM user_searches
+				 WHERE (search_text = $3 OR term_id = (SELECT id FROM search_terms WHERE md5(term) = md5($3) AND term = $3))
+				 AND (user_id = $6 OR anon_id = $6)),
+				NOW())`
+
+// RecordResult stores a result selection in the search_results table.
+//
+// A user who selects a result is done with the query, so the session is
+// flushed first: the live query is committed and the selection can be
+// matched to it. If the user searched the same term several times, the
+// selection is matched to the most recent of those searches, via searched_at.
+func (l *Logger) RecordResult(ctx context.Context, sel ResultSelection) error {
+	if l.Paused() {
+		return nil
+	}
+	if err := validateUserID(sel.UserID); err != nil {
+		return err
+	}
+	if sel.AnonID != "" {
+		if err := validateUserID(sel.AnonID); err != nil {
+			return err
+		}
+	}
+	query, err := l.resultQuery(sel.Query)
+	if err != nil {
+		return err
+	}
+	if sel.ResultID == "" || sel.Position < 1 {
+		return fmt.Errorf("%w: result_id and a position of at least 1 are required", ErrInvalidQuery)
+	}
+
+	sess, err := l.resolveSession(sel.UserID, sel.UserAgent, sel.AnonID)
+	if err != nil {
+		return err
+	}
+	if err := l.FlushSession(ctx, sel.UserID, sel.UserAgent, sel.AnonID); err != nil {
+		return err
+	}
+
+	_, err = l.shardDB(sess.id).ExecContext(ctx, insertResultQuery,
+		sess.userID, sess.anonID, query, sel.ResultID, sel.Position, sess.id)
+	if err != nil {
+		log.Printf("RecordResult: error inserting result for userID=%s: %v", sess.id, err)
+		return dbError(err)
+	}
+	return nil
+}
+
+// resultQuery returns the query of a result selection as it was stored by
+// writeSearch: normalized and generalized by QueryGeneralizer. Storing it
+// otherwise would keep what generalization drops, and never match the
+// search it came from.
+func (l *Logger) resultQuery(raw string) (string, error) {
+	query := l.normalize(raw)
+	if query == "" {
+		return "", fmt.Errorf("%w: query is required", ErrInvalidQuery)
+	}
+	if err := validateQuery(query); err != nil {
+		return "", err
+	}
+	return l.generalize(SearchEntry{Query: query}).Query, nil
+}
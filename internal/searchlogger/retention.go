@@ -0,0 +1,80 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// PurgeBatchSize is the number of rows deleted per statement by PurgeOlderThan.
+const PurgeBatchSize = 5000
+
+// DefaultPurgeInterval is how often StartRetentionJob purges old rows.
+const DefaultPurgeInterval = 24 * time.Hour
+
+const purgeBatchQuery = `DELETE FROM user_searches WHERE ctid IN (
+			SELECT ctid FROM user_searches WHERE last_searched_at < $1 LIMIT $2)`
+
+// PurgeOlderThan deletes searches last searched more than d ago and returns
+// the number of rows removed. Rows are deleted in batches of PurgeBatchSize,
+// each in its own statement, so large purges never hold long-running locks.
+// With Shards, every shard is purged in turn.
+func (l *Logger) PurgeOlderThan(ctx context.Context, d time.Duration) (int64, error) {
+	cutoff := l.now().Add(-d)
+	var total int64
+	for _, db := range l.shards() {
+		n, err := purgeShard(ctx, db, cutoff)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	if total > 0 {
+		l.clearHistoryCache(ctx)
+	}
+	return total, nil
+}
+
+func purgeShard(ctx context.Context, db *sql.DB, cutoff time.Time) (int64, error) {
+	var total int64
+	for {
+		res, err := db.ExecContext(ctx, purgeBatchQuery, cutoff, PurgeBatchSize)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < PurgeBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// StartRetentionJob purges searches older than retention every interval until
+// ctx is cancelled. It purges once immediately on start.
+func (l *Logger) StartRetentionJob(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Started retention job (retention %s, interval %s)", retention, interval)
+
+	for {
+		n, err := l.PurgeOlderThan(ctx, retention)
+		if err != nil {
+			log.Printf("RetentionJob: purge failed after removing %d rows: %v", n, err)
+		} else {
+			log.Printf("RetentionJob: removed %d rows older than %s", n, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Stopping retention job")
+			return
+		case <-ticker.C:
+		}
+	}
+}
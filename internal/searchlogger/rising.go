@@ -0,0 +1,130 @@
+package searchlogger
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// risingKey is the sorted set of committed terms scored by a count in
+	// which each commit's weight halves every TrendingHalfLife. Scores are
+	// stored relative to the time in risingLandmarkKey.
+	risingKey         = "search:rising"
+	risingLandmarkKey = "search:rising:landmark"
+	// risingLastKey is the sorted set of terms scored by their last commit
+	// time, in Unix seconds.
+	risingLastKey = "search:rising:last"
+)
+
+// MaxRising is the number of terms kept for TrendingRecent; the lowest
+// scored are trimmed beyond it.
+const MaxRising = 10000
+
+// risingRescale is how many half-lives may pass before stored scores are
+// rescaled to a new landmark, keeping commit weights within float range.
+const risingRescale = 32
+
+// incrementRisingScript adds a commit of ARGV[1] at time ARGV[2] with
+// half-life ARGV[3] seconds. Rather than decaying every score over time,
+// each commit is weighted by 2^(age of the landmark in half-lives), which
+// preserves the ratios between scores; readers divide the weight back out.
+// When weights grow large, all scores are rescaled to a new landmark.
+var incrementRisingScript = redis.NewScript(`
+local now = tonumber(ARGV[2])
+local halfLife = tonumber(ARGV[3])
+local landmark = tonumber(redis.call('GET', KEYS[2]))
+if not landmark then
+	landmark = now
+	redis.call('SET', KEYS[2], ARGV[2])
+end
+local e = (now - landmark) / halfLife
+if e > tonumber(ARGV[5]) then
+	redis.call('ZUNIONSTORE', KEYS[1], 1, KEYS[1], 'WEIGHTS', tostring(2 ^ -e))
+	redis.call('SET', KEYS[2], ARGV[2])
+	e = 0
+end
+redis.call('ZINCRBY', KEYS[1], tostring(2 ^ e), ARGV[1])
+redis.call('ZADD', KEYS[3], ARGV[2], ARGV[1])
+local over = redis.call('ZCARD', KEYS[1]) - tonumber(ARGV[4])
+if over > 0 then
+	local gone = redis.call('ZRANGE', KEYS[1], 0, over - 1)
+	redis.call('ZREMRANGEBYRANK', KEYS[1], 0, over - 1)
+	redis.call('ZREM', KEYS[3], unpack(gone))
+end
+return 1
+`)
+
+// TermScore is a term with a recency-weighted commit count.
+type TermScore struct {
+	Term  string  `json:"term"`
+	Score float64 `json:"score"`
+}
+
+// unixSeconds returns t as fractional Unix seconds.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// incrementRising counts a committed term towards TrendingRecent.
+func (l *Logger) incrementRising(ctx context.Context, term string) error {
+	return incrementRisingScript.Run(ctx, l.Redis,
+		[]string{risingKey, risingLandmarkKey, risingLastKey},
+		term, strconv.FormatFloat(unixSeconds(l.now()), 'f', 3, 64),
+		l.TrendingHalfLife.Seconds(), MaxRising, risingRescale).Err()
+}
+
+// TrendingRecent returns the n terms with the highest recency-weighted
+// commit counts, each commit counting 1 when made and half as much every
+// TrendingHalfLife since, so terms searched a lot lately outrank evergreen
+// ones. With a positive window, only terms committed within it are
+// returned. It is empty unless TrendingHalfLife is set.
+func (l *Logger) TrendingRecent(ctx context.Context, n int, window time.Duration) ([]TermScore, error) {
+	if l.TrendingHalfLife <= 0 || n <= 0 {
+		return []TermScore{}, nil
+	}
+	now := l.now()
+	pipe := l.Redis.Pipeline()
+	landmark := pipe.Get(ctx, risingLandmarkKey)
+	scores := pipe.ZRevRangeWithScores(ctx, risingKey, 0, -1)
+	var recent *redis.StringSliceCmd
+	if window > 0 {
+		recent = pipe.ZRangeByScore(ctx, risingLastKey, &redis.ZRangeBy{
+			Min: strconv.FormatFloat(unixSeconds(now.Add(-window)), 'f', 3, 64),
+			Max: "+inf",
+		})
+	}
+	if _, err := pipe.Exec(ctx); err == redis.Nil {
+		return []TermScore{}, nil
+	} else if err != nil {
+		return nil, redisError(err)
+	}
+
+	lm, err := landmark.Float64()
+	if err != nil {
+		return nil, redisError(err)
+	}
+	decay := math.Exp2((unixSeconds(now) - lm) / l.TrendingHalfLife.Seconds())
+	var inWindow map[string]bool
+	if recent != nil {
+		inWindow = make(map[string]bool, len(recent.Val()))
+		for _, term := range recent.Val() {
+			inWindow[term] = true
+		}
+	}
+	terms := []TermScore{}
+	for _, z := range scores.Val() {
+		term := z.Member.(string)
+		if inWindow != nil && !inWindow[term] {
+			continue
+		}
+		terms = append(terms, TermScore{Term: term, Score: z.Score / decay})
+		if len(terms) == n {
+			break
+		}
+	}
+	return terms, nil
+}
@@ -4,10 +4,19 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -16,166 +25,1544 @@ import (
 type Logger struct {
 	Redis *redis.Client // Redis client for caching recent searches
 	DB    *sql.DB       // SQL database for persistent search logs
+
+	// Shards, if set, are the databases holding user_searches and
+	// search_results instead of DB, with each user's rows on the shard
+	// chosen by ShardKey. DB is still used for the other tables and health
+	// checks. Writes are routed to the owning shard; per-user reads query it
+	// and aggregate reads fan out to every shard. Leave empty for a single
+	// database.
+	Shards []*sql.DB
+
+	// Outbox records every committed search in the search_outbox table in
+	// the same transaction as its insert, so a Publisher run by
+	// StartOutboxRelay sees exactly the committed searches even across
+	// crashes. Only the default PostgreSQL store supports it, and batch
+	// imports bypass it.
+	Outbox bool
+
+	// OnConflict selects how inserts that violate a unique constraint on
+	// user_searches are handled; the default fails the write. ConflictTarget
+	// is the PostgreSQL conflict target, e.g. "(user_id, search_text)" or
+	// "ON CONSTRAINT user_searches_dedup"; it is required for ConflictUpsert.
+	OnConflict     ConflictMode
+	ConflictTarget string
+
+	// TermsTable stores each query as a term_id into the search_terms table
+	// instead of inline text, saving space when terms repeat. Reads resolve
+	// both forms, so it can be turned on or off at any time. Batch imports
+	// always store inline text.
+	TermsTable bool
+
+	// Store, if set, receives committed searches instead of a PostgresStore
+	// on DB, e.g. a MultiStore to write to several sinks. DB is still used
+	// for reads, batch writes and maintenance.
+	Store Store
+
+	// LinkAnonID records the User-Agent derived anon id alongside the user id
+	// for logged-in users, so post-login searches can be joined to the
+	// anonymous activity that preceded them.
+	LinkAnonID bool
+
+	// Normalizer, if set, is applied after the built-in lowercase/trim
+	// normalization, e.g. to collapse spelling variants and synonyms. Its
+	// output is what is compared for resets and stored.
+	Normalizer func(string) string
+
+	// TrimPunctuation, if set, is the set of characters trimmed from both
+	// ends of queries during normalization, before Normalizer, e.g.
+	// DefaultTrimPunctuation, so "hello?" and "hello" are one query for
+	// storage, dedup and reset detection. Internal punctuation is kept.
+	TrimPunctuation string
+
+	// ResetCompare selects whether resets are detected on normalized or raw
+	// queries. Defaults to CompareNormalized.
+	ResetCompare ResetComparison
+
+	// SessionTTL is how long a session's live query survives without a new
+	// keystroke before it is flushed. Defaults to DefaultSessionTTL.
+	SessionTTL time.Duration
+	// BufferTTL is how long the buffered entry is kept for flushing after the
+	// live query expires. Defaults to DefaultBufferTTL.
+	BufferTTL time.Duration
+
+	// ExpiryCoalesceWindow, if positive, makes the keyspace listener wait
+	// this long after an expiration to gather further expirations for the
+	// same id, then flush them once, writing the id's entries in a single
+	// transaction. Off by default.
+	ExpiryCoalesceWindow time.Duration
+	expiryCoalescer      debouncer
+
+	// ExpiryBufferSize is how many expired-key events the keyspace listener
+	// buffers while flushing. Events beyond it are dropped, counted in
+	// expiry_events_dropped_total, and recovered by a scan for expired
+	// sessions. Defaults to DefaultExpiryBufferSize.
+	ExpiryBufferSize int
+
+	// FlushTimeout bounds the flush of an expired session and FlushAll. The
+	// flushes do not use the caller's context, so shutting down does not
+	// abort them. Defaults to DefaultFlushTimeout.
+	FlushTimeout time.Duration
+
+	// ReapInterval is how often expired sessions are polled for when keyspace
+	// notifications are unavailable. Defaults to DefaultReapInterval.
+	ReapInterval time.Duration
+
+	// DailyCounts maintains per-term daily counters in Redis for every
+	// committed search. See TermCountForDay.
+	DailyCounts bool
+	// DailyCountTTL is how long daily counters are kept. Defaults to DefaultDailyCountTTL.
+	DailyCountTTL time.Duration
+	// EventStream appends every committed search to a Redis stream per UTC
+	// day, alongside the store write, as a replayable event log. See
+	// ReadEventStream and ConsumeEventStream.
+	EventStream bool
+	// EventStreamMaxLen is roughly how many searches a day's stream keeps.
+	// Defaults to DefaultEventStreamMaxLen.
+	EventStreamMaxLen int64
+	// EventStreamTTL is how long a day's stream is kept. Defaults to
+	// DefaultEventStreamTTL.
+	EventStreamTTL time.Duration
+	// TimeZone determines day boundaries for daily counters. Defaults to UTC.
+	TimeZone *time.Location
+
+	// TrackGaps counts committed searches reported with outcome no_results
+	// in a Redis leaderboard of unmet demand. See TopGaps.
+	TrackGaps bool
+
+	// TrendingHalfLife, if positive, also counts committed searches in a
+	// Redis leaderboard where each commit's weight halves every half-life,
+	// so TrendingRecent surfaces rising terms rather than evergreen ones.
+	// It costs a script call per commit. Off by default.
+	TrendingHalfLife time.Duration
+
+	// TrackRefinements stores, with the commit of a session that began by
+	// resetting the previous query, that previous committed query in the
+	// refined_from column, e.g. "shoes" on "boots", so refinement graphs can
+	// be built from the rows. It costs a Redis read per keystroke of a
+	// continuing session. Off by default.
+	TrackRefinements bool
+
+	// AnonVisitWindow, if positive, groups an anonymous user's searches into
+	// visits: searches without a pause of this long, e.g. 30 minutes, share
+	// a visit id, stored in the visit_id column, so anonymous activity can be
+	// analyzed per visit like a logged-in session. The visit id is kept in
+	// Redis with a TTL that every search slides, which costs a round trip
+	// per anonymous keystroke. Off by default.
+	AnonVisitWindow time.Duration
+
+	// MemoryGuardThreshold, if positive, is the fraction of Redis maxmemory,
+	// e.g. 0.9, past which StartMemoryGuard sheds new sessions, keeping only
+	// MemoryGuardKeep of them (default DefaultMemoryGuardKeep; negative
+	// keeps none). Sessions already live continue, so their buffers are not
+	// lost to eviction. A new session is shed even if its first request is
+	// a submit, so that search is not written.
+	MemoryGuardThreshold float64
+	MemoryGuardKeep      float64
+
+	// IdleCommit, if positive and shorter than SessionTTL, commits a
+	// session's live query once it has been unchanged for that long, without
+	// ending the session, so a long SessionTTL does not delay stable
+	// queries. If the query then changes, the new one is committed as well.
+	// It relies on the same expiry events as the session TTL. Off by
+	// default.
+	IdleCommit time.Duration
+
+	// SingleKeySessions keeps each session in one Redis key, its buffered
+	// entry, which records when the live query expires, instead of a
+	// short-lived live key next to the buffer. That halves the keys and
+	// writes per session and removes the window in which one could exist
+	// without the other. Expired sessions are then found by polling every
+	// ReapInterval instead of through expiry events, so commits on expiry
+	// are up to that much later, and the clocks of all processes sharing
+	// Redis must agree. LastQueryCacheSize has no effect with it. Off by
+	// default.
+	SingleKeySessions bool
+
+	// Sequence numbers each committed search with a per-user counter kept
+	// in Redis, stored in the seq column, so a user's searches can be put in
+	// exact order even when their timestamps collide. Numbers increase but
+	// may have gaps, e.g. for searches skipped as duplicates. Batch imports
+	// are not numbered. Off by default.
+	Sequence bool
+	// SequenceTTL, if positive, expires a user's counter after that long
+	// without a commit, after which numbering restarts at 1. By default
+	// counters are kept forever.
+	SequenceTTL time.Duration
+
+	// QueryStats stores each committed query's word count in token_count
+	// and its length in characters in char_count, for analytics that would
+	// otherwise have to parse search_text. Both columns are only written
+	// with this option, so schemas without them keep working. Off by
+	// default.
+	QueryStats bool
+
+	// DebounceInterval, if positive, coalesces each user's keystrokes so only
+	// the latest query within the interval is written to Redis. LogSearch
+	// then returns before the update is applied. Off by default.
+	DebounceInterval time.Duration
+	debouncer        debouncer
+
+	// DedupLookback, if positive, remembers each session's last DedupLookback
+	// committed terms and skips committing a term again within DedupWindow
+	// (e.g. "shoes" -> "socks" -> "shoes" commits "shoes" once).
+	DedupLookback int
+	// DedupWindow defaults to DefaultDedupWindow.
+	DedupWindow time.Duration
+
+	// DailyUserCap, if positive, caps the searches committed per user or
+	// anon id per day (in TimeZone). Further commits that day are dropped
+	// and counted in daily_user_cap_dropped_total. It bounds the rows a
+	// runaway client can add, however slowly it sends them. Unlimited by
+	// default.
+	DailyUserCap int
+
+	// MinDwell, if positive, discards a live query that a reset replaces
+	// less than MinDwell after it was set, e.g. one passed through while
+	// typing quickly, instead of committing it. Expired, flushed and
+	// submitted queries are committed as before. Off by default.
+	MinDwell time.Duration
+
+	// CommitDedupWindow, if positive, skips committing a query that the same
+	// user or anon id committed less than CommitDedupWindow ago, from any
+	// session, e.g. in a client retry loop. Unlike DedupLookback, each
+	// query's window is fixed from its commit, so a repeat after the window
+	// is always written. Off by default.
+	CommitDedupWindow time.Duration
+
+	// RedisFallback writes every search straight to the DB while Redis is
+	// unavailable, instead of failing. Searches are not collapsed by reset
+	// detection in this mode, so every keystroke becomes a row.
+	RedisFallback bool
+
+	// AnonIDRotation, if positive, rotates anon ids every period (e.g.
+	// RotateDaily) so a browser cannot be tracked indefinitely by its
+	// User-Agent hash. The cost is that anonymous activity can no longer be
+	// linked across periods: returning visitors count as new anonymous users
+	// and a session that spans a period boundary is split in two. Defaults to
+	// RotateNever, where anon ids are stable.
+	AnonIDRotation time.Duration
+	// MaxUserAgentLength caps the bytes of a User-Agent hashed into an anon
+	// id. Longer User-Agents are truncated, so padding one does not mint new
+	// anon ids, and counted in user_agents_truncated_total. Defaults to
+	// DefaultMaxUserAgentLength.
+	MaxUserAgentLength int
+
+	// ResetGrace, if positive, delays the write triggered by a reset by this
+	// long. If a keystroke within the window corrects back towards the
+	// previous query ("shoes" -> "shoex" -> "shoes"), the reset is treated
+	// as a typo and nothing is written. Zero, the default, writes at once.
+	ResetGrace time.Duration
+	resetGrace debouncer
+
+	// ShadowEditDistance, if positive, runs an experimental edit-distance
+	// reset classifier allowing that many edits alongside the prefix
+	// classifier, even for variants that override it, and counts the
+	// transitions where they disagree in the
+	// reset_classifier_disagreements_total metric. Behavior is unchanged;
+	// this only gathers data for tuning. Off by default.
+	ShadowEditDistance int
+
+	// CompletenessScorer, if set, rates how complete a normalized query
+	// looks, from 0 (clearly mid-typing) to 1. The first query of a session
+	// rated at least CompletenessThreshold is committed at once, without
+	// waiting for a reset or the TTL. The session continues: its final query
+	// is still committed on reset or expiry unless it is the same query, so
+	// "lamps" committed early and then extended to "lamps for kids" gives
+	// two rows, and returning to "lamps" gives one. See LengthCompleteness.
+	CompletenessScorer func(string) float64
+	// CompletenessThreshold defaults to DefaultCompletenessThreshold.
+	CompletenessThreshold float64
+	// PopularTermCommits, if positive, also treats a query as complete when
+	// it was committed at least that many times today and yesterday, per the
+	// DailyCounts counters, so common complete queries are captured at once.
+	// It costs a Redis read per keystroke and needs DailyCounts, here or on
+	// another instance sharing Redis. Matches count in
+	// popular_term_commits_total. Off by default.
+	PopularTermCommits int64
+
+	// TrajectoryMode records every keystroke of a session in Redis and
+	// stores them, as JSON in the trajectory column, with the session's
+	// query when it is committed on reset, expiry or flush. Meant for
+	// training autocompletion models; it costs a Redis write per keystroke
+	// and a large column per row, so it is off by default. With
+	// DebounceInterval only the debounced keystrokes are recorded.
+	TrajectoryMode bool
+	// MaxTrajectory caps the keystrokes kept per session, dropping the
+	// oldest. Defaults to DefaultMaxTrajectory.
+	MaxTrajectory int
+
+	// HistoryCacheSize, if positive, caches each user's and anon id's most
+	// recent HistoryCacheSize committed searches in Redis, so the first page
+	// of their history is served without querying the DB. A list is filled
+	// from the DB on a miss, extended on each commit, kept for
+	// HistoryCacheTTL (default DefaultHistoryCacheTTL) and dropped when rows
+	// are linked, renormalized, purged or imported. Commits then store the
+	// application's clock as last_searched_at. Off by default.
+	HistoryCacheSize int
+	HistoryCacheTTL  time.Duration
+
+	// LastQueryCacheSize, if positive, caches up to that many sessions' live
+	// queries in process memory for LastQueryCacheTTL (default
+	// DefaultLastQueryCacheTTL, at most SessionTTL), saving the Redis read
+	// on most keystrokes. It assumes sticky sessions, i.e. one process
+	// handles a user's keystrokes: each write reads back the value it
+	// replaced (SET ... GET, Redis 6.2+), and an id another process also
+	// writes is no longer cached, counted in last_query_cache_conflicts_total.
+	// Off by default.
+	LastQueryCacheSize int
+	LastQueryCacheTTL  time.Duration
+	lastQueries        lastQueryCache
+
+	// QueryGeneralizer, if set, replaces each query with a generalized form
+	// before it is stored, e.g. FirstWord, for analytics under strict data
+	// minimization. The full text stays only transiently in Redis for reset
+	// detection; the raw query and trajectory are not stored. It also
+	// applies to WriteBatch and CopyBatch imports.
+	QueryGeneralizer func(string) string
+
+	// DeadLetter parks searches the store fails to write, e.g. during a
+	// database outage, in a Redis list instead of losing them; the write then
+	// counts as done. Replay them with ReplayDeadLetters once the store is
+	// back. The list length is published as dead_letter_depth. Unique
+	// violations with ConflictError are still returned. Off by default.
+	DeadLetter bool
+
+	// TrailingSpaceCommits treats a query submitted with trailing whitespace
+	// ("cat ") as a deliberate search: it is committed immediately and the
+	// session ends. Only enable this for clients that never send trailing
+	// spaces mid-typing, since "cat " is also a prefix of "cat food".
+	TrailingSpaceCommits bool
+
+	// Variants are named sets of alternative heuristics a request can select
+	// with SearchRequest.Variant, for A/B testing the logging logic itself.
+	// The selected name is stored in the variant column of committed rows.
+	Variants map[string]Variant
+
+	// PIIMode selects whether queries containing personal data, such as
+	// email addresses or card numbers, are redacted or dropped before they
+	// reach Redis. Detected searches are counted in pii_detected_total. A
+	// live query that was a prefix of the PII is discarded, so a partially
+	// typed address is not committed either. Off by default.
+	PIIMode PIIMode
+	// PIIPatterns are the patterns PIIMode applies. Defaults to
+	// DefaultPIIPatterns; append to it to detect more kinds.
+	PIIPatterns []PIIPattern
+
+	// AllowPatterns, if non-empty, restricts logging to normalized queries
+	// matching at least one pattern; everything else is dropped. Use it where
+	// free text must not be stored, with patterns for a known term catalog.
+	AllowPatterns []*regexp.Regexp
+	// DenyPatterns drops normalized queries matching any pattern. A query
+	// matching both lists is dropped. See CompileQueryPatterns.
+	DenyPatterns []*regexp.Regexp
+
+	// EmptyUserAgent selects how anonymous requests without a User-Agent are
+	// identified. Defaults to EmptyUAShared.
+	EmptyUserAgent EmptyUserAgentMode
+	emptyUAWarning sync.Once
+
+	// AnonSessionsPerIP, if positive, caps the distinct anon ids a client IP
+	// (SearchRequest.ClientIP) may create within AnonSessionWindow, so a
+	// client rotating User-Agents cannot flood the log with anon sessions.
+	// Sessions beyond the cap are handled per AnonOverflow. Off by default.
+	AnonSessionsPerIP int
+	// AnonSessionWindow is how long an IP's anon ids are remembered after
+	// its last request. Defaults to DefaultAnonSessionWindow.
+	AnonSessionWindow time.Duration
+	// AnonOverflow defaults to AnonOverflowBucket.
+	AnonOverflow AnonOverflowMode
+
+	// IPStorage selects whether the client IP is stored with each search,
+	// raw, truncated to its network or hashed with IPSalt. Off by default;
+	// where IPs are personal data, prefer truncated or hashed.
+	IPStorage IPStorageMode
+	IPSalt    string
+
+	// UAParser, if set, derives the device, browser and OS stored with each
+	// search from its User-Agent. Parsing is best-effort; see SimpleUAParser.
+	UAParser UAParser
+
+	// BotFilter, if set, drops searches from crawler User-Agents.
+	BotFilter *BotFilter
+
+	// OnSessionStart, if set, is called when a search starts a new session,
+	// i.e. the session had no live query. Like an Emitter it runs
+	// synchronously and must not block. Starts are also counted in
+	// sessions_started_total, for comparison with commits.
+	OnSessionStart func(ctx context.Context, start SessionStart)
+
+	// Emitter, if set, receives every committed search, e.g. to export it as
+	// an OpenTelemetry log record (see internal/otellog).
+	Emitter SearchEmitter
+
+	// Enricher, if set, is called with each search right before it is
+	// written, to fill in fields the application knows after the search ran,
+	// e.g. Outcome or Extra entries such as a result count or whether a "did
+	// you mean" was shown. entry.Extra is never nil. It cannot change the
+	// user, anon id or query. It runs on the write path, once per commit
+	// attempt, so it must be fast and enforce its own timeout; if it fails,
+	// the search is stored unenriched and enrich_errors_total is incremented.
+	Enricher func(ctx context.Context, entry *SearchEntry) error
+	// commitSubs are the callbacks registered with OnCommit.
+	commitSubs commitFanout
+
+	// CaptureSearchTime records when each search was made, at the LogSearch
+	// call, and writes that as last_searched_at instead of the commit time.
+	// History then stays in the order the user searched even when writes are
+	// debounced, delayed by ResetGrace, batched or retried.
+	CaptureSearchTime bool
+
+	// Now returns the current time. Defaults to time.Now; tests may override it.
+	Now func() time.Time
+
+	// Rand is the source of randomness for sampling and jitter. Defaults to
+	// a clock-seeded source; tests may set a fixed seed to make them
+	// deterministic. It is read on first use and must not be shared.
+	Rand rand.Source
+	rand lazyRand
+
+	paused         int32 // see SetPaused
+	memoryPressure int32 // see StartMemoryGuard
+	listenerBeat   int64 // Unix nanoseconds; see ListenerHeartbeat
+}
+
+const (
+	// DefaultSessionTTL is the default lifetime of a session's live query.
+	DefaultSessionTTL = 10 * time.Second
+	// DefaultBufferTTL is the default lifetime of a session's buffered entry.
+	DefaultBufferTTL = 1 * time.Hour
+)
+
+func (l *Logger) sessionTTL() time.Duration {
+	if l.SessionTTL > 0 {
+		return l.SessionTTL
+	}
+	return DefaultSessionTTL
+}
+
+func (l *Logger) bufferTTL() time.Duration {
+	if l.BufferTTL > 0 {
+		return l.BufferTTL
+	}
+	return DefaultBufferTTL
 }
 
 // SearchEntry represents a search to be logged.
 type SearchEntry struct {
-	UserID string
-	Query  string
-	AnonID string // new field for anon id
+	UserID string `json:"user_id,omitempty"`
+	Query  string `json:"query"`
+	AnonID string `json:"anon_id,omitempty"` // new field for anon id
+
+	RawQuery string `json:"raw_query,omitempty"` // query as typed, trimmed; set with CompareRaw
+
+	// Trajectory is every keystroke of the session that led to the query,
+	// recorded with TrajectoryMode.
+	Trajectory []Keystroke `json:"trajectory,omitempty"`
+
+	// CommittedQuery is bookkeeping for buffered entries: the query the
+	// session already committed because CompletenessScorer rated it complete.
+	// It is not stored.
+	CommittedQuery string `json:"committed_query,omitempty"`
+
+	// LiveUntil is bookkeeping for buffered entries with SingleKeySessions:
+	// when the session's live query expires, in Unix milliseconds. It is not
+	// stored.
+	LiveUntil int64 `json:"live_until,omitempty"`
+
+	Timestamp time.Time `json:"timestamp"` // last_searched_at; NOW() on write if zero
+
+	Location string            `json:"location,omitempty"` // optional structured location, e.g. "Paris"
+	Extra    map[string]string `json:"extra,omitempty"`    // optional additional search fields
+	Outcome  string            `json:"outcome,omitempty"`  // optional client-reported outcome, see OutcomeSuccess
+
+	LatencyMS *int64 `json:"latency_ms,omitempty"` // optional client-reported search latency
+
+	// Device, Browser and OS are derived from the User-Agent when a
+	// UAParser is configured.
+	Device  string `json:"device,omitempty"`
+	Browser string `json:"browser,omitempty"`
+	OS      string `json:"os,omitempty"`
+
+	IP string `json:"ip,omitempty"` // client IP in the form chosen by IPStorage
+
+	// UTMSource and UTMCampaign attribute the search to the marketing
+	// campaign that brought the user, e.g. "newsletter" and "spring_sale".
+	UTMSource   string `json:"utm_source,omitempty"`
+	UTMCampaign string `json:"utm_campaign,omitempty"`
+
+	// Seq is the search's position among the user's commits, with Sequence.
+	Seq int64 `json:"seq,omitempty"`
+
+	// TokenCount and CharCount are the query's words and characters, with
+	// QueryStats.
+	TokenCount int `json:"token_count,omitempty"`
+	CharCount  int `json:"char_count,omitempty"`
+
+	// VisitID groups an anonymous user's searches made without a pause of
+	// AnonVisitWindow, with that option.
+	VisitID string `json:"visit_id,omitempty"`
+
+	// RefinedFrom is the query the user committed just before, when this
+	// search's session began by resetting it, with TrackRefinements.
+	RefinedFrom string `json:"refined_from,omitempty"`
+
+	// Variant is the Logger.Variants entry that was selected for the query.
+	Variant string `json:"variant,omitempty"`
+}
+
+// Outcomes a client can report for a search.
+const (
+	OutcomeSuccess   = "success"
+	OutcomeNoResults = "no_results"
+	OutcomeError     = "error"
+)
+
+// SearchRequest is a single keystroke/search update passed to LogSearchRequest.
+type SearchRequest struct {
+	UserID    string
+	UserAgent string
+	Query     string
+
+	// AnonID is an optional client-chosen anonymous id, e.g. a device id,
+	// used instead of the User-Agent to identify anonymous users. It is
+	// hashed before use, like the User-Agent.
+	AnonID string
+
+	// ClientIP is the client's address, used by AnonSessionsPerIP and
+	// stored per IPStorage.
+	ClientIP string
+
+	// Location and Extra are carried alongside the query and stored with
+	// whichever query is eventually committed. They do not affect reset
+	// detection.
+	Location string
+	Extra    map[string]string
+
+	// Outcome optionally reports how the downstream search went: one of
+	// OutcomeSuccess, OutcomeNoResults or OutcomeError. The latest outcome
+	// reported for a query is stored with it.
+	Outcome string
+
+	// LatencyMS optionally reports how long the search took on the client,
+	// in milliseconds, from 0 to MaxLatencyMS. Like Outcome, the latest
+	// value reported for a query is stored with it.
+	LatencyMS *int64
+
+	// UTMSource and UTMCampaign optionally attribute the search to a
+	// campaign. Like Location, they are stored with the committed query.
+	UTMSource   string
+	UTMCampaign string
+
+	// Submit marks an explicit search, e.g. the user pressed Enter, rather
+	// than a keystroke. The query is committed immediately and the session
+	// ends, regardless of reset detection and TTLs.
+	Submit bool
+
+	// Variant optionally selects one of Logger.Variants for this request.
+	// An unknown name is rejected with ErrInvalidRequest.
+	Variant string
+
+	at time.Time // when LogSearchRequest was called, with CaptureSearchTime
 }
 
 // normalizeQuery lowercases and trims the input search query.
+// Surrounding whitespace is not significant: "cat " is the same live query as
+// "cat", so it neither triggers a reset nor a commit unless
+// TrailingSpaceCommits is enabled.
 func normalizeQuery(query string) string {
 	return strings.ToLower(strings.TrimSpace(query))
 }
 
-// buildRedisKey constructs a Redis key for storing the last search of a user.
-func buildRedisKey(userID string) string {
-	return "search:last:" + userID
+// normalize applies normalizeQuery and TrimPunctuation followed by the
+// configured Normalizer.
+func (l *Logger) normalize(query string) string {
+	normalized := normalizeQuery(query)
+	if l.TrimPunctuation != "" {
+		normalized = trimPunctuation(normalized, l.TrimPunctuation)
+	}
+	if l.Normalizer != nil {
+		normalized = l.Normalizer(normalized)
+	}
+	return normalized
+}
+
+// buildRedisKey constructs a Redis key for storing the last search of a
+// session, identified by its sessionKeyID.
+func buildRedisKey(id string) string {
+	return "search:last:" + id
 }
 
-const insertQuery = `INSERT INTO user_searches (user_id, search_text, last_searched_at, anon_id)
-			VALUES ($1, $2, NOW(), $3)`
+// buildBufferKey constructs the Redis key holding the buffered entry flushed on expiry.
+func buildBufferKey(id string) string {
+	return "search:buffer:" + id
+}
+
+// Markers distinguishing user and anon sessions in sessionKeyID.
+const (
+	userKeyMarker = "user:"
+	anonKeyMarker = "anon:"
+)
+
+// sessionKeyID returns the id a session's Redis keys are built from: the
+// user id, or the anon id without one, behind a marker, so the listener can
+// tell which it was from an expired key. A logged-in user whose id starts
+// with "anon" is still a user.
+func sessionKeyID(userID, anonID string) string {
+	if userID != "" {
+		return userKeyMarker + userID
+	}
+	return anonKeyMarker + anonID
+}
+
+// parseSessionKeyID reverses sessionKeyID. Ids without a marker come from
+// keys written by older versions, which told anon ids apart by their "anon"
+// prefix alone.
+func parseSessionKeyID(id string) (userID, anonID string) {
+	switch {
+	case strings.HasPrefix(id, userKeyMarker):
+		return strings.TrimPrefix(id, userKeyMarker), ""
+	case strings.HasPrefix(id, anonKeyMarker):
+		return "", strings.TrimPrefix(id, anonKeyMarker)
+	case strings.HasPrefix(id, "anon"):
+		return "", id
+	}
+	return id, ""
+}
+
+// encodeBuffer serializes an entry for storage in the buffer key.
+func encodeBuffer(entry SearchEntry) (string, error) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeBuffer parses a buffered entry. Plain-text values written by older
+// versions are treated as the query alone.
+func decodeBuffer(val string) SearchEntry {
+	var entry SearchEntry
+	if !strings.HasPrefix(val, "{") || json.Unmarshal([]byte(val), &entry) != nil {
+		return SearchEntry{Query: val}
+	}
+	return entry
+}
+
+// buildInsert returns the INSERT statement and arguments for entry. Optional
+// columns are only included when set, so schemas that predate them keep
+// working. A zero Timestamp is written as NOW().
+func buildInsert(entry SearchEntry) (string, []interface{}) {
+	return buildInsertAs(entry, "search_text", entry.Query)
+}
+
+// buildInsertAs is buildInsert with the query stored as text in column col,
+// e.g. a term id in term_id.
+func buildInsertAs(entry SearchEntry, col string, text interface{}) (string, []interface{}) {
+	return buildInsertDialect(postgresDialect, entry, col, text)
+}
+
+// buildInsertDialect is buildInsertAs for the SQL dialect d.
+func buildInsertDialect(d dialect, entry SearchEntry, col string, text interface{}) (string, []interface{}) {
+	cols, args := insertColumns(entry, col, text)
+	placeholders := make([]string, len(args))
+	for i := range args {
+		placeholders[i] = d.placeholder(i + 1)
+	}
+	cols = append(cols, "last_searched_at")
+	if entry.Timestamp.IsZero() {
+		placeholders = append(placeholders, d.now)
+	} else {
+		args = append(args, entry.Timestamp)
+		placeholders = append(placeholders, d.placeholder(len(args)))
+	}
+
+	query := fmt.Sprintf("INSERT INTO user_searches (%s) VALUES (%s)",
+		strings.Join(cols, ", "), strings.Join(placeholders, ", "))
+	return query, args
+}
+
+// insertColumns returns the columns an insert of entry writes, other than
+// last_searched_at, and their values, with the query stored as text in col.
+// Optional columns are only included when set, so older schemas without
+// them keep working until the feature is used.
+func insertColumns(entry SearchEntry, col string, text interface{}) ([]string, []interface{}) {
+	cols := []string{"user_id", col, "anon_id"}
+	args := []interface{}{entry.UserID, text, entry.AnonID}
+	if entry.Location != "" {
+		cols = append(cols, "location")
+		args = append(args, entry.Location)
+	}
+	if len(entry.Extra) > 0 {
+		extra, _ := json.Marshal(entry.Extra)
+		cols = append(cols, "extra")
+		args = append(args, string(extra))
+	}
+	if len(entry.Trajectory) > 0 {
+		trajectory, _ := json.Marshal(entry.Trajectory)
+		cols = append(cols, "trajectory")
+		args = append(args, string(trajectory))
+	}
+	if entry.LatencyMS != nil {
+		cols = append(cols, "latency_ms")
+		args = append(args, *entry.LatencyMS)
+	}
+	if entry.Seq != 0 {
+		cols = append(cols, "seq")
+		args = append(args, entry.Seq)
+	}
+	if entry.CharCount != 0 {
+		cols = append(cols, "token_count", "char_count")
+		args = append(args, entry.TokenCount, entry.CharCount)
+	}
+	for _, c := range []struct{ col, val string }{
+		{"raw_text", entry.RawQuery},
+		{"outcome", entry.Outcome},
+		{"device", entry.Device},
+		{"browser", entry.Browser},
+		{"os", entry.OS},
+		{"ip", entry.IP},
+		{"utm_source", entry.UTMSource},
+		{"utm_campaign", entry.UTMCampaign},
+		{"refined_from", entry.RefinedFrom},
+		{"visit_id", entry.VisitID},
+		{"variant", entry.Variant},
+	} {
+		if c.val != "" {
+			cols = append(cols, c.col)
+			args = append(args, c.val)
+		}
+	}
+	return cols, args
+}
 
 // LogSearch processes and logs a user's search query.
 // It uses Redis to track the latest query and only writes to the DB when a "reset" is detected
 // or when the query is extended significantly.
 func (l *Logger) LogSearch(ctx context.Context, userID, userAgent, query string) error {
-	normalizedQuery := normalizeQuery(query)
+	return l.LogSearchRequest(ctx, SearchRequest{UserID: userID, UserAgent: userAgent, Query: query})
+}
+
+// LogSearchRequest is LogSearch with optional structured fields.
+func (l *Logger) LogSearchRequest(ctx context.Context, req SearchRequest) error {
+	if l.Paused() {
+		return nil
+	}
+	if l.CaptureSearchTime {
+		req.at = l.now()
+	}
+	userID, userAgent := req.UserID, req.UserAgent
+	if l.BotFilter.IsBot(userAgent) {
+		logging.Debugf("LogSearch: ignored bot userAgent=%q", userAgent)
+		return nil
+	}
+
+	if err := validateUserID(userID); err != nil {
+		return err
+	}
+	if err := validateUserID(req.AnonID); err != nil {
+		return err
+	}
+	// piiQuery is the query as typed if it contains PII, before redaction.
+	var piiQuery string
+	if l.PIIMode != PIIOff {
+		if scrubbed, found := l.scrubPII(req.Query); found {
+			metrics.PIIDetected.Add(1)
+			piiQuery = req.Query
+			if l.PIIMode == PIIRedact {
+				req.Query = scrubbed
+			}
+		}
+	}
+	normalizedQuery := l.normalize(req.Query)
 	if normalizedQuery == "" {
-		log.Printf("LogSearch: empty query ignored for userID=%s", userID)
+		logging.Debugf("LogSearch: empty query ignored for userID=%s", userID)
+		return nil
+	}
+	if !l.queryAllowed(normalizedQuery) {
+		logging.Debugf("LogSearch: query not allowed by patterns for userID=%s", userID)
 		return nil
 	}
+	if err := validateQuery(normalizedQuery); err != nil {
+		return err
+	}
+	if err := validateOutcome(req.Outcome); err != nil {
+		return err
+	}
+	if err := validateLatency(req.LatencyMS); err != nil {
+		return err
+	}
+	if err := validateUTM(req.UTMSource, req.UTMCampaign); err != nil {
+		return err
+	}
+	variant, err := l.variant(req.Variant)
+	if err != nil {
+		return err
+	}
 
-	isAnon := false
-	anonID := ""
-	if strings.TrimSpace(userID) == "" {
-		anonID = generateAnonID(userAgent)
-		isAnon = true
-		log.Printf("LogSearch: generated anonymous anonID=%s from userAgent", anonID)
+	sess, err := l.resolveSession(userID, userAgent, req.AnonID)
+	if err != nil {
+		return err
+	}
+	sess, err = l.limitAnonSession(ctx, sess, req.ClientIP)
+	if err != nil {
+		return err
+	}
+	if piiQuery != "" {
+		if err := l.discardPIIPrefix(ctx, sess, piiQuery); err != nil {
+			return err
+		}
+		if l.PIIMode == PIIDrop {
+			logging.Debugf("LogSearch: dropped query containing PII for userID=%s", sess.id)
+			return nil
+		}
 	}
+	trailingSpaceCommits := l.TrailingSpaceCommits || variant.TrailingSpaceCommits
+	if req.Submit || (trailingSpaceCommits && hasTrailingSpace(req.Query)) {
+		return l.commitNow(ctx, sess, normalizedQuery, req)
+	}
+	if l.DebounceInterval > 0 {
+		// Only the latest query of a burst reaches Redis. The request context
+		// ends with the request, so the deferred update gets its own.
+		l.debouncer.do(sess.key, l.DebounceInterval, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), debounceUpdateTimeout)
+			defer cancel()
+			if _, err := l.applySearch(ctx, sess, normalizedQuery, req); err != nil {
+				log.Printf("LogSearch: debounced update failed for userID=%s: %v", sess.id, err)
+			}
+		})
+		return nil
+	}
+	_, err = l.applySearch(ctx, sess, normalizedQuery, req)
+	return err
+}
+
+// applySearch updates the session with the query. If Redis is unavailable
+// and RedisFallback is enabled, the query is written straight to the DB
+// instead and committed reports true.
+func (l *Logger) applySearch(ctx context.Context, sess session, normalizedQuery string, req SearchRequest) (committed bool, err error) {
+	err = l.updateSession(ctx, sess, normalizedQuery, req)
+	if err == nil {
+		metrics.RedisFallbackActive.Set(0)
+		return false, nil
+	}
+	if !l.RedisFallback || !errors.Is(err, ErrRedisUnavailable) {
+		return false, err
+	}
+
+	if metrics.RedisFallbackActive.Value() == 0 {
+		log.Printf("LogSearch: Redis unavailable, writing searches directly to the DB: %v", err)
+	}
+	metrics.RedisFallbackActive.Set(1)
+	metrics.RedisFallbackWrites.Add(1)
+	if err := l.writeSearch(ctx, l.newEntry(sess, normalizedQuery, req)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	idForRedis := userID
-	if isAnon {
-		idForRedis = anonID
+// newEntry returns the entry recorded for a session's current query.
+func (l *Logger) newEntry(sess session, normalizedQuery string, req SearchRequest) SearchEntry {
+	device := l.parseUserAgent(req.UserAgent)
+	return SearchEntry{
+		UserID:    sess.userID,
+		Query:     normalizedQuery,
+		RawQuery:  l.rawQuery(req.Query),
+		AnonID:    sess.anonID,
+		Location:  req.Location,
+		Extra:     req.Extra,
+		Outcome:   req.Outcome,
+		LatencyMS: req.LatencyMS,
+		Device:    device.Device,
+		Browser:   device.Browser,
+		OS:        device.OS,
+		IP:        l.storedIP(req.ClientIP),
+		Timestamp: req.at,
+
+		UTMSource:   req.UTMSource,
+		UTMCampaign: req.UTMCampaign,
+		Variant:     req.Variant,
+	}
+}
+
+// hasTrailingSpace reports whether the raw query ends in whitespace.
+func hasTrailingSpace(query string) bool {
+	return strings.TrimRightFunc(query, unicode.IsSpace) != query
+}
+
+// commitNow records the query as the session's live query and then commits
+// it immediately, ending the session. A pending debounced keystroke is
+// dropped so it cannot start the session again.
+func (l *Logger) commitNow(ctx context.Context, sess session, normalizedQuery string, req SearchRequest) error {
+	l.debouncer.cancel(sess.key)
+	committed, err := l.applySearch(ctx, sess, normalizedQuery, req)
+	if err != nil || committed {
+		return err
 	}
+	return l.FlushUser(ctx, sess.userID, sess.anonID)
+}
+
+// session identifies whose live search state a request updates.
+type session struct {
+	userID string // logged-in user id, empty for anonymous users
+	anonID string // anon id, set for anonymous users and when LinkAnonID is enabled
+	id     string // user id, or anon id for anonymous users
+	key    string // id used in the session's Redis keys, see sessionKeyID
+}
+
+// resolveSession determines the session for a request, deriving an anon id
+// from the User-Agent (or the client's own anon id) when there is no user id.
+func (l *Logger) resolveSession(userID, userAgent, clientAnonID string) (session, error) {
+	if strings.TrimSpace(userID) == "" {
+		anonID, err := l.anonIDFor(userAgent, clientAnonID)
+		if err != nil {
+			return session{}, err
+		}
+		logging.Debugf("LogSearch: generated anonymous anonID=%s from userAgent", anonID)
+		return session{anonID: anonID, id: anonID, key: sessionKeyID("", anonID)}, nil
+	}
+	sess := session{userID: userID, id: userID, key: sessionKeyID(userID, "")}
+	if l.LinkAnonID {
+		// A missing or shared anon id is not worth linking.
+		if anonID, err := l.anonIDFor(userAgent, clientAnonID); err == nil && anonID != NoUserAgentAnonID {
+			sess.anonID = anonID
+		}
+	}
+	return sess, nil
+}
+
+// updateSession records the query as the session's live query, committing
+// the previous one first if the new query is a reset. The live query is the
+// normalized or raw form, per ResetCompare.
+func (l *Logger) updateSession(ctx context.Context, sess session, normalizedQuery string, req SearchRequest) error {
+	userID, anonID, idForRedis := sess.userID, sess.anonID, sess.key
 
 	redisKey := buildRedisKey(idForRedis)
-	bufferKey := "search:buffer:" + idForRedis
-	lastQuery, _ := l.Redis.Get(ctx, redisKey).Result()
+	bufferKey := buildBufferKey(idForRedis)
+	lastQuery, cached := l.cachedLastQuery(idForRedis)
+	if !cached {
+		var err error
+		lastQuery, err = l.liveQuery(ctx, idForRedis)
+		if err != nil {
+			return err
+		}
+	}
 
-	// If lastQuery is completely different from the new query, write it to the DB.
-	if lastQuery != "" &&
-		!strings.HasPrefix(normalizedQuery, lastQuery) && !strings.HasPrefix(lastQuery, normalizedQuery) {
+	// A new session adds keys; under memory pressure most are shed rather
+	// than risk evicting the buffers of live ones.
+	if lastQuery == "" && l.shedSession() {
+		logging.Debugf("LogSearch: shed new session for userID=%s under Redis memory pressure", userID)
+		return nil
+	}
 
-		log.Printf("LogSearch: detected reset for userID=%s, lastQuery='%s', newQuery='%s'", userID, lastQuery, normalizedQuery)
-		entry := SearchEntry{
-			UserID: userID,
-			Query:  lastQuery,
-			AnonID: anonID,
+	// If lastQuery is completely different from the new query, write it to the DB.
+	liveQuery := l.compareForm(req.Query, normalizedQuery)
+	reset := lastQuery != "" && l.Variants[req.Variant].isReset(lastQuery, liveQuery)
+	l.shadowClassify(userID, lastQuery, liveQuery)
+	if l.ResetGrace > 0 {
+		corrected, err := l.cancelCorrectedReset(ctx, sess, lastQuery, liveQuery)
+		if err != nil {
+			return err
+		}
+		if corrected {
+			reset = false
+		}
+	}
+	transient := reset && l.transient(ctx, idForRedis)
+	var refinedFrom string
+	if transient {
+		logging.Debugf("LogSearch: discarding transient query for userID=%s, lastQuery='%s'", userID, lastQuery)
+	} else if reset {
+		logging.Debugf("LogSearch: detected reset for userID=%s, lastQuery='%s', newQuery='%s'", userID, lastQuery, liveQuery)
+		// The buffer holds the fields that were current for lastQuery.
+		buffered, err := l.Redis.Get(ctx, bufferKey).Result()
+		if err != nil && err != redis.Nil {
+			log.Printf("LogSearch: could not retrieve buffered query for userID=%s: %v", userID, err)
+			return redisError(err)
+		}
+		entry := decodeBuffer(buffered)
+		entry.UserID = userID
+		switch {
+		case l.ResetCompare == CompareNormalized:
+			entry.Query = lastQuery
+		case entry.Query == "":
+			entry.Query = l.normalize(lastQuery)
 		}
-		if err := l.writeSearch(ctx, entry); err != nil {
+		entry.AnonID = anonID
+		entry = l.withTrajectory(ctx, idForRedis, entry)
+		if l.ResetGrace > 0 {
+			if err := l.deferReset(ctx, sess, entry); err != nil {
+				log.Printf("LogSearch: error deferring reset for userID=%s: %v", userID, err)
+				return err
+			}
+		} else if err := l.writeSearch(ctx, entry); err != nil {
 			log.Printf("LogSearch: error writing search to DB for userID=%s: %v", userID, err)
 			return err
 		}
+		refinedFrom = entry.Query
+		if l.TrajectoryMode {
+			if err := l.Redis.Del(ctx, buildTrajectoryKey(idForRedis)).Err(); err != nil {
+				return redisError(err)
+			}
+		}
+	}
+	if l.TrajectoryMode {
+		if err := l.recordKeystroke(ctx, idForRedis, req.Query); err != nil {
+			log.Printf("LogSearch: error recording keystroke for userID=%s: %v", userID, err)
+			return err
+		}
+	}
+
+	entry := l.newEntry(sess, normalizedQuery, req)
+	if l.TrackRefinements {
+		if err := l.carryRefinedFrom(ctx, &entry, bufferKey, refinedFrom, lastQuery == "" || (reset && !transient)); err != nil {
+			log.Printf("LogSearch: error reading refinement for userID=%s: %v", userID, err)
+			return err
+		}
+	}
+	if err := l.stampVisit(ctx, sess, &entry); err != nil {
+		log.Printf("LogSearch: error tracking visit for anonID=%s: %v", anonID, err)
+		return err
+	}
+	if l.CompletenessScorer != nil || l.PopularTermCommits > 0 {
+		if err := l.commitIfComplete(ctx, &entry, bufferKey, reset || lastQuery == ""); err != nil {
+			log.Printf("LogSearch: error committing complete query for userID=%s: %v", userID, err)
+			return err
+		}
+	} else if l.idleCommitEnabled() && !reset && lastQuery != "" {
+		// Keep an idle commit's mark, so the query is not written again.
+		if err := l.carryCommittedQuery(ctx, &entry, bufferKey); err != nil {
+			log.Printf("LogSearch: error reading buffered query for userID=%s: %v", userID, err)
+			return err
+		}
+	}
+	if l.SingleKeySessions {
+		entry.LiveUntil = l.now().Add(l.sessionTTL()).UnixMilli()
+	}
+	buffered, err := encodeBuffer(entry)
+	if err != nil {
+		return err
+	}
+	// The live key and buffer are set in one transaction, so a failure
+	// cannot leave a live query whose expiry finds no buffer to flush.
+	pipe := l.Redis.TxPipeline()
+	var started *redis.BoolCmd
+	var prev *redis.StatusCmd
+	switch {
+	case l.SingleKeySessions:
+		if lastQuery == "" {
+			started = pipe.SetNX(ctx, bufferKey, buffered, l.bufferTTL())
+		}
+	case lastQuery == "":
+		started = pipe.SetNX(ctx, redisKey, liveQuery, l.sessionTTL())
+	}
+	switch {
+	case l.SingleKeySessions:
+	case l.LastQueryCacheSize > 0:
+		prev = pipe.SetArgs(ctx, redisKey, liveQuery, redis.SetArgs{TTL: l.sessionTTL(), Get: true})
+	default:
+		pipe.Set(ctx, redisKey, liveQuery, l.sessionTTL())
+	}
+	pipe.Set(ctx, bufferKey, buffered, l.bufferTTL())
+	if l.idleCommitEnabled() {
+		pipe.Set(ctx, buildIdleKey(idForRedis), "", l.IdleCommit)
+	}
+	if err := execIgnoringNil(pipe.Exec(ctx)); err != nil {
+		l.forgetLastQuery(idForRedis)
+		log.Printf("LogSearch: Redis set error: key=%s bufferKey=%s err=%v", redisKey, bufferKey, err)
+		return redisError(fmt.Errorf("redis set error: %w", err))
+	}
+	expected := lastQuery
+	if started != nil && started.Val() {
+		expected = liveQuery
+		l.sessionStarted(ctx, redisKey, entry)
+	}
+	l.rememberLastQuery(idForRedis, liveQuery, expected, prev)
+	logging.Debugf("LogSearch: updated Redis and buffer with new query for redisKey=%s", redisKey)
+	return nil
+}
+
+// writeSearches commits several searches, in one transaction if the store
+// is a BatchStore.
+func (l *Logger) writeSearches(ctx context.Context, entries []SearchEntry) error {
+	var todo []SearchEntry
+	for _, entry := range entries {
+		entry = l.generalize(entry)
+		if entry.Query == "" || committedEarly(entry) || l.isRecentCommit(ctx, entry) {
+			continue
+		}
+		entry.CommittedQuery, entry.LiveUntil = "", 0
+		todo = append(todo, entry)
+	}
+	bs, ok := l.store().(BatchStore)
+	if len(todo) < 2 || !ok {
+		for _, entry := range todo {
+			if err := l.commitOrPark(ctx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	err1 := l.Redis.Set(ctx, redisKey, normalizedQuery, 10*time.Second).Err()
-	err2 := l.Redis.Set(ctx, bufferKey, normalizedQuery, 1*time.Hour).Err()
-	if err1 != nil || err2 != nil {
-		log.Printf("LogSearch: Redis set error: key=%s err1=%v, bufferKey=%s err2=%v", redisKey, err1, bufferKey, err2)
-		return fmt.Errorf("redis set error: %v %v", err1, err2)
+	var batch []SearchEntry
+	var undos []func()
+	for _, entry := range todo {
+		undo, skip := l.reserveCommit(ctx, entry)
+		if skip {
+			continue
+		}
+		batch = append(batch, l.stampSeq(ctx, l.stampQueryStats(l.stampHistory(l.enrich(ctx, entry)))))
+		undos = append(undos, undo)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := bs.WriteSearches(ctx, batch); err != nil {
+		for _, undo := range undos {
+			undo()
+		}
+		if !errors.Is(err, ErrDBWrite) {
+			err = dbError(err)
+		}
+		if l.parkDeadLetters(ctx, batch, err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range batch {
+		l.afterCommit(ctx, entry)
 	}
-	log.Printf("LogSearch: updated Redis and buffer with new query for redisKey=%s", redisKey)
 	return nil
 }
 
-// writeSearch writes the user's search query to the SQL database in a transaction.
+// writeSearch commits the user's search query to the store, generalized
+// by QueryGeneralizer. With DeadLetter, a search the store fails to write is
+// parked instead.
 func (l *Logger) writeSearch(ctx context.Context, entry SearchEntry) error {
+	return l.commitOrPark(ctx, l.generalize(entry))
+}
+
+// commitOrPark is writeSearch for an already generalized entry.
+func (l *Logger) commitOrPark(ctx context.Context, entry SearchEntry) error {
+	// Number the search before writing, so a parked one keeps its place.
+	if entry.Query != "" {
+		entry = l.stampSeq(ctx, entry)
+	}
+	err := l.commit(ctx, entry)
+	if err != nil && l.parkDeadLetters(ctx, []SearchEntry{entry}, err) {
+		return nil
+	}
+	return err
+}
+
+// commit is writeSearch without dead-lettering.
+func (l *Logger) commit(ctx context.Context, entry SearchEntry) error {
 	if entry.Query == "" {
-		log.Printf("writeSearch: empty query for userID=%s, skipping write", entry.UserID)
+		logging.Debugf("writeSearch: empty query for userID=%s, skipping write", entry.UserID)
 		return nil
 	}
-	tx, err := l.DB.BeginTx(ctx, nil)
-	if err != nil {
-		log.Printf("writeSearch: error starting transaction for userID=%s: %v", entry.UserID, err)
+	if committedEarly(entry) {
+		logging.Debugf("writeSearch: query='%s' already committed as complete for userID=%s, skipping write", entry.Query, entrySessionID(entry))
+		return nil
+	}
+	entry.CommittedQuery, entry.LiveUntil = "", 0
+	if l.isRecentCommit(ctx, entry) {
+		logging.Debugf("writeSearch: query='%s' recently committed for userID=%s, skipping write", entry.Query, entrySessionID(entry))
+		return nil
+	}
+	undo, skip := l.reserveCommit(ctx, entry)
+	if skip {
+		return nil
+	}
+	entry = l.stampQueryStats(l.stampHistory(l.enrich(ctx, entry)))
+	if err := l.storeWrite(ctx, entry); err != nil {
+		undo()
 		return err
 	}
-	defer func() {
-		if p := recover(); p != nil {
-			tx.Rollback()
-			log.Printf("writeSearch: panic recovered for userID=%s: %v", entry.UserID, p)
-			panic(p)
+	logging.Debugf("writeSearch: successfully logged search for userID=%s, query='%s'", entry.UserID, entry.Query)
+	l.afterCommit(ctx, entry)
+	return nil
+}
+
+// afterCommit runs the side effects of a search being committed to the DB.
+// Failures are logged and never undo the commit.
+func (l *Logger) afterCommit(ctx context.Context, entry SearchEntry) {
+	if l.DedupLookback > 0 {
+		if err := l.rememberCommit(ctx, entry); err != nil {
+			log.Printf("afterCommit: failed to remember commit for userID=%s: %v", entrySessionID(entry), err)
+		}
+	}
+	if l.DailyCounts {
+		if err := l.incrementDailyCount(ctx, entry.Query); err != nil {
+			log.Printf("afterCommit: failed to increment daily count for query='%s': %v", entry.Query, err)
+		}
+	}
+	if l.EventStream {
+		if err := l.appendEventStream(ctx, entry); err != nil {
+			log.Printf("afterCommit: failed to append query='%s' to the event stream: %v", entry.Query, err)
 		}
-	}()
+	}
+	if l.TrackGaps && entry.Outcome == OutcomeNoResults {
+		if err := l.incrementGap(ctx, entry.Query); err != nil {
+			log.Printf("afterCommit: failed to count zero-result query='%s': %v", entry.Query, err)
+		}
+	}
+	if l.TrendingHalfLife > 0 {
+		if err := l.incrementRising(ctx, entry.Query); err != nil {
+			log.Printf("afterCommit: failed to count rising query='%s': %v", entry.Query, err)
+		}
+	}
+	if l.HistoryCacheSize > 0 {
+		l.cacheHistory(ctx, entry)
+	}
+	if l.Emitter != nil {
+		l.Emitter.EmitSearch(ctx, entry)
+	}
+	l.publishCommit(entry)
+}
+
+// now returns the current time from the configured clock.
+func (l *Logger) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// FlushUser writes the buffered search for userID (or anonID when userID is
+// empty) to the DB immediately and ends the session, instead of waiting for
+// the TTL to expire.
+func (l *Logger) FlushUser(ctx context.Context, userID string, anonID string) error {
+	return l.flushSessionKey(ctx, sessionKeyID(userID, anonID))
+}
+
+// flushSessionKey is FlushUser for the session with key id id.
+func (l *Logger) flushSessionKey(ctx context.Context, id string) error {
+	if l.Paused() {
+		return nil
+	}
+	bufferKey := buildBufferKey(id)
 
-	args := []interface{}{entry.UserID, entry.Query, entry.AnonID}
-	_, err = tx.ExecContext(ctx, insertQuery, args...)
+	if l.ResetGrace > 0 {
+		if err := l.commitPending(ctx, id); err != nil {
+			log.Printf("FlushUser: failed to write pending reset for userID=%s: %v", id, err)
+			return err
+		}
+	}
+	buffered, err := l.Redis.Get(ctx, bufferKey).Result()
+	if err == redis.Nil {
+		return nil
+	}
 	if err != nil {
-		tx.Rollback()
-		log.Printf("writeSearch: error inserting query for userID=%s: %v", entry.UserID, err)
+		log.Printf("FlushUser: could not retrieve buffered query for userID=%s: %v", id, err)
+		return redisError(err)
+	}
+
+	entry := decodeBuffer(buffered)
+	if entry.UserID == "" && entry.AnonID == "" {
+		entry.UserID, entry.AnonID = parseSessionKeyID(id)
+	}
+	if err := l.writeSearch(ctx, l.withTrajectory(ctx, id, entry)); err != nil {
+		log.Printf("FlushUser: failed to write search to DB for userID=%s: %v", id, err)
 		return err
 	}
+	// Deleting the live key does not publish an expired event, so the
+	// listener will not write the same query again.
+	l.forgetLastQuery(id)
+	if err := l.Redis.Del(ctx, buildRedisKey(id), bufferKey, buildTrajectoryKey(id)).Err(); err != nil {
+		log.Printf("FlushUser: failed to delete session keys for userID=%s: %v", id, err)
+		return redisError(err)
+	}
+	logging.Debugf("FlushUser: flushed buffered query for userID=%s", id)
+	return nil
+}
+
+// FlushSession flushes the session identified the same way as
+// LogSearchRequest: by userID, or for anonymous users by clientAnonID if
+// set, else by the anon id derived from userAgent. Anonymous requests that
+// LogSearchRequest would reject have nothing to flush.
+func (l *Logger) FlushSession(ctx context.Context, userID, userAgent, clientAnonID string) error {
+	sess, err := l.resolveSession(userID, userAgent, clientAnonID)
+	if err != nil {
+		return nil
+	}
+	if sess.userID == "" {
+		return l.FlushUser(ctx, "", sess.anonID)
+	}
+	return l.FlushUser(ctx, sess.userID, "")
+}
 
-	if err := tx.Commit(); err != nil {
-		log.Printf("writeSearch: error committing transaction for userID=%s: %v", entry.UserID, err)
+// ClearSession abandons the session identified the same way as
+// LogSearchRequest, e.g. because the user cleared the search box: its live
+// query, buffered entry, pending reset and trajectory are deleted without
+// being committed, and a debounced keystroke is dropped. Clearing a session
+// that does not exist is not an error.
+func (l *Logger) ClearSession(ctx context.Context, userID, userAgent, clientAnonID string) error {
+	if err := validateUserID(userID); err != nil {
+		return err
+	}
+	if clientAnonID != "" {
+		if err := validateUserID(clientAnonID); err != nil {
+			return err
+		}
+	}
+	sess, err := l.resolveSession(userID, userAgent, clientAnonID)
+	if err != nil {
 		return err
 	}
-	log.Printf("writeSearch: successfully logged search for userID=%s, query='%s'", entry.UserID, entry.Query)
+
+	l.debouncer.cancel(sess.key)
+	l.forgetLastQuery(sess.key)
+	// Deleting the live key does not publish an expired event, so nothing is
+	// flushed.
+	err = l.Redis.Del(ctx, buildRedisKey(sess.key), buildBufferKey(sess.key),
+		buildPendingKey(sess.key), buildTrajectoryKey(sess.key)).Err()
+	if err != nil {
+		log.Printf("ClearSession: failed to delete session keys for userID=%s: %v", sess.id, err)
+		return redisError(err)
+	}
+	logging.Debugf("ClearSession: cleared session for userID=%s", sess.id)
 	return nil
 }
 
+// EndSession commits the live query of the session identified the same way
+// as LogSearchRequest and ends the session, e.g. because the search box lost
+// focus. A debounced keystroke is applied first, so the query committed is
+// the last one typed. The next search starts a new session. Ending a session
+// that does not exist is not an error.
+func (l *Logger) EndSession(ctx context.Context, userID, userAgent, clientAnonID string) error {
+	if l.Paused() {
+		return nil
+	}
+	if err := validateUserID(userID); err != nil {
+		return err
+	}
+	if clientAnonID != "" {
+		if err := validateUserID(clientAnonID); err != nil {
+			return err
+		}
+	}
+	sess, err := l.resolveSession(userID, userAgent, clientAnonID)
+	if err != nil {
+		return err
+	}
+
+	if pending := l.debouncer.take(sess.key); pending != nil {
+		pending()
+	}
+	if sess.userID == "" {
+		return l.FlushUser(ctx, "", sess.anonID)
+	}
+	return l.FlushUser(ctx, sess.userID, "")
+}
+
 // generateAnonID generates a stable anonymous ID from the User-Agent string.
 func generateAnonID(userAgent string) string {
 	return "anon" + fmt.Sprintf("%x", sha256.Sum256([]byte(userAgent)))
 }
 
 // StartKeyspaceListener listens to Redis key expiry events and flushes expired queries to the DB.
+// If keyspace notifications are not enabled and cannot be enabled (CONFIG SET is
+// often disabled on managed Redis), it falls back to polling for expired sessions.
 func (l *Logger) StartKeyspaceListener(ctx context.Context) {
+	if l.SingleKeySessions {
+		// No key expires when a session does.
+		l.runReaper(ctx, l.reapInterval())
+		return
+	}
+	if !l.ensureKeyspaceEvents(ctx) {
+		l.runReaper(ctx, l.reapInterval())
+		return
+	}
+
 	pubsub := l.Redis.PSubscribe(ctx, "__keyevent@0__:expired")
 	defer pubsub.Close()
-	ch := pubsub.Channel()
+	ch := make(chan string, l.expiryBufferSize())
+	reconcile := make(chan struct{}, 1)
+	go l.receiveExpired(ctx, pubsub, ch, reconcile)
 
 	log.Println("Started Redis keyspace listener")
+	l.beat()
+	heartbeat := time.NewTicker(listenerHeartbeatInterval)
+	defer heartbeat.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("Stopping keyspace listener")
-			return
-		case msg := <-ch:
-			expiredKey := msg.Payload
-			if !strings.HasPrefix(expiredKey, "search:last:") {
-				continue
+			// Handle the events already received, so sessions that expired
+			// before shutdown are still written.
+			for {
+				select {
+				case expiredKey := <-ch:
+					l.handleExpiredKey(expiredKey)
+				default:
+					return
+				}
 			}
-
-			userID := strings.TrimPrefix(expiredKey, "search:last:")
-			bufferKey := "search:buffer:" + userID
-
-			query, err := l.Redis.Get(ctx, bufferKey).Result()
-			if err != nil {
-				log.Printf("KeyspaceListener: could not retrieve buffered query for userID=%s: %v", userID, err)
+		case <-heartbeat.C:
+			// A ping that cannot be written means the subscription is gone.
+			if err := pubsub.Ping(ctx); err != nil {
+				logging.Warnf("KeyspaceListener: heartbeat ping failed: %v", err)
 				continue
 			}
+			l.beat()
+		case <-reconcile:
+			// Events were lost, so find their sessions the way the reaper does.
+			l.reapExpired(ctx)
+		case expiredKey := <-ch:
+			l.handleExpiredKey(expiredKey)
+		}
+	}
+}
 
-			isAnon := strings.HasPrefix(userID, "anon") // robust check for anon ID
-			entry := SearchEntry{
-				UserID: "",
-				Query:  query,
-				AnonID: "",
-			}
-			if isAnon {
-				entry.AnonID = userID
-			} else {
-				entry.UserID = userID
-			}
-			if err := l.writeSearch(ctx, entry); err != nil {
-				log.Printf("KeyspaceListener: failed to write search to DB for userID=%s: %v", userID, err)
-				continue
+// receiveExpired reads expired-key events into ch until ctx is cancelled.
+// go-redis's own channel drops events silently when it is full; here a full
+// ch, or a lost connection, counts the loss and requests a reconcile scan.
+func (l *Logger) receiveExpired(ctx context.Context, pubsub *redis.PubSub, ch chan<- string, reconcile chan<- struct{}) {
+	requestReconcile := func() {
+		select {
+		case reconcile <- struct{}{}:
+		default: // one is already pending
+		}
+	}
+	for {
+		msg, err := pubsub.ReceiveMessage(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("KeyspaceListener: receive error, reconciling after reconnect: %v", err)
+			requestReconcile()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
 			}
-			_ = l.Redis.Del(ctx, bufferKey).Err()
-			log.Printf("KeyspaceListener: flushed expired query for userID=%s", userID)
+			continue
+		}
+		select {
+		case ch <- msg.Payload:
+		default:
+			metrics.ExpiryEventsDropped.Add(1)
+			requestReconcile()
+		}
+	}
+}
+
+// handleExpired flushes an expired session, coalescing repeated expirations
+// for the same id within ExpiryCoalesceWindow into a single flush.
+func (l *Logger) handleExpired(id string) {
+	if l.ExpiryCoalesceWindow <= 0 {
+		l.flushExpired(id)
+		return
+	}
+	l.expiryCoalescer.do(id, l.ExpiryCoalesceWindow, func() {
+		l.flushExpired(id)
+	})
+}
+
+// FlushPending runs the expiry flushes waiting out ExpiryCoalesceWindow and
+// the reset entries held for ResetGrace now, and waits for those already
+// running. Shutdown calls it after stopping the keyspace listener, so no
+// session expired or reset before exit is left unwritten.
+func (l *Logger) FlushPending() {
+	l.expiryCoalescer.flush()
+	l.resetGrace.flush()
+}
+
+// bufferGetRetries is how many times claiming an expired session's buffer is
+// retried after a Redis error, first after bufferRetryDelay and then doubling.
+const (
+	bufferGetRetries = 2
+	bufferRetryDelay = 100 * time.Millisecond
+)
+
+// claimBuffer takes a buffered entry with GETDEL, retrying Redis errors, so
+// only one of the listener, the reaper and other instances writes it.
+// redis.Nil, a missing or already claimed buffer, is returned at once since
+// retrying cannot change it.
+func (l *Logger) claimBuffer(ctx context.Context, bufferKey string) (string, error) {
+	delay := bufferRetryDelay
+	for attempt := 0; ; attempt++ {
+		buffered, err := l.Redis.GetDel(ctx, bufferKey).Result()
+		if err == nil || err == redis.Nil || attempt == bufferGetRetries {
+			return buffered, err
+		}
+		logging.Debugf("KeyspaceListener: retrying read of %s in %v: %v", bufferKey, delay, err)
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// flushExpired writes the buffered entry of a session whose live key has
+// expired, together with any entry pending under ResetGrace, in one
+// transaction when the store supports it. The buffer is claimed before it is
+// written and put back if the write fails; with SingleKeySessions nothing is
+// claimed if the session is still live. It runs under flushContext.
+func (l *Logger) flushExpired(id string) {
+	if l.Paused() {
+		// Left in Redis for the scan on resume.
+		return
+	}
+	ctx, cancel := l.flushContext()
+	defer cancel()
+
+	var buffered string
+	var err error
+	if l.SingleKeySessions {
+		buffered, err = l.claimExpired(ctx, id)
+		if err == errSessionLive {
+			return
+		}
+	}
+	l.forgetLastQuery(id)
+
+	var entries []SearchEntry
+	if l.ResetGrace > 0 {
+		pending, err := l.Redis.GetDel(ctx, buildPendingKey(id)).Result()
+		if err == nil {
+			entries = append(entries, decodeBuffer(pending))
+		} else if err != redis.Nil {
+			log.Printf("KeyspaceListener: could not retrieve pending reset for userID=%s: %v", id, err)
+		}
+	}
+	if !l.SingleKeySessions {
+		buffered, err = l.claimBuffer(ctx, buildBufferKey(id))
+	}
+	switch {
+	case err == redis.Nil:
+		// The live key and buffer are written together, so this only
+		// happens if the session was already flushed (possibly by another
+		// instance or the reaper) or linked, the buffer
+		// was evicted, or an older version set them separately. There is
+		// nothing to flush.
+		metrics.BuffersMissing.Add(1)
+		logging.Debugf("KeyspaceListener: no buffered query for userID=%s", id)
+	case err != nil:
+		log.Printf("KeyspaceListener: could not retrieve buffered query for userID=%s after %d retries, leaving it buffered: %v", id, bufferGetRetries, err)
+	default:
+		entry := decodeBuffer(buffered)
+		if entry.UserID == "" && entry.AnonID == "" {
+			entry.UserID, entry.AnonID = parseSessionKeyID(id)
+		}
+		entries = append(entries, l.withTrajectory(ctx, id, entry))
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if err := l.writeSearches(ctx, entries); err != nil {
+		log.Printf("KeyspaceListener: failed to write search to DB for userID=%s: %v", id, err)
+		if buffered != "" {
+			l.unclaim(ctx, id, buffered)
 		}
+		return
 	}
+	// The claimed buffer is gone; the key may hold a new session now.
+	_ = l.Redis.Del(ctx, buildTrajectoryKey(id)).Err()
+	logging.Debugf("KeyspaceListener: flushed expired query for userID=%s", id)
 }
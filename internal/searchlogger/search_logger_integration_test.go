@@ -0,0 +1,530 @@
+//go:build integration
+
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// setupLogger initializes a Logger with test DB and Redis, and cleans up test data.
+func setupLogger(t testing.TB) *Logger {
+	t.Helper()
+
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatalf("DB error: %v", err)
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: redisURL})
+
+	// Clean up test data from previous runs
+	db.Exec(`DELETE FROM user_searches WHERE user_id LIKE 'test-%' OR user_id = 'user123'`)
+	rdb.FlushAll(context.Background())
+
+	return &Logger{DB: db, Redis: rdb}
+}
+
+// getLatestQuery fetches the most recent search_text for a user from the DB.
+func getLatestQuery(t *testing.T, logger *Logger, userID string) string {
+	var query string
+	var err error
+	if userID == "" {
+		t.Fatal("userID must not be empty")
+	}
+	// If userID looks like an anonID, check for both user_id and anon_id columns
+	err = logger.DB.QueryRow(`
+		SELECT search_text FROM user_searches 
+		WHERE (user_id = $1 OR anon_id = $1) 
+		ORDER BY last_searched_at DESC
+	`, userID).Scan(&query)
+	if err != nil {
+		t.Fatalf("DB read error: %v", err)
+	}
+	return query
+}
+
+func TestPurgeOlderThan(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	userID := "test-purge"
+
+	old := SearchEntry{UserID: userID, Query: "old", Timestamp: time.Now().Add(-48 * time.Hour)}
+	recent := SearchEntry{UserID: userID, Query: "recent", Timestamp: time.Now()}
+	if err := logger.WriteBatch(ctx, []SearchEntry{old, recent}); err != nil {
+		t.Fatalf("WriteBatch error: %v", err)
+	}
+
+	n, err := logger.PurgeOlderThan(ctx, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("PurgeOlderThan error: %v", err)
+	}
+	if n < 1 {
+		t.Errorf("expected at least 1 row removed, got %d", n)
+	}
+	if got := getLatestQuery(t, logger, userID); got != "recent" {
+		t.Errorf("expected 'recent' to survive the purge, got '%s'", got)
+	}
+}
+
+func TestSnapshotDailyCounts_WritesAndOverwritesDay(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	day := time.Date(2001, 2, 3, 12, 0, 0, 0, time.UTC)
+	logger.Now = func() time.Time { return day }
+	logger.DB.Exec(`DELETE FROM search_term_daily_counts WHERE day = '2001-02-03'`)
+	t.Cleanup(func() { logger.DB.Exec(`DELETE FROM search_term_daily_counts WHERE day = '2001-02-03'`) })
+
+	for _, term := range []string{"shoes", "shoes", "lamps"} {
+		if err := logger.incrementDailyCount(ctx, term); err != nil {
+			t.Fatalf("incrementDailyCount error: %v", err)
+		}
+	}
+	storedCount := func(term string) int64 {
+		var n int64
+		if err := logger.DB.QueryRow(`SELECT count FROM search_term_daily_counts WHERE day = '2001-02-03' AND term = $1`, term).Scan(&n); err != nil {
+			t.Fatalf("DB read error for %q: %v", term, err)
+		}
+		return n
+	}
+
+	n, err := logger.SnapshotDailyCounts(ctx, day)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 terms snapshotted, got %d, err=%v", n, err)
+	}
+	if got := storedCount("shoes"); got != 2 {
+		t.Errorf("expected 2 for 'shoes', got %d", got)
+	}
+
+	// A later snapshot of the same day replaces the counts.
+	_ = logger.incrementDailyCount(ctx, "shoes")
+	if _, err := logger.SnapshotDailyCounts(ctx, day); err != nil {
+		t.Fatalf("SnapshotDailyCounts error: %v", err)
+	}
+	if got := storedCount("shoes"); got != 3 {
+		t.Errorf("expected the second snapshot to overwrite 'shoes' with 3, got %d", got)
+	}
+	if got := storedCount("lamps"); got != 1 {
+		t.Errorf("expected 1 for 'lamps', got %d", got)
+	}
+}
+
+func TestRecordResult_LinksLatestSearch(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	userID := "test-result"
+	logger.DB.Exec(`DELETE FROM search_results WHERE user_id = $1`, userID)
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoes")
+	err := logger.RecordResult(ctx, ResultSelection{UserID: userID, Query: "Shoes", ResultID: "sku-42", Position: 3})
+	if err != nil {
+		t.Fatalf("RecordResult error: %v", err)
+	}
+
+	// Selecting a result commits the live query.
+	if got := getLatestQuery(t, logger, userID); got != "shoes" {
+		t.Errorf("expected 'shoes' to be committed, got '%s'", got)
+	}
+	var resultID string
+	var position int
+	var searchedAt sql.NullTime
+	err = logger.DB.QueryRow(`SELECT result_id, position, searched_at FROM search_results WHERE user_id = $1`, userID).
+		Scan(&resultID, &position, &searchedAt)
+	if err != nil {
+		t.Fatalf("DB read error: %v", err)
+	}
+	if resultID != "sku-42" || position != 3 || !searchedAt.Valid {
+		t.Errorf("unexpected result row: %s %d %v", resultID, position, searchedAt)
+	}
+}
+
+func TestSearchesForUsers(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	since := time.Now().Add(-time.Hour)
+
+	err := logger.WriteBatch(ctx, []SearchEntry{
+		{UserID: "bulk-a", Query: "apples"},
+		{UserID: "bulk-b", Query: "bananas"},
+		{UserID: "bulk-c", Query: "cherries"},
+		{UserID: "bulk-a", Query: "old", Timestamp: since.Add(-time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+
+	entries, err := logger.SearchesForUsers(ctx, []string{"bulk-a", "bulk-b"}, since)
+	if err != nil {
+		t.Fatalf("SearchesForUsers: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.UserID+":"+e.Query)
+	}
+	if strings.Join(got, ",") != "bulk-a:apples,bulk-b:bananas" {
+		t.Errorf("unexpected entries: %v", got)
+	}
+}
+
+func TestCopyBatch(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	err := logger.CopyBatch(ctx, []SearchEntry{
+		{UserID: "test-copy", Query: "  Red Shoes ", Timestamp: ts, Location: "US", Extra: map[string]string{"page": "home"}},
+		{UserID: "test-copy", Query: "   "},
+	})
+	if err != nil {
+		t.Fatalf("CopyBatch: %v", err)
+	}
+
+	var query, location, extra string
+	var at time.Time
+	err = logger.DB.QueryRow(`SELECT search_text, location, extra::text, last_searched_at
+		FROM user_searches WHERE user_id = 'test-copy'`).Scan(&query, &location, &extra, &at)
+	if err != nil {
+		t.Fatalf("DB read error: %v", err)
+	}
+	if query != "red shoes" || location != "US" || extra != `{"page": "home"}` || !at.Equal(ts) {
+		t.Errorf("unexpected row: %q %q %q %v", query, location, extra, at)
+	}
+}
+
+func benchmarkBatch(b *testing.B, write func(*Logger) func(context.Context, []SearchEntry) error) {
+	ctx := context.Background()
+	logger := setupLogger(b)
+	entries := make([]SearchEntry, 1000)
+	for i := range entries {
+		entries[i] = SearchEntry{UserID: "test-bench", Query: fmt.Sprintf("query %d", i)}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := write(logger)(ctx, entries); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	benchmarkBatch(b, func(l *Logger) func(context.Context, []SearchEntry) error { return l.WriteBatch })
+}
+
+func BenchmarkCopyBatch(b *testing.B) {
+	benchmarkBatch(b, func(l *Logger) func(context.Context, []SearchEntry) error { return l.CopyBatch })
+}
+
+func TestRecentSearchesPage_Cursor(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	userID := "test-paging"
+	base := time.Now().Add(-time.Hour)
+
+	_ = logger.WriteBatch(ctx, []SearchEntry{
+		{UserID: userID, Query: "first", Timestamp: base},
+		{UserID: userID, Query: "second", Timestamp: base.Add(time.Minute)},
+		{UserID: userID, Query: "third", Timestamp: base.Add(2 * time.Minute)},
+	})
+
+	page1, next, err := logger.RecentSearchesPage(ctx, userID, Page{Limit: 2})
+	if err != nil || len(page1) != 2 || page1[0].Query != "third" || next == nil {
+		t.Fatalf("unexpected first page: %v, next=%v, err=%v", page1, next, err)
+	}
+	cursor, err := ParseCursor(next.String())
+	if err != nil {
+		t.Fatalf("ParseCursor error: %v", err)
+	}
+	page2, next, err := logger.RecentSearchesPage(ctx, userID, Page{Limit: 2, Cursor: cursor})
+	if err != nil || len(page2) != 1 || page2[0].Query != "first" || next != nil {
+		t.Errorf("unexpected second page: %v, next=%v, err=%v", page2, next, err)
+	}
+}
+
+func TestRecentWithActive_MergesLiveQuery(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	userID := "test-recent"
+	base := time.Now().Add(-time.Hour)
+
+	_ = logger.WriteBatch(ctx, []SearchEntry{
+		{UserID: userID, Query: "socks", Timestamp: base},
+		{UserID: userID, Query: "shoes", Timestamp: base.Add(time.Minute)},
+	})
+	if err := logger.LogSearch(ctx, userID, "TestAgent", "Shoes"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+
+	recent, err := logger.RecentWithActive(ctx, userID, 10)
+	if err != nil {
+		t.Fatalf("RecentWithActive error: %v", err)
+	}
+	if len(recent) != 2 || !recent[0].Active || recent[0].Query != "shoes" ||
+		recent[1].Active || recent[1].Query != "socks" {
+		t.Errorf("expected active 'shoes' then 'socks', got %+v", recent)
+	}
+}
+
+func TestRenormalizeExisting(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	userID := "test-renormalize"
+
+	_, err := logger.DB.Exec(`INSERT INTO user_searches (user_id, search_text) VALUES
+		($1, ' Red Shoes'), ($1, 'socks'), ($1, '   ')`, userID)
+	if err != nil {
+		t.Fatalf("insert error: %v", err)
+	}
+
+	res, err := logger.RenormalizeExisting(ctx)
+	if err != nil {
+		t.Fatalf("RenormalizeExisting error: %v", err)
+	}
+	if res.Updated < 1 || res.Deleted < 1 {
+		t.Errorf("expected updates and deletes, got %+v", res)
+	}
+
+	rows, err := logger.DB.Query(`SELECT search_text FROM user_searches WHERE user_id = $1 ORDER BY search_text`, userID)
+	if err != nil {
+		t.Fatalf("DB read error: %v", err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var q string
+		rows.Scan(&q)
+		got = append(got, q)
+	}
+	if strings.Join(got, ",") != "red shoes,socks" {
+		t.Errorf("unexpected rows after renormalizing: %v", got)
+	}
+}
+
+// fakePublisher records published messages and fails when failAt is reached.
+type fakePublisher struct {
+	published []OutboxMessage
+	failAt    int
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, msg OutboxMessage) error {
+	if p.failAt > 0 && len(p.published)+1 == p.failAt {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, msg)
+	return nil
+}
+
+func TestOutbox_RelayPublishesInOrderAndResumes(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	logger.DB.Exec(`DELETE FROM search_outbox`)
+	logger.Outbox = true
+	userID := "test-outbox"
+
+	for _, q := range []string{"one", "two", "three"} {
+		if err := logger.writeSearch(ctx, SearchEntry{UserID: userID, Query: q}); err != nil {
+			t.Fatalf("writeSearch error: %v", err)
+		}
+	}
+
+	pub := &fakePublisher{failAt: 2}
+	n, err := logger.RelayOutbox(ctx, pub)
+	if err == nil || n != 1 {
+		t.Fatalf("expected 1 message published before the error, got %d, %v", n, err)
+	}
+
+	pub.failAt = 0
+	if n, err := logger.RelayOutbox(ctx, pub); err != nil || n != 2 {
+		t.Fatalf("expected the remaining 2 messages on retry, got %d, %v", n, err)
+	}
+	if n, _ := logger.RelayOutbox(ctx, pub); n != 0 {
+		t.Errorf("expected nothing left to publish, got %d", n)
+	}
+
+	var got []string
+	for _, msg := range pub.published {
+		var entry SearchEntry
+		json.Unmarshal(msg.Payload, &entry)
+		if msg.Key != userID {
+			t.Errorf("expected key %q, got %q", userID, msg.Key)
+		}
+		got = append(got, entry.Query)
+	}
+	if strings.Join(got, ",") != "one,two,three" {
+		t.Errorf("expected messages in commit order, got %v", got)
+	}
+}
+
+func TestLinkAnonToUser_AttributesHistoryAndSession(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	ua := "LinkAgent"
+	anonID := generateAnonID(ua)
+	userID := "test-link"
+
+	_ = logger.LogSearch(ctx, "", ua, "old query")
+	if err := logger.FlushUser(ctx, "", anonID); err != nil {
+		t.Fatalf("FlushUser error: %v", err)
+	}
+	_ = logger.LogSearch(ctx, "", ua, "live query")
+
+	if err := logger.LinkAnonToUser(ctx, anonID, userID); err != nil {
+		t.Fatalf("LinkAnonToUser error: %v", err)
+	}
+
+	var n int
+	if err := logger.DB.QueryRow(`SELECT COUNT(*) FROM user_searches WHERE anon_id = $1 AND user_id = $2`, anonID, userID).Scan(&n); err != nil {
+		t.Fatalf("DB read error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected the flushed search to be linked, got %d rows", n)
+	}
+	if got, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID(userID, ""))).Result(); got != "live query" {
+		t.Errorf("expected the live session to move to the user, got %q", got)
+	}
+	if n, _ := logger.Redis.Exists(ctx, buildRedisKey(sessionKeyID("", anonID)), buildBufferKey(sessionKeyID("", anonID))).Result(); n != 0 {
+		t.Errorf("expected anon session keys to be removed, %d remain", n)
+	}
+
+	if err := logger.FlushUser(ctx, userID, ""); err != nil {
+		t.Fatalf("FlushUser error: %v", err)
+	}
+	if got := getLatestQuery(t, logger, userID); got != "live query" {
+		t.Errorf("expected 'live query', got '%s'", got)
+	}
+}
+
+func TestWriteSearch_ConflictingRowPostgres(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	userID := "test-conflict"
+	target := "(user_id, search_text) WHERE user_id = 'test-conflict'"
+	if _, err := logger.DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS user_searches_test_conflict
+		ON user_searches (user_id, search_text) WHERE user_id = 'test-conflict'`); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	defer logger.DB.Exec(`DROP INDEX IF EXISTS user_searches_test_conflict`)
+
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := logger.writeSearch(ctx, SearchEntry{UserID: userID, Query: "shoes", Timestamp: first}); err != nil {
+		t.Fatalf("first write: %v", err)
+	}
+	second := SearchEntry{UserID: userID, Query: "shoes", Timestamp: first.Add(time.Hour)}
+
+	if err := logger.writeSearch(ctx, second); !IsUniqueViolation(err) {
+		t.Errorf("error mode: expected a unique violation, got %v", err)
+	}
+
+	logger.OnConflict, logger.ConflictTarget = ConflictIgnore, target
+	if err := logger.writeSearch(ctx, second); err != nil {
+		t.Errorf("ignore mode: %v", err)
+	}
+	var at time.Time
+	logger.DB.QueryRow(`SELECT last_searched_at FROM user_searches WHERE user_id = $1`, userID).Scan(&at)
+	if !at.Equal(first) {
+		t.Errorf("ignore mode: expected the existing row to be kept, got %v", at)
+	}
+
+	logger.OnConflict = ConflictUpsert
+	if err := logger.writeSearch(ctx, second); err != nil {
+		t.Errorf("upsert mode: %v", err)
+	}
+	var n int
+	logger.DB.QueryRow(`SELECT COUNT(*), MAX(last_searched_at) FROM user_searches WHERE user_id = $1`, userID).Scan(&n, &at)
+	if n != 1 || !at.Equal(second.Timestamp) {
+		t.Errorf("upsert mode: expected one row bumped to %v, got %d rows at %v", second.Timestamp, n, at)
+	}
+}
+
+func TestTermsTable_StoresEachTermOnce(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	logger.TermsTable = true
+	userID := "test-terms"
+	term := "terms table " + fmt.Sprint(time.Now().UnixNano())
+
+	for i := 0; i < 3; i++ {
+		if err := logger.writeSearch(ctx, SearchEntry{UserID: userID, Query: term}); err != nil {
+			t.Fatalf("writeSearch error: %v", err)
+		}
+	}
+
+	var terms, inline int
+	logger.DB.QueryRow(`SELECT COUNT(*) FROM search_terms WHERE term = $1`, term).Scan(&terms)
+	logger.DB.QueryRow(`SELECT COUNT(*) FROM user_searches WHERE user_id = $1 AND search_text IS NOT NULL`, userID).Scan(&inline)
+	if terms != 1 || inline != 0 {
+		t.Errorf("expected one search_terms row and no inline text, got %d terms and %d inline rows", terms, inline)
+	}
+
+	entries, err := logger.RecentSearches(ctx, userID, 10)
+	if err != nil {
+		t.Fatalf("RecentSearches error: %v", err)
+	}
+	if len(entries) != 3 || entries[0].Query != term {
+		t.Errorf("expected 3 searches for %q, got %+v", term, entries)
+	}
+}
+
+func TestQueryRefinements_CountsChainsAcrossUsers(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	base := time.Now().Add(-time.Hour)
+
+	var entries []SearchEntry
+	for _, userID := range []string{"test-funnel-1", "test-funnel-2"} {
+		entries = append(entries,
+			SearchEntry{UserID: userID, Query: "funnel sho", Timestamp: base},
+			SearchEntry{UserID: userID, Query: "funnel shoes", Timestamp: base.Add(time.Minute)},
+		)
+	}
+	if err := logger.WriteBatch(ctx, entries); err != nil {
+		t.Fatalf("WriteBatch error: %v", err)
+	}
+
+	refinements, err := logger.QueryRefinements(ctx, base.Add(-time.Second))
+	if err != nil {
+		t.Fatalf("QueryRefinements error: %v", err)
+	}
+	for _, r := range refinements {
+		if fmt.Sprint(r.Steps) == "[funnel sho funnel shoes]" {
+			if r.Count != 2 {
+				t.Errorf("expected the chain to be counted for both users, got %d", r.Count)
+			}
+			return
+		}
+	}
+	t.Errorf("expected the 'funnel sho' -> 'funnel shoes' chain, got %+v", refinements)
+}
+
+func TestHistoryCache_FilledOnMissAndInvalidatedOnLink(t *testing.T) {
+	ctx := context.Background()
+	logger := setupLogger(t)
+	logger.HistoryCacheSize = 10
+	anonID, userID := "test-history-anon", "test-history-user"
+
+	_ = logger.WriteBatch(ctx, []SearchEntry{{AnonID: anonID, Query: "shoes", Timestamp: time.Now().Add(-time.Minute)}})
+	if _, err := logger.RecentSearches(ctx, anonID, 5); err != nil {
+		t.Fatalf("RecentSearches error: %v", err)
+	}
+	if n, _ := logger.Redis.LLen(ctx, buildHistoryKey(anonID)).Result(); n != 1 {
+		t.Fatalf("expected the miss to cache 1 search, got %d", n)
+	}
+
+	if err := logger.LinkAnonToUser(ctx, anonID, userID); err != nil {
+		t.Fatalf("LinkAnonToUser error: %v", err)
+	}
+	if n, _ := logger.Redis.Exists(ctx, buildHistoryKey(anonID)).Result(); n != 0 {
+		t.Error("expected linking to drop the anon id's cached history")
+	}
+	entries, err := logger.RecentSearches(ctx, anonID, 5)
+	if err != nil || len(entries) != 1 || entries[0].UserID != userID {
+		t.Errorf("expected the refreshed history to show the linked user, got %+v, err=%v", entries, err)
+	}
+}
@@ -1,13 +1,25 @@
 package searchlogger
 
 import (
+	"compress/gzip"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"go-search-logger/internal/metrics"
+
 	"github.com/go-redis/redis/v8"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var (
@@ -15,68 +27,54 @@ var (
 	redisURL = "localhost:6379"
 )
 
-// setupLogger initializes a Logger with test DB and Redis, and cleans up test data.
-func setupLogger(t *testing.T) *Logger {
+// setupMemoryLogger initializes a Logger with the test Redis and a
+// MemoryStore in place of the DB, and clears Redis.
+func setupMemoryLogger(t testing.TB) (*Logger, *MemoryStore) {
 	t.Helper()
 
-	db, err := sql.Open("postgres", dbURL)
-	if err != nil {
-		t.Fatalf("DB error: %v", err)
-	}
 	rdb := redis.NewClient(&redis.Options{Addr: redisURL})
-
-	// Clean up test data from previous runs
-	db.Exec(`DELETE FROM user_searches WHERE user_id LIKE 'test-%' OR user_id = 'user123'`)
 	rdb.FlushAll(context.Background())
 
-	return &Logger{DB: db, Redis: rdb}
+	store := &MemoryStore{}
+	return &Logger{Redis: rdb, Store: store}, store
 }
 
-// getLatestQuery fetches the most recent search_text for a user from the DB.
-func getLatestQuery(t *testing.T, logger *Logger, userID string) string {
-	var query string
-	var err error
-	if userID == "" {
-		t.Fatal("userID must not be empty")
-	}
-	// If userID looks like an anonID, check for both user_id and anon_id columns
-	err = logger.DB.QueryRow(`
-		SELECT search_text FROM user_searches 
-		WHERE (user_id = $1 OR anon_id = $1) 
-		ORDER BY last_searched_at DESC
-	`, userID).Scan(&query)
-	if err != nil {
-		t.Fatalf("DB read error: %v", err)
+// latestQuery returns the query most recently stored for a user or anon id.
+func latestQuery(t *testing.T, store *MemoryStore, id string) string {
+	t.Helper()
+	entry, ok := store.Latest(id)
+	if !ok {
+		t.Fatalf("no search stored for %s", id)
 	}
-	return query
+	return entry.Query
 }
 
-// FlushUser writes the last search query for a user from Redis to the DB.
-func (l *Logger) FlushUser(ctx context.Context, userID string, anonID string) error {
-	key := buildRedisKey(userID)
-	if userID == "" {
-		key = buildRedisKey(anonID)
-	}
+// triggerExpiry simulates the live key of a session expiring without waiting
+// for its TTL: it deletes the key and publishes the keyevent notification Redis
+// would have sent. The event is re-published until the search reaches the
+// store, since the listener may still be subscribing when the test starts.
+// id is a logged-in user's id.
+func triggerExpiry(t *testing.T, logger *Logger, store *MemoryStore, id, want string) {
+	t.Helper()
+	ctx := context.Background()
+	key := buildRedisKey(sessionKeyID(id, ""))
+	logger.Redis.Del(ctx, key)
 
-	query, _ := l.Redis.Get(ctx, key).Result()
-	if query == "" {
-		// Do not write empty queries to the DB
-		return nil
-	}
-	// Write the last query to the DB
-	entry := SearchEntry{
-		UserID: userID,
-		Query:  query,
-		AnonID: anonID,
-		// Add other required fields if needed, e.g. Timestamp, UserAgent, etc.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		logger.Redis.Publish(ctx, "__keyevent@0__:expired", key)
+		if entry, ok := store.Latest(id); ok && entry.Query == want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
 	}
-	return l.writeSearch(ctx, entry)
+	t.Fatalf("expected '%s' to be flushed for %s after expiry", want, id)
 }
 
 // TestLogSearchAndWrite checks that only the last full query is written after a sequence of LogSearch calls.
 func TestLogSearchAndWrite(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, store := setupMemoryLogger(t)
 
 	// Enable Redis keyspace notifications for expired events
 	err := logger.Redis.ConfigSet(ctx, "notify-keyspace-events", "Ex").Err()
@@ -104,7 +102,7 @@ func TestLogSearchAndWrite(t *testing.T) {
 	anonID := generateAnonID(userAgent)
 	// _ = logger.FlushUser(ctx, "", anonID)
 	time.Sleep(11 * time.Second) // Wait for TTL expiry
-	searchText := getLatestQuery(t, logger, anonID)
+	searchText := latestQuery(t, store, anonID)
 	if searchText != query {
 		t.Errorf("expected 'testquery', got '%s'", searchText)
 	}
@@ -113,7 +111,7 @@ func TestLogSearchAndWrite(t *testing.T) {
 // TestAnonSearchReset checks that a new search resets the previous one for anonymous users.
 func TestAnonSearchReset(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, store := setupMemoryLogger(t)
 	// Start listener in background
 	done := make(chan struct{})
 	go func() {
@@ -130,13 +128,13 @@ func TestAnonSearchReset(t *testing.T) {
 	_ = logger.LogSearch(ctx, userID, ua, "business")
 	_ = logger.LogSearch(ctx, userID, ua, "data")
 
-	got := getLatestQuery(t, logger, anonID)
+	got := latestQuery(t, store, anonID)
 
 	if got != "business" {
 		t.Errorf("expected 'business', got '%s'", got)
 	}
 	time.Sleep(11 * time.Second) // Wait for TTL expiry
-	got = getLatestQuery(t, logger, anonID)
+	got = latestQuery(t, store, anonID)
 	if got != "data" {
 		t.Errorf("expected 'data', got '%s'", got)
 	}
@@ -145,7 +143,7 @@ func TestAnonSearchReset(t *testing.T) {
 // TestLoggedInUserSearch checks that the last full query before a reset is written for logged-in users.
 func TestLoggedInUserSearch(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, store := setupMemoryLogger(t)
 	// Start listener in background
 	done := make(chan struct{})
 	go func() {
@@ -157,12 +155,12 @@ func TestLoggedInUserSearch(t *testing.T) {
 	_ = logger.LogSearch(ctx, userID, "", "caterpillar")
 	_ = logger.LogSearch(ctx, userID, "", "dog") // triggers flush
 
-	got := getLatestQuery(t, logger, userID)
+	got := latestQuery(t, store, userID)
 	if got != "caterpillar" {
 		t.Errorf("expected 'caterpillar', got '%s'", got)
 	}
 	time.Sleep(11 * time.Second) // Wait for TTL expiry
-	got = getLatestQuery(t, logger, userID)
+	got = latestQuery(t, store, userID)
 	if got != "dog" {
 		t.Errorf("expected 'dog', got '%s'", got)
 	}
@@ -171,7 +169,7 @@ func TestLoggedInUserSearch(t *testing.T) {
 // TestTTLExpiryTriggersWrite checks that a search is written to DB after TTL expiry and flush.
 func TestTTLExpiryTriggersWrite(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, store := setupMemoryLogger(t)
 	// Start listener in background
 	done := make(chan struct{})
 	go func() {
@@ -192,12 +190,12 @@ func TestTTLExpiryTriggersWrite(t *testing.T) {
 	// Now log unrelated query
 	_ = logger.LogSearch(ctx, userID, ua, "world")
 
-	got := getLatestQuery(t, logger, anonID)
+	got := latestQuery(t, store, anonID)
 	if got != "hello" {
 		t.Errorf("expected 'hello', got '%s'", got)
 	}
 	time.Sleep(11 * time.Second)
-	got = getLatestQuery(t, logger, anonID)
+	got = latestQuery(t, store, anonID)
 	if got != "world" {
 		t.Errorf("expected 'world', got '%s'", got)
 	}
@@ -205,7 +203,7 @@ func TestTTLExpiryTriggersWrite(t *testing.T) {
 
 func TestMultipleAnonUsers(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, store := setupMemoryLogger(t)
 
 	ua1 := "AnonA"
 	ua2 := "AnonB"
@@ -218,8 +216,8 @@ func TestMultipleAnonUsers(t *testing.T) {
 	_ = logger.FlushUser(ctx, "", id1)
 	_ = logger.FlushUser(ctx, "", id2)
 
-	got1 := getLatestQuery(t, logger, id1)
-	got2 := getLatestQuery(t, logger, id2)
+	got1 := latestQuery(t, store, id1)
+	got2 := latestQuery(t, store, id2)
 
 	if got1 != "alpha" {
 		t.Errorf("expected 'alpha' for anon1, got '%s'", got1)
@@ -231,7 +229,7 @@ func TestMultipleAnonUsers(t *testing.T) {
 
 func TestLogSearch_EmptyQueryIgnored(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, _ := setupMemoryLogger(t)
 	userID := "test-empty"
 	userAgent := "TestAgent"
 	err := logger.LogSearch(ctx, userID, userAgent, "   ")
@@ -239,7 +237,7 @@ func TestLogSearch_EmptyQueryIgnored(t *testing.T) {
 		t.Errorf("expected no error for empty query, got %v", err)
 	}
 	// Should not write anything to Redis or DB
-	val, _ := logger.Redis.Get(ctx, buildRedisKey(userID)).Result()
+	val, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID(userID, ""))).Result()
 	if val != "" {
 		t.Errorf("expected no value in Redis for empty query, got '%s'", val)
 	}
@@ -247,7 +245,7 @@ func TestLogSearch_EmptyQueryIgnored(t *testing.T) {
 
 func TestLogSearch_AnonUserStoresAnonID(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, _ := setupMemoryLogger(t)
 	userID := ""
 	userAgent := "AnonTestAgent"
 	query := "search term"
@@ -257,7 +255,7 @@ func TestLogSearch_AnonUserStoresAnonID(t *testing.T) {
 	if err != nil {
 		t.Fatalf("LogSearch error: %v", err)
 	}
-	val, _ := logger.Redis.Get(ctx, buildRedisKey(anonID)).Result()
+	val, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID("", anonID))).Result()
 	if val != normalizeQuery(query) {
 		t.Errorf("expected Redis to store normalized query '%s', got '%s'", normalizeQuery(query), val)
 	}
@@ -265,7 +263,7 @@ func TestLogSearch_AnonUserStoresAnonID(t *testing.T) {
 
 func TestLogSearch_LoggedInUserStoresUserID(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, _ := setupMemoryLogger(t)
 	userID := "test-user"
 	userAgent := "TestAgent"
 	query := "MyQuery"
@@ -274,7 +272,7 @@ func TestLogSearch_LoggedInUserStoresUserID(t *testing.T) {
 	if err != nil {
 		t.Fatalf("LogSearch error: %v", err)
 	}
-	val, _ := logger.Redis.Get(ctx, buildRedisKey(userID)).Result()
+	val, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID(userID, ""))).Result()
 	if val != normalizeQuery(query) {
 		t.Errorf("expected Redis to store normalized query '%s', got '%s'", normalizeQuery(query), val)
 	}
@@ -282,7 +280,7 @@ func TestLogSearch_LoggedInUserStoresUserID(t *testing.T) {
 
 func TestLogSearch_ResetTriggersDBWrite(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, store := setupMemoryLogger(t)
 	userID := "test-reset"
 	userAgent := "TestAgent"
 	// Start listener in background
@@ -307,13 +305,13 @@ func TestLogSearch_ResetTriggersDBWrite(t *testing.T) {
 		t.Fatalf("LogSearch error: %v", err)
 	}
 	// The DB should have "alphabet" as the last search before reset
-	got := getLatestQuery(t, logger, userID)
+	got := latestQuery(t, store, userID)
 	if got != "alphabet" {
 		t.Errorf("expected 'alphabet' to be written to DB, got '%s'", got)
 	}
 	// Now check the latest query after TTL expiry
 	time.Sleep(11 * time.Second) // Wait for TTL expiry
-	got = getLatestQuery(t, logger, userID)
+	got = latestQuery(t, store, userID)
 	if got != "beta" {
 		t.Errorf("expected 'beta' after TTL expiry, got '%s'", got)
 	}
@@ -321,7 +319,7 @@ func TestLogSearch_ResetTriggersDBWrite(t *testing.T) {
 
 func TestLogSearch_PrefixExtensionDoesNotWriteDB(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, store := setupMemoryLogger(t)
 	userID := "test-prefix"
 	userAgent := "TestAgent"
 	// Start listener in background
@@ -338,7 +336,7 @@ func TestLogSearch_PrefixExtensionDoesNotWriteDB(t *testing.T) {
 	// No reset, so nothing should be written to DB yet
 	// Wait for TTL expiry and flush
 	time.Sleep(11 * time.Second)
-	got := getLatestQuery(t, logger, userID)
+	got := latestQuery(t, store, userID)
 	if got != "foobar" {
 		t.Errorf("expected 'foobar' after TTL expiry, got '%s'", got)
 	}
@@ -346,7 +344,7 @@ func TestLogSearch_PrefixExtensionDoesNotWriteDB(t *testing.T) {
 
 func TestLogSearch_AnonResetTriggersDBWrite(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, store := setupMemoryLogger(t)
 	userID := ""
 	userAgent := "AnonResetAgent"
 	anonID := generateAnonID(userAgent)
@@ -361,13 +359,13 @@ func TestLogSearch_AnonResetTriggersDBWrite(t *testing.T) {
 	_ = logger.LogSearch(ctx, userID, userAgent, "three")
 	_ = logger.LogSearch(ctx, userID, userAgent, "reset") // triggers DB write
 
-	got := getLatestQuery(t, logger, anonID)
+	got := latestQuery(t, store, anonID)
 	if got != "three" {
 		t.Errorf("expected 'three' to be written to DB, got '%s'", got)
 	}
 	// Now check the latest query after TTL expiry
 	time.Sleep(11 * time.Second) // Wait for TTL expiry
-	got = getLatestQuery(t, logger, anonID)
+	got = latestQuery(t, store, anonID)
 	if got != "reset" {
 		t.Errorf("expected 'reset' after TTL expiry, got '%s'", got)
 	}
@@ -375,7 +373,7 @@ func TestLogSearch_AnonResetTriggersDBWrite(t *testing.T) {
 
 func TestWriteSearch_EmptyQueryNoInsert(t *testing.T) {
 	ctx := context.Background()
-	logger := setupLogger(t)
+	logger, store := setupMemoryLogger(t)
 
 	entry := SearchEntry{
 		UserID: "test-empty-query",
@@ -388,13 +386,2810 @@ func TestWriteSearch_EmptyQueryNoInsert(t *testing.T) {
 		t.Fatalf("writeSearch should not error on empty query, got: %v", err)
 	}
 
-	// Should not insert anything, so DB query should fail
-	var count int
-	err = logger.DB.QueryRow(`SELECT COUNT(*) FROM user_searches WHERE user_id = $1`, entry.UserID).Scan(&count)
+	if n := len(store.Entries()); n != 0 {
+		t.Errorf("expected 0 rows inserted for empty query, got %d", n)
+	}
+}
+
+func TestLogSearch_LinkAnonIDStoresBoth(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.LinkAnonID = true
+	userID := "test-linked"
+	userAgent := "LinkedAgent"
+	anonID := generateAnonID(userAgent)
+
+	_ = logger.LogSearch(ctx, userID, userAgent, "laptop")
+	_ = logger.LogSearch(ctx, userID, userAgent, "phone") // triggers DB write
+
+	entry, ok := store.Latest(userID)
+	if !ok {
+		t.Fatalf("expected 'laptop' to be stored")
+	}
+	if gotAnonID := entry.AnonID; gotAnonID != anonID {
+		t.Errorf("expected anon_id '%s' to be stored with user_id, got '%s'", anonID, gotAnonID)
+	}
+
+	// The buffered entry must carry the anon id so TTL flushes link too.
+	buffered, _ := logger.Redis.Get(ctx, buildBufferKey(sessionKeyID(userID, ""))).Result()
+	if entry := decodeBuffer(buffered); entry.AnonID != anonID {
+		t.Errorf("expected buffered anon_id '%s', got '%s'", anonID, entry.AnonID)
+	}
+}
+
+func TestDecodeBuffer_LegacyPlainQuery(t *testing.T) {
+	entry := decodeBuffer("plain query")
+	if entry.Query != "plain query" || entry.UserID != "" || entry.AnonID != "" {
+		t.Errorf("expected legacy buffer to decode as query only, got %+v", entry)
+	}
+}
+
+func TestFlushUser_EndsSession(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-flush"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "flushed query")
+	if err := logger.FlushUser(ctx, userID, ""); err != nil {
+		t.Fatalf("FlushUser error: %v", err)
+	}
+
+	got := latestQuery(t, store, userID)
+	if got != "flushed query" {
+		t.Errorf("expected 'flushed query', got '%s'", got)
+	}
+	n, _ := logger.Redis.Exists(ctx, buildRedisKey(sessionKeyID(userID, "")), buildBufferKey(sessionKeyID(userID, ""))).Result()
+	if n != 0 {
+		t.Errorf("expected session keys to be deleted after flush, %d remain", n)
+	}
+}
+
+func TestNormalize_DefaultIsBuiltIn(t *testing.T) {
+	logger := &Logger{}
+	if got := logger.normalize("  iPhone "); got != "iphone" {
+		t.Errorf("expected 'iphone', got '%s'", got)
+	}
+}
+
+func TestNormalize_HookRunsAfterBuiltIn(t *testing.T) {
+	var seen string
+	logger := &Logger{Normalizer: func(q string) string {
+		seen = q
+		return strings.ReplaceAll(q, "i phone", "iphone")
+	}}
+
+	got := logger.normalize("  I Phone Case ")
+	if seen != "i phone case" {
+		t.Errorf("expected hook to receive built-in normalized query 'i phone case', got '%s'", seen)
+	}
+	if got != "iphone case" {
+		t.Errorf("expected 'iphone case', got '%s'", got)
+	}
+}
+
+func TestLogSearch_NormalizerOutputStored(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.Normalizer = func(q string) string {
+		return strings.ReplaceAll(q, "i phone", "iphone")
+	}
+	userID := "test-normalizer"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "iphone")
+	// "i phone" canonicalizes to the same query, so it is not a reset.
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "I Phone")
+
+	val, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID(userID, ""))).Result()
+	if val != "iphone" {
+		t.Errorf("expected Redis to store canonical query 'iphone', got '%s'", val)
+	}
+}
+
+func TestHasExpiredEvents(t *testing.T) {
+	cases := map[string]bool{
+		"":      false,
+		"Ex":    true,
+		"xE":    true,
+		"KEA":   true,
+		"Kx":    false,
+		"Eg$lh": false,
+	}
+	for flags, want := range cases {
+		if got := hasExpiredEvents(flags); got != want {
+			t.Errorf("hasExpiredEvents(%q) = %v, want %v", flags, got, want)
+		}
+	}
+}
+
+// configHook fails CONFIG GET and records whether CONFIG SET was sent.
+type configHook struct{ set bool }
+
+func (h *configHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if cmd.Name() == "config" && len(cmd.Args()) > 1 {
+		switch strings.ToLower(fmt.Sprint(cmd.Args()[1])) {
+		case "get":
+			return ctx, errors.New("ERR unknown command 'CONFIG'")
+		case "set":
+			h.set = true
+		}
+	}
+	return ctx, nil
+}
+
+func (h *configHook) AfterProcess(context.Context, redis.Cmder) error { return nil }
+
+func (h *configHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *configHook) AfterProcessPipeline(context.Context, []redis.Cmder) error { return nil }
+
+func TestEnsureKeyspaceEvents_ConfigGetFailureKeepsFlags(t *testing.T) {
+	logger, _ := setupMemoryLogger(t)
+	hook := &configHook{}
+	logger.Redis.AddHook(hook)
+
+	if logger.ensureKeyspaceEvents(context.Background()) {
+		t.Error("expected polling when the current flags cannot be read")
+	}
+	if hook.set {
+		t.Error("expected CONFIG SET not to overwrite flags it could not read")
+	}
+}
+
+func TestReapExpired_FlushesSessionsWithoutLiveKey(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-reaper"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "reaped query")
+	// Simulate expiry of the live key without a keyspace event.
+	logger.Redis.Del(ctx, buildRedisKey(sessionKeyID(userID, "")))
+
+	logger.reapExpired(ctx)
+
+	got := latestQuery(t, store, userID)
+	if got != "reaped query" {
+		t.Errorf("expected 'reaped query', got '%s'", got)
+	}
+	if n, _ := logger.Redis.Exists(ctx, buildBufferKey(sessionKeyID(userID, ""))).Result(); n != 0 {
+		t.Errorf("expected buffer to be deleted after reaping")
+	}
+}
+
+func TestResetCompare_CaseChange(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		mode      ResetComparison
+		wantReset bool
+	}{
+		{CompareNormalized, false},
+		{CompareRaw, true},
+	} {
+		logger, store := setupMemoryLogger(t)
+		logger.ResetCompare = tc.mode
+		for _, q := range []string{"Cat", " cat "} {
+			if err := logger.LogSearch(ctx, "test-reset-compare", "TestAgent", q); err != nil {
+				t.Fatalf("LogSearch error: %v", err)
+			}
+		}
+		entries := store.Entries()
+		if !tc.wantReset {
+			if len(entries) != 0 {
+				t.Errorf("mode %d: expected no write, got %v", tc.mode, entries)
+			}
+			continue
+		}
+		if len(entries) != 1 {
+			t.Fatalf("mode %d: expected one write, got %v", tc.mode, entries)
+		}
+		if entries[0].Query != "cat" || entries[0].RawQuery != "Cat" {
+			t.Errorf("mode %d: expected query 'cat' with raw 'Cat', got %q/%q", tc.mode, entries[0].Query, entries[0].RawQuery)
+		}
+	}
+}
+
+func TestBuildInsert_OptionalColumns(t *testing.T) {
+	query, args := buildInsert(SearchEntry{UserID: "u", Query: "hotels", AnonID: ""})
+	want := "INSERT INTO user_searches (user_id, search_text, anon_id, last_searched_at) VALUES ($1, $2, $3, NOW())"
+	if query != want || len(args) != 3 {
+		t.Errorf("unexpected insert without optional fields:\n got %s (%d args)\nwant %s", query, len(args), want)
+	}
+
+	query, args = buildInsert(SearchEntry{
+		UserID:   "u",
+		Query:    "hotels",
+		Location: "Paris",
+		Extra:    map[string]string{"guests": "2"},
+	})
+	want = "INSERT INTO user_searches (user_id, search_text, anon_id, location, extra, last_searched_at) VALUES ($1, $2, $3, $4, $5, NOW())"
+	if query != want {
+		t.Errorf("unexpected insert with optional fields:\n got %s\nwant %s", query, want)
+	}
+	if args[3] != "Paris" || args[4] != `{"guests":"2"}` {
+		t.Errorf("unexpected optional args: %v", args)
+	}
+}
+
+func TestBuildInsertDialect_SQLite(t *testing.T) {
+	query, args := buildInsertDialect(sqliteDialect, SearchEntry{UserID: "u", Query: "hotels", Location: "Paris"}, "search_text", "hotels")
+	want := "INSERT INTO user_searches (user_id, search_text, anon_id, location, last_searched_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)"
+	if query != want || len(args) != 4 {
+		t.Errorf("unexpected SQLite insert:\n got %s (%d args)\nwant %s", query, len(args), want)
+	}
+}
+
+func TestBuildInsert_UTMColumns(t *testing.T) {
+	query, args := buildInsert(SearchEntry{UserID: "u", Query: "shoes", UTMCampaign: "spring"})
+	want := "INSERT INTO user_searches (user_id, search_text, anon_id, utm_campaign, last_searched_at) VALUES ($1, $2, $3, $4, NOW())"
+	if query != want || len(args) != 4 || args[3] != "spring" {
+		t.Errorf("unexpected insert with a campaign:\n got %s %v\nwant %s", query, args, want)
+	}
+}
+
+func TestCopyRows_UsesInsertColumns(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cols, rows := copyRows([]SearchEntry{
+		{UserID: "u", Query: "shoes", Location: "Paris", Timestamp: ts},
+		{UserID: "u", Query: "boots", RawQuery: "Boots", Variant: "b", Timestamp: ts},
+	})
+	want := []string{"user_id", "search_text", "anon_id", "location", "last_searched_at", "raw_text", "variant"}
+	if strings.Join(cols, ",") != strings.Join(want, ",") {
+		t.Fatalf("columns = %v, want %v", cols, want)
+	}
+	if rows[0][3] != "Paris" || rows[0][5] != nil || rows[0][6] != nil {
+		t.Errorf("unexpected first row: %v", rows[0])
+	}
+	if rows[1][1] != "boots" || rows[1][3] != nil || rows[1][4] != ts || rows[1][5] != "Boots" || rows[1][6] != "b" {
+		t.Errorf("unexpected second row: %v", rows[1])
+	}
+}
+
+func TestLogSearchRequest_ResetCarriesLocation(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-location"
+
+	_ = logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, Query: "hotels", Location: "Par"})
+	_ = logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, Query: "hotels", Location: "Paris"})
+	_ = logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, Query: "flights", Location: "Rome"}) // triggers DB write
+
+	entry, ok := store.Latest(userID)
+	if !ok {
+		t.Fatalf("expected 'hotels' to be stored")
+	}
+	query, location := entry.Query, entry.Location
+	if query != "hotels" || location != "Paris" {
+		t.Errorf("expected 'hotels' in 'Paris', got '%s' in '%s'", query, location)
+	}
+}
+
+func TestDayOf_UsesTimeZone(t *testing.T) {
+	ts := time.Date(2024, 6, 1, 23, 30, 0, 0, time.UTC)
+
+	logger := &Logger{}
+	if got := logger.dayOf(ts); got != "2024-06-01" {
+		t.Errorf("expected UTC day 2024-06-01, got %s", got)
+	}
+	logger.TimeZone = time.FixedZone("UTC+2", 2*60*60)
+	if got := logger.dayOf(ts); got != "2024-06-02" {
+		t.Errorf("expected UTC+2 day 2024-06-02, got %s", got)
+	}
+}
+
+func TestDailyCounts_IncrementedOnCommit(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.DailyCounts = true
+	day := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	logger.Now = func() time.Time { return day }
+	userID := "test-counts"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoes")
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "socks") // commits "shoes"
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoes") // commits "socks"
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "hats")  // commits "shoes"
+
+	n, err := logger.TermCountForDay(ctx, "Shoes", day)
+	if err != nil {
+		t.Fatalf("TermCountForDay error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 commits of 'shoes', got %d", n)
+	}
+	if n, _ := logger.TermCountForDay(ctx, "shoes", day.AddDate(0, 0, 1)); n != 0 {
+		t.Errorf("expected no commits on the next day, got %d", n)
+	}
+}
+
+func TestTrendingRecent_DecaysByHalfLife(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.TrendingHalfLife = time.Hour
+	if err := logger.Redis.Del(ctx, risingKey, risingLandmarkKey, risingLastKey).Err(); err != nil {
+		t.Fatalf("Del error: %v", err)
+	}
+	t.Cleanup(func() { logger.Redis.Del(ctx, risingKey, risingLandmarkKey, risingLastKey) })
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	logger.Now = func() time.Time { return now }
+	commit := func(q string, times int) {
+		for i := 0; i < times; i++ {
+			if err := logger.writeSearch(ctx, SearchEntry{UserID: "u" + strconv.Itoa(i), Query: q}); err != nil {
+				t.Fatalf("writeSearch error: %v", err)
+			}
+		}
+	}
+
+	commit("shoes", 4)
+	now = now.Add(2 * time.Hour)
+	commit("hats", 2)
+
+	// Two half-lives later, 4 commits of shoes weigh 1 and hats' 2 weigh 2.
+	terms, err := logger.TrendingRecent(ctx, 10, 0)
+	if err != nil {
+		t.Fatalf("TrendingRecent error: %v", err)
+	}
+	if len(terms) != 2 || terms[0].Term != "hats" || math.Abs(terms[0].Score-2) > 1e-6 || math.Abs(terms[1].Score-1) > 1e-6 {
+		t.Errorf("expected hats (2) ahead of shoes (1), got %v", terms)
+	}
+	if terms, _ := logger.TrendingRecent(ctx, 10, time.Hour); len(terms) != 1 || terms[0].Term != "hats" {
+		t.Errorf("expected only hats within the last hour, got %v", terms)
+	}
+
+	// Far past the landmark, scores are rescaled and keep their ratios.
+	now = now.Add(40 * time.Hour)
+	commit("caps", 1)
+	terms, _ = logger.TrendingRecent(ctx, 1, 0)
+	if len(terms) != 1 || terms[0].Term != "caps" || math.Abs(terms[0].Score-1) > 1e-6 {
+		t.Errorf("expected caps alone on top after the rescale, got %v", terms)
+	}
+}
+
+func TestBotFilter_DefaultPatterns(t *testing.T) {
+	filter, err := NewBotFilter(DefaultBotPatterns...)
+	if err != nil {
+		t.Fatalf("NewBotFilter error: %v", err)
+	}
+	cases := map[string]bool{
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": true,
+		"Mozilla/5.0 (compatible; bingbot/2.0)":                                    true,
+		"Mozilla/5.0 (compatible; Yahoo! Slurp)":                                   true,
+		"facebookexternalhit/1.1":                                                  true,
+		"Mozilla/5.0 (X11; Linux x86_64) HeadlessChrome/120.0.0.0":                 true,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/120.0.0.0 Safari/537.36": false,
+		"CUBOT_X30 Mobile Safari":                                                  false,
+		"curl/8.4.0":                                                               false,
+		"":                                                                         false,
+	}
+	for ua, want := range cases {
+		if got := filter.IsBot(ua); got != want {
+			t.Errorf("IsBot(%q) = %v, want %v", ua, got, want)
+		}
+	}
+}
+
+func TestBotFilter_CustomPatternsAndNil(t *testing.T) {
+	filter, err := NewBotFilter(`^internal-monitor/`)
+	if err != nil {
+		t.Fatalf("NewBotFilter error: %v", err)
+	}
+	if !filter.IsBot("Internal-Monitor/1.0") {
+		t.Error("expected custom pattern to match case-insensitively")
+	}
+	if _, err := NewBotFilter(`(`); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+	var none *BotFilter
+	if none.IsBot("Googlebot") {
+		t.Error("expected nil filter to match nothing")
+	}
+}
+
+func TestLogSearch_BotNotLogged(t *testing.T) {
+	filter, _ := NewBotFilter(DefaultBotPatterns...)
+	// No Redis or DB: a bot request must return before touching either.
+	logger := &Logger{BotFilter: filter}
+	if err := logger.LogSearch(context.Background(), "", "Googlebot/2.1", "shoes"); err != nil {
+		t.Errorf("expected bot search to be ignored, got %v", err)
+	}
+}
+
+func TestDebouncer_RunsLatestOnce(t *testing.T) {
+	var d debouncer
+	ran := make(chan string, 10)
+
+	for _, q := range []string{"s", "sh", "sho", "shoes"} {
+		q := q
+		d.do("user", 20*time.Millisecond, func() { ran <- q })
+	}
+	d.do("other", 20*time.Millisecond, func() { ran <- "other" })
+
+	time.Sleep(100 * time.Millisecond)
+	close(ran)
+	var got []string
+	for q := range ran {
+		got = append(got, q)
+	}
+	if len(got) != 2 || !(contains(got, "shoes") && contains(got, "other")) {
+		t.Errorf("expected only 'shoes' and 'other' to run, got %v", got)
+	}
+}
+
+func contains(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogSearch_InvalidInputErrors(t *testing.T) {
+	ctx := context.Background()
+	// Validation happens before Redis or the DB are used.
+	logger := &Logger{}
+
+	err := logger.LogSearch(ctx, "test-user", "TestAgent", strings.Repeat("a", MaxQueryLength+1))
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("expected ErrInvalidQuery for overlong query, got %v", err)
+	}
+	err = logger.LogSearch(ctx, "test\x00user", "TestAgent", "shoes")
+	if !errors.Is(err, ErrInvalidUserID) {
+		t.Errorf("expected ErrInvalidUserID for control characters, got %v", err)
+	}
+	err = logger.LogSearch(ctx, strings.Repeat("u", MaxUserIDLength+1), "TestAgent", "shoes")
+	if !errors.Is(err, ErrInvalidUserID) {
+		t.Errorf("expected ErrInvalidUserID for overlong id, got %v", err)
+	}
+}
+
+func TestLogSearch_RedisUnavailable(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	logger := &Logger{Redis: rdb}
+
+	err := logger.LogSearch(context.Background(), "test-user", "TestAgent", "shoes")
+	if !errors.Is(err, ErrRedisUnavailable) {
+		t.Errorf("expected ErrRedisUnavailable, got %v", err)
+	}
+	if errors.Is(err, ErrDBWrite) {
+		t.Errorf("did not expect ErrDBWrite for a Redis failure")
+	}
+}
+
+func TestWriteSearch_DBWriteError(t *testing.T) {
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatalf("DB error: %v", err)
+	}
+	db.Close()
+	logger := &Logger{DB: db}
+
+	err = logger.writeSearch(context.Background(), SearchEntry{UserID: "test-user", Query: "shoes"})
+	if !errors.Is(err, ErrDBWrite) {
+		t.Errorf("expected ErrDBWrite, got %v", err)
+	}
+	if errors.Unwrap(err) == nil {
+		t.Errorf("expected the driver error to be wrapped")
+	}
+}
+
+func TestDedupLookback_SuppressesRecommit(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.DedupLookback = 2
+	userID := "test-dedup"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoes")
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "socks") // commits "shoes"
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoes") // commits "socks"
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "hats")  // "shoes" is suppressed
+
+	count := 0
+	for _, entry := range store.EntriesFor(userID) {
+		if entry.Query == "shoes" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected 'shoes' to be committed once, got %d", count)
+	}
+}
+
+func TestRecordResult_Validation(t *testing.T) {
+	logger := &Logger{}
+	err := logger.RecordResult(context.Background(), ResultSelection{UserID: "u", Query: "shoes", Position: 1})
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("expected ErrInvalidQuery without result_id, got %v", err)
+	}
+}
+
+func TestHasTrailingSpace(t *testing.T) {
+	cases := map[string]bool{
+		"cat":   false,
+		"cat ":  true,
+		"cat\t": true,
+		" cat":  false,
+		"":      false,
+	}
+	for q, want := range cases {
+		if got := hasTrailingSpace(q); got != want {
+			t.Errorf("hasTrailingSpace(%q) = %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestLogSearch_TrailingSpaceIgnoredByDefault(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-trailing-default"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "cat")
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "cat ")
+
+	if count := len(store.EntriesFor(userID)); count != 0 {
+		t.Errorf("expected trailing space not to commit, got %d rows", count)
+	}
+	if val, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID(userID, ""))).Result(); val != "cat" {
+		t.Errorf("expected live query 'cat', got '%s'", val)
+	}
+}
+
+func TestLogSearch_TrailingSpaceCommits(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.TrailingSpaceCommits = true
+	userID := "test-trailing-commit"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "ca")
+	if err := logger.LogSearch(ctx, userID, "TestAgent", "cat "); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+
+	if got := latestQuery(t, store, userID); got != "cat" {
+		t.Errorf("expected 'cat' to be committed, got '%s'", got)
+	}
+	if n, _ := logger.Redis.Exists(ctx, buildRedisKey(sessionKeyID(userID, "")), buildBufferKey(sessionKeyID(userID, ""))).Result(); n != 0 {
+		t.Errorf("expected the session to end after an explicit commit")
+	}
+}
+
+func TestFlushLifecycle_WithoutSleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger, store := setupMemoryLogger(t)
+	go logger.StartKeyspaceListener(ctx)
+	userID := "test-lifecycle"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "qu")
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "quick")
+
+	triggerExpiry(t, logger, store, userID, "quick")
+
+	if n, _ := logger.Redis.Exists(ctx, buildBufferKey(sessionKeyID(userID, ""))).Result(); n != 0 {
+		t.Errorf("expected buffer to be deleted after flush")
+	}
+}
+
+func TestLogSearchRequest_Outcome(t *testing.T) {
+	ctx := context.Background()
+	if err := (&Logger{}).LogSearchRequest(ctx, SearchRequest{UserID: "u", Query: "shoes", Outcome: "maybe"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected ErrInvalidRequest for unknown outcome, got %v", err)
+	}
+
+	logger, store := setupMemoryLogger(t)
+	userID := "test-outcome"
+	_ = logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, Query: "unicorn socks", Outcome: OutcomeNoResults})
+	_ = logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, Query: "socks", Outcome: OutcomeSuccess}) // commits "unicorn socks"
+
+	entry, ok := store.Latest(userID)
+	if !ok {
+		t.Fatalf("expected 'unicorn socks' to be stored")
+	}
+	if outcome := entry.Outcome; outcome != OutcomeNoResults {
+		t.Errorf("expected outcome '%s', got '%s'", OutcomeNoResults, outcome)
+	}
+}
+
+func TestAnonID_Rotation(t *testing.T) {
+	day1 := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	now := day1
+	logger := &Logger{Now: func() time.Time { return now }}
+
+	if got := logger.anonID("UA"); got != generateAnonID("UA") {
+		t.Errorf("expected stable anon id without rotation")
+	}
+
+	logger.AnonIDRotation = RotateDaily
+	first := logger.anonID("UA")
+	now = day1.Add(13 * time.Hour) // still 2024-06-01 UTC
+	if got := logger.anonID("UA"); got != first {
+		t.Errorf("expected the same anon id within a day")
+	}
+	now = day1.Add(14 * time.Hour) // 2024-06-02 UTC
+	if got := logger.anonID("UA"); got == first {
+		t.Errorf("expected a new anon id on the next day")
+	}
+	if first == generateAnonID("UA") {
+		t.Errorf("expected rotated id to differ from the stable id")
+	}
+
+	logger.AnonIDRotation = 500 * time.Millisecond
+	sub := logger.anonID("UA")
+	now = now.Add(500 * time.Millisecond)
+	if got := logger.anonID("UA"); got == sub {
+		t.Errorf("expected a sub-second rotation to rotate")
+	}
+}
+
+func TestAnonIDFor_EmptyUserAgentModes(t *testing.T) {
+	logger := &Logger{}
+	if got, err := logger.anonIDFor(" ", ""); err != nil || got != generateAnonID(" ") {
+		t.Errorf("shared: got %q, %v", got, err)
+	}
+	if got, err := logger.anonIDFor("", "device-1"); err != nil || got != generateAnonID("client:device-1") {
+		t.Errorf("client anon id: got %q, %v", got, err)
+	}
+
+	logger.EmptyUserAgent = EmptyUABucket
+	if got, err := logger.anonIDFor("", ""); err != nil || got != NoUserAgentAnonID {
+		t.Errorf("bucket: got %q, %v", got, err)
+	}
+
+	logger.EmptyUserAgent = EmptyUARequireAnonID
+	if _, err := logger.anonIDFor("", ""); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("require_anon_id: expected ErrInvalidRequest, got %v", err)
+	}
+	if _, err := logger.anonIDFor("", "device-1"); err != nil {
+		t.Errorf("require_anon_id with anon id: unexpected error %v", err)
+	}
+
+	logger.EmptyUserAgent = EmptyUAReject
+	if _, err := logger.anonIDFor("\t", "device-1"); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("reject: expected ErrInvalidRequest, got %v", err)
+	}
+	if _, err := logger.anonIDFor("TestAgent", ""); err != nil {
+		t.Errorf("reject with User-Agent: unexpected error %v", err)
+	}
+}
+
+func TestAnonIDFor_CapsUserAgentLength(t *testing.T) {
+	logger := &Logger{MaxUserAgentLength: 16}
+	before := metrics.UserAgentsTruncated.Value()
+
+	ua := "Mozilla/5.0 (X11)"
+	padded, err := logger.anonIDFor(ua+strings.Repeat("x", 4096), "")
 	if err != nil {
-		t.Fatalf("DB count error: %v", err)
+		t.Fatalf("anonIDFor error: %v", err)
+	}
+	other, _ := logger.anonIDFor(ua+strings.Repeat("y", 4096), "")
+	if padded != other || padded != generateAnonID(ua[:16]) {
+		t.Errorf("expected padded User-Agents to share the anon id of their first 16 bytes")
+	}
+	if short, _ := logger.anonIDFor("curl/8", ""); short != generateAnonID("curl/8") {
+		t.Errorf("expected short User-Agents to be hashed whole")
+	}
+	if got := metrics.UserAgentsTruncated.Value() - before; got != 2 {
+		t.Errorf("expected 2 truncations counted, got %d", got)
+	}
+}
+
+func TestLogSearch_RedisFallbackWritesToDB(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.Redis = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	logger.RedisFallback = true
+	userID := "test-fallback"
+
+	if err := logger.LogSearch(ctx, userID, "TestAgent", "offline"); err != nil {
+		t.Fatalf("expected fallback to succeed, got %v", err)
+	}
+	if got := latestQuery(t, store, userID); got != "offline" {
+		t.Errorf("expected 'offline' written directly to DB, got '%s'", got)
+	}
+	if metrics.RedisFallbackActive.Value() != 1 {
+		t.Errorf("expected fallback gauge to be set")
+	}
+}
+
+func TestSearchesForUsers_TooManyIDs(t *testing.T) {
+	ids := make([]string, MaxBulkUserIDs+1)
+	for i := range ids {
+		ids[i] = "u"
+	}
+	_, err := (&Logger{}).SearchesForUsers(context.Background(), ids, time.Time{})
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected ErrInvalidRequest, got %v", err)
+	}
+}
+
+func TestQueryAllowed_AllowAndDenyPatterns(t *testing.T) {
+	allow, err := CompileQueryPatterns(`^(shoes|socks)$`, `^red `)
+	if err != nil {
+		t.Fatalf("CompileQueryPatterns error: %v", err)
+	}
+	deny, _ := CompileQueryPatterns(`socks`)
+	logger := &Logger{AllowPatterns: allow, DenyPatterns: deny}
+
+	cases := map[string]bool{
+		"shoes":       true,
+		"red dress":   true,
+		"shoes size":  false, // not in the allow list
+		"socks":       false, // deny wins over allow
+		"my password": false,
+	}
+	for q, want := range cases {
+		if got := logger.queryAllowed(q); got != want {
+			t.Errorf("queryAllowed(%q) = %t, want %t", q, got, want)
+		}
+	}
+
+	if !(&Logger{}).queryAllowed("anything") {
+		t.Error("expected every query allowed with no patterns")
+	}
+	if _, err := CompileQueryPatterns(`(`); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestResetClassifiers(t *testing.T) {
+	cases := []struct {
+		last, query  string
+		prefix, edit bool
+	}{
+		{"sho", "shoes", false, false},
+		{"shoes", "sho", false, false},
+		{"shoez", "shoes", true, false},
+		{"shoes", "socks", true, true},
+		{"cat", "dog food", true, true},
+	}
+	for _, c := range cases {
+		if got := isPrefixReset(c.last, c.query); got != c.prefix {
+			t.Errorf("isPrefixReset(%q, %q) = %t, want %t", c.last, c.query, got, c.prefix)
+		}
+		if got := isEditDistanceReset(c.last, c.query, 1); got != c.edit {
+			t.Errorf("isEditDistanceReset(%q, %q, 1) = %t, want %t", c.last, c.query, got, c.edit)
+		}
+	}
+}
+
+func TestShadowClassify_CountsDisagreements(t *testing.T) {
+	logger := &Logger{ShadowEditDistance: 1}
+	before := metrics.ResetClassifierDisagreements.Value()
+
+	logger.shadowClassify("u", "shoez", "shoes")
+	logger.shadowClassify("u", "shoes", "socks")
+	logger.shadowClassify("u", "", "shoes")
+
+	if got := metrics.ResetClassifierDisagreements.Value() - before; got != 1 {
+		t.Errorf("expected 1 disagreement, got %d", got)
+	}
+}
+
+func TestShadowClassify_IgnoresVariantClassifier(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.ShadowEditDistance = 1
+	logger.Variants = map[string]Variant{"typo": {ResetEditDistance: 1}}
+	userID := "test-shadow-variant"
+
+	_ = logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, UserAgent: "TestAgent", Query: "shoez", Variant: "typo"})
+	before := metrics.ResetClassifierDisagreements.Value()
+	// Not a reset for the variant or the shadow, but one for the prefix
+	// classifier the shadow is measured against.
+	_ = logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, UserAgent: "TestAgent", Query: "shoes", Variant: "typo"})
+
+	if got := metrics.ResetClassifierDisagreements.Value() - before; got != 1 {
+		t.Errorf("expected the shadow compared with the prefix classifier, got %d disagreements", got)
+	}
+}
+
+func TestLogSearchRequest_SubmitCommitsImmediately(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-submit"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "sho")
+	err := logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, UserAgent: "TestAgent", Query: "shoes", Submit: true})
+	if err != nil {
+		t.Fatalf("LogSearchRequest error: %v", err)
+	}
+
+	if got := latestQuery(t, store, userID); got != "shoes" {
+		t.Errorf("expected 'shoes' to be committed, got '%s'", got)
+	}
+	if n, _ := logger.Redis.Exists(ctx, buildRedisKey(sessionKeyID(userID, "")), buildBufferKey(sessionKeyID(userID, ""))).Result(); n != 0 {
+		t.Errorf("expected the session to end after a submit")
+	}
+}
+
+func TestLogSearchRequest_KeystrokeWithoutSubmitIsBuffered(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-keystroke"
+
+	err := logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, UserAgent: "TestAgent", Query: "shoes"})
+	if err != nil {
+		t.Fatalf("LogSearchRequest error: %v", err)
+	}
+
+	if live, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID(userID, ""))).Result(); live != "shoes" {
+		t.Errorf("expected live query 'shoes', got '%s'", live)
+	}
+	n := len(store.EntriesFor(userID))
+	if n != 0 {
+		t.Errorf("expected nothing committed before a reset or submit, got %d rows", n)
+	}
+}
+
+func TestDebouncer_Cancel(t *testing.T) {
+	var d debouncer
+	ran := make(chan string, 1)
+
+	d.do("user", 20*time.Millisecond, func() { ran <- "sho" })
+	d.cancel("user")
+
+	time.Sleep(60 * time.Millisecond)
+	select {
+	case q := <-ran:
+		t.Errorf("expected cancelled update not to run, got %q", q)
+	default:
+	}
+}
+
+func TestDebouncer_FlushRunsPendingNow(t *testing.T) {
+	var d debouncer
+	ran := make(chan string, 2)
+
+	d.do("user", time.Hour, func() { ran <- "sho" })
+	d.do("user", time.Hour, func() { ran <- "shoes" })
+	d.flush()
+
+	select {
+	case q := <-ran:
+		if q != "shoes" {
+			t.Errorf("expected the latest function to run, got %q", q)
+		}
+	default:
+		t.Fatal("expected flush to run the pending function")
+	}
+	select {
+	case q := <-ran:
+		t.Errorf("expected one run, also got %q", q)
+	default:
+	}
+}
+
+func TestSimpleUAParser(t *testing.T) {
+	cases := map[string]DeviceInfo{
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1": {"mobile", "Safari", "iOS"},
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36":                       {"mobile", "Chrome", "Android"},
+		"Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/604.1":                        {"tablet", "Safari", "iOS"},
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36 Edg/120.0":                   {"desktop", "Edge", "Windows"},
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14.0; rv:121.0) Gecko/20100101 Firefox/121.0":                                                     {"desktop", "Firefox", "macOS"},
+		"": {},
+	}
+	for ua, want := range cases {
+		if got := (SimpleUAParser{}).Parse(ua); got != want {
+			t.Errorf("Parse(%q) = %+v, want %+v", ua, got, want)
+		}
+	}
+}
+
+type panicParser struct{}
+
+func (panicParser) Parse(string) DeviceInfo { panic("bad parser") }
+
+func TestNewEntry_DeviceInfoIsBestEffort(t *testing.T) {
+	sess := session{userID: "u", id: "u"}
+	req := SearchRequest{UserAgent: "Mozilla/5.0 (Windows NT 10.0) Firefox/121.0"}
+
+	entry := (&Logger{UAParser: SimpleUAParser{}}).newEntry(sess, "shoes", req)
+	if entry.Device != "desktop" || entry.Browser != "Firefox" || entry.OS != "Windows" {
+		t.Errorf("unexpected device info: %+v", entry)
+	}
+	if entry := (&Logger{}).newEntry(sess, "shoes", req); entry.Device != "" {
+		t.Errorf("expected no device info without a parser, got %+v", entry)
+	}
+	if entry := (&Logger{UAParser: panicParser{}}).newEntry(sess, "shoes", req); entry.Query != "shoes" || entry.Device != "" {
+		t.Errorf("expected a panicking parser to be ignored, got %+v", entry)
+	}
+
+	query, _ := buildInsert(SearchEntry{UserID: "u", Query: "shoes", Device: "mobile", OS: "iOS"})
+	want := "INSERT INTO user_searches (user_id, search_text, anon_id, device, os, last_searched_at) VALUES ($1, $2, $3, $4, $5, NOW())"
+	if query != want {
+		t.Errorf("unexpected insert:\n got %s\nwant %s", query, want)
+	}
+}
+
+func TestLogSearch_ResetGraceCorrection(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.ResetGrace = 50 * time.Millisecond
+	userID := "test-grace-corrected"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoes")
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoex") // looks like a reset
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoes") // corrected within the window
+
+	time.Sleep(100 * time.Millisecond)
+	n := len(store.EntriesFor(userID))
+	if n != 0 {
+		t.Errorf("expected a corrected reset not to be written, got %d rows", n)
+	}
+	if live, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID(userID, ""))).Result(); live != "shoes" {
+		t.Errorf("expected live query 'shoes', got '%s'", live)
+	}
+}
+
+func TestLogSearch_ResetGraceWritesAfterWindow(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.ResetGrace = 20 * time.Millisecond
+	userID := "test-grace-reset"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoes")
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "socks")
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "s") // a new search, not a correction
+
+	deadline := time.Now().Add(time.Second)
+	var query string
+	for time.Now().Before(deadline) {
+		if entry, ok := store.Latest(userID); ok {
+			query = entry.Query
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if query != "shoes" {
+		t.Errorf("expected 'shoes' to be written after the grace window, got '%s'", query)
+	}
+}
+
+func TestFlushPending_WritesResetHeldForGrace(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.ResetGrace = time.Hour
+	userID := "test-grace-shutdown"
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoes")
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "socks")
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "s")
+	logger.FlushPending()
+
+	if got := latestQuery(t, store, userID); got != "shoes" {
+		t.Errorf("expected the held reset to be written by FlushPending, got %q", got)
+	}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"shoes", "shoex", 4},
+		{"shoes", "shoes", 5},
+		{"s", "socks", 1},
+		{"", "shoes", 0},
+	}
+	for _, c := range cases {
+		if got := commonPrefixLen(c.a, c.b); got != c.want {
+			t.Errorf("commonPrefixLen(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+// memStore is a Store that records entries, or fails with err if set.
+type memStore struct {
+	entries []SearchEntry
+	err     error
+}
+
+func (m *memStore) WriteSearch(ctx context.Context, entry SearchEntry) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func TestMultiStore_SecondaryFailureIsNotFatal(t *testing.T) {
+	primary, failing, lake := &memStore{}, &memStore{err: errors.New("lake down")}, &memStore{}
+	store := &MultiStore{Primary: primary, Secondaries: []Store{failing, lake}}
+	before := metrics.StoreSecondaryErrors.Value()
+
+	if err := store.WriteSearch(context.Background(), SearchEntry{UserID: "u", Query: "shoes"}); err != nil {
+		t.Fatalf("expected no error when only a secondary fails, got %v", err)
+	}
+	if len(primary.entries) != 1 || len(lake.entries) != 1 {
+		t.Errorf("expected primary and healthy secondary to be written, got %d and %d", len(primary.entries), len(lake.entries))
+	}
+	if got := metrics.StoreSecondaryErrors.Value() - before; got != 1 {
+		t.Errorf("expected 1 secondary error counted, got %d", got)
+	}
+}
+
+func TestMultiStore_PrimaryFailureIsFatal(t *testing.T) {
+	primary, secondary := &memStore{err: errors.New("db down")}, &memStore{}
+	logger := &Logger{Store: &MultiStore{Primary: primary, Secondaries: []Store{secondary}}}
+
+	err := logger.writeSearch(context.Background(), SearchEntry{UserID: "u", Query: "shoes"})
+	if !errors.Is(err, ErrDBWrite) {
+		t.Errorf("expected ErrDBWrite when the primary fails, got %v", err)
+	}
+	if len(secondary.entries) != 0 {
+		t.Errorf("expected secondaries to be skipped when the primary fails")
+	}
+}
+
+func TestDeadLetter_ParksFailedWritesForReplay(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	store := &memStore{err: errors.New("db down")}
+	logger.Store = store
+	logger.DeadLetter = true
+	if err := logger.Redis.Del(ctx, deadLetterKey).Err(); err != nil {
+		t.Fatalf("Del error: %v", err)
+	}
+	t.Cleanup(func() { logger.Redis.Del(ctx, deadLetterKey) })
+
+	for _, q := range []string{"shoes", "socks"} {
+		if err := logger.writeSearch(ctx, SearchEntry{UserID: "u", Query: q}); err != nil {
+			t.Fatalf("expected the failed write to be parked, got %v", err)
+		}
+	}
+	if metrics.DeadLetterDepth.Value() != 2 {
+		t.Errorf("expected a dead-letter depth of 2, got %d", metrics.DeadLetterDepth.Value())
+	}
+
+	// Replay stops at the first failure and keeps everything parked.
+	if n, err := logger.ReplayDeadLetters(ctx); n != 0 || !errors.Is(err, ErrDBWrite) {
+		t.Fatalf("expected the replay to fail without writing, got %d, %v", n, err)
+	}
+	store.err = nil
+	n, err := logger.ReplayDeadLetters(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 searches replayed, got %d, %v", n, err)
+	}
+	if len(store.entries) != 2 || store.entries[0].Query != "shoes" || store.entries[0].Timestamp.IsZero() {
+		t.Errorf("expected the parked searches written oldest first with their commit time, got %v", store.entries)
+	}
+	if depth, _ := logger.Redis.LLen(ctx, deadLetterKey).Result(); depth != 0 || metrics.DeadLetterDepth.Value() != 0 {
+		t.Errorf("expected an empty dead-letter list, got %d", depth)
+	}
+}
+
+// batchMemStore is a memStore that also records WriteSearches calls.
+type batchMemStore struct {
+	memStore
+	batches [][]SearchEntry
+}
+
+func (m *batchMemStore) WriteSearches(ctx context.Context, entries []SearchEntry) error {
+	m.batches = append(m.batches, entries)
+	return nil
+}
+
+func TestWriteSearches_UsesOneBatch(t *testing.T) {
+	store := &batchMemStore{}
+	logger := &Logger{Store: store}
+
+	err := logger.writeSearches(context.Background(), []SearchEntry{
+		{UserID: "u", Query: "shoes"},
+		{UserID: "u", Query: ""},
+		{UserID: "u", Query: "socks"},
+	})
+	if err != nil {
+		t.Fatalf("writeSearches error: %v", err)
+	}
+	if len(store.batches) != 1 || len(store.batches[0]) != 2 || len(store.entries) != 0 {
+		t.Errorf("expected one batch of 2 entries, got %v (single writes %v)", store.batches, store.entries)
+	}
+
+	store = &batchMemStore{}
+	logger.Store = store
+	_ = logger.writeSearches(context.Background(), []SearchEntry{{UserID: "u", Query: "hats"}})
+	if len(store.batches) != 0 || len(store.entries) != 1 {
+		t.Errorf("expected a single entry to use WriteSearch")
+	}
+}
+
+func TestHandleExpired_Coalesces(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.ExpiryCoalesceWindow = 30 * time.Millisecond
+	userID := "test-coalesce"
+
+	buffered, _ := encodeBuffer(SearchEntry{UserID: userID, Query: "lamps"})
+	logger.Redis.Set(ctx, buildBufferKey(sessionKeyID(userID, "")), buffered, time.Minute)
+	logger.handleExpired(sessionKeyID(userID, ""))
+	logger.handleExpired(sessionKeyID(userID, ""))
+
+	time.Sleep(100 * time.Millisecond)
+	n := len(store.EntriesFor(userID))
+	if n != 1 {
+		t.Errorf("expected repeated expirations to be flushed once, got %d rows", n)
+	}
+}
+
+func TestFlushPending_WritesCoalescedExpiry(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.ExpiryCoalesceWindow = time.Hour
+	userID := "test-coalesce-shutdown"
+
+	buffered, _ := encodeBuffer(SearchEntry{UserID: userID, Query: "lamps"})
+	logger.Redis.Set(ctx, buildBufferKey(sessionKeyID(userID, "")), buffered, time.Minute)
+	logger.handleExpired(sessionKeyID(userID, ""))
+	logger.FlushPending()
+
+	if got := latestQuery(t, store, userID); got != "lamps" {
+		t.Errorf("expected the coalesced expiry to be written by FlushPending, got %q", got)
+	}
+}
+
+func TestFlushAll_AfterContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	logger, store := setupMemoryLogger(t)
+	userID := "test-shutdown"
+
+	if err := logger.LogSearch(ctx, userID, "TestAgent", "lamps"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	// Shutdown cancels the application context before the final flush.
+	cancel()
+	n, err := logger.FlushAll()
+	if err != nil || n != 1 {
+		t.Fatalf("expected one session flushed, got %d, err=%v", n, err)
+	}
+	if got := latestQuery(t, store, userID); got != "lamps" {
+		t.Errorf("expected 'lamps' to be written, got '%s'", got)
+	}
+	if exists, _ := logger.Redis.Exists(context.Background(), buildBufferKey(sessionKeyID(userID, ""))).Result(); exists != 0 {
+		t.Errorf("expected the buffer to be removed after flushing")
+	}
+}
+
+func TestFlushAll_LegacyUnmarkedKeys(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+
+	// A session buffered before keys were marked with user: or anon:.
+	buffered, _ := encodeBuffer(SearchEntry{UserID: "user:42", Query: "lamps"})
+	if err := logger.Redis.Set(ctx, buildBufferKey("user:42"), buffered, 0).Err(); err != nil {
+		t.Fatalf("Redis set error: %v", err)
+	}
+	if n, err := logger.FlushAll(); err != nil || n != 1 {
+		t.Fatalf("expected one session flushed, got %d, err=%v", n, err)
+	}
+	if got := latestQuery(t, store, "user:42"); got != "lamps" {
+		t.Errorf("expected the legacy session flushed for its own user, got %q", got)
+	}
+}
+
+func TestDebounce_UserAndAnonWithSameIDAreSeparate(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.DebounceInterval = 20 * time.Millisecond
+
+	// A user id that happens to equal an anon id.
+	userID := generateAnonID("UA")
+	if err := logger.LogSearch(ctx, userID, "UA", "lamps"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	if err := logger.LogSearch(ctx, "", "UA", "sofas"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for id, want := range map[string]string{sessionKeyID(userID, ""): "lamps", sessionKeyID("", userID): "sofas"} {
+		if got, _ := logger.Redis.Get(ctx, buildRedisKey(id)).Result(); got != want {
+			t.Errorf("expected %q live for %s, got %q", want, id, got)
+		}
+	}
+}
+
+func TestPaused_NoWritePathTouchesRedisOrDB(t *testing.T) {
+	ctx := context.Background()
+	// Without Redis or a DB, any write path reached would panic.
+	logger := &Logger{ResetGrace: time.Millisecond}
+	logger.SetPaused(true)
+
+	if err := logger.RecordResult(ctx, ResultSelection{UserID: "u", Query: "shoes", ResultID: "sku-1", Position: 1}); err != nil {
+		t.Errorf("RecordResult: expected nil while paused, got %v", err)
+	}
+	if err := logger.FlushSession(ctx, "u", "UA", ""); err != nil {
+		t.Errorf("FlushSession: expected nil while paused, got %v", err)
+	}
+	if n, err := logger.FlushAll(); n != 0 || err != nil {
+		t.Errorf("FlushAll: expected nothing flushed while paused, got %d, %v", n, err)
+	}
+	logger.flushExpired(sessionKeyID("u", ""))
+	logger.idleCommit(sessionKeyID("u", ""))
+}
+
+type recordingEmitter struct{ entries []SearchEntry }
+
+func (e *recordingEmitter) EmitSearch(ctx context.Context, entry SearchEntry) {
+	e.entries = append(e.entries, entry)
+}
+
+func TestEmitter_ReceivesCommittedSearches(t *testing.T) {
+	emitter := &recordingEmitter{}
+	logger := &Logger{Store: &MemoryStore{}, Emitter: emitter}
+
+	_ = logger.writeSearch(context.Background(), SearchEntry{UserID: "u", Query: "lamps", Outcome: OutcomeSuccess})
+	_ = logger.writeSearch(context.Background(), SearchEntry{UserID: "u", Query: ""})
+	if len(emitter.entries) != 1 || emitter.entries[0].Query != "lamps" || emitter.entries[0].Outcome != OutcomeSuccess {
+		t.Errorf("expected only the committed search to be emitted, got %v", emitter.entries)
+	}
+}
+
+func TestAnonSessionsPerIP_OverflowBucketed(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.AnonSessionsPerIP = 2
+
+	for i, ua := range []string{"UA-1", "UA-2", "UA-3", "UA-1"} {
+		req := SearchRequest{UserAgent: ua, ClientIP: "203.0.113.7", Query: "lamps"}
+		if err := logger.LogSearchRequest(ctx, req); err != nil {
+			t.Fatalf("LogSearchRequest %d error: %v", i, err)
+		}
+	}
+	// Another overflowing client does not reset the third one's query.
+	if err := logger.LogSearchRequest(ctx, SearchRequest{UserAgent: "UA-5", ClientIP: "203.0.113.7", Query: "tables"}); err != nil {
+		t.Fatalf("LogSearchRequest error: %v", err)
+	}
+	if entries := store.Entries(); len(entries) != 0 {
+		t.Fatalf("expected overflowing clients to keep separate sessions, got %v", entries)
+	}
+	if err := logger.FlushSession(ctx, "", "UA-3", ""); err != nil {
+		t.Fatalf("FlushSession error: %v", err)
+	}
+	if entries := store.Entries(); len(entries) != 1 || entries[0].Query != "lamps" || entries[0].AnonID != OverflowAnonID {
+		t.Errorf("expected 'lamps' committed under %s, got %v", OverflowAnonID, entries)
+	}
+	if n, _ := logger.Redis.SCard(ctx, buildIPAnonKey("203.0.113.7")).Result(); n != 2 {
+		t.Errorf("expected 2 anon ids remembered for the IP, got %d", n)
+	}
+
+	logger.AnonOverflow = AnonOverflowReject
+	err := logger.LogSearchRequest(ctx, SearchRequest{UserAgent: "UA-4", ClientIP: "203.0.113.7", Query: "lamps"})
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected ErrInvalidRequest beyond the cap, got %v", err)
+	}
+}
+
+func TestCompletenessScorer_CommitsOncePerSession(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.CompletenessScorer = LengthCompleteness(5)
+	userID := "test-complete"
+
+	for _, q := range []string{"lam", "lamps", "lampsh", "lamps"} {
+		if err := logger.LogSearch(ctx, userID, "TestAgent", q); err != nil {
+			t.Fatalf("LogSearch error: %v", err)
+		}
+		if q == "lamps" && len(store.EntriesFor(userID)) != 1 {
+			t.Fatalf("expected 'lamps' to be committed once complete, got %v", store.EntriesFor(userID))
+		}
+	}
+	if err := logger.FlushUser(ctx, userID, ""); err != nil {
+		t.Fatalf("FlushUser error: %v", err)
+	}
+	entries := store.EntriesFor(userID)
+	if len(entries) != 1 || entries[0].Query != "lamps" || entries[0].CommittedQuery != "" {
+		t.Errorf("expected the early commit not to be repeated, got %v", entries)
+	}
+}
+
+func TestPopularTermCommits_CommitsKnownTermAtOnce(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.PopularTermCommits = 3
+	day := time.Date(2024, 6, 2, 12, 0, 0, 0, time.UTC)
+	logger.Now = func() time.Time { return day }
+	userID := "test-popular"
+
+	// Two commits yesterday and one today make "shoes" popular; "socks" is not.
+	yesterday := buildCountKey(logger.dayOf(day.AddDate(0, 0, -1)), "shoes")
+	today := buildCountKey(logger.dayOf(day), "shoes")
+	if err := logger.Redis.MSet(ctx, yesterday, 2, today, 1).Err(); err != nil {
+		t.Fatalf("MSet error: %v", err)
+	}
+	t.Cleanup(func() { logger.Redis.Del(ctx, yesterday, today) })
+
+	for _, q := range []string{"sock", "socks", "shoe"} {
+		_ = logger.LogSearch(ctx, userID, "TestAgent", q)
+	}
+	if entries := store.EntriesFor(userID); len(entries) != 1 || entries[0].Query != "socks" {
+		t.Fatalf("expected only 'socks' committed by the reset, got %v", entries)
+	}
+	if err := logger.LogSearch(ctx, userID, "TestAgent", "shoes"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	entries := store.EntriesFor(userID)
+	if len(entries) != 2 || entries[1].Query != "shoes" {
+		t.Errorf("expected 'shoes' committed as soon as it was typed, got %v", entries)
+	}
+}
+
+func TestEndSession_CommitsLiveQueryAndStartsFresh(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-blur"
+
+	for _, q := range []string{"lam", "lamps"} {
+		if err := logger.LogSearch(ctx, userID, "TestAgent", q); err != nil {
+			t.Fatalf("LogSearch error: %v", err)
+		}
+	}
+	if err := logger.EndSession(ctx, userID, "TestAgent", ""); err != nil {
+		t.Fatalf("EndSession error: %v", err)
+	}
+	if entries := store.EntriesFor(userID); len(entries) != 1 || entries[0].Query != "lamps" {
+		t.Fatalf("expected 'lamps' committed on blur, got %v", entries)
+	}
+
+	// Refocusing and typing a query the old session would have extended
+	// starts a new session rather than resuming it.
+	if err := logger.LogSearch(ctx, userID, "TestAgent", "lamps for kids"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	if live, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID(userID, ""))).Result(); live != "lamps for kids" {
+		t.Errorf("expected a fresh live query, got %q", live)
+	}
+	if err := logger.EndSession(ctx, userID, "TestAgent", ""); err != nil {
+		t.Fatalf("EndSession error: %v", err)
+	}
+	if entries := store.EntriesFor(userID); len(entries) != 2 || entries[1].Query != "lamps for kids" {
+		t.Errorf("expected the second session committed separately, got %v", entries)
+	}
+	if err := logger.EndSession(ctx, userID, "TestAgent", ""); err != nil || len(store.EntriesFor(userID)) != 2 {
+		t.Errorf("expected ending an ended session to do nothing, err=%v", err)
+	}
+}
+
+func TestLengthCompleteness(t *testing.T) {
+	score := LengthCompleteness(4)
+	if s := score("ab"); s != 0.5 {
+		t.Errorf("expected 0.5 for half the length, got %v", s)
+	}
+	if s := score("lamps"); s != 1 {
+		t.Errorf("expected scores to be capped at 1, got %v", s)
+	}
+}
+
+func TestTrajectoryMode_StoredWithCommit(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.TrajectoryMode = true
+	logger.MaxTrajectory = 3
+	userID := "test-trajectory"
+
+	for _, q := range []string{"l", "la", "Lam", "lamp", "lamps", "chairs"} {
+		if err := logger.LogSearch(ctx, userID, "TestAgent", q); err != nil {
+			t.Fatalf("LogSearch error: %v", err)
+		}
+	}
+	entry, ok := store.Latest(userID)
+	if !ok || entry.Query != "lamps" {
+		t.Fatalf("expected 'lamps' to be committed by the reset, got %v", entry)
+	}
+	var got []string
+	for _, k := range entry.Trajectory {
+		got = append(got, k.Query)
+	}
+	if strings.Join(got, ",") != "Lam,lamp,lamps" {
+		t.Errorf("expected the last 3 keystrokes before the reset, got %v", got)
+	}
+
+	if err := logger.FlushUser(ctx, userID, ""); err != nil {
+		t.Fatalf("FlushUser error: %v", err)
+	}
+	entry, _ = store.Latest(userID)
+	if len(entry.Trajectory) != 1 || entry.Trajectory[0].Query != "chairs" {
+		t.Errorf("expected the new session's trajectory to start at the reset, got %v", entry.Trajectory)
+	}
+}
+
+func TestClearSession_DiscardsWithoutCommit(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-clear"
+
+	if err := logger.LogSearch(ctx, userID, "TestAgent", "lamps"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	if err := logger.ClearSession(ctx, userID, "TestAgent", ""); err != nil {
+		t.Fatalf("ClearSession error: %v", err)
+	}
+	if n, _ := logger.Redis.Exists(ctx, buildRedisKey(sessionKeyID(userID, "")), buildBufferKey(sessionKeyID(userID, ""))).Result(); n != 0 {
+		t.Errorf("expected the session keys to be deleted, %d remain", n)
+	}
+	if err := logger.FlushUser(ctx, userID, ""); err != nil {
+		t.Fatalf("FlushUser error: %v", err)
+	}
+	if entries := store.EntriesFor(userID); len(entries) != 0 {
+		t.Errorf("expected nothing to be committed, got %v", entries)
+	}
+}
+
+func TestCommitDedupWindow_SuppressesBurstOnly(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.CommitDedupWindow = 200 * time.Millisecond
+	entry := SearchEntry{UserID: "test-commit-dedup", Query: "lamps"}
+
+	for i := 0; i < 3; i++ {
+		if err := logger.writeSearch(ctx, entry); err != nil {
+			t.Fatalf("writeSearch error: %v", err)
+		}
+	}
+	if n := len(store.EntriesFor(entry.UserID)); n != 1 {
+		t.Fatalf("expected a burst of the same query to be written once, got %d rows", n)
+	}
+	if err := logger.writeSearch(ctx, SearchEntry{UserID: entry.UserID, Query: "chairs"}); err != nil {
+		t.Fatalf("writeSearch error: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if err := logger.writeSearch(ctx, entry); err != nil {
+		t.Fatalf("writeSearch error: %v", err)
+	}
+	if n := len(store.EntriesFor(entry.UserID)); n != 3 {
+		t.Errorf("expected other queries and later repeats to be written, got %d rows", n)
+	}
+}
+
+func TestCommitDedupWindow_ReleasedOnFailedWrite(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.CommitDedupWindow = time.Minute
+	store := &memStore{err: errors.New("db down")}
+	logger.Store = store
+	entry := SearchEntry{UserID: "test-commit-dedup-fail", Query: "lamps"}
+
+	if err := logger.writeSearch(ctx, entry); err == nil {
+		t.Fatalf("expected the write to fail")
+	}
+	store.err = nil
+	if err := logger.writeSearch(ctx, entry); err != nil || len(store.entries) != 1 {
+		t.Errorf("expected the retry to be written, got %v, err=%v", store.entries, err)
+	}
+}
+
+func TestDailyUserCap_DropsBeyondCap(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.DailyUserCap = 2
+	store := &memStore{err: errors.New("db down")}
+	logger.Store = store
+	userID := "test-daily-cap"
+	before := metrics.DailyUserCapDropped.Value()
+
+	// A failed write does not use up the cap.
+	if err := logger.writeSearch(ctx, SearchEntry{UserID: userID, Query: "lamps"}); err == nil {
+		t.Fatalf("expected the write to fail")
+	}
+	store.err = nil
+	for _, q := range []string{"lamps", "chairs", "tables"} {
+		if err := logger.writeSearch(ctx, SearchEntry{UserID: userID, Query: q}); err != nil {
+			t.Fatalf("writeSearch error: %v", err)
+		}
+	}
+	if len(store.entries) != 2 || store.entries[1].Query != "chairs" {
+		t.Errorf("expected the first 2 searches to be written, got %v", store.entries)
+	}
+	if d := metrics.DailyUserCapDropped.Value() - before; d != 1 {
+		t.Errorf("expected 1 dropped commit, got %d", d)
+	}
+	if err := logger.writeSearch(ctx, SearchEntry{UserID: "other-user", Query: "lamps"}); err != nil || len(store.entries) != 3 {
+		t.Errorf("expected other users to be unaffected, got %v, err=%v", store.entries, err)
+	}
+}
+
+func TestDBError_SchemaMissing(t *testing.T) {
+	err := dbError(&pq.Error{Code: "42P01", Message: `relation "user_searches" does not exist`})
+	if !errors.Is(err, ErrSchemaMissing) || !errors.Is(err, ErrDBWrite) {
+		t.Errorf("expected a missing table to match ErrSchemaMissing and ErrDBWrite, got %v", err)
+	}
+	if err := dbError(errors.New("connection refused")); errors.Is(err, ErrSchemaMissing) {
+		t.Errorf("expected other failures not to match ErrSchemaMissing")
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	if k := (&Logger{}).ShardKey(SearchEntry{UserID: "u1"}); k != 0 {
+		t.Errorf("expected shard 0 without Shards, got %d", k)
+	}
+
+	four := &Logger{Shards: make([]*sql.DB, 4)}
+	five := &Logger{Shards: make([]*sql.DB, 5)}
+	used := map[int]bool{}
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		entry := SearchEntry{UserID: fmt.Sprintf("user-%d", i)}
+		k := four.ShardKey(entry)
+		if k != four.ShardKey(entry) {
+			t.Fatalf("ShardKey is not deterministic for %s", entry.UserID)
+		}
+		used[k] = true
+		// Adding a shard only moves users onto the new shard.
+		if k5 := five.ShardKey(entry); k5 != k {
+			if k5 != 4 {
+				t.Errorf("%s moved from shard %d to %d", entry.UserID, k, k5)
+			}
+			moved++
+		}
+	}
+	if len(used) != 4 {
+		t.Errorf("expected users on all 4 shards, got %v", used)
+	}
+	if moved < 100 || moved > 300 {
+		t.Errorf("expected about 1/5 of users to move, got %d", moved)
+	}
+
+	anon := SearchEntry{AnonID: "anon123"}
+	if four.ShardKey(anon) != four.shardIndex("anon123") {
+		t.Errorf("expected anonymous users to be sharded by anon id")
+	}
+}
+
+func TestBuildInsert_Latency(t *testing.T) {
+	latency := int64(0)
+	query, args := buildInsert(SearchEntry{UserID: "u", Query: "shoes", LatencyMS: &latency})
+	want := "INSERT INTO user_searches (user_id, search_text, anon_id, latency_ms, last_searched_at) VALUES ($1, $2, $3, $4, NOW())"
+	if query != want || args[3] != int64(0) {
+		t.Errorf("unexpected insert for a zero latency:\n got %s %v\nwant %s", query, args, want)
+	}
+}
+
+func TestLinkAnonToUser_RequiresBothIDs(t *testing.T) {
+	logger := &Logger{}
+	if err := logger.LinkAnonToUser(context.Background(), "anon", ""); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected ErrInvalidRequest, got %v", err)
+	}
+}
+
+func TestWriteSearch_UniqueViolationModes(t *testing.T) {
+	ctx := context.Background()
+	conflict := &memStore{err: &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}}
+	entry := SearchEntry{UserID: "u", Query: "shoes"}
+
+	logger := &Logger{Store: conflict}
+	err := logger.writeSearch(ctx, entry)
+	if !errors.Is(err, ErrDBWrite) || !IsUniqueViolation(err) {
+		t.Errorf("error mode: expected a unique violation matching ErrDBWrite, got %v", err)
+	}
+
+	logger.OnConflict = ConflictIgnore
+	if err := logger.writeSearch(ctx, entry); err != nil {
+		t.Errorf("ignore mode: expected the conflict to be ignored, got %v", err)
+	}
+	logger.Store = &memStore{err: errors.New("db down")}
+	if err := logger.writeSearch(ctx, entry); err == nil || IsUniqueViolation(err) {
+		t.Errorf("ignore mode: expected other errors to be returned, got %v", err)
+	}
+}
+
+func TestBuildInsertAs_TermID(t *testing.T) {
+	query, args := buildInsertAs(SearchEntry{UserID: "u", Query: "shoes"}, "term_id", int64(7))
+	if !strings.HasPrefix(query, "INSERT INTO user_searches (user_id, term_id, anon_id, last_searched_at)") {
+		t.Errorf("unexpected insert: %s", query)
+	}
+	if len(args) != 3 || args[1] != int64(7) {
+		t.Errorf("expected the term id as the second argument, got %v", args)
+	}
+}
+
+func TestCaptureSearchTime_UsesSearchTimeNotCommitTime(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-capture-time"
+	typed := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	now := typed
+	logger.Now = func() time.Time { return now }
+
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "shoes")
+	now = typed.Add(time.Minute)
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "socks") // commits "shoes"
+	if entry, ok := store.Latest(userID); !ok || !entry.Timestamp.IsZero() {
+		t.Errorf("expected no timestamp without CaptureSearchTime, got %+v", entry)
+	}
+
+	logger.CaptureSearchTime = true
+	now = typed.Add(2 * time.Minute)
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "hats") // commits "socks", typed before capturing
+	now = typed.Add(3 * time.Minute)
+	_ = logger.LogSearch(ctx, userID, "TestAgent", "gloves") // commits "hats"
+
+	entry, ok := store.Latest(userID)
+	if !ok || entry.Query != "hats" || !entry.Timestamp.Equal(typed.Add(2*time.Minute)) {
+		t.Errorf("expected 'hats' stamped with its search time, got %+v", entry)
+	}
+}
+
+func TestTopGaps_CountsZeroResultCommits(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.TrackGaps = true
+
+	for _, userID := range []string{"test-gap-1", "test-gap-2"} {
+		_ = logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, Query: "unicorn socks", Outcome: OutcomeNoResults})
+		_ = logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, Query: "socks", Outcome: OutcomeSuccess}) // commits "unicorn socks"
+		_ = logger.LogSearchRequest(ctx, SearchRequest{UserID: userID, Query: "hats", Submit: true})             // commits "socks"
+	}
+
+	gaps, err := logger.TopGaps(ctx, 10)
+	if err != nil {
+		t.Fatalf("TopGaps error: %v", err)
+	}
+	if len(gaps) != 1 || gaps[0] != (TermCount{Term: "unicorn socks", Count: 2}) {
+		t.Errorf("expected only 'unicorn socks' twice, got %v", gaps)
+	}
+}
+
+func TestReceiveExpired_OverflowRequestsReconcile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger, _ := setupMemoryLogger(t)
+	pubsub := logger.Redis.PSubscribe(ctx, "__keyevent@0__:expired")
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	ch := make(chan string, 1)
+	reconcile := make(chan struct{}, 1)
+	go logger.receiveExpired(ctx, pubsub, ch, reconcile)
+
+	before := metrics.ExpiryEventsDropped.Value()
+	for _, id := range []string{"a", "b", "c"} {
+		logger.Redis.Publish(ctx, "__keyevent@0__:expired", buildRedisKey(id))
+	}
+	select {
+	case <-reconcile:
+	case <-time.After(time.Second):
+		t.Fatal("expected a reconcile request after the buffer overflowed")
+	}
+	if got := <-ch; got != buildRedisKey("a") {
+		t.Errorf("expected the first event to be buffered, got %q", got)
+	}
+	if dropped := metrics.ExpiryEventsDropped.Value() - before; dropped < 1 {
+		t.Errorf("expected dropped events to be counted, got %d", dropped)
+	}
+}
+
+func TestMinDwell_DiscardsTransientQuery(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.MinDwell = 200 * time.Millisecond
+	userID := "test-min-dwell"
+
+	for _, q := range []string{"lamps", "chairs"} {
+		if err := logger.LogSearch(ctx, userID, "", q); err != nil {
+			t.Fatalf("LogSearch error: %v", err)
+		}
+	}
+	if n := len(store.EntriesFor(userID)); n != 0 {
+		t.Fatalf("expected a query replaced within MinDwell to be discarded, got %d rows", n)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if err := logger.LogSearch(ctx, userID, "", "tables"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	if got := latestQuery(t, store, userID); got != "chairs" {
+		t.Errorf("expected the query that dwelt to be committed, got %q", got)
+	}
+}
+
+func TestOnCommit_FanOutUntilCancelled(t *testing.T) {
+	logger := &Logger{Store: &MemoryStore{}}
+	var a, b []string
+	cancelA := logger.OnCommit(func(entry SearchEntry) { a = append(a, entry.Query) })
+	cancelB := logger.OnCommit(func(entry SearchEntry) { b = append(b, entry.Query) })
+	defer cancelB()
+
+	_ = logger.writeSearch(context.Background(), SearchEntry{UserID: "u", Query: "lamps"})
+	cancelA()
+	_ = logger.writeSearch(context.Background(), SearchEntry{UserID: "u", Query: "chairs"})
+	if len(a) != 1 || a[0] != "lamps" {
+		t.Errorf("expected the cancelled subscriber to see only 'lamps', got %v", a)
+	}
+	if len(b) != 2 {
+		t.Errorf("expected the remaining subscriber to see both commits, got %v", b)
+	}
+}
+
+func TestStoredIP(t *testing.T) {
+	cases := []struct {
+		mode IPStorageMode
+		in   string
+		want string
+	}{
+		{IPStorageOff, "203.0.113.7", ""},
+		{IPStorageRaw, "203.0.113.7", "203.0.113.7"},
+		{IPStorageRaw, "not-an-ip", ""},
+		{IPStorageTruncated, "203.0.113.7", "203.0.113.0"},
+		{IPStorageTruncated, "2001:db8:abcd:12::1", "2001:db8:abcd::"},
+	}
+	for _, c := range cases {
+		l := &Logger{IPStorage: c.mode}
+		if got := l.storedIP(c.in); got != c.want {
+			t.Errorf("storedIP(%q) with mode %d = %q, want %q", c.in, c.mode, got, c.want)
+		}
+	}
+
+	a := &Logger{IPStorage: IPStorageHashed, IPSalt: "a"}
+	b := &Logger{IPStorage: IPStorageHashed, IPSalt: "b"}
+	if h := a.storedIP("203.0.113.7"); h == "" || h == "203.0.113.7" || h != a.storedIP("203.0.113.7") || h == b.storedIP("203.0.113.7") {
+		t.Errorf("expected a stable, salt-dependent hash, got %q", h)
+	}
+}
+
+func TestRand_SeededSourceIsDeterministic(t *testing.T) {
+	a := &Logger{Rand: rand.NewSource(42)}
+	b := &Logger{Rand: rand.NewSource(42)}
+	for i := 0; i < 100; i++ {
+		if a.sampled(0.5) != b.sampled(0.5) {
+			t.Fatalf("expected identical sampling decisions from the same seed at draw %d", i)
+		}
+		if da, db := a.jitter(time.Second, 0.2), b.jitter(time.Second, 0.2); da != db || da < 800*time.Millisecond || da >= 1200*time.Millisecond {
+			t.Fatalf("expected identical jitter within ±20%% at draw %d, got %v and %v", i, da, db)
+		}
+	}
+	if a.sampled(0) || !a.sampled(1) {
+		t.Error("expected rates of 0 and 1 to drop and keep without drawing")
+	}
+}
+
+func TestLastQueryCache_EvictsExpiresAndBypassesShared(t *testing.T) {
+	var c lastQueryCache
+	t0 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	exp := t0.Add(2 * time.Second)
+
+	c.put("a", "sho", exp, 2)
+	c.put("b", "hat", exp, 2)
+	c.get("a", t0) // b is now least recently used
+	c.put("c", "cap", exp, 2)
+	if _, ok := c.get("b", t0); ok {
+		t.Error("expected the least recently used id to be evicted")
+	}
+	if q, ok := c.get("a", t0); !ok || q != "sho" {
+		t.Errorf("expected 'sho' cached for a, got %q, %t", q, ok)
+	}
+	if _, ok := c.get("a", exp); ok {
+		t.Error("expected the entry to expire")
+	}
+
+	c.markShared("c", t0.Add(time.Minute), 2)
+	c.put("c", "caps", exp, 2)
+	c.forget("c")
+	if _, ok := c.get("c", t0); ok {
+		t.Error("expected a shared id to stay uncached")
+	}
+	c.put("c", "caps", t0.Add(2*time.Minute), 2)
+	if q, ok := c.get("c", t0.Add(time.Minute)); !ok || q != "caps" {
+		t.Errorf("expected the id cached again once the shared mark expired, got %q, %t", q, ok)
+	}
+}
+
+func TestRefinementChains(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(id, q string, min int) SearchEntry {
+		return SearchEntry{UserID: id, Query: q, Timestamp: t0.Add(time.Duration(min) * time.Minute)}
+	}
+	entries := []SearchEntry{
+		at("a", "sho", 0),
+		at("a", "shoes", 1),
+		at("a", "shoes", 2), // repeat, skipped
+		at("a", "shoes red", 3),
+		at("a", "lamps", 4), // unrelated: new chain
+		at("a", "lamps desk", 5),
+		at("a", "lamps desk led", 30), // after RefinementGap: new chain of one
+		at("b", "red shoes", 0),
+		at("b", "red boots", 1), // same first word
+		at("c", "sho", 0),       // different user: not joined to b's chain
+	}
+	got := refinementChains(entries)
+	want := [][]string{
+		{"sho", "shoes", "shoes red"},
+		{"lamps", "lamps desk"},
+		{"red shoes", "red boots"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("refinementChains = %v, want %v", got, want)
+	}
+}
+
+func TestHistoryCache_ExtendedOnCommit(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.HistoryCacheSize = 2
+	userID := "test-history-cache"
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+
+	logger.fillHistory(ctx, userID, []SearchEntry{{UserID: userID, Query: "socks", Timestamp: t0}})
+	for _, q := range []string{"shoes", "lamps"} {
+		if err := logger.writeSearch(ctx, SearchEntry{UserID: userID, Query: q}); err != nil {
+			t.Fatalf("writeSearch error: %v", err)
+		}
+	}
+
+	if n, err := logger.Redis.LLen(ctx, buildHistoryKey(userID)).Result(); err != nil || n != 2 {
+		t.Fatalf("expected the commits to extend the cached list to 2, got %d, err=%v", n, err)
+	}
+
+	// The logger has no DB, so the page must come from the cache.
+	entries, next, err := logger.RecentSearchesPage(ctx, userID, Page{Limit: 2})
+	if err != nil {
+		t.Fatalf("RecentSearchesPage error: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Query != "lamps" || entries[1].Query != "shoes" || entries[0].Timestamp.IsZero() {
+		t.Fatalf("expected the cached 'lamps' then 'shoes', got %+v", entries)
+	}
+	if next == nil || !next.At.Equal(entries[1].Timestamp) {
+		t.Errorf("expected a cursor after 'shoes', got %+v", next)
+	}
+	if n, _ := logger.Redis.Exists(ctx, buildHistoryKey("test-history-other")).Result(); n != 0 {
+		t.Error("expected no list to be created for an id that was not cached")
+	}
+}
+
+func TestScrubPII(t *testing.T) {
+	l := &Logger{}
+	cases := []struct {
+		in, want string
+	}{
+		{"refund john.doe+shop@example.co.uk", "refund [email]"},
+		{"card 4111 1111 1111 1111 declined", "card [card] declined"},
+		{"4111-1111-1111-1111", "[card]"},
+		{"378282246310005", "[card]"},
+		{"ssn 123-45-6789", "ssn [ssn]"},
+		{"transfer GB82 WEST 1234 5698 7654 32", "transfer [iban]"},
+		{"de89370400440532013000", "[iban]"},
+		{"call +44 20 7946 0958", "call [phone]"},
+		{"+1 (415) 555-2671", "[phone]"},
+		// Not PII: failed checksums, unissued SSNs and ordinary numbers.
+		{"4111 1111 1111 1112", "4111 1111 1111 1112"},
+		{"000-12-3456", "000-12-3456"},
+		{"GB82 WEST 1234 5698 7654 33", "GB82 WEST 1234 5698 7654 33"},
+		{"order 1234567", "order 1234567"},
+		{"iphone 15 pro 256gb", "iphone 15 pro 256gb"},
+		{"2024-01-15", "2024-01-15"},
+		{"user@localhost", "user@localhost"},
+	}
+	for _, c := range cases {
+		got, found := l.scrubPII(c.in)
+		if got != c.want || found != (c.in != c.want) {
+			t.Errorf("scrubPII(%q) = %q, %t; want %q", c.in, got, found, c.want)
+		}
+	}
+
+	l.PIIPatterns = append(DefaultPIIPatterns(), PIIPattern{Name: "ticket", Regexp: regexp.MustCompile(`tkt-\d+`)})
+	if got, _ := l.scrubPII("status tkt-42"); got != "status [ticket]" {
+		t.Errorf("expected a custom pattern to be applied, got %q", got)
+	}
+}
+
+func TestPIIMode_DiscardsPartialPrefix(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.PIIMode = PIIRedact
+	userID := "test-pii"
+
+	for _, q := range []string{"john@exam", "john@example.com", "shoes"} {
+		if err := logger.LogSearch(ctx, userID, "", q); err != nil {
+			t.Fatalf("LogSearch error: %v", err)
+		}
+	}
+	entries := store.EntriesFor(userID)
+	if len(entries) != 1 || entries[0].Query != "[email]" {
+		t.Errorf("expected only the redacted query to be committed, got %+v", entries)
+	}
+
+	logger.PIIMode = PIIDrop
+	for _, q := range []string{"4111 1111", "4111 1111 1111 1111"} {
+		if err := logger.LogSearch(ctx, userID, "", q); err != nil {
+			t.Fatalf("LogSearch error: %v", err)
+		}
+	}
+	if live, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID(userID, ""))).Result(); live != "" {
+		t.Errorf("expected the partial card number to be discarded, got live query %q", live)
+	}
+}
+
+func TestOnSessionStart_CalledOncePerSession(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	var starts []SessionStart
+	logger.OnSessionStart = func(_ context.Context, start SessionStart) { starts = append(starts, start) }
+	userID := "test-session-start"
+
+	for _, q := range []string{"sho", "shoes", "lamps"} {
+		if err := logger.LogSearch(ctx, userID, "", q); err != nil {
+			t.Fatalf("LogSearch error: %v", err)
+		}
+	}
+	if err := logger.FlushUser(ctx, userID, ""); err != nil {
+		t.Fatalf("FlushUser error: %v", err)
+	}
+	if err := logger.LogSearch(ctx, userID, "", "chairs"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+
+	if len(starts) != 2 || starts[0].Query != "sho" || starts[0].UserID != userID || starts[1].Query != "chairs" {
+		t.Errorf("expected starts for 'sho' and, after the flush, 'chairs', got %+v", starts)
+	}
+}
+
+// failingTxHook fails every transaction while fail is set, as if Redis
+// rejected it.
+type failingTxHook struct{ fail bool }
+
+func (h *failingTxHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *failingTxHook) AfterProcess(context.Context, redis.Cmder) error { return nil }
+
+func (h *failingTxHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	if h.fail {
+		return ctx, errors.New("transaction rejected")
+	}
+	return ctx, nil
+}
+
+func (h *failingTxHook) AfterProcessPipeline(context.Context, []redis.Cmder) error { return nil }
+
+// failingGetHook fails the next failures GETs or GETDELs of key, as if Redis
+// timed out.
+type failingGetHook struct {
+	key      string
+	failures int
+}
+
+func (h *failingGetHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if (cmd.Name() == "get" || cmd.Name() == "getdel") && len(cmd.Args()) == 2 && cmd.Args()[1] == h.key && h.failures > 0 {
+		h.failures--
+		return ctx, errors.New("i/o timeout")
+	}
+	return ctx, nil
+}
+
+func (h *failingGetHook) AfterProcess(context.Context, redis.Cmder) error { return nil }
+
+func (h *failingGetHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *failingGetHook) AfterProcessPipeline(context.Context, []redis.Cmder) error { return nil }
+
+func TestFlushExpired_MissingBufferIsNotAnError(t *testing.T) {
+	logger, store := setupMemoryLogger(t)
+	userID := "test-missing-buffer"
+	if err := logger.Redis.Del(context.Background(), buildBufferKey(sessionKeyID(userID, ""))).Err(); err != nil {
+		t.Fatalf("Del error: %v", err)
+	}
+	missing := metrics.BuffersMissing.Value()
+
+	logger.flushExpired(sessionKeyID(userID, ""))
+	if len(store.EntriesFor(userID)) != 0 {
+		t.Errorf("expected nothing flushed, got %v", store.EntriesFor(userID))
+	}
+	if metrics.BuffersMissing.Value() != missing+1 {
+		t.Error("expected the missing buffer to be counted")
+	}
+}
+
+func TestFlushExpired_RetriesRedisErrors(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-buffer-retry"
+	if err := logger.LogSearch(ctx, userID, "", "shoes"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	hook := &failingGetHook{key: buildBufferKey(sessionKeyID(userID, "")), failures: bufferGetRetries}
+	logger.Redis.AddHook(hook)
+
+	logger.flushExpired(sessionKeyID(userID, ""))
+	if entries := store.EntriesFor(userID); len(entries) != 1 || entries[0].Query != "shoes" {
+		t.Errorf("expected 'shoes' flushed after the failed reads were retried, got %v", entries)
+	}
+
+	// Past the retries, the buffer is left in place rather than lost.
+	userID = "test-buffer-retry-exhausted"
+	if err := logger.LogSearch(ctx, userID, "", "hats"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	hook.key, hook.failures = buildBufferKey(sessionKeyID(userID, "")), bufferGetRetries+1
+	logger.flushExpired(sessionKeyID(userID, ""))
+	if len(store.EntriesFor(userID)) != 0 {
+		t.Errorf("expected nothing flushed, got %v", store.EntriesFor(userID))
+	}
+	if n, _ := logger.Redis.Exists(ctx, buildBufferKey(sessionKeyID(userID, ""))).Result(); n != 1 {
+		t.Error("expected the buffer to be kept for a later flush")
+	}
+}
+
+func TestLogSearch_ResetBufferReadErrorIsReturned(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "test-reset-buffer-error"
+	if err := logger.LogSearch(ctx, userID, "", "shoes"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	logger.Redis.AddHook(&failingGetHook{key: buildBufferKey(sessionKeyID(userID, "")), failures: 1})
+
+	if err := logger.LogSearch(ctx, userID, "", "flights"); !errors.Is(err, ErrRedisUnavailable) {
+		t.Fatalf("expected ErrRedisUnavailable, got %v", err)
+	}
+	if entries := store.EntriesFor(userID); len(entries) != 0 {
+		t.Errorf("expected nothing written without the buffer, got %v", entries)
+	}
+}
+
+// flushingStore records entries like memStore, but first flushes id again
+// from inside the first write, as a concurrent listener or reaper would.
+type flushingStore struct {
+	memStore
+	logger *Logger
+	id     string
+}
+
+func (s *flushingStore) WriteSearch(ctx context.Context, entry SearchEntry) error {
+	if l := s.logger; l != nil {
+		s.logger = nil
+		l.flushExpired(s.id)
+	}
+	return s.memStore.WriteSearch(ctx, entry)
+}
+
+func TestFlushExpired_ClaimsBufferOnce(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	userID := "test-buffer-claim"
+	if err := logger.LogSearch(ctx, userID, "", "shoes"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	store := &flushingStore{logger: logger, id: sessionKeyID(userID, "")}
+	logger.Store = store
+
+	logger.flushExpired(sessionKeyID(userID, ""))
+	if len(store.entries) != 1 {
+		t.Errorf("expected the buffer written once, got %v", store.entries)
+	}
+}
+
+func TestFlushExpired_RestoresBufferOnWriteFailure(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	userID := "test-buffer-restore"
+	if err := logger.LogSearch(ctx, userID, "", "shoes"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	logger.Store = &memStore{err: errors.New("db down")}
+
+	logger.flushExpired(sessionKeyID(userID, ""))
+	buffered, err := logger.Redis.Get(ctx, buildBufferKey(sessionKeyID(userID, ""))).Result()
+	if err != nil || decodeBuffer(buffered).Query != "shoes" {
+		t.Errorf("expected the buffer put back for a later flush, got %q, %v", buffered, err)
+	}
+}
+
+func TestUpdateSession_LiveKeyAndBufferSetTogether(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	hook := &failingTxHook{}
+	logger.Redis.AddHook(hook)
+	userID := "test-atomic-set"
+
+	if err := logger.LogSearch(ctx, userID, "", "shoes"); err != nil {
+		t.Fatalf("LogSearch error: %v", err)
+	}
+	hook.fail = true
+	if err := logger.LogSearch(ctx, userID, "", "shoes red"); !errors.Is(err, ErrRedisUnavailable) {
+		t.Fatalf("expected the failed transaction to be reported, got %v", err)
+	}
+	hook.fail = false
+
+	live, _ := logger.Redis.Get(ctx, buildRedisKey(sessionKeyID(userID, ""))).Result()
+	buffered, _ := logger.Redis.Get(ctx, buildBufferKey(sessionKeyID(userID, ""))).Result()
+	if live != "shoes" || decodeBuffer(buffered).Query != "shoes" {
+		t.Errorf("expected neither key to change, got live %q and buffer %q", live, buffered)
+	}
+}
+
+func TestStdoutStore_WritesJSONLines(t *testing.T) {
+	var buf strings.Builder
+	logger := &Logger{Store: &StdoutStore{W: &buf}}
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := logger.writeSearch(context.Background(), SearchEntry{UserID: "u", Query: "lamps", Location: "Paris", Timestamp: at}); err != nil {
+		t.Fatalf("writeSearch error: %v", err)
+	}
+	if err := logger.writeSearches(context.Background(), []SearchEntry{{AnonID: "a", Query: "chairs"}, {AnonID: "a", Query: "tables"}}); err != nil {
+		t.Fatalf("writeSearches error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 JSON lines, got %q", buf.String())
+	}
+	want := `{"user_id":"u","query":"lamps","timestamp":"2024-01-01T12:00:00Z","location":"Paris"}`
+	if lines[0] != want {
+		t.Errorf("got line %s, want %s", lines[0], want)
+	}
+	var entry SearchEntry
+	if err := json.Unmarshal([]byte(lines[2]), &entry); err != nil || entry.Query != "tables" || entry.AnonID != "a" || entry.Timestamp.IsZero() {
+		t.Errorf("expected a stamped 'tables' entry, got %+v, err=%v", entry, err)
+	}
+}
+
+// flakyObjects is an ObjectStore failing the first failures puts.
+type flakyObjects struct {
+	failures int
+	objects  map[string][]byte
+}
+
+func (f *flakyObjects) PutObject(ctx context.Context, key string, data []byte) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("unavailable")
+	}
+	if f.objects == nil {
+		f.objects = make(map[string][]byte)
+	}
+	f.objects[key] = data
+	return nil
+}
+
+func TestArchiveStore_FlushesWindowsAndKeepsFailedUploads(t *testing.T) {
+	ctx := context.Background()
+	objects := &flakyObjects{failures: 2}
+	archive := &ArchiveStore{Objects: objects, Prefix: "searches/", Retries: 1, RetryBackoff: time.Millisecond}
+	at := time.Date(2024, 6, 1, 15, 30, 0, 0, time.UTC)
+	for _, entry := range []SearchEntry{
+		{UserID: "u", Query: "lamps", Timestamp: at},
+		{UserID: "u", Query: "chairs", Timestamp: at.Add(10 * time.Minute)},
+		{UserID: "v", Query: "tables", Timestamp: at.Add(time.Hour)},
+	} {
+		if err := archive.WriteSearch(ctx, entry); err != nil {
+			t.Fatalf("WriteSearch error: %v", err)
+		}
+	}
+
+	// The first window fails twice, exhausting its retry; the second succeeds.
+	if err := archive.Flush(ctx); err == nil {
+		t.Fatal("expected the failed upload to be reported")
+	}
+	if len(objects.objects) != 1 {
+		t.Fatalf("expected one object after the first flush, got %d", len(objects.objects))
+	}
+	if err := archive.Flush(ctx); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+
+	lines := map[string]int{}
+	for key, data := range objects.objects {
+		if !strings.HasPrefix(key, "searches/2024/06/01/") || !strings.HasSuffix(key, ".ndjson.gz") {
+			t.Errorf("unexpected object key %s", key)
+		}
+		zr, err := gzip.NewReader(strings.NewReader(string(data)))
+		if err != nil {
+			t.Fatalf("gzip error for %s: %v", key, err)
+		}
+		body, _ := io.ReadAll(zr)
+		lines[key[len("searches/2024/06/01/"):len("searches/2024/06/01/15")]] += strings.Count(string(body), "\n")
+	}
+	if lines["15"] != 2 || lines["16"] != 1 {
+		t.Errorf("expected 2 searches in hour 15 and 1 in hour 16, got %v", lines)
+	}
+	if err := archive.Flush(ctx); err != nil || len(objects.objects) != 2 {
+		t.Errorf("expected an empty flush to upload nothing, got %d objects, err=%v", len(objects.objects), err)
+	}
+}
+
+func TestQueryGeneralizer_StoresFirstWord(t *testing.T) {
+	store := &MemoryStore{}
+	logger := &Logger{Store: store, QueryGeneralizer: FirstWord}
+	entry := SearchEntry{UserID: "u", Query: "red running shoes", RawQuery: "Red running shoes",
+		Trajectory: []Keystroke{{Query: "red"}, {Query: "red running shoes"}}}
+	if err := logger.writeSearch(context.Background(), entry); err != nil {
+		t.Fatalf("writeSearch: %v", err)
+	}
+	got, ok := store.Latest("u")
+	if !ok {
+		t.Fatal("expected the search to be stored")
+	}
+	if got.Query != "red" || got.RawQuery != "" || got.Trajectory != nil {
+		t.Errorf("expected only the first word to be stored, got %+v", got)
+	}
+	if FirstWord("  ") != "" {
+		t.Errorf("expected a blank query to generalize to nothing")
+	}
+}
+
+func TestRecordResult_GeneralizesQuery(t *testing.T) {
+	logger := &Logger{QueryGeneralizer: FirstWord}
+	if query, err := logger.resultQuery("  Red Running Shoes "); err != nil || query != "red" {
+		t.Errorf("expected the selection's query generalized like the search, got %q, %v", query, err)
+	}
+	if _, err := logger.resultQuery("   "); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("expected ErrInvalidQuery for a blank query, got %v", err)
+	}
+}
+
+func TestListenerAlive_RequiresRecentHeartbeat(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	logger := &Logger{Now: func() time.Time { return now }}
+	if logger.ListenerAlive() {
+		t.Fatal("expected a listener that never started not to be alive")
+	}
+	logger.beat()
+	now = now.Add(listenerMissedBeats * DefaultReapInterval)
+	if !logger.ListenerAlive() {
+		t.Error("expected the listener to be alive within the missed-beat allowance")
+	}
+	now = now.Add(time.Second)
+	if logger.ListenerAlive() {
+		t.Error("expected a listener without recent heartbeats not to be alive")
+	}
+}
+
+func TestBuildInsert_SeqColumn(t *testing.T) {
+	query, args := buildInsert(SearchEntry{UserID: "u", Query: "shoes", Seq: 7})
+	want := "INSERT INTO user_searches (user_id, search_text, anon_id, seq, last_searched_at) VALUES ($1, $2, $3, $4, NOW())"
+	if query != want || len(args) != 4 || args[3] != int64(7) {
+		t.Errorf("unexpected insert with a sequence number:\n got %s %v\nwant %s", query, args, want)
+	}
+}
+
+func TestSequence_NumbersCommitsPerUser(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.Sequence = true
+	for _, entry := range []SearchEntry{
+		{UserID: "seq-a", Query: "lamps"},
+		{UserID: "seq-b", Query: "chairs"},
+		{UserID: "seq-a", Query: "sofas"},
+	} {
+		if err := logger.writeSearch(ctx, entry); err != nil {
+			t.Fatalf("writeSearch: %v", err)
+		}
+	}
+	var seqs []int64
+	for _, entry := range store.EntriesFor("seq-a") {
+		seqs = append(seqs, entry.Seq)
+	}
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 {
+		t.Errorf("expected seq-a's searches numbered 1 and 2, got %v", seqs)
+	}
+	if got, _ := store.Latest("seq-b"); got.Seq != 1 {
+		t.Errorf("expected seq-b's counter to be separate, got %d", got.Seq)
+	}
+}
+
+func TestTrackRefinements_LinksSessionToPreviousCommit(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.TrackRefinements = true
+	userID := "test-refined"
+
+	for _, q := range []string{"shoes", "boots", "boots red", "lamps"} {
+		if err := logger.LogSearch(ctx, userID, "agent", q); err != nil {
+			t.Fatalf("LogSearch(%q): %v", q, err)
+		}
+	}
+	if err := logger.FlushUser(ctx, userID, ""); err != nil {
+		t.Fatalf("FlushUser: %v", err)
+	}
+
+	want := map[string]string{"shoes": "", "boots red": "shoes", "lamps": "boots red"}
+	entries := store.EntriesFor(userID)
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d commits, got %+v", len(want), entries)
+	}
+	for _, entry := range entries {
+		if entry.RefinedFrom != want[entry.Query] {
+			t.Errorf("%q: expected refined_from %q, got %q", entry.Query, want[entry.Query], entry.RefinedFrom)
+		}
+	}
+}
+
+func TestBuildInsert_RefinedFromColumn(t *testing.T) {
+	query, args := buildInsert(SearchEntry{UserID: "u", Query: "boots", RefinedFrom: "shoes"})
+	want := "INSERT INTO user_searches (user_id, search_text, anon_id, refined_from, last_searched_at) VALUES ($1, $2, $3, $4, NOW())"
+	if query != want || len(args) != 4 || args[3] != "shoes" {
+		t.Errorf("unexpected insert with refined_from:\n got %s %v\nwant %s", query, args, want)
+	}
+}
+
+func TestTrimPunctuation(t *testing.T) {
+	cases := map[string]string{
+		"hello?":         "hello",
+		"¿qué?":          "qué",
+		`"red shoes"`:    "red shoes",
+		"(shoes) !":      "shoes",
+		"c#":             "c#",
+		"c++":            "c++",
+		"c++?":           "c++",
+		"a.i.":           "a.i.",
+		"learn a.i.!":    "learn a.i.",
+		"u.s.a.":         "u.s.a.",
+		"node.js.":       "node.js",
+		"hello.":         "hello",
+		"what is .net":   "what is .net",
+		"...":            "",
+		"rock 'n' roll'": "rock 'n' roll",
+	}
+	for in, want := range cases {
+		if got := trimPunctuation(in, DefaultTrimPunctuation); got != want {
+			t.Errorf("trimPunctuation(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	logger := &Logger{TrimPunctuation: DefaultTrimPunctuation}
+	if got := logger.normalize("  Hello? "); got != "hello" {
+		t.Errorf("expected normalize to trim punctuation, got %q", got)
+	}
+}
+
+func TestIdleCommit_CommitsUnchangedQueryOnce(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.SessionTTL = 30 * time.Second
+	logger.IdleCommit = 3 * time.Second
+	userID := "test-idle"
+
+	if err := logger.LogSearch(ctx, userID, "agent", "shoes"); err != nil {
+		t.Fatalf("LogSearch: %v", err)
+	}
+	logger.idleCommit(sessionKeyID(userID, ""))
+	if n := len(store.EntriesFor(userID)); n != 0 {
+		t.Fatalf("expected no commit while the idle timer runs, got %d", n)
+	}
+
+	// Simulate the idle key expiring.
+	logger.Redis.Del(ctx, buildIdleKey(sessionKeyID(userID, "")))
+	logger.idleCommit(sessionKeyID(userID, ""))
+	if got := latestQuery(t, store, userID); got != "shoes" {
+		t.Fatalf("expected the idle query to be committed, got %q", got)
+	}
+	if err := logger.FlushUser(ctx, userID, ""); err != nil {
+		t.Fatalf("FlushUser: %v", err)
+	}
+	if n := len(store.EntriesFor(userID)); n != 1 {
+		t.Errorf("expected the session's end not to commit the query again, got %d rows", n)
+	}
+}
+
+func TestAnonVisitWindow_GroupsAnonymousSearches(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.AnonVisitWindow = 30 * time.Minute
+	agent := "visit-agent"
+	anonID, err := logger.anonIDFor(agent, "")
+	if err != nil {
+		t.Fatalf("anonIDFor: %v", err)
+	}
+
+	for _, q := range []string{"shoes", "lamps"} {
+		if err := logger.LogSearch(ctx, "", agent, q); err != nil {
+			t.Fatalf("LogSearch(%q): %v", q, err)
+		}
+	}
+	// Simulate a pause longer than the window.
+	logger.Redis.Del(ctx, buildVisitKey(anonID))
+	if err := logger.LogSearch(ctx, "", agent, "chairs"); err != nil {
+		t.Fatalf("LogSearch: %v", err)
+	}
+	if err := logger.FlushUser(ctx, "", anonID); err != nil {
+		t.Fatalf("FlushUser: %v", err)
+	}
+
+	visits := map[string]string{}
+	for _, entry := range store.EntriesFor(anonID) {
+		visits[entry.Query] = entry.VisitID
+	}
+	if visits["shoes"] == "" || visits["shoes"] != visits["lamps"] {
+		t.Errorf("expected shoes and lamps in one visit, got %v", visits)
+	}
+	if visits["chairs"] == "" || visits["chairs"] == visits["shoes"] {
+		t.Errorf("expected chairs to start a new visit, got %v", visits)
+	}
+}
+
+func TestParseMemoryInfo(t *testing.T) {
+	info := "# Memory\r\nused_memory:900\r\nused_memory_human:900B\r\nmaxmemory:1000\r\nmaxmemory_human:1000B\r\n"
+	used, max, err := parseMemoryInfo(info)
+	if err != nil || used != 900 || max != 1000 {
+		t.Errorf("parseMemoryInfo = %d, %d, %v; want 900, 1000, nil", used, max, err)
+	}
+	if _, _, err := parseMemoryInfo("# Memory\r\nused_memory:900\r\n"); err == nil {
+		t.Error("expected an error without maxmemory")
+	}
+}
+
+func TestShedSession_OnlyUnderMemoryPressure(t *testing.T) {
+	logger := &Logger{MemoryGuardThreshold: 0.9, MemoryGuardKeep: 0.25, Rand: rand.NewSource(1)}
+	if logger.shedSession() {
+		t.Fatal("expected no shedding without memory pressure")
+	}
+	logger.setMemoryPressure(true, 0.95)
+	shed := 0
+	for i := 0; i < 1000; i++ {
+		if logger.shedSession() {
+			shed++
+		}
+	}
+	if shed < 700 || shed > 800 {
+		t.Errorf("expected about 75%% of new sessions shed, got %d of 1000", shed)
+	}
+	logger.setMemoryPressure(false, 0.5)
+	if logger.shedSession() {
+		t.Error("expected shedding to stop once pressure is gone")
+	}
+}
+
+func TestShedSession_NegativeKeepShedsAll(t *testing.T) {
+	logger := &Logger{MemoryGuardThreshold: 0.9, MemoryGuardKeep: -1, Rand: rand.NewSource(1)}
+	logger.setMemoryPressure(true, 0.95)
+	for i := 0; i < 100; i++ {
+		if !logger.shedSession() {
+			t.Fatal("expected every new session shed with a negative MemoryGuardKeep")
+		}
+	}
+}
+
+func TestParseVariants(t *testing.T) {
+	variants, err := ParseVariants("control=; typo=edit-distance:2,trailing-space")
+	if err != nil {
+		t.Fatalf("ParseVariants error: %v", err)
+	}
+	want := map[string]Variant{"control": {}, "typo": {ResetEditDistance: 2, TrailingSpaceCommits: true}}
+	if len(variants) != len(want) {
+		t.Fatalf("expected %v, got %v", want, variants)
+	}
+	for name, v := range want {
+		if variants[name] != v {
+			t.Errorf("%s: expected %+v, got %+v", name, v, variants[name])
+		}
+	}
+
+	for _, bad := range []string{"typo", "=trailing-space", "a=;a=", "typo=edit-distance:0", "typo=fuzzy"} {
+		if _, err := ParseVariants(bad); err == nil {
+			t.Errorf("ParseVariants(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestVariants_SelectResetClassifierPerRequest(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.Variants = map[string]Variant{"control": {}, "typo": {ResetEditDistance: 1}}
+
+	if err := logger.LogSearchRequest(ctx, SearchRequest{UserID: "u", UserAgent: "agent", Query: "shoes", Variant: "nope"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected ErrInvalidRequest for an unknown variant, got %v", err)
+	}
+
+	for variant, wantCommits := range map[string]int{"control": 1, "typo": 0} {
+		userID := "test-variant-" + variant
+		for _, q := range []string{"shoez", "shoes"} {
+			req := SearchRequest{UserID: userID, UserAgent: "agent", Query: q, Variant: variant}
+			if err := logger.LogSearchRequest(ctx, req); err != nil {
+				t.Fatalf("LogSearchRequest(%q): %v", q, err)
+			}
+		}
+		entries := store.EntriesFor(userID)
+		if len(entries) != wantCommits {
+			t.Fatalf("%s: expected %d commits before the session ends, got %+v", variant, wantCommits, entries)
+		}
+		if err := logger.FlushUser(ctx, userID, ""); err != nil {
+			t.Fatalf("FlushUser: %v", err)
+		}
+		entries = store.EntriesFor(userID)
+		if last := entries[len(entries)-1]; last.Query != "shoes" || last.Variant != variant {
+			t.Errorf("%s: expected shoes committed with its variant, got %+v", variant, last)
+		}
+	}
+}
+
+func TestSingleKeySessions_OneKeyPerSession(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.SingleKeySessions = true
+	now := time.Now()
+	logger.Now = func() time.Time { return now }
+	userID := "test-single-key"
+
+	for _, q := range []string{"sho", "shoes", "lamps"} {
+		if err := logger.LogSearch(ctx, userID, "agent", q); err != nil {
+			t.Fatalf("LogSearch(%q): %v", q, err)
+		}
+	}
+	if n := logger.Redis.Exists(ctx, buildRedisKey(sessionKeyID(userID, ""))).Val(); n != 0 {
+		t.Errorf("expected no live key, found %d", n)
+	}
+	if n := logger.Redis.Exists(ctx, buildBufferKey(sessionKeyID(userID, ""))).Val(); n != 1 {
+		t.Fatalf("expected the buffer key, found %d", n)
+	}
+	if got := latestQuery(t, store, userID); got != "shoes" {
+		t.Errorf("expected the reset to commit shoes, got %q", got)
+	}
+
+	// A live session is left alone by the reaper.
+	logger.reapExpired(ctx)
+	if n := len(store.EntriesFor(userID)); n != 1 {
+		t.Fatalf("expected 1 commit while the session is live, got %d", n)
+	}
+
+	// An expired session not reaped yet is committed by the next search.
+	now = now.Add(logger.sessionTTL() + time.Millisecond)
+	if err := logger.LogSearch(ctx, userID, "agent", "lamp shade"); err != nil {
+		t.Fatalf("LogSearch: %v", err)
+	}
+	if got := latestQuery(t, store, userID); got != "lamps" {
+		t.Errorf("expected the expired session to commit lamps, got %q", got)
+	}
+
+	now = now.Add(logger.sessionTTL() + time.Millisecond)
+	logger.reapExpired(ctx)
+	entries := store.EntriesFor(userID)
+	if len(entries) != 3 || latestQuery(t, store, userID) != "lamp shade" {
+		t.Fatalf("expected the reaper to commit lamp shade, got %+v", entries)
+	}
+	if entries[2].LiveUntil != 0 {
+		t.Errorf("expected LiveUntil cleared on commit, got %d", entries[2].LiveUntil)
+	}
+	if n := logger.Redis.Exists(ctx, buildBufferKey(sessionKeyID(userID, ""))).Val(); n != 0 {
+		t.Errorf("expected the reaped buffer deleted, found %d", n)
+	}
+}
+
+func BenchmarkLogSearch_SessionKeys(b *testing.B) {
+	const users = 100
+	for _, singleKey := range []bool{false, true} {
+		b.Run(fmt.Sprintf("SingleKeySessions=%t", singleKey), func(b *testing.B) {
+			ctx := context.Background()
+			logger, _ := setupMemoryLogger(b)
+			logger.SingleKeySessions = singleKey
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				userID := fmt.Sprintf("test-bench-%d", i%users)
+				if err := logger.LogSearch(ctx, userID, "agent", "shoes"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(logger.Redis.DBSize(ctx).Val())/users, "keys/session")
+		})
+	}
+}
+
+func TestSessionKeyID_MarksUsersAndAnons(t *testing.T) {
+	cases := []struct {
+		id             string
+		userID, anonID string
+	}{
+		{sessionKeyID("anonymous_admin", ""), "anonymous_admin", ""},
+		{sessionKeyID("", "anon1234"), "", "anon1234"},
+		{sessionKeyID("user:1", ""), "user:1", ""},
+		// Keys written before the markers.
+		{"anon1234", "", "anon1234"},
+		{"bob", "bob", ""},
+	}
+	for _, c := range cases {
+		if userID, anonID := parseSessionKeyID(c.id); userID != c.userID || anonID != c.anonID {
+			t.Errorf("parseSessionKeyID(%q) = %q, %q; want %q, %q", c.id, userID, anonID, c.userID, c.anonID)
+		}
+	}
+}
+
+func TestFlushExpired_AnonPrefixedUserID(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	userID := "anonymous_admin"
+
+	// A plain-text buffer carries no ids, so they come from the key.
+	key := sessionKeyID(userID, "")
+	logger.Redis.Set(ctx, buildBufferKey(key), "admin tools", time.Minute)
+	logger.flushExpired(key)
+
+	entries := store.EntriesFor(userID)
+	if len(entries) != 1 || entries[0].UserID != userID || entries[0].AnonID != "" {
+		t.Fatalf("expected admin tools stored for user %s without an anon id, got %+v", userID, entries)
+	}
+}
+
+func TestQueryStats_CountsTokensAndCharacters(t *testing.T) {
+	logger := &Logger{QueryStats: true}
+	entry := logger.stampQueryStats(SearchEntry{UserID: "u", Query: "café  au lait"})
+	if entry.TokenCount != 3 || entry.CharCount != 13 {
+		t.Errorf("expected 3 tokens and 13 characters, got %d and %d", entry.TokenCount, entry.CharCount)
+	}
+
+	query, args := buildInsert(entry)
+	want := "INSERT INTO user_searches (user_id, search_text, anon_id, token_count, char_count, last_searched_at) VALUES ($1, $2, $3, $4, $5, NOW())"
+	if query != want || len(args) != 5 || args[3] != 3 || args[4] != 13 {
+		t.Errorf("unexpected insert with query stats:\n got %s %v\nwant %s", query, args, want)
+	}
+
+	if entry := (&Logger{}).stampQueryStats(SearchEntry{Query: "shoes"}); entry.TokenCount != 0 || entry.CharCount != 0 {
+		t.Errorf("expected no counts without QueryStats, got %+v", entry)
+	}
+}
+
+func TestEnricher_AddsFieldsBeforeWrite(t *testing.T) {
+	ctx := context.Background()
+	store := &MemoryStore{}
+	extra := map[string]string{"page": "home"}
+	logger := &Logger{Store: store, Enricher: func(ctx context.Context, entry *SearchEntry) error {
+		if entry.Query == "broken" {
+			entry.Outcome = OutcomeSuccess
+			return errors.New("catalog unavailable")
+		}
+		entry.Extra["results"] = "42"
+		entry.Query = "rewritten"
+		return nil
+	}}
+
+	if err := logger.writeSearch(ctx, SearchEntry{UserID: "u", Query: "lamps", Extra: extra}); err != nil {
+		t.Fatalf("writeSearch error: %v", err)
+	}
+	if err := logger.writeSearch(ctx, SearchEntry{UserID: "u", Query: "broken"}); err != nil {
+		t.Fatalf("expected a failing enricher not to fail the write, got %v", err)
+	}
+	entries := store.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 searches stored, got %d", len(entries))
+	}
+	if entries[0].Query != "lamps" || entries[0].Extra["results"] != "42" {
+		t.Errorf("expected the enriched search stored under its own query, got %+v", entries[0])
+	}
+	if _, ok := extra["results"]; ok {
+		t.Errorf("expected the caller's Extra map not to be modified, got %v", extra)
+	}
+	if entries[1].Query != "broken" || entries[1].Outcome != "" {
+		t.Errorf("expected the search stored unenriched when the enricher fails, got %+v", entries[1])
+	}
+}
+
+func TestEnricher_GetsExtraMapWhenNil(t *testing.T) {
+	ctx := context.Background()
+	store := &MemoryStore{}
+	logger := &Logger{Store: store, Enricher: func(ctx context.Context, entry *SearchEntry) error {
+		if entry.Query == "lamps" {
+			entry.Extra["results"] = "42"
+		}
+		return nil
+	}}
+
+	for _, q := range []string{"lamps", "sofas"} {
+		if err := logger.writeSearch(ctx, SearchEntry{UserID: "u", Query: q}); err != nil {
+			t.Fatalf("writeSearch error: %v", err)
+		}
+	}
+	entries := store.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 searches stored, got %d", len(entries))
+	}
+	if entries[0].Extra["results"] != "42" {
+		t.Errorf("expected the enricher to add to a nil Extra, got %+v", entries[0])
+	}
+	if entries[1].Extra != nil {
+		t.Errorf("expected Extra left nil when the enricher adds nothing, got %v", entries[1].Extra)
+	}
+}
+
+func TestEventStream_AppendsAndReplaysCommits(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.EventStream = true
+	day := time.Date(2024, 5, 1, 23, 30, 0, 0, time.UTC)
+	logger.Now = func() time.Time { return day }
+
+	for _, q := range []string{"lamps", "sofas", "rugs"} {
+		if err := logger.writeSearch(ctx, SearchEntry{UserID: "u", Query: q}); err != nil {
+			t.Fatalf("writeSearch error: %v", err)
+		}
+	}
+	if ttl, _ := logger.Redis.TTL(ctx, buildEventStreamKey("2024-05-01")).Result(); ttl <= 0 {
+		t.Errorf("expected the day's stream to expire, got TTL %v", ttl)
+	}
+
+	first, err := logger.ReadEventStream(ctx, day, "", 2)
+	if err != nil {
+		t.Fatalf("ReadEventStream error: %v", err)
+	}
+	rest, err := logger.ReadEventStream(ctx, day, first[len(first)-1].ID, 10)
+	if err != nil {
+		t.Fatalf("ReadEventStream error: %v", err)
+	}
+	if len(first) != 2 || first[0].Entry.Query != "lamps" || len(rest) != 1 || rest[0].Entry.Query != "rugs" {
+		t.Fatalf("expected lamps, sofas then rugs, got %v and %v", first, rest)
+	}
+
+	// The next day's search goes to a new stream, which the consumer moves
+	// on to once the first day is drained.
+	logger.Now = func() time.Time { return day.Add(time.Hour) }
+	if err := logger.writeSearch(ctx, SearchEntry{UserID: "u", Query: "chairs"}); err != nil {
+		t.Fatalf("writeSearch error: %v", err)
+	}
+	var got []string
+	done := errors.New("done")
+	err = logger.ConsumeEventStream(ctx, day, func(event StreamEvent) error {
+		got = append(got, event.Day+" "+event.Entry.Query)
+		if len(got) == 4 {
+			return done
+		}
+		return nil
+	})
+	want := "2024-05-01 lamps,2024-05-01 sofas,2024-05-01 rugs,2024-05-02 chairs"
+	if err != done || strings.Join(got, ",") != want {
+		t.Errorf("expected %v, got %v (err %v)", want, got, err)
+	}
+}
+
+func TestEventStream_DeleteAnonRemovesEvents(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := setupMemoryLogger(t)
+	logger.EventStream = true
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	logger.Now = func() time.Time { return day }
+
+	for _, entry := range []SearchEntry{{AnonID: "anon-1", Query: "lamps"}, {AnonID: "anon-2", Query: "sofas"}, {UserID: "u", AnonID: "anon-1", Query: "rugs"}} {
+		if err := logger.writeSearch(ctx, entry); err != nil {
+			t.Fatalf("writeSearch error: %v", err)
+		}
+	}
+	if _, err := logger.DeleteAnon(ctx, "anon-1"); err != nil {
+		t.Fatalf("DeleteAnon error: %v", err)
+	}
+	events, err := logger.ReadEventStream(ctx, day, "", 10)
+	if err != nil {
+		t.Fatalf("ReadEventStream error: %v", err)
+	}
+	if len(events) != 2 || events[0].Entry.Query != "sofas" || events[1].Entry.Query != "rugs" {
+		t.Errorf("expected only anon-1's anonymous search removed, got %v", events)
+	}
+}
+
+func TestEventStream_ConsumeStartsAtOldestKeptDay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger, _ := setupMemoryLogger(t)
+	logger.EventStream = true
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	logger.Now = func() time.Time { return now }
+
+	if err := logger.writeSearch(ctx, SearchEntry{UserID: "u", Query: "lamps"}); err != nil {
+		t.Fatalf("writeSearch error: %v", err)
+	}
+	done := errors.New("done")
+	start := time.Now()
+	err := logger.ConsumeEventStream(ctx, time.Time{}, func(event StreamEvent) error {
+		return done
+	})
+	if err != done || time.Since(start) > 5*time.Second {
+		t.Errorf("expected the consumer to reach today's search quickly from a zero since, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestFlushSession_ClientAnonID(t *testing.T) {
+	ctx := context.Background()
+	logger, store := setupMemoryLogger(t)
+	logger.EmptyUserAgent = EmptyUARequireAnonID
+
+	if err := logger.LogSearchRequest(ctx, SearchRequest{AnonID: "device-1", Query: "lamps"}); err != nil {
+		t.Fatalf("LogSearchRequest error: %v", err)
+	}
+	if err := logger.FlushSession(ctx, "", "", "device-1"); err != nil {
+		t.Fatalf("FlushSession error: %v", err)
 	}
-	if count != 0 {
-		t.Errorf("expected 0 rows inserted for empty query, got %d", count)
+	anonID, _ := logger.anonIDFor("", "device-1")
+	if got := latestQuery(t, store, anonID); got != "lamps" {
+		t.Errorf("expected the client anon id's session to be flushed, got %q", got)
 	}
 }
@@ -0,0 +1,33 @@
+package searchlogger
+
+import (
+	"context"
+	"log"
+)
+
+// buildSeqKey returns the Redis key of a session id's commit counter.
+func buildSeqKey(id string) string {
+	return "search:seq:" + id
+}
+
+// stampSeq numbers entry with the next value of its session id's counter
+// when Sequence is set and it has no number yet, e.g. from a dead-letter
+// list. If Redis fails, the search is committed without a number rather
+// than lost.
+func (l *Logger) stampSeq(ctx context.Context, entry SearchEntry) SearchEntry {
+	if !l.Sequence || entry.Seq != 0 {
+		return entry
+	}
+	key := buildSeqKey(entrySessionID(entry))
+	pipe := l.Redis.TxPipeline()
+	seq := pipe.Incr(ctx, key)
+	if l.SequenceTTL > 0 {
+		pipe.Expire(ctx, key, l.SequenceTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("writeSearch: failed to number search for userID=%s, storing it without seq: %v", entrySessionID(entry), err)
+		return entry
+	}
+	entry.Seq = seq.Val()
+	return entry
+}
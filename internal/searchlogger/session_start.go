@@ -0,0 +1,28 @@
+package searchlogger
+
+import (
+	"context"
+	"time"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
+)
+
+// SessionStart describes the search that started a session.
+type SessionStart struct {
+	UserID string    `json:"user_id,omitempty"`
+	AnonID string    `json:"anon_id,omitempty"`
+	Query  string    `json:"query"`
+	At     time.Time `json:"at"`
+}
+
+// sessionStarted reports that a search started a new session. The live key
+// was created with SET NX, so of concurrent first searches exactly one
+// reports the start.
+func (l *Logger) sessionStarted(ctx context.Context, redisKey string, entry SearchEntry) {
+	logging.Debugf("LogSearch: session started for redisKey=%s", redisKey)
+	metrics.SessionsStarted.Add(1)
+	if l.OnSessionStart != nil {
+		l.OnSessionStart(ctx, SessionStart{UserID: entry.UserID, AnonID: entry.AnonID, Query: entry.Query, At: l.now()})
+	}
+}
@@ -0,0 +1,85 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+)
+
+// ShardKey returns the index in Shards of the database holding entry's rows.
+// It is a jump consistent hash of the user id, or of the anon id for
+// anonymous users, so each user's rows stay on one shard and adding a shard
+// moves only about 1/n of users. It is always 0 without Shards.
+func (l *Logger) ShardKey(entry SearchEntry) int {
+	return l.shardIndex(entrySessionID(entry))
+}
+
+func (l *Logger) shardIndex(id string) int {
+	n := len(l.Shards)
+	if n <= 1 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return jumpHash(h.Sum64(), n)
+}
+
+// jumpHash is Lamping and Veach's jump consistent hash.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// shards returns the databases holding user_searches: Shards, or just DB.
+func (l *Logger) shards() []*sql.DB {
+	if len(l.Shards) > 0 {
+		return l.Shards
+	}
+	return []*sql.DB{l.DB}
+}
+
+// shardDB returns the database holding the rows of the given user or anon id.
+func (l *Logger) shardDB(id string) *sql.DB {
+	return l.shards()[l.shardIndex(id)]
+}
+
+// groupByShard splits entries by ShardKey, preserving their order.
+func (l *Logger) groupByShard(entries []SearchEntry) map[int][]SearchEntry {
+	groups := make(map[int][]SearchEntry)
+	for _, entry := range entries {
+		k := l.ShardKey(entry)
+		groups[k] = append(groups[k], entry)
+	}
+	return groups
+}
+
+// shardedStore routes each search to its shard's PostgresStore.
+type shardedStore struct {
+	l *Logger
+}
+
+func (s shardedStore) WriteSearch(ctx context.Context, entry SearchEntry) error {
+	return s.l.postgresStore(s.l.shards()[s.l.ShardKey(entry)]).WriteSearch(ctx, entry)
+}
+
+// WriteSearches writes one transaction per shard, so it is only atomic
+// within a shard.
+func (s shardedStore) WriteSearches(ctx context.Context, entries []SearchEntry) error {
+	for k, group := range s.l.groupByShard(entries) {
+		if err := s.l.postgresStore(s.l.shards()[k]).WriteSearches(ctx, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasDB reports whether a database is configured, in DB or Shards. Without
+// one, searches can only be written to Store, and reads are unavailable.
+func (l *Logger) HasDB() bool {
+	return l.DB != nil || len(l.Shards) > 0
+}
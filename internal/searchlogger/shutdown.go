@@ -0,0 +1,61 @@
+package searchlogger
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// DefaultFlushTimeout is the default FlushTimeout.
+const DefaultFlushTimeout = 10 * time.Second
+
+func (l *Logger) flushTimeout() time.Duration {
+	if l.FlushTimeout > 0 {
+		return l.FlushTimeout
+	}
+	return DefaultFlushTimeout
+}
+
+// flushContext returns the context for flushing finished sessions. It is
+// derived from context.Background rather than the listener's or caller's
+// context: cancelling those during shutdown would abort a write midway,
+// leaving the buffer in place with the row possibly committed.
+func (l *Logger) flushContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), l.flushTimeout())
+}
+
+// FlushAll writes every buffered session to the DB and ends it, for use at
+// shutdown after the server has stopped accepting searches. It runs under
+// its own FlushTimeout, since the application context is usually cancelled
+// by then, and returns the number of sessions flushed.
+func (l *Logger) FlushAll() (int, error) {
+	if l.Paused() {
+		log.Printf("FlushAll: logging is paused, leaving sessions in Redis")
+		return 0, nil
+	}
+	ctx, cancel := l.flushContext()
+	defer cancel()
+
+	var ids []string
+	iter := l.Redis.Scan(ctx, 0, buildBufferKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		ids = append(ids, strings.TrimPrefix(iter.Val(), buildBufferKey("")))
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("FlushAll: error scanning buffered sessions: %v", err)
+		return 0, redisError(err)
+	}
+
+	flushed := 0
+	for _, id := range ids {
+		// Flushed by the scanned key, so sessions buffered under unmarked
+		// keys by older versions are flushed too.
+		if err := l.flushSessionKey(ctx, id); err != nil {
+			return flushed, err
+		}
+		flushed++
+	}
+	log.Printf("FlushAll: flushed %d sessions", flushed)
+	return flushed, nil
+}
@@ -0,0 +1,118 @@
+package searchlogger
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// errSessionLive is returned by claimExpired for a session that has not
+// expired, or changed while it was being claimed.
+var errSessionLive = errors.New("session is live")
+
+// live reports whether a SingleKeySessions buffer still holds a live query.
+// Entries buffered without SingleKeySessions have no LiveUntil and count as
+// expired, so switching the option on flushes their sessions.
+func (l *Logger) live(entry SearchEntry) bool {
+	return entry.LiveUntil > l.now().UnixMilli()
+}
+
+// liveQuery returns the session's live query, or "" if it has none. With
+// SingleKeySessions it is read from the buffer, and a session that expired
+// but was not reaped yet is flushed first, so the new session cannot
+// overwrite its buffer.
+func (l *Logger) liveQuery(ctx context.Context, id string) (string, error) {
+	key := buildRedisKey(id)
+	if l.SingleKeySessions {
+		key = buildBufferKey(id)
+	}
+	val, err := l.Redis.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		log.Printf("LogSearch: Redis get error: key=%s err=%v", key, err)
+		return "", redisError(err)
+	}
+	if !l.SingleKeySessions {
+		return val, nil
+	}
+	if entry := decodeBuffer(val); l.live(entry) {
+		return l.liveForm(entry), nil
+	}
+	l.flushExpired(id)
+	return "", nil
+}
+
+// sessionLive reports whether the session has a live query.
+func (l *Logger) sessionLive(ctx context.Context, id string) (bool, error) {
+	if !l.SingleKeySessions {
+		n, err := l.Redis.Exists(ctx, buildRedisKey(id)).Result()
+		return n == 1, err
+	}
+	buffered, err := l.Redis.Get(ctx, buildBufferKey(id)).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return l.live(decodeBuffer(buffered)), nil
+}
+
+// liveTTL returns how long the session's live query has left, or a
+// non-positive duration if it has none.
+func (l *Logger) liveTTL(ctx context.Context, id string) (time.Duration, error) {
+	if !l.SingleKeySessions {
+		return l.Redis.PTTL(ctx, buildRedisKey(id)).Result()
+	}
+	buffered, err := l.Redis.Get(ctx, buildBufferKey(id)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(decodeBuffer(buffered).LiveUntil-l.now().UnixMilli()) * time.Millisecond, nil
+}
+
+// claimExpired takes the buffer of an expired SingleKeySessions session,
+// deleting it, so the reaper and a search that finds the session expired
+// cannot both commit it. It returns redis.Nil if there is no buffer and
+// errSessionLive if the session is live.
+func (l *Logger) claimExpired(ctx context.Context, id string) (string, error) {
+	key := buildBufferKey(id)
+	var claimed string
+	err := l.Redis.Watch(ctx, func(tx *redis.Tx) error {
+		buffered, err := tx.Get(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if l.live(decodeBuffer(buffered)) {
+			return errSessionLive
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			return nil
+		})
+		claimed = buffered
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		// A keystroke updated the session meanwhile.
+		return "", errSessionLive
+	}
+	return claimed, err
+}
+
+// unclaim puts back a buffer taken by claimExpired or claimBuffer whose
+// commit failed, so the reaper retries it, unless a new session has started meanwhile.
+func (l *Logger) unclaim(ctx context.Context, id, buffered string) {
+	ok, err := l.Redis.SetNX(ctx, buildBufferKey(id), buffered, l.bufferTTL()).Result()
+	if err != nil || !ok {
+		log.Printf("KeyspaceListener: could not restore expired query for userID=%s, it is lost: %v", id, err)
+	}
+}
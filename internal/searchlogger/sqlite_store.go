@@ -0,0 +1,43 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// SQLiteStore writes searches to the user_searches table of a SQLite
+// database created with database.SQLiteSchema, for single-node and edge
+// deployments. It writes searches only: the outbox, TermsTable, OnConflict
+// and the read methods of Logger need PostgreSQL.
+type SQLiteStore struct {
+	DB *sql.DB
+}
+
+// WriteSearch inserts entry. Errors match ErrDBWrite.
+func (s *SQLiteStore) WriteSearch(ctx context.Context, entry SearchEntry) error {
+	return s.WriteSearches(ctx, []SearchEntry{entry})
+}
+
+// WriteSearches inserts entries in a single transaction. Errors match ErrDBWrite.
+func (s *SQLiteStore) WriteSearches(ctx context.Context, entries []SearchEntry) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("writeSearch: error starting SQLite transaction: %v", err)
+		return dbError(err)
+	}
+	defer tx.Rollback()
+
+	for _, entry := range entries {
+		query, args := buildInsertDialect(sqliteDialect, entry, "search_text", entry.Query)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			log.Printf("writeSearch: error inserting query for userID=%s: %v", entry.UserID, err)
+			return dbError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("writeSearch: error committing SQLite transaction: %v", err)
+		return dbError(err)
+	}
+	return nil
+}
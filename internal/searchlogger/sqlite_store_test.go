@@ -0,0 +1,36 @@
+//go:build sqlite
+
+package searchlogger
+
+import (
+	"context"
+	"testing"
+
+	"go-search-logger/internal/database"
+)
+
+func TestSQLiteStore_WritesSearches(t *testing.T) {
+	ctx := context.Background()
+	db := database.ConnectSQLite(":memory:")
+	defer db.Close()
+	logger := &Logger{Store: &SQLiteStore{DB: db}}
+
+	latency := int64(42)
+	err := logger.writeSearches(ctx, []SearchEntry{
+		{UserID: "u1", Query: "lamps"},
+		{AnonID: "anon1", Query: "hotels", Location: "Paris", Extra: map[string]string{"guests": "2"}, LatencyMS: &latency},
+	})
+	if err != nil {
+		t.Fatalf("writeSearches error: %v", err)
+	}
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM user_searches`).Scan(&n); err != nil || n != 2 {
+		t.Fatalf("expected 2 rows, got %d, err=%v", n, err)
+	}
+	var location, extra string
+	err = db.QueryRow(`SELECT location, extra FROM user_searches WHERE anon_id = ?`, "anon1").Scan(&location, &extra)
+	if err != nil || location != "Paris" || extra != `{"guests":"2"}` {
+		t.Errorf("unexpected optional fields: %q %q, err=%v", location, extra, err)
+	}
+}
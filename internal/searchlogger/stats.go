@@ -0,0 +1,336 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TermCount is a search term with the number of times it was logged.
+type TermCount struct {
+	Term  string `json:"term"`
+	Count int64  `json:"count"`
+}
+
+// Totals summarizes the contents of the search log.
+type Totals struct {
+	Searches  int64 `json:"searches"`
+	Users     int64 `json:"users"`
+	AnonUsers int64 `json:"anon_users"`
+	Terms     int64 `json:"distinct_terms"`
+}
+
+// Queries read search text from either search_text or, for rows written with
+// TermsTable, the joined search_terms row.
+const recentSearchesQuery = `SELECT s.id, COALESCE(s.user_id, ''), COALESCE(s.search_text, t.term), COALESCE(s.anon_id, ''), COALESCE(s.refined_from, ''), s.last_searched_at
+			FROM user_searches s LEFT JOIN search_terms t ON t.id = s.term_id
+			WHERE ($1 = '' OR s.user_id = $1 OR s.anon_id = $1)
+			AND ($2::timestamptz IS NULL OR (s.last_searched_at, s.id) < ($2, $3))
+			ORDER BY s.last_searched_at DESC, s.id DESC
+			LIMIT $4 OFFSET $5`
+
+// RecentSearches returns the most recently logged searches, newest first.
+// If id is non-empty only searches for that user or anon id are returned.
+func (l *Logger) RecentSearches(ctx context.Context, id string, limit int) ([]SearchEntry, error) {
+	entries, _, err := l.RecentSearchesPage(ctx, id, Page{Limit: limit})
+	return entries, err
+}
+
+// RecentSearchesPage is RecentSearches for an arbitrary page. It also
+// returns the cursor for the next page, or nil if this page is the last.
+// With Shards, every shard is queried and the results are merged.
+func (l *Logger) RecentSearchesPage(ctx context.Context, id string, page Page) ([]SearchEntry, *Cursor, error) {
+	var after sql.NullTime
+	var afterID int64
+	if page.Cursor != nil {
+		after = sql.NullTime{Time: page.Cursor.At, Valid: true}
+		afterID = page.Cursor.ID
+	}
+
+	// The first page of an id's history is served from, or fills, the cache.
+	cacheable := l.HistoryCacheSize > 0 && id != "" && page.Offset == 0 && page.Cursor == nil && page.Limit <= l.HistoryCacheSize
+	if cacheable {
+		if entries, ok := l.cachedHistory(ctx, id, page.Limit); ok {
+			return entries, historyCursor(entries, page.Limit), nil
+		}
+	}
+
+	fetch := page.Limit
+	if cacheable {
+		fetch = l.HistoryCacheSize
+	}
+	shards := l.shards()
+	limit, offset := fetch, page.Offset
+	if len(shards) > 1 {
+		// Each shard returns its first offset+limit rows, which are merged
+		// and paged here.
+		limit, offset = fetch+page.Offset, 0
+	}
+	var rows []rowWithID
+	for _, db := range shards {
+		shardRows, err := recentSearches(ctx, db, id, after, afterID, limit, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		rows = append(rows, shardRows...)
+	}
+	if len(shards) > 1 {
+		sort.Slice(rows, func(i, j int) bool {
+			if !rows[i].Timestamp.Equal(rows[j].Timestamp) {
+				return rows[i].Timestamp.After(rows[j].Timestamp)
+			}
+			return rows[i].id > rows[j].id
+		})
+		rows = rows[minInt(page.Offset, len(rows)):minInt(page.Offset+fetch, len(rows))]
+	}
+	if cacheable {
+		cached := make([]SearchEntry, len(rows))
+		for i, row := range rows {
+			cached[i] = row.SearchEntry
+		}
+		l.fillHistory(ctx, id, cached)
+		rows = rows[:minInt(page.Limit, len(rows))]
+	}
+
+	entries := make([]SearchEntry, len(rows))
+	for i, row := range rows {
+		entries[i] = row.SearchEntry
+	}
+	if len(rows) == 0 || len(rows) < page.Limit {
+		return entries, nil, nil
+	}
+	last := rows[len(rows)-1]
+	return entries, &Cursor{At: last.Timestamp, ID: last.id}, nil
+}
+
+// rowWithID is a user_searches row with its id, for cursors.
+type rowWithID struct {
+	SearchEntry
+	id int64
+}
+
+func recentSearches(ctx context.Context, db *sql.DB, id string, after sql.NullTime, afterID int64, limit, offset int) ([]rowWithID, error) {
+	rows, err := db.QueryContext(ctx, recentSearchesQuery, id, after, afterID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []rowWithID
+	for rows.Next() {
+		var row rowWithID
+		if err := rows.Scan(&row.id, &row.UserID, &row.Query, &row.AnonID, &row.RefinedFrom, &row.Timestamp); err != nil {
+			return nil, err
+		}
+		res = append(res, row)
+	}
+	return res, rows.Err()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// MaxBulkUserIDs is the maximum number of user ids SearchesForUsers accepts
+// in one call.
+const MaxBulkUserIDs = 1000
+
+const searchesForUsersQuery = `SELECT s.user_id, COALESCE(s.search_text, t.term), COALESCE(s.anon_id, ''), COALESCE(s.refined_from, ''), s.last_searched_at
+			FROM user_searches s LEFT JOIN search_terms t ON t.id = s.term_id
+			WHERE s.user_id = ANY($1) AND s.last_searched_at >= $2
+			ORDER BY s.user_id, s.last_searched_at`
+
+// SearchesForUsers returns every search logged for the given user ids since
+// the given time, in a single query. Results are ordered by user id, then
+// oldest first.
+func (l *Logger) SearchesForUsers(ctx context.Context, ids []string, since time.Time) ([]SearchEntry, error) {
+	if len(ids) == 0 {
+		return []SearchEntry{}, nil
+	}
+	if len(ids) > MaxBulkUserIDs {
+		return nil, fmt.Errorf("%w: %d user ids exceeds the limit of %d", ErrInvalidRequest, len(ids), MaxBulkUserIDs)
+	}
+	for _, id := range ids {
+		if err := validateUserID(id); err != nil {
+			return nil, err
+		}
+	}
+
+	byShard := make(map[int][]string)
+	for _, id := range ids {
+		k := l.shardIndex(id)
+		byShard[k] = append(byShard[k], id)
+	}
+	entries := []SearchEntry{}
+	for k, shardIDs := range byShard {
+		shardEntries, err := searchesForUsers(ctx, l.shards()[k], shardIDs, since)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, shardEntries...)
+	}
+	if len(byShard) > 1 {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].UserID < entries[j].UserID })
+	}
+	return entries, nil
+}
+
+func searchesForUsers(ctx context.Context, db *sql.DB, ids []string, since time.Time) ([]SearchEntry, error) {
+	rows, err := db.QueryContext(ctx, searchesForUsersQuery, pq.Array(ids), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []SearchEntry
+	for rows.Next() {
+		var entry SearchEntry
+		if err := rows.Scan(&entry.UserID, &entry.Query, &entry.AnonID, &entry.RefinedFrom, &entry.Timestamp); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+const trendingTermsQuery = `SELECT COALESCE(s.search_text, t.term) AS term, COUNT(*) AS n
+			FROM user_searches s LEFT JOIN search_terms t ON t.id = s.term_id
+			WHERE s.last_searched_at >= $1 AND ($3 = '' OR s.utm_campaign = $3)
+			GROUP BY 1
+			ORDER BY n DESC, 1
+			LIMIT $2`
+
+// TrendingTerms returns the n most searched terms since the given time. With
+// Shards, each shard's top n terms are summed, so a term that is common
+// overall but outside the top n on some shards is undercounted.
+func (l *Logger) TrendingTerms(ctx context.Context, since time.Time, n int) ([]TermCount, error) {
+	return l.CampaignTrendingTerms(ctx, since, n, "")
+}
+
+// CampaignTrendingTerms is TrendingTerms restricted to searches attributed
+// to the given utm_campaign. An empty campaign matches every search.
+func (l *Logger) CampaignTrendingTerms(ctx context.Context, since time.Time, n int, campaign string) ([]TermCount, error) {
+	shards := l.shards()
+	if len(shards) == 1 {
+		return trendingTerms(ctx, shards[0], since, n, campaign)
+	}
+
+	counts := make(map[string]int64)
+	for _, db := range shards {
+		terms, err := trendingTerms(ctx, db, since, n, campaign)
+		if err != nil {
+			return nil, err
+		}
+		for _, tc := range terms {
+			counts[tc.Term] += tc.Count
+		}
+	}
+	terms := []TermCount{}
+	for term, count := range counts {
+		terms = append(terms, TermCount{Term: term, Count: count})
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].Count != terms[j].Count {
+			return terms[i].Count > terms[j].Count
+		}
+		return terms[i].Term < terms[j].Term
+	})
+	return terms[:minInt(n, len(terms))], nil
+}
+
+func trendingTerms(ctx context.Context, db *sql.DB, since time.Time, n int, campaign string) ([]TermCount, error) {
+	rows, err := db.QueryContext(ctx, trendingTermsQuery, since, n, campaign)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	terms := []TermCount{}
+	for rows.Next() {
+		var tc TermCount
+		if err := rows.Scan(&tc.Term, &tc.Count); err != nil {
+			return nil, err
+		}
+		terms = append(terms, tc)
+	}
+	return terms, rows.Err()
+}
+
+// LatencyStats summarizes client-reported search latencies, in milliseconds.
+type LatencyStats struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+}
+
+const latencyQuery = `SELECT COUNT(latency_ms),
+			COALESCE(percentile_cont(ARRAY[0.5, 0.9, 0.99]) WITHIN GROUP (ORDER BY latency_ms), ARRAY[0, 0, 0]::float8[])
+			FROM user_searches
+			WHERE last_searched_at >= $1 AND latency_ms IS NOT NULL
+			AND ($2 = '' OR utm_campaign = $2)`
+
+// SearchLatency returns percentiles of the latencies reported for searches
+// since the given time. With Shards, each shard's percentiles are averaged
+// weighted by its count, which approximates the overall percentiles.
+func (l *Logger) SearchLatency(ctx context.Context, since time.Time) (LatencyStats, error) {
+	return l.CampaignSearchLatency(ctx, since, "")
+}
+
+// CampaignSearchLatency is SearchLatency restricted to searches attributed
+// to the given utm_campaign. An empty campaign matches every search.
+func (l *Logger) CampaignSearchLatency(ctx context.Context, since time.Time, campaign string) (LatencyStats, error) {
+	var total LatencyStats
+	for _, db := range l.shards() {
+		var count int64
+		var p pq.Float64Array
+		if err := db.QueryRowContext(ctx, latencyQuery, since, campaign).Scan(&count, &p); err != nil {
+			return LatencyStats{}, err
+		}
+		if count == 0 || len(p) != 3 {
+			continue
+		}
+		w := float64(count)
+		total.P50 += p[0] * w
+		total.P90 += p[1] * w
+		total.P99 += p[2] * w
+		total.Count += count
+	}
+	if total.Count > 0 {
+		w := float64(total.Count)
+		total.P50, total.P90, total.P99 = total.P50/w, total.P90/w, total.P99/w
+	}
+	return total, nil
+}
+
+const totalsQuery = `SELECT COUNT(*),
+			COUNT(DISTINCT NULLIF(user_id, '')),
+			COUNT(DISTINCT NULLIF(anon_id, '')),
+			COUNT(DISTINCT COALESCE(s.search_text, t.term))
+			FROM user_searches s LEFT JOIN search_terms t ON t.id = s.term_id`
+
+// SearchTotals returns overall counts of logged searches, users and terms.
+// With Shards, the per-shard counts are summed; users are exact since each
+// lives on one shard, but a term searched on several shards is counted once
+// per shard.
+func (l *Logger) SearchTotals(ctx context.Context) (Totals, error) {
+	var total Totals
+	for _, db := range l.shards() {
+		var t Totals
+		if err := db.QueryRowContext(ctx, totalsQuery).Scan(&t.Searches, &t.Users, &t.AnonUsers, &t.Terms); err != nil {
+			return Totals{}, err
+		}
+		total.Searches += t.Searches
+		total.Users += t.Users
+		total.AnonUsers += t.AnonUsers
+		total.Terms += t.Terms
+	}
+	return total, nil
+}
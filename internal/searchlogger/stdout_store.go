@@ -0,0 +1,48 @@
+package searchlogger
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// StdoutStore is a BatchStore that writes each committed search as a JSON
+// line, for deployments that ship stdout to a log pipeline instead of
+// running a database. Entries without a Timestamp are stamped with the time
+// of the write. It is safe for concurrent use; lines are never interleaved.
+type StdoutStore struct {
+	// W receives the lines. Defaults to os.Stdout.
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+// WriteSearch writes entry as a JSON line.
+func (s *StdoutStore) WriteSearch(ctx context.Context, entry SearchEntry) error {
+	return s.WriteSearches(ctx, []SearchEntry{entry})
+}
+
+// WriteSearches writes entries as consecutive JSON lines. Errors match
+// ErrDBWrite.
+func (s *StdoutStore) WriteSearches(ctx context.Context, entries []SearchEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.W
+	if w == nil {
+		w = os.Stdout
+	}
+	enc := json.NewEncoder(w)
+	now := time.Now().UTC()
+	for _, entry := range entries {
+		if entry.Timestamp.IsZero() {
+			entry.Timestamp = now
+		}
+		if err := enc.Encode(entry); err != nil {
+			return dbError(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"go-search-logger/internal/logging"
+)
+
+// Store persists committed searches. Unless Logger.Store is set, searches
+// are written to a PostgresStore on Logger.DB, or on the entry's shard when
+// Logger.Shards is set.
+type Store interface {
+	WriteSearch(ctx context.Context, entry SearchEntry) error
+}
+
+// PostgresStore writes searches to the user_searches table.
+type PostgresStore struct {
+	DB *sql.DB
+
+	// Outbox also records each search in search_outbox in the same
+	// transaction, for publishing by RelayOutbox.
+	Outbox bool
+
+	// OnConflict and ConflictTarget handle unique constraint violations; see
+	// Logger.OnConflict.
+	OnConflict     ConflictMode
+	ConflictTarget string
+
+	// TermsTable stores queries as ids into search_terms; see Logger.TermsTable.
+	TermsTable bool
+}
+
+// BatchStore is a Store that can write several searches atomically.
+type BatchStore interface {
+	Store
+	WriteSearches(ctx context.Context, entries []SearchEntry) error
+}
+
+// WriteSearch inserts entry in a transaction. Errors match ErrDBWrite.
+func (s *PostgresStore) WriteSearch(ctx context.Context, entry SearchEntry) error {
+	return s.WriteSearches(ctx, []SearchEntry{entry})
+}
+
+// WriteSearches inserts entries in a single transaction. Errors match ErrDBWrite.
+func (s *PostgresStore) WriteSearches(ctx context.Context, entries []SearchEntry) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("writeSearch: error starting transaction: %v", err)
+		return dbError(err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			log.Printf("writeSearch: panic recovered: %v", p)
+			panic(p)
+		}
+	}()
+
+	for _, entry := range entries {
+		insertQuery, args, err := buildStoreInsert(ctx, tx, entry, s.TermsTable)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("writeSearch: error storing term for userID=%s: %v", entry.UserID, err)
+			return dbError(err)
+		}
+		res, err := tx.ExecContext(ctx, insertQuery+conflictClause(s.OnConflict, s.ConflictTarget), args...)
+		if err != nil {
+			tx.Rollback()
+			log.Printf("writeSearch: error inserting query for userID=%s: %v", entry.UserID, err)
+			return dbError(err)
+		}
+		// An ignored conflict inserts nothing, so there is nothing to publish.
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			continue
+		}
+		if s.Outbox {
+			if err := insertOutbox(ctx, tx, entry); err != nil {
+				tx.Rollback()
+				log.Printf("writeSearch: error inserting outbox message for userID=%s: %v", entry.UserID, err)
+				return dbError(err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("writeSearch: error committing transaction: %v", err)
+		return dbError(err)
+	}
+	return nil
+}
+
+func (l *Logger) store() Store {
+	if l.Store != nil {
+		return l.Store
+	}
+	if len(l.Shards) > 1 {
+		return shardedStore{l: l}
+	}
+	return l.postgresStore(l.shards()[0])
+}
+
+// ActiveStore returns the Store searches are written to: Store if set,
+// otherwise the PostgresStore on DB or Shards configured from the Logger. It
+// lets a MultiStore wrap the default store, e.g. to add an ArchiveStore.
+func (l *Logger) ActiveStore() Store {
+	return l.store()
+}
+
+// postgresStore returns a PostgresStore on db configured from l.
+func (l *Logger) postgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{
+		DB:             db,
+		Outbox:         l.Outbox,
+		OnConflict:     l.OnConflict,
+		ConflictTarget: l.ConflictTarget,
+		TermsTable:     l.TermsTable,
+	}
+}
+
+// storeWrite writes entry to the configured store. Errors from custom stores
+// are wrapped so they match ErrDBWrite like PostgresStore's. Stores that do
+// not handle conflicts themselves still have them ignored with ConflictIgnore.
+func (l *Logger) storeWrite(ctx context.Context, entry SearchEntry) error {
+	err := l.store().WriteSearch(ctx, entry)
+	if err != nil && l.OnConflict == ConflictIgnore && IsUniqueViolation(err) {
+		logging.Debugf("writeSearch: query='%s' already stored for userID=%s, ignoring conflict", entry.Query, entrySessionID(entry))
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrDBWrite) {
+		err = dbError(err)
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package searchlogger
+
+import (
+	"context"
+	"database/sql"
+)
+
+// termIDQuery returns the id of a term in search_terms, inserting it if it
+// is new. Terms are unique by md5, since long queries exceed the btree row
+// size limit.
+const termIDQuery = `WITH ins AS (
+				INSERT INTO search_terms (term) VALUES ($1)
+				ON CONFLICT ((md5(term))) DO NOTHING
+				RETURNING id)
+			SELECT id FROM ins
+			UNION ALL
+			SELECT id FROM search_terms WHERE md5(term) = md5($1) AND term = $1
+			LIMIT 1`
+
+// termIDAttempts bounds the retries of termIDQuery.
+const termIDAttempts = 3
+
+// termID looks up or inserts term within tx. It is safe against concurrent
+// writers: if another transaction inserts the same term first, the insert
+// waits for it and then does nothing, but the statement's snapshot predates
+// that commit and finds no row, so the query is retried with a new snapshot.
+func termID(ctx context.Context, tx *sql.Tx, term string) (int64, error) {
+	var id int64
+	var err error
+	for i := 0; i < termIDAttempts; i++ {
+		err = tx.QueryRowContext(ctx, termIDQuery, term).Scan(&id)
+		if err != sql.ErrNoRows {
+			break
+		}
+	}
+	return id, err
+}
+
+// buildStoreInsert returns the insert for entry, storing its query in
+// search_terms first if terms is set.
+func buildStoreInsert(ctx context.Context, tx *sql.Tx, entry SearchEntry, terms bool) (string, []interface{}, error) {
+	if !terms {
+		query, args := buildInsert(entry)
+		return query, args, nil
+	}
+	id, err := termID(ctx, tx, entry.Query)
+	if err != nil {
+		return "", nil, err
+	}
+	query, args := buildInsertAs(entry, "term_id", id)
+	return query, args, nil
+}
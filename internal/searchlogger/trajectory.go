@@ -0,0 +1,76 @@
+package searchlogger
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// DefaultMaxTrajectory is the default MaxTrajectory.
+const DefaultMaxTrajectory = 100
+
+// Keystroke is one LogSearch call of a session, as recorded by TrajectoryMode.
+type Keystroke struct {
+	Query string    `json:"query"` // as typed, before normalization
+	At    time.Time `json:"ts"`
+}
+
+func (l *Logger) maxTrajectory() int {
+	if l.MaxTrajectory > 0 {
+		return l.MaxTrajectory
+	}
+	return DefaultMaxTrajectory
+}
+
+// buildTrajectoryKey constructs the key holding a session's keystrokes.
+func buildTrajectoryKey(id string) string {
+	return "search:trajectory:" + id
+}
+
+// recordKeystroke appends a keystroke to the session's trajectory, keeping
+// the latest MaxTrajectory. The list lives as long as the buffer.
+func (l *Logger) recordKeystroke(ctx context.Context, id, query string) error {
+	b, err := json.Marshal(Keystroke{Query: query, At: l.now()})
+	if err != nil {
+		return err
+	}
+	key := buildTrajectoryKey(id)
+	pipe := l.Redis.TxPipeline()
+	pipe.RPush(ctx, key, b)
+	pipe.LTrim(ctx, key, -int64(l.maxTrajectory()), -1)
+	pipe.Expire(ctx, key, l.bufferTTL())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return redisError(err)
+	}
+	return nil
+}
+
+// trajectory returns the session's recorded keystrokes, oldest first. A
+// trajectory that cannot be read is logged and left out rather than failing
+// the commit it would be stored with.
+func (l *Logger) trajectory(ctx context.Context, id string) []Keystroke {
+	vals, err := l.Redis.LRange(ctx, buildTrajectoryKey(id), 0, -1).Result()
+	if err != nil {
+		log.Printf("LogSearch: could not read trajectory for userID=%s: %v", id, err)
+		return nil
+	}
+	var res []Keystroke
+	for _, v := range vals {
+		var k Keystroke
+		if err := json.Unmarshal([]byte(v), &k); err == nil {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// withTrajectory attaches the session's trajectory to entry when
+// TrajectoryMode is on. The caller deletes the trajectory key once the entry
+// is committed.
+func (l *Logger) withTrajectory(ctx context.Context, id string, entry SearchEntry) SearchEntry {
+	if l.TrajectoryMode {
+		entry.Trajectory = l.trajectory(ctx, id)
+	}
+	return entry
+}
@@ -0,0 +1,76 @@
+package searchlogger
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go-search-logger/internal/logging"
+	"go-search-logger/internal/metrics"
+)
+
+// userCommitsTTL keeps a day's per-user commit counter past the day's end in
+// any time zone.
+const userCommitsTTL = 48 * time.Hour
+
+// buildUserCommitsKey constructs the Redis key counting the searches an id
+// committed on day.
+func buildUserCommitsKey(day, id string) string {
+	return "search:usercommits:" + day + ":" + id
+}
+
+// reserveCommit applies CommitDedupWindow and DailyUserCap to entry before it
+// is written. It reports whether the write should be skipped, and otherwise
+// returns a function undoing the reservation if the write fails.
+func (l *Logger) reserveCommit(ctx context.Context, entry SearchEntry) (undo func(), skip bool) {
+	claim, dup := l.claimCommit(ctx, entry)
+	if dup {
+		logging.Debugf("writeSearch: query='%s' committed within CommitDedupWindow for userID=%s, skipping write", entry.Query, entrySessionID(entry))
+		return nil, true
+	}
+	counter, over := l.countDailyCommit(ctx, entry)
+	if over {
+		l.releaseCommit(ctx, claim)
+		metrics.DailyUserCapDropped.Add(1)
+		logging.Debugf("writeSearch: userID=%s reached DailyUserCap, dropping query='%s'", entrySessionID(entry), entry.Query)
+		return nil, true
+	}
+	return func() {
+		l.releaseCommit(ctx, claim)
+		l.uncountDailyCommit(ctx, counter)
+	}, false
+}
+
+// countDailyCommit counts entry towards its id's DailyUserCap for today. It
+// reports the counter to decrement if the write fails, and whether the cap is
+// exceeded. Redis errors are logged and treated as under the cap so a search
+// is never lost to the check.
+func (l *Logger) countDailyCommit(ctx context.Context, entry SearchEntry) (key string, over bool) {
+	if l.DailyUserCap <= 0 {
+		return "", false
+	}
+	key = buildUserCommitsKey(l.dayOf(l.now()), entrySessionID(entry))
+	pipe := l.Redis.TxPipeline()
+	n := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, userCommitsTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("countDailyCommit: could not count commit for userID=%s: %v", entrySessionID(entry), err)
+		return "", false
+	}
+	if n.Val() > int64(l.DailyUserCap) {
+		// Dropped commits don't count, so the counter stays at the cap.
+		l.uncountDailyCommit(ctx, key)
+		return "", true
+	}
+	return key, false
+}
+
+// uncountDailyCommit reverses countDailyCommit.
+func (l *Logger) uncountDailyCommit(ctx context.Context, key string) {
+	if key == "" {
+		return
+	}
+	if err := l.Redis.Decr(ctx, key).Err(); err != nil {
+		log.Printf("uncountDailyCommit: could not decrement %s: %v", key, err)
+	}
+}
@@ -0,0 +1,101 @@
+package searchlogger
+
+import (
+	"log"
+	"strings"
+)
+
+// DeviceInfo is the segmentation data derived from a User-Agent. Fields the
+// parser cannot determine are left empty.
+type DeviceInfo struct {
+	Device  string // "mobile", "tablet" or "desktop"
+	Browser string // e.g. "Chrome", "Safari"
+	OS      string // e.g. "Android", "iOS", "Windows"
+}
+
+// UAParser derives DeviceInfo from a User-Agent string. Implementations should
+// be safe for concurrent use.
+type UAParser interface {
+	Parse(userAgent string) DeviceInfo
+}
+
+// SimpleUAParser is a lightweight UAParser that recognizes the common
+// browsers and operating systems by substring. It does not report versions.
+type SimpleUAParser struct{}
+
+// Parse implements UAParser.
+func (SimpleUAParser) Parse(userAgent string) DeviceInfo {
+	ua := strings.ToLower(userAgent)
+	if ua == "" {
+		return DeviceInfo{}
+	}
+	return DeviceInfo{Device: uaDevice(ua), Browser: uaBrowser(ua), OS: uaOS(ua)}
+}
+
+func uaDevice(ua string) string {
+	switch {
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") ||
+		(strings.Contains(ua, "android") && !strings.Contains(ua, "mobile")):
+		return "tablet"
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") || strings.Contains(ua, "ipod"):
+		return "mobile"
+	default:
+		return "desktop"
+	}
+}
+
+func uaBrowser(ua string) string {
+	// Order matters: Edge and Opera also claim Chrome, which claims Safari.
+	for _, b := range []struct{ token, name string }{
+		{"edg", "Edge"},
+		{"opr/", "Opera"},
+		{"opera", "Opera"},
+		{"samsungbrowser", "Samsung Internet"},
+		{"chrome/", "Chrome"},
+		{"crios/", "Chrome"},
+		{"firefox/", "Firefox"},
+		{"fxios/", "Firefox"},
+		{"safari/", "Safari"},
+	} {
+		if strings.Contains(ua, b.token) {
+			return b.name
+		}
+	}
+	return ""
+}
+
+func uaOS(ua string) string {
+	// iOS User-Agents contain "like Mac OS X", and Android ones "Linux".
+	for _, o := range []struct{ token, name string }{
+		{"windows", "Windows"},
+		{"iphone", "iOS"},
+		{"ipad", "iOS"},
+		{"ipod", "iOS"},
+		{"android", "Android"},
+		{"cros", "ChromeOS"},
+		{"mac os x", "macOS"},
+		{"macintosh", "macOS"},
+		{"linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			return o.name
+		}
+	}
+	return ""
+}
+
+// parseUserAgent applies the configured UAParser. Parsing is best-effort: a
+// panicking parser is logged and yields empty DeviceInfo rather than failing
+// the search.
+func (l *Logger) parseUserAgent(userAgent string) (info DeviceInfo) {
+	if l.UAParser == nil {
+		return DeviceInfo{}
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("LogSearch: User-Agent parser panicked: %v", p)
+			info = DeviceInfo{}
+		}
+	}()
+	return l.UAParser.Parse(userAgent)
+}
@@ -0,0 +1,84 @@
+package searchlogger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxVariantLength bounds a variant name.
+const MaxVariantLength = 64
+
+// Variant overrides logging heuristics for the requests that select it, so
+// alternatives can be compared in production. The zero Variant behaves like
+// the Logger's own settings, which makes it a control group.
+type Variant struct {
+	// ResetEditDistance, if positive, detects resets with the edit-distance
+	// classifier tolerating this many edits instead of the prefix one.
+	ResetEditDistance int
+	// TrailingSpaceCommits commits queries with trailing whitespace
+	// immediately, as if Logger.TrailingSpaceCommits were enabled.
+	TrailingSpaceCommits bool
+}
+
+// ParseVariants parses semicolon-separated variants of the form
+// "name=policy,policy", e.g. "control=;typo=edit-distance:2,trailing-space".
+// The policies are "edit-distance:N" and "trailing-space".
+func ParseVariants(s string) (map[string]Variant, error) {
+	variants := make(map[string]Variant)
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, policies, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || len(name) > MaxVariantLength {
+			return nil, fmt.Errorf("invalid variant %q", spec)
+		}
+		if _, dup := variants[name]; dup {
+			return nil, fmt.Errorf("duplicate variant %q", name)
+		}
+		var v Variant
+		for _, policy := range strings.Split(policies, ",") {
+			policy = strings.TrimSpace(policy)
+			switch {
+			case policy == "":
+			case policy == "trailing-space":
+				v.TrailingSpaceCommits = true
+			case strings.HasPrefix(policy, "edit-distance:"):
+				n, err := strconv.Atoi(strings.TrimPrefix(policy, "edit-distance:"))
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("variant %q: invalid policy %q", name, policy)
+				}
+				v.ResetEditDistance = n
+			default:
+				return nil, fmt.Errorf("variant %q: unknown policy %q", name, policy)
+			}
+		}
+		variants[name] = v
+	}
+	return variants, nil
+}
+
+// variant returns the configured Variant a request selects. An empty name
+// selects the Logger's own settings.
+func (l *Logger) variant(name string) (Variant, error) {
+	if name == "" {
+		return Variant{}, nil
+	}
+	v, ok := l.Variants[name]
+	if !ok {
+		return Variant{}, fmt.Errorf("%w: unknown variant %q", ErrInvalidRequest, name)
+	}
+	return v, nil
+}
+
+// isReset classifies a new query as a reset of the live one, with the
+// classifier the variant selects.
+func (v Variant) isReset(lastQuery, query string) bool {
+	if v.ResetEditDistance > 0 {
+		return isEditDistanceReset(lastQuery, query, v.ResetEditDistance)
+	}
+	return isPrefixReset(lastQuery, query)
+}
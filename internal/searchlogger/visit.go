@@ -0,0 +1,45 @@
+package searchlogger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// buildVisitKey constructs the Redis key holding an anon id's current visit
+// id, for AnonVisitWindow.
+func buildVisitKey(anonID string) string {
+	return "search:visit:" + anonID
+}
+
+// newVisitID returns a random 64-bit visit id in hex.
+func newVisitID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// stampVisit sets entry.VisitID for an anonymous session with
+// AnonVisitWindow: the anon id's current visit id, or a new one if it has
+// been inactive for the window. Every search slides the window.
+func (l *Logger) stampVisit(ctx context.Context, sess session, entry *SearchEntry) error {
+	if l.AnonVisitWindow <= 0 || sess.userID != "" {
+		return nil
+	}
+	candidate, err := newVisitID()
+	if err != nil {
+		return err
+	}
+	key := buildVisitKey(sess.anonID)
+	pipe := l.Redis.TxPipeline()
+	pipe.SetNX(ctx, key, candidate, l.AnonVisitWindow)
+	visit := pipe.Get(ctx, key)
+	pipe.Expire(ctx, key, l.AnonVisitWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return redisError(err)
+	}
+	entry.VisitID = visit.Val()
+	return nil
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+//go:embed admin/index.html
+var adminFS embed.FS
+
+// adminHandler serves the embedded admin dashboard.
+func (s *Server) adminHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := adminFS.ReadFile("admin/index.html")
+	if err != nil {
+		http.Error(w, "admin page unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+// pauseHandler returns a handler that pauses or resumes logging, e.g. for DB
+// maintenance, and reports the resulting state.
+func (s *Server) pauseHandler(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.Logger.SetPaused(paused)
+		logRequestf(r, "Admin: logging paused=%t", paused)
+		writeJSON(w, map[string]bool{"paused": paused})
+	}
+}
+
+// statsHandler returns search totals, and the trending terms and latency
+// percentiles within a window. The optional campaign parameter restricts
+// trending terms and latency to searches with that utm_campaign; totals are
+// always overall.
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	window, ok := parseWindow(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	totals, err := s.Logger.SearchTotals(ctx)
+	if err != nil {
+		logRequestf(r, "error reading totals: %v", err)
+		http.Error(w, "error reading stats", http.StatusInternalServerError)
+		return
+	}
+	since := time.Now().Add(-window)
+	campaign := r.URL.Query().Get("campaign")
+	trending, err := s.Logger.CampaignTrendingTerms(ctx, since, limit, campaign)
+	if err != nil {
+		logRequestf(r, "error reading trending terms: %v", err)
+		http.Error(w, "error reading stats", http.StatusInternalServerError)
+		return
+	}
+	latency, err := s.Logger.CampaignSearchLatency(ctx, since, campaign)
+	if err != nil {
+		logRequestf(r, "error reading latency: %v", err)
+		http.Error(w, "error reading stats", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"totals":   totals,
+		"trending": trending,
+		"latency":  latency,
+	})
+}
+
+// funnelHandler returns the most frequent query refinement chains within the
+// window, e.g. "sho" -> "shoes" -> "red shoes".
+func (s *Server) funnelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	window, ok := parseWindow(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	refinements, err := s.Logger.QueryRefinements(r.Context(), time.Now().Add(-window))
+	if err != nil {
+		logRequestf(r, "error reading query refinements: %v", err)
+		http.Error(w, "error reading funnel", http.StatusInternalServerError)
+		return
+	}
+	if len(refinements) > limit {
+		refinements = refinements[:limit]
+	}
+	writeJSON(w, refinements)
+}
+
+// gapsHandler returns the most frequent searches that found nothing.
+func (s *Server) gapsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	gaps, err := s.Logger.TopGaps(r.Context(), limit)
+	if err != nil {
+		logRequestf(r, "error reading zero-result searches: %v", err)
+		http.Error(w, "error reading gaps", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, gaps)
+}
+
+// risingHandler returns the terms with the most recency-weighted commits
+// among those searched within the window.
+func (s *Server) risingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	window, ok := parseWindow(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	rising, err := s.Logger.TrendingRecent(r.Context(), limit, window)
+	if err != nil {
+		logRequestf(r, "error reading rising searches: %v", err)
+		http.Error(w, "error reading rising searches", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, rising)
+}
+
+// historyHandler returns recent searches, optionally for a single user or anon
+// id. It is paginated with limit and either offset or cursor; the cursor for
+// the next page is returned in the X-Next-Cursor header.
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+
+	entries, next, err := s.Logger.RecentSearchesPage(r.Context(), r.URL.Query().Get("user_id"), page)
+	if err != nil {
+		logRequestf(r, "error reading history: %v", err)
+		http.Error(w, "error reading history", http.StatusInternalServerError)
+		return
+	}
+	if next != nil {
+		w.Header().Set("X-Next-Cursor", next.String())
+	}
+	writeJSON(w, entries)
+}
+
+const maxUserHistoryBody = 64 << 10
+
+// userHistoryRequest is the body accepted by userHistoryHandler.
+type userHistoryRequest struct {
+	UserIDs []string  `json:"user_ids"`
+	Since   time.Time `json:"since"`
+}
+
+// userHistoryHandler returns every search for a list of user ids in one
+// call. The body is JSON: {"user_ids": ["1", "2"], "since": "2024-01-01T00:00:00Z"}.
+// Results are a flat list with the user id on each entry.
+func (s *Server) userHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req userHistoryRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxUserHistoryBody)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := s.Logger.SearchesForUsers(r.Context(), req.UserIDs, req.Since)
+	if err != nil {
+		if errors.Is(err, searchlogger.ErrInvalidRequest) || errors.Is(err, searchlogger.ErrInvalidUserID) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logRequestf(r, "error reading user history: %v", err)
+		http.Error(w, "error reading history", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error encoding response: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+// deleteAnonHandler erases an anonymous user's searches and live session for
+// DELETE /anon?anon_id=..., e.g. for a "forget me" request after the visitor
+// cleared cookies, and returns the number of rows deleted.
+func (s *Server) deleteAnonHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+	if err := singleValued(r, "anon_id"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	anonID := r.FormValue("anon_id")
+	if anonID == "" {
+		http.Error(w, "missing anon_id", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.Logger.DeleteAnon(r.Context(), anonID)
+	if err != nil {
+		switch {
+		case errors.Is(err, searchlogger.ErrInvalidUserID):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, searchlogger.ErrRedisUnavailable):
+			logRequestf(r, "error deleting anon id: %v", err)
+			http.Error(w, "search logging temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		logRequestf(r, "error deleting anon id: %v", err)
+		http.Error(w, "error deleting searches", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int64{"deleted": deleted})
+}
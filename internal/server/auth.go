@@ -0,0 +1,45 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// Authenticator decides whether a request may access protected endpoints.
+type Authenticator interface {
+	Authenticate(r *http.Request) bool
+}
+
+// BasicAuth authenticates requests using HTTP basic credentials.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// Authenticate reports whether the request carries the configured credentials.
+func (a *BasicAuth) Authenticate(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.Password)) == 1
+	return userOK && passOK
+}
+
+// requireAuth rejects requests that the server's Authenticator does not accept.
+// Without an Authenticator protected endpoints are disabled entirely.
+func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Auth == nil {
+			http.Error(w, "authentication not configured", http.StatusForbidden)
+			return
+		}
+		if !s.Auth.Authenticate(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="search-logger"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const maxBeaconBody = 1 << 10
+
+// DefaultBeaconFlushTimeout is the default BeaconFlushTimeout.
+const DefaultBeaconFlushTimeout = 5 * time.Second
+
+func (s *Server) beaconFlushTimeout() time.Duration {
+	if s.BeaconFlushTimeout > 0 {
+		return s.BeaconFlushTimeout
+	}
+	return DefaultBeaconFlushTimeout
+}
+
+// beaconHandler accepts navigator.sendBeacon requests sent on page unload and
+// flushes the user's buffered query without waiting for the session TTL.
+//
+// The body is sent as text/plain and may contain form-encoded fields
+// ("user_id=123", or "anon_id=..." for anonymous visitors identified like
+// /search); both may also be passed in the URL. The response is written
+// before flushing since browsers never read it.
+func (s *Server) beaconHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	anonID := r.URL.Query().Get("anon_id")
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBeaconBody))
+	if err == nil && len(body) > 0 {
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			if values.Get("user_id") != "" {
+				userID = values.Get("user_id")
+			}
+			if values.Get("anon_id") != "" {
+				anonID = values.Get("anon_id")
+			}
+		}
+	}
+	userAgent := r.UserAgent()
+
+	w.WriteHeader(http.StatusNoContent)
+
+	// The request context is cancelled as soon as the browser goes away, so
+	// the flush runs on its own bounded context. Run waits for it.
+	s.beacons.Add(1)
+	go func() {
+		defer s.beacons.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), s.beaconFlushTimeout())
+		defer cancel()
+		if err := s.Logger.FlushSession(ctx, userID, userAgent, anonID); err != nil {
+			logRequestf(r, "error flushing search on beacon: %v", err)
+		}
+	}()
+}
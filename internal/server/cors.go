@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS configures cross-origin access to the endpoints browsers call
+// directly: /search, /search/result, /beacon and /link. The read and admin
+// endpoints never send CORS headers. Without a CORS config, or for origins
+// not listed, no CORS headers are sent and browsers block cross-origin calls.
+type CORS struct {
+	// AllowedOrigins are exact origins, e.g. "https://shop.example.com", or
+	// "*" for any origin.
+	AllowedOrigins []string
+	// AllowedMethods defaults to POST.
+	AllowedMethods []string
+	// AllowedHeaders defaults to Content-Type.
+	AllowedHeaders []string
+	// AllowCredentials lets browsers send cookies and HTTP auth.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache preflight results. Zero leaves
+	// it to the browser.
+	MaxAge time.Duration
+}
+
+func (c *CORS) allowOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) methods() string {
+	if len(c.AllowedMethods) == 0 {
+		return http.MethodPost
+	}
+	return strings.Join(c.AllowedMethods, ", ")
+}
+
+func (c *CORS) headers() string {
+	if len(c.AllowedHeaders) == 0 {
+		return "Content-Type"
+	}
+	return strings.Join(c.AllowedHeaders, ", ")
+}
+
+// cors adds the server's CORS headers to responses for allowed origins and
+// answers preflight requests itself.
+func (s *Server) cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		c := s.CORS
+		if c == nil || origin == "" {
+			next(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !c.allowOrigin(origin) {
+			if preflight {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		// The origin is echoed rather than "*" so credentials work with "*".
+		h.Set("Access-Control-Allow-Origin", origin)
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			next(w, r)
+			return
+		}
+		h.Set("Access-Control-Allow-Methods", c.methods())
+		h.Set("Access-Control-Allow-Headers", c.headers())
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const healthTimeout = 2 * time.Second
+
+// healthHandler reports whether Redis and the DB are reachable, and whether
+// logging is paused. While paused the DB is expected to be down for
+// maintenance, so an unreachable DB does not fail the check.
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	status, code := s.checkDependencies(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, status)
+}
+
+// livezHandler reports that the process is running. It checks nothing else,
+// so an orchestrator restarts the process only when it is wedged, not when
+// Redis or the DB is down.
+func (s *Server) livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// readyzHandler reports whether the service is ready to serve: Redis and the
+// DB are reachable as for /healthz, and the keyspace listener has sent a
+// recent heartbeat, so expired sessions are being committed.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status, code := s.checkDependencies(r.Context())
+	last := s.Logger.ListenerHeartbeat()
+	switch {
+	case last.IsZero():
+		status["listener"] = "not started"
+	case !s.Logger.ListenerAlive():
+		status["listener"] = "no heartbeat since " + last.UTC().Format(time.RFC3339)
+	default:
+		status["listener"] = "ok"
+	}
+	if status["listener"] != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, status)
+}
+
+// checkDependencies pings Redis and the DB and returns their status with
+// 200, or 503 if one is down.
+func (s *Server) checkDependencies(ctx context.Context) (map[string]string, int) {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	paused := s.Logger.Paused()
+	status := map[string]string{"redis": "ok", "db": "ok", "paused": strconv.FormatBool(paused)}
+	code := http.StatusOK
+	if err := s.Logger.Redis.Ping(ctx).Err(); err != nil {
+		status["redis"] = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	if !s.Logger.HasDB() {
+		status["db"] = "disabled"
+	} else if err := s.Logger.DB.PingContext(ctx); err != nil {
+		status["db"] = err.Error()
+		if !paused {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	return status, code
+}
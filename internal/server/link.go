@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+const maxLinkBody = 1 << 10
+
+// linkRequest is the body accepted by linkHandler.
+type linkRequest struct {
+	UserID string `json:"user_id"`
+	AnonID string `json:"anon_id"`
+}
+
+// linkHandler attributes a visitor's anonymous searches to the user they just
+// logged in as. The body is JSON: {"user_id": "123"}. The anon id is the one
+// /search used for the same client: anon_id if given, else the User-Agent.
+// It requires admin credentials, since user_id is taken on trust: it is
+// meant to be called by the application's backend once it has verified the
+// login, forwarding the visitor's User-Agent or anon id.
+func (s *Server) linkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req linkRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxLinkBody)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Logger.LinkSession(r.Context(), req.UserID, r.UserAgent(), req.AnonID); err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
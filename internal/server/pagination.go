@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+	// maxOffset bounds offset paging; deeper pages should use a cursor.
+	maxOffset = 10000
+	// defaultWindow is how far back /stats and /funnel look by default.
+	defaultWindow = 24 * time.Hour
+)
+
+// parseLimit reads the optional limit query parameter, writing a 400 if it is invalid.
+func parseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultLimit, true
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 || limit > maxLimit {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
+}
+
+// parseWindow reads the optional window query parameter, a duration
+// defaulting to 24h, writing a 400 if it is invalid.
+func parseWindow(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	v := r.URL.Query().Get("window")
+	if v == "" {
+		return defaultWindow, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		http.Error(w, "invalid window", http.StatusBadRequest)
+		return 0, false
+	}
+	return d, true
+}
+
+// parsePage reads the limit, offset and cursor query parameters, writing a
+// 400 if any is invalid or both offset and cursor are given.
+func parsePage(w http.ResponseWriter, r *http.Request) (searchlogger.Page, bool) {
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return searchlogger.Page{}, false
+	}
+	page := searchlogger.Page{Limit: limit}
+
+	q := r.URL.Query()
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 || offset > maxOffset {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return searchlogger.Page{}, false
+		}
+		page.Offset = offset
+	}
+	if v := q.Get("cursor"); v != "" {
+		if page.Offset > 0 {
+			http.Error(w, "offset and cursor are mutually exclusive", http.StatusBadRequest)
+			return searchlogger.Page{}, false
+		}
+		cursor, err := searchlogger.ParseCursor(v)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return searchlogger.Page{}, false
+		}
+		page.Cursor = cursor
+	}
+	return page, true
+}
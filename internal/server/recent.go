@@ -0,0 +1,33 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+// recentHandler returns a user's recent searches for a "recent searches" UI:
+// the in-progress query, flagged active, followed by the committed history.
+func (s *Server) recentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	recent, err := s.Logger.RecentWithActive(r.Context(), r.URL.Query().Get("user_id"), limit)
+	switch {
+	case errors.Is(err, searchlogger.ErrInvalidRequest), errors.Is(err, searchlogger.ErrInvalidUserID):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		logRequestf(r, "error reading recent searches: %v", err)
+		http.Error(w, "error reading recent searches", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, recent)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"go-search-logger/internal/logging"
+)
+
+// DefaultRequestIDHeader is the default Server.RequestIDHeader.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength caps a client-supplied request id, in bytes. Longer or
+// non-printable ids are replaced with a fresh one.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+func (s *Server) requestIDHeader() string {
+	if s.RequestIDHeader != "" {
+		return s.RequestIDHeader
+	}
+	return DefaultRequestIDHeader
+}
+
+// withRequestID wraps every route: it takes the request id from the
+// incoming RequestIDHeader, or generates one, echoes it in the response and
+// stores it in the request context for logRequestf. It also sets the
+// configured Headers on every response.
+func (s *Server) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(s.requestIDHeader())
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		h := w.Header()
+		for name, values := range s.Headers {
+			h[name] = append([]string(nil), values...)
+		}
+		h.Set(s.requestIDHeader(), id)
+		logging.Debugf("%s %s request_id=%s", r.Method, r.URL.Path, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether a client-supplied id is safe to echo and
+// log: non-empty, at most maxRequestIDLength bytes of printable ASCII.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128-bit id in hex.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// requestID returns the id withRequestID stored in ctx, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logRequestf logs like log.Printf, tagged with r's request id so server
+// logs can be matched to what the client reported.
+func logRequestf(r *http.Request, format string, args ...interface{}) {
+	if id := requestID(r.Context()); id != "" {
+		format += " request_id=%s"
+		args = append(args, id)
+	}
+	log.Printf(format, args...)
+}
+
+// ParseHeaders parses semicolon-separated "Name: value" pairs, e.g.
+// "Cache-Control: no-store; X-Frame-Options: DENY", for Server.Headers.
+func ParseHeaders(s string) (http.Header, error) {
+	headers := http.Header{}
+	for _, pair := range strings.Split(s, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header %q: want \"Name: value\"", strings.TrimSpace(pair))
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
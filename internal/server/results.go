@@ -0,0 +1,34 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"go-search-logger/internal/searchlogger"
+)
+
+const maxResultBody = 4 << 10
+
+// resultHandler records the result a user selected for a search. The body is
+// JSON: {"user_id": "123", "query": "shoes", "result_id": "sku-42", "position": 3}.
+// Anonymous visitors that send anon_id to /search send it here too.
+func (s *Server) resultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sel searchlogger.ResultSelection
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxResultBody)).Decode(&sel); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	sel.UserAgent = r.UserAgent()
+
+	if err := s.Logger.RecordResult(r.Context(), sel); err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
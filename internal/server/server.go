@@ -1,13 +1,84 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
 	"go-search-logger/internal/searchlogger"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	extraFieldPrefix = "extra."
+	maxExtraFields   = 16
+
+	// eventBlur is the /search event sent when the search box loses focus.
+	eventBlur = "blur"
 )
 
 type Server struct {
 	Logger *searchlogger.Logger
+	Auth   Authenticator // guards /admin and the read endpoints
+	CORS   *CORS         // cross-origin access for browser clients; nil denies it
+
+	// TrustProxy takes the client IP from X-Forwarded-For instead of the
+	// connection. Only enable it behind a proxy that sets the header.
+	TrustProxy bool
+	// ProxyHops is the number of trusted proxies in front of the server,
+	// each appending the address it received from to X-Forwarded-For. The
+	// client IP is the ProxyHops-th address from the right; addresses to its
+	// left are sent by the client and can be forged. Defaults to 1.
+	ProxyHops int
+
+	// BasePath mounts all routes under a prefix, e.g. "/api/searchlog" serves
+	// /api/searchlog/search. Leading and trailing slashes are optional.
+	BasePath string
+
+	// Pprof mounts net/http/pprof at /debug/pprof/, behind Auth, for
+	// profiling under real traffic. Profiles expose internals, so it is off
+	// by default.
+	Pprof bool
+
+	// RequestIDHeader is the header a request id is read from and echoed
+	// in, generated when the client sends none. Server logs include it.
+	// Defaults to DefaultRequestIDHeader.
+	RequestIDHeader string
+
+	// VariantHeader is the header selecting a Logger.Variants entry for a
+	// search, honored only on requests that pass Auth. Defaults to
+	// DefaultVariantHeader.
+	VariantHeader string
+
+	// Headers are set on every response, e.g. a Cache-Control policy for a
+	// CDN in front of the server. Handlers may override them.
+	Headers http.Header
+
+	// ShutdownTimeout bounds how long Run waits for in-flight requests once
+	// ctx is cancelled. Defaults to DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+
+	// BeaconFlushTimeout bounds each flush started by /beacon. Defaults to
+	// DefaultBeaconFlushTimeout.
+	BeaconFlushTimeout time.Duration
+	// DisableBeacon leaves /beacon unregistered, e.g. where a session must
+	// not be committed before the session TTL.
+	DisableBeacon bool
+
+	// beacons tracks /beacon flushes still running, for Run to wait on.
+	beacons sync.WaitGroup
+
+	// stopping is closed when Run begins shutting down, ending /tail streams
+	// that would otherwise hold up the shutdown.
+	stopping chan struct{}
 }
 
 func NewServer(logger *searchlogger.Logger) *Server {
@@ -15,9 +86,108 @@ func NewServer(logger *searchlogger.Logger) *Server {
 }
 
 func (s *Server) Start(addr string) error {
-	http.HandleFunc("/search", s.searchHandler)
-	log.Printf("Listening on %s", addr)
-	return http.ListenAndServe(addr, nil)
+	return s.Run(context.Background(), addr)
+}
+
+// DefaultShutdownTimeout is the default ShutdownTimeout.
+const DefaultShutdownTimeout = 10 * time.Second
+
+func (s *Server) shutdownTimeout() time.Duration {
+	if s.ShutdownTimeout > 0 {
+		return s.ShutdownTimeout
+	}
+	return DefaultShutdownTimeout
+}
+
+// Run serves until ctx is cancelled, then stops accepting connections and
+// waits up to ShutdownTimeout for in-flight requests to finish, and then for
+// the session flushes started by /beacon.
+func (s *Server) Run(ctx context.Context, addr string) error {
+	s.stopping = make(chan struct{})
+	srv := &http.Server{Addr: addr, Handler: s.routes()}
+	srv.RegisterOnShutdown(func() { close(s.stopping) })
+	errc := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s", addr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	s.beacons.Wait()
+	return err
+}
+
+// routes registers the server's handlers on a new mux, under BasePath if set.
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthHandler)
+	mux.HandleFunc("/livez", s.livezHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	mux.HandleFunc("/search", s.cors(s.searchHandler))
+	mux.HandleFunc("/submit", s.cors(s.submitHandler))
+	mux.HandleFunc("/search/result", s.cors(s.requireDB(s.resultHandler)))
+	if !s.DisableBeacon {
+		mux.HandleFunc("/beacon", s.cors(s.beaconHandler))
+	}
+	mux.HandleFunc("/link", s.requireAuth(s.linkHandler))
+	mux.HandleFunc("/session/clear", s.cors(s.clearSessionHandler))
+	mux.HandleFunc("/stats", s.requireAuth(s.requireDB(s.statsHandler)))
+	mux.HandleFunc("/history", s.requireAuth(s.requireDB(s.historyHandler)))
+	mux.HandleFunc("/history/users", s.requireAuth(s.requireDB(s.userHistoryHandler)))
+	mux.HandleFunc("/recent", s.requireAuth(s.requireDB(s.recentHandler)))
+	mux.HandleFunc("/tail", s.requireAuth(s.tailHandler))
+	mux.HandleFunc("/funnel", s.requireAuth(s.requireDB(s.funnelHandler)))
+	mux.HandleFunc("/gaps", s.requireAuth(s.gapsHandler))
+	mux.HandleFunc("/rising", s.requireAuth(s.risingHandler))
+	mux.HandleFunc("/anon", s.requireAuth(s.requireDB(s.deleteAnonHandler)))
+	mux.HandleFunc("/admin", s.requireAuth(s.adminHandler))
+	mux.HandleFunc("/admin/pause", s.requireAuth(s.pauseHandler(true)))
+	mux.HandleFunc("/admin/resume", s.requireAuth(s.pauseHandler(false)))
+	mux.HandleFunc("/debug/vars", s.requireAuth(expvar.Handler().ServeHTTP))
+	if s.Pprof {
+		mux.HandleFunc("/debug/pprof/", s.requireAuth(pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", s.requireAuth(pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", s.requireAuth(pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", s.requireAuth(pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", s.requireAuth(pprof.Trace))
+	}
+
+	base := cleanBasePath(s.BasePath)
+	if base == "" {
+		return s.withRequestID(mux)
+	}
+	outer := http.NewServeMux()
+	outer.Handle(base+"/", http.StripPrefix(base, mux))
+	return s.withRequestID(outer)
+}
+
+// requireDB rejects requests to endpoints that read or update stored
+// searches when no database is configured, e.g. with a StdoutStore.
+func (s *Server) requireDB(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.Logger.HasDB() {
+			http.Error(w, "this endpoint requires a database", http.StatusNotImplemented)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// cleanBasePath normalizes a base path to "/prefix" form, or "" for the root.
+func cleanBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
 }
 
 func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
@@ -31,22 +201,191 @@ func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := r.FormValue("q")
-	if query == "" {
-		http.Error(w, "missing query parameter q", http.StatusBadRequest)
+	// Bots are acknowledged but not logged.
+	if s.Logger.BotFilter.IsBot(r.UserAgent()) {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	if err := singleValued(r, singleValuedFields...); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.FormValue("q")
+	event := r.FormValue("event")
+	if event != "" && event != eventBlur {
+		http.Error(w, "unknown event "+strconv.Quote(event), http.StatusBadRequest)
+		return
+	}
 	ctx := r.Context()
 	userID := r.FormValue("user_id")
+	if event == eventBlur && query == "" {
+		// The search box lost focus: commit whatever was typed last.
+		if err := s.Logger.EndSession(ctx, userID, r.UserAgent(), r.FormValue("anon_id")); err != nil {
+			writeLogError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if query == "" {
+		http.Error(w, "missing query parameter q", http.StatusBadRequest)
+		return
+	}
 
-	userAgent := r.UserAgent()
+	req, err := s.searchRequest(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Submit = r.FormValue("submit") == "true" || event == eventBlur
 
-	if err := s.Logger.LogSearch(ctx, userID, userAgent, query); err != nil {
-		log.Printf("error logging search: %v", err)
-		http.Error(w, "error logging search", http.StatusInternalServerError)
+	if err := s.Logger.LogSearchRequest(ctx, req); err != nil {
+		writeLogError(w, r, err)
 		return
 	}
 
 	w.Write([]byte("Query logged"))
 }
+
+// searchRequest builds the SearchRequest shared by /search and /submit from
+// the parsed form. Submit is left for the caller to decide.
+func (s *Server) searchRequest(r *http.Request, query string) (searchlogger.SearchRequest, error) {
+	extra, err := extraFields(r)
+	if err != nil {
+		return searchlogger.SearchRequest{}, err
+	}
+	latency, err := latencyField(r)
+	if err != nil {
+		return searchlogger.SearchRequest{}, err
+	}
+	utmSource, utmCampaign := utmFields(r)
+	return searchlogger.SearchRequest{
+		UserID:    r.FormValue("user_id"),
+		UserAgent: r.UserAgent(),
+		ClientIP:  s.clientIP(r),
+		AnonID:    r.FormValue("anon_id"),
+		Query:     query,
+		Location:  r.FormValue("location"),
+		Extra:     extra,
+		Outcome:   r.FormValue("outcome"),
+		LatencyMS: latency,
+
+		UTMSource:   utmSource,
+		UTMCampaign: utmCampaign,
+		Variant:     s.variant(r),
+	}, nil
+}
+
+// singleValuedFields are the /search fields a request may send at most once,
+// counting the URL query and the body together. FormValue would silently use
+// the first value, hiding client bugs and letting a second value smuggle past
+// whatever inspected the first.
+var singleValuedFields = []string{"q", "user_id", "anon_id", "event", "utm_source", "utm_campaign", "url"}
+
+// singleValued returns an error if any of keys has more than one value in the
+// parsed form.
+func singleValued(r *http.Request, keys ...string) error {
+	for _, key := range keys {
+		if len(r.Form[key]) > 1 {
+			return fmt.Errorf("parameter %s must not be repeated", key)
+		}
+	}
+	return nil
+}
+
+// clientIP returns the IP address of the client making r.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.TrustProxy {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			addrs := strings.Split(strings.Join(fwd, ","), ",")
+			hops := s.ProxyHops
+			if hops <= 0 {
+				hops = 1
+			}
+			i := len(addrs) - hops
+			if i < 0 {
+				// Fewer addresses than proxies: all were added by proxies.
+				i = 0
+			}
+			return strings.TrimSpace(addrs[i])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeLogError maps errors from the logger to HTTP responses.
+func writeLogError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, searchlogger.ErrInvalidQuery),
+		errors.Is(err, searchlogger.ErrInvalidUserID),
+		errors.Is(err, searchlogger.ErrInvalidRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, searchlogger.ErrRedisUnavailable):
+		logRequestf(r, "error logging search: %v", err)
+		http.Error(w, "search logging temporarily unavailable", http.StatusServiceUnavailable)
+	default:
+		logRequestf(r, "error logging search: %v", err)
+		http.Error(w, "error logging search", http.StatusInternalServerError)
+	}
+}
+
+// utmFields returns the campaign attribution of a /search request: the
+// utm_source and utm_campaign form fields, or failing those the same
+// parameters of the page URL passed in the url field. An unparsable url is
+// ignored rather than rejecting the search.
+func utmFields(r *http.Request) (source, campaign string) {
+	source, campaign = r.FormValue("utm_source"), r.FormValue("utm_campaign")
+	if source != "" && campaign != "" {
+		return source, campaign
+	}
+	page, err := url.Parse(r.FormValue("url"))
+	if err != nil {
+		return source, campaign
+	}
+	params := page.Query()
+	if source == "" {
+		source = params.Get("utm_source")
+	}
+	if campaign == "" {
+		campaign = params.Get("utm_campaign")
+	}
+	return source, campaign
+}
+
+// latencyField parses the optional latency_ms form field. Range checks are
+// left to the logger.
+func latencyField(r *http.Request) (*int64, error) {
+	v := r.FormValue("latency_ms")
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, errors.New("latency_ms must be an integer")
+	}
+	return &n, nil
+}
+
+// extraFields collects "extra.<name>" form fields into a map.
+func extraFields(r *http.Request) (map[string]string, error) {
+	var extra map[string]string
+	for key, values := range r.Form {
+		name := strings.TrimPrefix(key, extraFieldPrefix)
+		if name == key || name == "" || len(values) == 0 {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]string)
+		}
+		extra[name] = values[0]
+	}
+	if len(extra) > maxExtraFields {
+		return nil, fmt.Errorf("too many extra fields (max %d)", maxExtraFields)
+	}
+	return extra, nil
+}
@@ -0,0 +1,790 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-search-logger/internal/searchlogger"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestSearchHandler_BotAcknowledgedNotLogged(t *testing.T) {
+	filter, err := searchlogger.NewBotFilter(searchlogger.DefaultBotPatterns...)
+	if err != nil {
+		t.Fatalf("NewBotFilter error: %v", err)
+	}
+	// The logger has no Redis or DB, so reaching LogSearch would panic.
+	srv := NewServer(&searchlogger.Logger{BotFilter: filter})
+
+	req := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader("q=shoes"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Googlebot/2.1)")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204 for bot request, got %d", rec.Code)
+	}
+}
+
+func TestSearchHandler_InvalidQueryIsBadRequest(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+
+	form := "q=" + strings.Repeat("a", searchlogger.MaxQueryLength+1)
+	req := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid query, got %d", rec.Code)
+	}
+}
+
+func TestCleanBasePath(t *testing.T) {
+	cases := map[string]string{
+		"":                "",
+		"/":               "",
+		"api/searchlog":   "/api/searchlog",
+		"/api/searchlog/": "/api/searchlog",
+	}
+	for in, want := range cases {
+		if got := cleanBasePath(in); got != want {
+			t.Errorf("cleanBasePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRoutes_BasePath(t *testing.T) {
+	filter, _ := searchlogger.NewBotFilter(searchlogger.DefaultBotPatterns...)
+	srv := NewServer(&searchlogger.Logger{BotFilter: filter})
+	srv.BasePath = "/api/searchlog/"
+	handler := srv.routes()
+
+	cases := map[string]int{
+		"/api/searchlog/search": http.StatusNoContent,
+		"/search":               http.StatusNotFound,
+		"/api/searchlogsearch":  http.StatusNotFound,
+	}
+	for path, want := range cases {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("q=shoes"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", "Googlebot/2.1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("POST %s: got %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestPause_SearchAcceptedNotLogged(t *testing.T) {
+	// The logger has no Redis or DB, so reaching them would panic.
+	srv := NewServer(&searchlogger.Logger{})
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+	h := srv.routes()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/pause", nil)
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !srv.Logger.Paused() {
+		t.Fatalf("expected pause to succeed, got %d paused=%t", rec.Code, srv.Logger.Paused())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/search", strings.NewReader("q=shoes"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 while paused, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/resume", nil)
+	req.SetBasicAuth("admin", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if srv.Logger.Paused() {
+		t.Error("expected resume to clear the paused state")
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	cursor := (&searchlogger.Cursor{At: time.Unix(1700000000, 5), ID: 42}).String()
+	cases := []struct {
+		query  string
+		ok     bool
+		limit  int
+		offset int
+	}{
+		{"", true, defaultLimit, 0},
+		{"limit=50&offset=100", true, 50, 100},
+		{"cursor=" + cursor, true, defaultLimit, 0},
+		{"limit=0", false, 0, 0},
+		{"limit=101", false, 0, 0},
+		{"offset=-1", false, 0, 0},
+		{"offset=10001", false, 0, 0},
+		{"cursor=not-a-cursor", false, 0, 0},
+		{"offset=10&cursor=" + cursor, false, 0, 0},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		page, ok := parsePage(rec, httptest.NewRequest(http.MethodGet, "/history?"+c.query, nil))
+		if ok != c.ok {
+			t.Errorf("parsePage(%q) ok = %t, want %t", c.query, ok, c.ok)
+			continue
+		}
+		if !ok {
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("parsePage(%q) wrote %d, want 400", c.query, rec.Code)
+			}
+			continue
+		}
+		if page.Limit != c.limit || page.Offset != c.offset {
+			t.Errorf("parsePage(%q) = %+v", c.query, page)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	page, _ := parsePage(rec, httptest.NewRequest(http.MethodGet, "/history?cursor="+cursor, nil))
+	if page.Cursor == nil || page.Cursor.ID != 42 || !page.Cursor.At.Equal(time.Unix(1700000000, 5)) {
+		t.Errorf("cursor did not round-trip: %+v", page.Cursor)
+	}
+}
+
+func TestSearchHandler_RepeatedFieldIsBadRequest(t *testing.T) {
+	// The logger has no Redis or DB; the request must be rejected first.
+	srv := NewServer(&searchlogger.Logger{})
+
+	for _, body := range []string{"q=shoes&q=socks", "q=shoes&user_id=1&user_id=2"} {
+		req := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		srv.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rec.Code)
+		}
+	}
+
+	// A value in the URL and another in the body are also repeats.
+	req := httptest.NewRequest(http.MethodPost, "/search?q=shoes", strings.NewReader("q=socks"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for q in both URL and body, got %d", rec.Code)
+	}
+}
+
+func TestSearchHandler_EventValidation(t *testing.T) {
+	// The logger has no Redis or DB; the request must be rejected first.
+	srv := NewServer(&searchlogger.Logger{})
+
+	for _, body := range []string{"q=shoes&event=focus", "event=blur&user_id=" + strings.Repeat("u", searchlogger.MaxUserIDLength+1)} {
+		req := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", "TestAgent")
+		rec := httptest.NewRecorder()
+		srv.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%.40s: expected 400, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestSearchHandler_InvalidLatencyIsBadRequest(t *testing.T) {
+	// The logger has no Redis or DB; invalid latencies must be rejected first.
+	srv := NewServer(&searchlogger.Logger{})
+
+	for _, latency := range []string{"fast", "-1", "600001"} {
+		req := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader("q=shoes&latency_ms="+latency))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		srv.routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("latency_ms=%s: expected 400, got %d", latency, rec.Code)
+		}
+	}
+}
+
+func TestSearchHandler_EmptyUserAgentRejected(t *testing.T) {
+	// The logger has no Redis or DB; the request must be rejected first.
+	srv := NewServer(&searchlogger.Logger{EmptyUserAgent: searchlogger.EmptyUAReject})
+
+	req := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader("q=shoes"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "  ")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a blank User-Agent, got %d", rec.Code)
+	}
+}
+
+func TestLinkHandler_RequiresAuth(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+
+	req := httptest.NewRequest(http.MethodPost, "/link", strings.NewReader(`{"user_id": "123", "anon_id": "device-1"}`))
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", rec.Code)
+	}
+}
+
+func TestLinkHandler_MissingUserIDIsBadRequest(t *testing.T) {
+	// The logger has no Redis or DB; the request must be rejected first.
+	srv := NewServer(&searchlogger.Logger{})
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+
+	req := httptest.NewRequest(http.MethodPost, "/link", strings.NewReader(`{"anon_id": "device-1"}`))
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without user_id, got %d", rec.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/search", nil)
+	req.RemoteAddr = "192.0.2.1:5555"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+
+	if ip := (&Server{}).clientIP(req); ip != "192.0.2.1" {
+		t.Errorf("expected the connection address without TrustProxy, got %s", ip)
+	}
+	if ip := (&Server{TrustProxy: true}).clientIP(req); ip != "10.0.0.1" {
+		t.Errorf("expected the address added by the proxy with TrustProxy, got %s", ip)
+	}
+	if ip := (&Server{TrustProxy: true, ProxyHops: 2}).clientIP(req); ip != "203.0.113.7" {
+		t.Errorf("expected the address added by the first of two proxies, got %s", ip)
+	}
+	if ip := (&Server{TrustProxy: true, ProxyHops: 3}).clientIP(req); ip != "203.0.113.7" {
+		t.Errorf("expected the leftmost address with more proxies than addresses, got %s", ip)
+	}
+
+	// A client prepending its own header cannot choose its address.
+	req.Header.Set("X-Forwarded-For", "198.51.100.9")
+	req.Header.Add("X-Forwarded-For", "203.0.113.7")
+	if ip := (&Server{TrustProxy: true}).clientIP(req); ip != "203.0.113.7" {
+		t.Errorf("expected the address added by the proxy, got %s", ip)
+	}
+}
+
+func TestUTMFields(t *testing.T) {
+	tests := []struct {
+		form             string
+		source, campaign string
+	}{
+		{"q=shoes", "", ""},
+		{"q=shoes&utm_source=newsletter&utm_campaign=spring", "newsletter", "spring"},
+		{"q=shoes&url=" + url.QueryEscape("https://shop.example/?utm_source=ads&utm_campaign=sale"), "ads", "sale"},
+		{"q=shoes&utm_campaign=spring&url=" + url.QueryEscape("https://shop.example/?utm_source=ads&utm_campaign=sale"), "ads", "spring"},
+		{"q=shoes&url=%25zz", "", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(tt.form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := req.ParseForm(); err != nil {
+			t.Fatalf("%s: %v", tt.form, err)
+		}
+		source, campaign := utmFields(req)
+		if source != tt.source || campaign != tt.campaign {
+			t.Errorf("%s: got (%q, %q), want (%q, %q)", tt.form, source, campaign, tt.source, tt.campaign)
+		}
+	}
+}
+
+func TestClearSessionHandler_Validation(t *testing.T) {
+	// The logger has no Redis or DB; the request must be rejected first.
+	srv := NewServer(&searchlogger.Logger{})
+
+	req := httptest.NewRequest(http.MethodGet, "/session/clear?user_id=1", nil)
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/session/clear?user_id=1&user_id=2", nil)
+	rec = httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a repeated user_id, got %d", rec.Code)
+	}
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+	srv.CORS = &CORS{AllowedOrigins: []string{"https://shop.example.com"}, AllowCredentials: true}
+
+	for origin, want := range map[string]int{
+		"https://shop.example.com": http.StatusNoContent,
+		"https://evil.example.com": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodOptions, "/search", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		rec := httptest.NewRecorder()
+		srv.routes().ServeHTTP(rec, req)
+
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", origin, want, rec.Code)
+		}
+		allowed := rec.Header().Get("Access-Control-Allow-Origin")
+		if want == http.StatusNoContent && (allowed != origin || rec.Header().Get("Access-Control-Allow-Credentials") != "true") {
+			t.Errorf("%s: expected CORS headers, got %v", origin, rec.Header())
+		}
+		if want != http.StatusNoContent && allowed != "" {
+			t.Errorf("%s: expected no Access-Control-Allow-Origin, got %q", origin, allowed)
+		}
+	}
+}
+
+func TestCORS_NotOnAdminEndpoints(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+	srv.CORS = &CORS{AllowedOrigins: []string{"*"}}
+
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	req.Header.Set("Origin", "https://shop.example.com")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("expected no CORS headers on /stats, got %q", got)
+	}
+}
+
+func TestTailHandler_RequiresAuth(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/tail", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected /tail to be disabled without an Authenticator, got %d", rec.Code)
+	}
+
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+	req := httptest.NewRequest(http.MethodPost, "/tail", nil)
+	req.SetBasicAuth("admin", "secret")
+	rec = httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST /tail to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestPprof_MountedBehindAuthWhenEnabled(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+	get := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		req.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		srv.routes().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := get(); code != http.StatusNotFound {
+		t.Errorf("expected pprof to be off by default, got %d", code)
+	}
+
+	srv.Pprof = true
+	if code := get(); code != http.StatusOK {
+		t.Errorf("expected pprof to be served with credentials, got %d", code)
+	}
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected pprof to require credentials, got %d", rec.Code)
+	}
+}
+
+func TestRequireDB_WithoutDatabase(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{Store: &searchlogger.StdoutStore{}})
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+
+	req := httptest.NewRequest(http.MethodGet, "/history?user_id=u1", nil)
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501 for /history without a database, got %d", rec.Code)
+	}
+}
+
+func TestLivez_OKWithoutDependencies(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestReadyz_UnavailableWithoutRedisOrListener(t *testing.T) {
+	// Nothing listens on port 1, so the Redis ping fails at once.
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	defer rdb.Close()
+	srv := NewServer(&searchlogger.Logger{Redis: rdb})
+
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	var status map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	if status["redis"] == "ok" || status["listener"] != "not started" || status["db"] != "disabled" {
+		t.Errorf("unexpected status %v", status)
+	}
+}
+
+func TestRequestID_EchoedOrGenerated(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+	srv.Headers = http.Header{"Cache-Control": {"no-store"}}
+	handler := srv.routes()
+
+	req := httptest.NewRequest(http.MethodGet, "/livez", nil)
+	req.Header.Set("X-Request-Id", "client-42")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-Id"); got != "client-42" {
+		t.Errorf("expected the client's request id echoed, got %q", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("expected the configured Cache-Control, got %q", got)
+	}
+
+	for _, incoming := range []string{"", "bad id\x01", strings.Repeat("x", maxRequestIDLength+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/livez", nil)
+		req.Header.Set("X-Request-Id", incoming)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get("X-Request-Id"); len(got) != 32 {
+			t.Errorf("incoming %q: expected a generated request id, got %q", incoming, got)
+		}
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	h, err := ParseHeaders("Cache-Control: public, max-age=60; x-frame-options: DENY")
+	if err != nil {
+		t.Fatalf("ParseHeaders: %v", err)
+	}
+	if h.Get("Cache-Control") != "public, max-age=60" || h.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("unexpected headers: %v", h)
+	}
+	if _, err := ParseHeaders("no colon"); err == nil {
+		t.Error("expected an error for a pair without a colon")
+	}
+}
+
+func TestDeleteAnonHandler_Validation(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{DB: &sql.DB{}})
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+	cases := []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodGet, "/anon?anon_id=anon1", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/anon", http.StatusBadRequest},
+		{http.MethodDelete, "/anon?anon_id=a&anon_id=b", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.target, nil)
+		req.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		srv.routes().ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s %s: got %d, want %d", c.method, c.target, rec.Code, c.want)
+		}
+	}
+}
+
+func TestSubmitHandler_Validation(t *testing.T) {
+	// The logger has no Redis or DB; the request must be rejected first.
+	srv := NewServer(&searchlogger.Logger{})
+
+	req := httptest.NewRequest(http.MethodGet, "/submit?q=shoes", nil)
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: expected 405, got %d", rec.Code)
+	}
+
+	for _, body := range []string{"", "user_id=u1", "q=shoes&event=blur", "q=shoes&submit=false", "q=a&q=b"} {
+		req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", "TestAgent")
+		rec := httptest.NewRecorder()
+		srv.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestVariantHeader_TrustedOnlyWithAuth(t *testing.T) {
+	// The logger has no Redis or DB; the request must be rejected first.
+	srv := NewServer(&searchlogger.Logger{})
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+
+	req := httptest.NewRequest(http.MethodPost, "/search", strings.NewReader("q=shoes"))
+	req.Header.Set(DefaultVariantHeader, "unknown")
+	if got := srv.variant(req); got != "" {
+		t.Errorf("expected the header ignored without credentials, got %q", got)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown variant, got %d", rec.Code)
+	}
+}
+
+func TestAdminHandler_RequiresAuth(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected /admin to be disabled without an Authenticator, got %d", rec.Code)
+	}
+
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.SetBasicAuth("admin", "wrong")
+	rec = httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected 401 with a challenge for bad credentials, got %d", rec.Code)
+	}
+
+	req.SetBasicAuth("admin", "secret")
+	rec = httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("expected the dashboard page, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestPauseHandler_RequiresPost(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/pause", nil)
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed || srv.Logger.Paused() {
+		t.Errorf("expected 405 and no pause for GET, got %d paused=%t", rec.Code, srv.Logger.Paused())
+	}
+}
+
+// statsDriver is a database/sql driver answering the /stats queries with
+// fixed rows, so the handler can be tested without PostgreSQL.
+type statsDriver struct{}
+
+func (statsDriver) Open(string) (driver.Conn, error) { return statsConn{}, nil }
+
+type statsConn struct{}
+
+func (statsConn) Prepare(query string) (driver.Stmt, error) { return statsStmt(query), nil }
+func (statsConn) Close() error                              { return nil }
+func (statsConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+type statsStmt string
+
+func (statsStmt) Close() error                               { return nil }
+func (statsStmt) NumInput() int                              { return -1 }
+func (statsStmt) Exec([]driver.Value) (driver.Result, error) { return nil, driver.ErrSkip }
+
+func (q statsStmt) Query([]driver.Value) (driver.Rows, error) {
+	switch {
+	case strings.Contains(string(q), "percentile_cont"):
+		return &statsRows{cols: []string{"count", "p"}, rows: [][]driver.Value{{int64(4), []byte("{10,20,30}")}}}, nil
+	case strings.Contains(string(q), "COUNT(DISTINCT"):
+		return &statsRows{cols: []string{"searches", "users", "anon", "terms"}, rows: [][]driver.Value{{int64(5), int64(2), int64(1), int64(3)}}}, nil
+	}
+	return &statsRows{cols: []string{"term", "count"}, rows: [][]driver.Value{{"shoes", int64(3)}, {"lamps", int64(2)}}}, nil
+}
+
+type statsRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *statsRows) Columns() []string { return r.cols }
+func (r *statsRows) Close() error      { return nil }
+
+func (r *statsRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("statsstub", statsDriver{})
+}
+
+func TestStatsHandler_Validation(t *testing.T) {
+	// The DB is never queried; the request must be rejected first.
+	srv := NewServer(&searchlogger.Logger{DB: &sql.DB{}})
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", rec.Code)
+	}
+
+	cases := map[string]int{
+		"GET /stats?window=soon":  http.StatusBadRequest,
+		"GET /stats?window=-1h":   http.StatusBadRequest,
+		"GET /stats?limit=0":      http.StatusBadRequest,
+		"GET /stats?limit=abc":    http.StatusBadRequest,
+		"POST /stats":             http.StatusMethodNotAllowed,
+		"GET /history?offset=-1":  http.StatusBadRequest,
+		"GET /history/users":      http.StatusMethodNotAllowed,
+		"POST /history/users":     http.StatusBadRequest,
+		"GET /funnel?window=soon": http.StatusBadRequest,
+	}
+	for c, want := range cases {
+		method, target, _ := strings.Cut(c, " ")
+		req := httptest.NewRequest(method, target, strings.NewReader("not json"))
+		req.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		srv.routes().ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: got %d, want %d", c, rec.Code, want)
+		}
+	}
+}
+
+func TestStatsHandler_ReturnsStats(t *testing.T) {
+	db, err := sql.Open("statsstub", "")
+	if err != nil {
+		t.Fatalf("sql.Open error: %v", err)
+	}
+	defer db.Close()
+	srv := NewServer(&searchlogger.Logger{DB: db})
+	srv.Auth = &BasicAuth{Username: "admin", Password: "secret"}
+
+	req := httptest.NewRequest(http.MethodGet, "/stats?window=1h&limit=5&campaign=spring", nil)
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var got struct {
+		Totals   searchlogger.Totals       `json:"totals"`
+		Trending []searchlogger.TermCount  `json:"trending"`
+		Latency  searchlogger.LatencyStats `json:"latency"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	if got.Totals != (searchlogger.Totals{Searches: 5, Users: 2, AnonUsers: 1, Terms: 3}) {
+		t.Errorf("unexpected totals %+v", got.Totals)
+	}
+	if len(got.Trending) != 2 || got.Trending[0] != (searchlogger.TermCount{Term: "shoes", Count: 3}) {
+		t.Errorf("unexpected trending terms %+v", got.Trending)
+	}
+	if got.Latency != (searchlogger.LatencyStats{Count: 4, P50: 10, P90: 20, P99: 30}) {
+		t.Errorf("unexpected latency %+v", got.Latency)
+	}
+}
+
+func TestBeacon_Disabled(t *testing.T) {
+	srv := NewServer(&searchlogger.Logger{})
+	srv.DisableBeacon = true
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/beacon", strings.NewReader("user_id=u1")))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+// slowHook delays every Redis command and then fails it, recording that the
+// command finished.
+type slowHook struct{ done atomic.Bool }
+
+func (h *slowHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	time.Sleep(200 * time.Millisecond)
+	h.done.Store(true)
+	return ctx, errors.New("redis unavailable")
+}
+
+func (h *slowHook) AfterProcess(context.Context, redis.Cmder) error { return nil }
+
+func (h *slowHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	time.Sleep(200 * time.Millisecond)
+	h.done.Store(true)
+	return ctx, errors.New("redis unavailable")
+}
+
+func (h *slowHook) AfterProcessPipeline(context.Context, []redis.Cmder) error { return nil }
+
+func TestRun_WaitsForBeaconFlush(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer rdb.Close()
+	hook := &slowHook{}
+	rdb.AddHook(hook)
+	srv := NewServer(&searchlogger.Logger{Redis: rdb})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx, addr) }()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Post("http://"+addr+"/beacon", "text/plain", strings.NewReader("user_id=u1")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("POST /beacon: %v", err)
+	}
+	resp.Body.Close()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !hook.done.Load() {
+		t.Error("expected Run to wait for the beacon flush")
+	}
+}
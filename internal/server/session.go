@@ -0,0 +1,29 @@
+package server
+
+import "net/http"
+
+// clearSessionHandler abandons the client's in-progress query without
+// committing it, e.g. when the user clears the search box. user_id and
+// anon_id identify the session as for /search and may be sent in the URL or
+// a form body.
+func (s *Server) clearSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+	if err := singleValued(r, "user_id", "anon_id"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := s.Logger.ClearSession(r.Context(), r.FormValue("user_id"), r.UserAgent(), r.FormValue("anon_id"))
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,53 @@
+package server
+
+import "net/http"
+
+// submitHandler logs a search the user executed, e.g. by pressing Enter or
+// clicking the search button. Unlike /search, whose requests are keystroke
+// updates to a live query, every /submit commits its query immediately and
+// ends the session; it is equivalent to /search with submit=true. It accepts
+// the same fields as /search except event and submit.
+func (s *Server) submitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	// Bots are acknowledged but not logged.
+	if s.Logger.BotFilter.IsBot(r.UserAgent()) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := singleValued(r, singleValuedFields...); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Form.Has("event") || r.Form.Has("submit") {
+		http.Error(w, "event and submit are not accepted by /submit", http.StatusBadRequest)
+		return
+	}
+	query := r.FormValue("q")
+	if query == "" {
+		http.Error(w, "missing query parameter q", http.StatusBadRequest)
+		return
+	}
+
+	req, err := s.searchRequest(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Submit = true
+
+	if err := s.Logger.LogSearchRequest(r.Context(), req); err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("Query logged"))
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go-search-logger/internal/metrics"
+	"go-search-logger/internal/searchlogger"
+)
+
+const (
+	// tailBuffer is how many committed searches a /tail client may fall
+	// behind by before further ones are dropped for it.
+	tailBuffer = 64
+	// tailKeepalive is how often an idle stream sends a comment, so proxies
+	// do not close it.
+	tailKeepalive = 15 * time.Second
+)
+
+// tailHandler streams committed searches as Server-Sent Events, one
+// "search" event with the entry as JSON per commit, until the client
+// disconnects or the server shuts down.
+func (s *Server) tailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make(chan searchlogger.SearchEntry, tailBuffer)
+	cancel := s.Logger.OnCommit(func(entry searchlogger.SearchEntry) {
+		select {
+		case entries <- entry:
+		default:
+			metrics.TailEventsDropped.Add(1)
+		}
+	})
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(tailKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case entry := <-entries:
+			data, err := json.Marshal(entry)
+			if err != nil {
+				logRequestf(r, "tail: error encoding search: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: search\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
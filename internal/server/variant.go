@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+
+	"go-search-logger/internal/logging"
+)
+
+// DefaultVariantHeader is the default Server.VariantHeader.
+const DefaultVariantHeader = "X-SearchLog-Variant"
+
+func (s *Server) variantHeader() string {
+	if s.VariantHeader != "" {
+		return s.VariantHeader
+	}
+	return DefaultVariantHeader
+}
+
+// variant returns the Logger.Variants name a /search or /submit request
+// selects with the VariantHeader. Clients could otherwise skew an
+// experiment, so the header is only trusted on requests the Authenticator
+// accepts, e.g. from a backend that assigns variants; it is ignored on
+// others.
+func (s *Server) variant(r *http.Request) string {
+	name := r.Header.Get(s.variantHeader())
+	if name == "" {
+		return ""
+	}
+	if s.Auth == nil || !s.Auth.Authenticate(r) {
+		logging.Debugf("ignoring %s from an unauthenticated request", s.variantHeader())
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,304 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: searchlogger/v1/searchlogger.proto
+
+package searchloggerpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type SearchRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	UserId string                 `protobuf:"bytes,1,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
+	// user_agent identifies anonymous users. If empty, the caller's gRPC
+	// user-agent metadata is used.
+	UserAgent string            `protobuf:"bytes,2,opt,name=user_agent,json=userAgent,proto3" json:"user_agent,omitempty"`
+	Query     string            `protobuf:"bytes,3,opt,name=query,proto3" json:"query,omitempty"`
+	Location  string            `protobuf:"bytes,4,opt,name=location,proto3" json:"location,omitempty"`
+	Extra     map[string]string `protobuf:"bytes,5,rep,name=extra,proto3" json:"extra,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Outcome   string            `protobuf:"bytes,6,opt,name=outcome,proto3" json:"outcome,omitempty"`
+	// submit marks an explicit search (e.g. Enter was pressed): it is
+	// committed immediately and the session ends.
+	Submit bool `protobuf:"varint,7,opt,name=submit,proto3" json:"submit,omitempty"`
+	// latency_ms is the client-measured search latency, if reported.
+	LatencyMs *int64 `protobuf:"varint,8,opt,name=latency_ms,json=latencyMs,proto3,oneof" json:"latency_ms,omitempty"`
+	// anon_id is an optional client-chosen id for anonymous users, used
+	// instead of the user agent.
+	AnonId        string `protobuf:"bytes,9,opt,name=anon_id,json=anonId,proto3" json:"anon_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchRequest) Reset() {
+	*x = SearchRequest{}
+	mi := &file_searchlogger_v1_searchlogger_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchRequest) ProtoMessage() {}
+
+func (x *SearchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_searchlogger_v1_searchlogger_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchRequest.ProtoReflect.Descriptor instead.
+func (*SearchRequest) Descriptor() ([]byte, []int) {
+	return file_searchlogger_v1_searchlogger_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SearchRequest) GetUserId() string {
+	if x != nil {
+		return x.UserId
+	}
+	return ""
+}
+
+func (x *SearchRequest) GetUserAgent() string {
+	if x != nil {
+		return x.UserAgent
+	}
+	return ""
+}
+
+func (x *SearchRequest) GetQuery() string {
+	if x != nil {
+		return x.Query
+	}
+	return ""
+}
+
+func (x *SearchRequest) GetLocation() string {
+	if x != nil {
+		return x.Location
+	}
+	return ""
+}
+
+func (x *SearchRequest) GetExtra() map[string]string {
+	if x != nil {
+		return x.Extra
+	}
+	return nil
+}
+
+func (x *SearchRequest) GetOutcome() string {
+	if x != nil {
+		return x.Outcome
+	}
+	return ""
+}
+
+func (x *SearchRequest) GetSubmit() bool {
+	if x != nil {
+		return x.Submit
+	}
+	return false
+}
+
+func (x *SearchRequest) GetLatencyMs() int64 {
+	if x != nil && x.LatencyMs != nil {
+		return *x.LatencyMs
+	}
+	return 0
+}
+
+func (x *SearchRequest) GetAnonId() string {
+	if x != nil {
+		return x.AnonId
+	}
+	return ""
+}
+
+type LogSearchResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogSearchResponse) Reset() {
+	*x = LogSearchResponse{}
+	mi := &file_searchlogger_v1_searchlogger_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogSearchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogSearchResponse) ProtoMessage() {}
+
+func (x *LogSearchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_searchlogger_v1_searchlogger_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogSearchResponse.ProtoReflect.Descriptor instead.
+func (*LogSearchResponse) Descriptor() ([]byte, []int) {
+	return file_searchlogger_v1_searchlogger_proto_rawDescGZIP(), []int{1}
+}
+
+type StreamSearchesResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// received is the number of searches accepted.
+	Received      int64 `protobuf:"varint,1,opt,name=received,proto3" json:"received,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamSearchesResponse) Reset() {
+	*x = StreamSearchesResponse{}
+	mi := &file_searchlogger_v1_searchlogger_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamSearchesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamSearchesResponse) ProtoMessage() {}
+
+func (x *StreamSearchesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_searchlogger_v1_searchlogger_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamSearchesResponse.ProtoReflect.Descriptor instead.
+func (*StreamSearchesResponse) Descriptor() ([]byte, []int) {
+	return file_searchlogger_v1_searchlogger_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *StreamSearchesResponse) GetReceived() int64 {
+	if x != nil {
+		return x.Received
+	}
+	return 0
+}
+
+var File_searchlogger_v1_searchlogger_proto protoreflect.FileDescriptor
+
+const file_searchlogger_v1_searchlogger_proto_rawDesc = "" +
+	"\n" +
+	"\"searchlogger/v1/searchlogger.proto\x12\x0fsearchlogger.v1\"\xf2\x02\n" +
+	"\rSearchRequest\x12\x17\n" +
+	"\auser_id\x18\x01 \x01(\tR\x06userId\x12\x1d\n" +
+	"\n" +
+	"user_agent\x18\x02 \x01(\tR\tuserAgent\x12\x14\n" +
+	"\x05query\x18\x03 \x01(\tR\x05query\x12\x1a\n" +
+	"\blocation\x18\x04 \x01(\tR\blocation\x12?\n" +
+	"\x05extra\x18\x05 \x03(\v2).searchlogger.v1.SearchRequest.ExtraEntryR\x05extra\x12\x18\n" +
+	"\aoutcome\x18\x06 \x01(\tR\aoutcome\x12\x16\n" +
+	"\x06submit\x18\a \x01(\bR\x06submit\x12\"\n" +
+	"\n" +
+	"latency_ms\x18\b \x01(\x03H\x00R\tlatencyMs\x88\x01\x01\x12\x17\n" +
+	"\aanon_id\x18\t \x01(\tR\x06anonId\x1a8\n" +
+	"\n" +
+	"ExtraEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01B\r\n" +
+	"\v_latency_ms\"\x13\n" +
+	"\x11LogSearchResponse\"4\n" +
+	"\x16StreamSearchesResponse\x12\x1a\n" +
+	"\breceived\x18\x01 \x01(\x03R\breceived2\xbc\x01\n" +
+	"\fSearchLogger\x12O\n" +
+	"\tLogSearch\x12\x1e.searchlogger.v1.SearchRequest\x1a\".searchlogger.v1.LogSearchResponse\x12[\n" +
+	"\x0eStreamSearches\x12\x1e.searchlogger.v1.SearchRequest\x1a'.searchlogger.v1.StreamSearchesResponse(\x01B7Z5go-search-logger/proto/searchlogger/v1;searchloggerpbb\x06proto3"
+
+var (
+	file_searchlogger_v1_searchlogger_proto_rawDescOnce sync.Once
+	file_searchlogger_v1_searchlogger_proto_rawDescData []byte
+)
+
+func file_searchlogger_v1_searchlogger_proto_rawDescGZIP() []byte {
+	file_searchlogger_v1_searchlogger_proto_rawDescOnce.Do(func() {
+		file_searchlogger_v1_searchlogger_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_searchlogger_v1_searchlogger_proto_rawDesc), len(file_searchlogger_v1_searchlogger_proto_rawDesc)))
+	})
+	return file_searchlogger_v1_searchlogger_proto_rawDescData
+}
+
+var file_searchlogger_v1_searchlogger_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_searchlogger_v1_searchlogger_proto_goTypes = []any{
+	(*SearchRequest)(nil),          // 0: searchlogger.v1.SearchRequest
+	(*LogSearchResponse)(nil),      // 1: searchlogger.v1.LogSearchResponse
+	(*StreamSearchesResponse)(nil), // 2: searchlogger.v1.StreamSearchesResponse
+	nil,                            // 3: searchlogger.v1.SearchRequest.ExtraEntry
+}
+var file_searchlogger_v1_searchlogger_proto_depIdxs = []int32{
+	3, // 0: searchlogger.v1.SearchRequest.extra:type_name -> searchlogger.v1.SearchRequest.ExtraEntry
+	0, // 1: searchlogger.v1.SearchLogger.LogSearch:input_type -> searchlogger.v1.SearchRequest
+	0, // 2: searchlogger.v1.SearchLogger.StreamSearches:input_type -> searchlogger.v1.SearchRequest
+	1, // 3: searchlogger.v1.SearchLogger.LogSearch:output_type -> searchlogger.v1.LogSearchResponse
+	2, // 4: searchlogger.v1.SearchLogger.StreamSearches:output_type -> searchlogger.v1.StreamSearchesResponse
+	3, // [3:5] is the sub-list for method output_type
+	1, // [1:3] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_searchlogger_v1_searchlogger_proto_init() }
+func file_searchlogger_v1_searchlogger_proto_init() {
+	if File_searchlogger_v1_searchlogger_proto != nil {
+		return
+	}
+	file_searchlogger_v1_searchlogger_proto_msgTypes[0].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_searchlogger_v1_searchlogger_proto_rawDesc), len(file_searchlogger_v1_searchlogger_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_searchlogger_v1_searchlogger_proto_goTypes,
+		DependencyIndexes: file_searchlogger_v1_searchlogger_proto_depIdxs,
+		MessageInfos:      file_searchlogger_v1_searchlogger_proto_msgTypes,
+	}.Build()
+	File_searchlogger_v1_searchlogger_proto = out.File
+	file_searchlogger_v1_searchlogger_proto_goTypes = nil
+	file_searchlogger_v1_searchlogger_proto_depIdxs = nil
+}
@@ -0,0 +1,165 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: searchlogger/v1/searchlogger.proto
+
+package searchloggerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	SearchLogger_LogSearch_FullMethodName      = "/searchlogger.v1.SearchLogger/LogSearch"
+	SearchLogger_StreamSearches_FullMethodName = "/searchlogger.v1.SearchLogger/StreamSearches"
+)
+
+// SearchLoggerClient is the client API for SearchLogger service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// SearchLogger records user searches. It is backed by the same Logger as the
+// HTTP /search endpoint, so validation and reset detection are identical.
+type SearchLoggerClient interface {
+	// LogSearch records a single search or keystroke.
+	LogSearch(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*LogSearchResponse, error)
+	// StreamSearches records a stream of keystrokes, e.g. from an autocomplete
+	// box, in order. The stream is aborted on the first request that fails.
+	StreamSearches(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[SearchRequest, StreamSearchesResponse], error)
+}
+
+type searchLoggerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSearchLoggerClient(cc grpc.ClientConnInterface) SearchLoggerClient {
+	return &searchLoggerClient{cc}
+}
+
+func (c *searchLoggerClient) LogSearch(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*LogSearchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LogSearchResponse)
+	err := c.cc.Invoke(ctx, SearchLogger_LogSearch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *searchLoggerClient) StreamSearches(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[SearchRequest, StreamSearchesResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &SearchLogger_ServiceDesc.Streams[0], SearchLogger_StreamSearches_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SearchRequest, StreamSearchesResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SearchLogger_StreamSearchesClient = grpc.ClientStreamingClient[SearchRequest, StreamSearchesResponse]
+
+// SearchLoggerServer is the server API for SearchLogger service.
+// All implementations must embed UnimplementedSearchLoggerServer
+// for forward compatibility.
+//
+// SearchLogger records user searches. It is backed by the same Logger as the
+// HTTP /search endpoint, so validation and reset detection are identical.
+type SearchLoggerServer interface {
+	// LogSearch records a single search or keystroke.
+	LogSearch(context.Context, *SearchRequest) (*LogSearchResponse, error)
+	// StreamSearches records a stream of keystrokes, e.g. from an autocomplete
+	// box, in order. The stream is aborted on the first request that fails.
+	StreamSearches(grpc.ClientStreamingServer[SearchRequest, StreamSearchesResponse]) error
+	mustEmbedUnimplementedSearchLoggerServer()
+}
+
+// UnimplementedSearchLoggerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSearchLoggerServer struct{}
+
+func (UnimplementedSearchLoggerServer) LogSearch(context.Context, *SearchRequest) (*LogSearchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LogSearch not implemented")
+}
+func (UnimplementedSearchLoggerServer) StreamSearches(grpc.ClientStreamingServer[SearchRequest, StreamSearchesResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamSearches not implemented")
+}
+func (UnimplementedSearchLoggerServer) mustEmbedUnimplementedSearchLoggerServer() {}
+func (UnimplementedSearchLoggerServer) testEmbeddedByValue()                      {}
+
+// UnsafeSearchLoggerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SearchLoggerServer will
+// result in compilation errors.
+type UnsafeSearchLoggerServer interface {
+	mustEmbedUnimplementedSearchLoggerServer()
+}
+
+func RegisterSearchLoggerServer(s grpc.ServiceRegistrar, srv SearchLoggerServer) {
+	// If the following call pancis, it indicates UnimplementedSearchLoggerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&SearchLogger_ServiceDesc, srv)
+}
+
+func _SearchLogger_LogSearch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SearchLoggerServer).LogSearch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SearchLogger_LogSearch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SearchLoggerServer).LogSearch(ctx, req.(*SearchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SearchLogger_StreamSearches_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SearchLoggerServer).StreamSearches(&grpc.GenericServerStream[SearchRequest, StreamSearchesResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SearchLogger_StreamSearchesServer = grpc.ClientStreamingServer[SearchRequest, StreamSearchesResponse]
+
+// SearchLogger_ServiceDesc is the grpc.ServiceDesc for SearchLogger service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SearchLogger_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "searchlogger.v1.SearchLogger",
+	HandlerType: (*SearchLoggerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "LogSearch",
+			Handler:    _SearchLogger_LogSearch_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamSearches",
+			Handler:       _SearchLogger_StreamSearches_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "searchlogger/v1/searchlogger.proto",
+}